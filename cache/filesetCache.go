@@ -7,6 +7,7 @@ package cache
 
 import (
 	"fmt"
+	"strings"
 
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/rio/fs"
@@ -20,3 +21,22 @@ func ShelfFor(wareID api.WareID) fs.RelPath {
 		chunk1, chunk2, wareID.Hash,
 	))
 }
+
+/*
+	Where the cache records that a ware unpacks to a fileset shelved under
+	another wareID (e.g. an OCI image's digest, to the tar hash of its
+	flattened layers).  The file there holds that other wareID.
+*/
+func AliasFor(wareID api.WareID) fs.RelPath {
+	// Digests have an "<algo>:" prefix; chunk by what follows it,
+	//  just as ChunkifyHash skips a "<tag>-" prefix.
+	chunkable := wareID
+	if i := strings.IndexByte(chunkable.Hash, ':'); i > 0 {
+		chunkable.Hash = chunkable.Hash[i+1:]
+	}
+	chunk1, chunk2, _ := whutil.ChunkifyHash(chunkable)
+	return fs.MustRelPath(fmt.Sprintf("%s/alias/%s/%s/%s",
+		wareID.Type,
+		chunk1, chunk2, wareID.Hash,
+	))
+}
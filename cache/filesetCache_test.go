@@ -0,0 +1,22 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package cache
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+)
+
+func TestAliasFor(t *testing.T) {
+	Convey("Aliases are chunked by the digest, not its algorithm", t, func() {
+		So(AliasFor(api.WareID{"oci", "sha256:0123456789abcdef"}).String(), ShouldEqual,
+			"./oci/alias/012/345/sha256:0123456789abcdef")
+		So(AliasFor(api.WareID{"tar", "0123456789abcdef"}).String(), ShouldEqual,
+			"./tar/alias/012/345/0123456789abcdef")
+	})
+}
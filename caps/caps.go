@@ -82,3 +82,13 @@ func (f Fulcrum) CanMountAny() bool {
 	}
 	return f.ourCaps.Get(capability.EFFECTIVE, capability.CAP_SYS_ADMIN)
 }
+
+// Whether we have enough caps to create block and character device nodes.
+// This requires "have CAP_MKNOD";
+// or, on mac, is uid==0.
+func (f Fulcrum) CanMakeDevices() bool {
+	if !f.onLinux {
+		return f.ourUID == 0
+	}
+	return f.ourCaps.Get(capability.EFFECTIVE, capability.CAP_MKNOD)
+}
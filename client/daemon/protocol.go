@@ -0,0 +1,87 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Client for a rio daemon (`rio daemon`), which runs transmats on behalf
+	of other processes, over a unix socket.
+
+	The protocol is simple: the client sends one Request (as a line of JSON),
+	and the daemon answers with a stream of rio.Event, each a line of JSON
+	(the same as `rio --format=json` prints), the last of which is the result.
+	To cancel, the client sends another Request with Cancel set (or just
+	hangs up); the daemon still answers with a result, which will usually
+	be a rio.ErrCancelled error.
+*/
+package riodaemonclient
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"go.polydawn.net/go-timeless-api"
+)
+
+// Bumped whenever Request or the event stream changes incompatibly.
+const ProtocolVersion = 1
+
+// Where `rio daemon` listens if not told otherwise.
+const DefaultAddr = "unix:///run/rio.sock"
+
+// The operations a daemon serves, for Request.Op.
+const (
+	Op_Pack   = "pack"
+	Op_Unpack = "unpack"
+	Op_Scan   = "scan"
+	Op_Mirror = "mirror"
+)
+
+/*
+	A request to the daemon.  Which fields are used depends on Op,
+	mirroring the args of the corresponding rio func:
+
+	  - pack:   PackType, Path, Filters, Target
+	  - unpack: WareID, Path, Filters, PlacementMode, Sources
+	  - scan:   PackType, Filters, PlacementMode, Sources (exactly one)
+	  - mirror: WareID, Target, Sources
+
+	Paths must be absolute, since the daemon doesn't share our working dir.
+	Warehouses may be names ("@name"), which the daemon resolves per its config.
+*/
+type Request struct {
+	Version       int                `json:"version"`
+	Op            string             `json:"op,omitempty"`
+	WareID        string             `json:"wareID,omitempty"`
+	PackType      string             `json:"packType,omitempty"`
+	Path          string             `json:"path,omitempty"`
+	Filters       api.FilesetFilters `json:"filters"`
+	PlacementMode string             `json:"placementMode,omitempty"`
+	Target        string             `json:"target,omitempty"`
+	Sources       []string           `json:"sources,omitempty"`
+	Cancel        bool               `json:"cancel,omitempty"`
+}
+
+/*
+	Parses a daemon address, which must be of the form "unix:///path/to.sock",
+	and returns the socket path.
+*/
+func ParseAddr(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid daemon address %q: %s", addr, err)
+	}
+	if u.Scheme != "unix" || u.Host != "" || u.Path == "" {
+		return "", fmt.Errorf("invalid daemon address %q: must be of the form \"unix:///path/to.sock\"", addr)
+	}
+	return u.Path, nil
+}
+
+func dial(addr string) (net.Conn, error) {
+	pth, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("unix", pth)
+}
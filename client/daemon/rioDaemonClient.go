@@ -0,0 +1,192 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package riodaemonclient
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	Talks to the rio daemon at Addr (see ParseAddr).
+	A new connection is made for each call.
+*/
+type Client struct {
+	Addr string
+}
+
+var (
+	_ rio.PackFunc   = Client{}.Pack
+	_ rio.UnpackFunc = Client{}.Unpack
+	_ rio.ScanFunc   = Client{}.Scan
+	_ rio.MirrorFunc = Client{}.Mirror
+)
+
+// Talks to the daemon at DefaultAddr.
+var Default = Client{DefaultAddr}
+
+func (c Client) Pack(
+	ctx context.Context,
+	packType api.PackType,
+	path string,
+	filters api.FilesetFilters,
+	warehouse api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	if monitor.Chan != nil {
+		defer close(monitor.Chan)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+	}
+	return c.call(ctx, Request{
+		Op:       Op_Pack,
+		PackType: string(packType),
+		Path:     path,
+		Filters:  filters,
+		Target:   string(warehouse),
+	}, monitor)
+}
+
+func (c Client) Unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	if monitor.Chan != nil {
+		defer close(monitor.Chan)
+	}
+	// "-" is for placement mode none; anything else is a real path.
+	if path != "-" {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+		}
+	}
+	return c.call(ctx, Request{
+		Op:            Op_Unpack,
+		WareID:        wareID.String(),
+		Path:          path,
+		Filters:       filters,
+		PlacementMode: string(placementMode),
+		Sources:       addrStrings(warehouses),
+	}, monitor)
+}
+
+func (c Client) Scan(
+	ctx context.Context,
+	packType api.PackType,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	addr api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	if monitor.Chan != nil {
+		defer close(monitor.Chan)
+	}
+	return c.call(ctx, Request{
+		Op:            Op_Scan,
+		PackType:      string(packType),
+		Filters:       filters,
+		PlacementMode: string(placementMode),
+		Sources:       []string{string(addr)},
+	}, monitor)
+}
+
+func (c Client) Mirror(
+	ctx context.Context,
+	wareID api.WareID,
+	target api.WarehouseAddr,
+	sources []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	if monitor.Chan != nil {
+		defer close(monitor.Chan)
+	}
+	return c.call(ctx, Request{
+		Op:      Op_Mirror,
+		WareID:  wareID.String(),
+		Target:  string(target),
+		Sources: addrStrings(sources),
+	}, monitor)
+}
+
+/*
+	Sends the request, forwards events to the monitor until the result
+	comes, and returns that.  If ctx is cancelled meanwhile, we tell the
+	daemon, and still wait for its result (which says how it stopped).
+*/
+func (c Client) call(ctx context.Context, req Request, monitor rio.Monitor) (api.WareID, error) {
+	conn, err := dial(c.Addr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	req.Version = ProtocolVersion
+	enc := stdjson.NewEncoder(conn)
+	if err := enc.Encode(req); err != nil {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: cannot send request: %s", err)
+	}
+
+	// Pass on cancellation.  (The done channel keeps this from outliving the call.)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			enc.Encode(Request{Version: ProtocolVersion, Cancel: true})
+		case <-done:
+		}
+	}()
+
+	unmarshaller := refmt.NewUnmarshallerAtlased(json.DecodeOptions{}, conn, rio.Atlas)
+	for {
+		var evt rio.Event
+		if err := unmarshaller.Unmarshal(&evt); err != nil {
+			if err == io.EOF {
+				return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: hung up without a result")
+			}
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: API parse error: %s", err)
+		}
+		if evt.Result != nil {
+			if evt.Result.Error != nil {
+				return api.WareID{}, evt.Result.Error
+			}
+			return evt.Result.WareID, nil
+		}
+		if monitor.Chan != nil {
+			select {
+			case <-ctx.Done():
+			case monitor.Chan <- evt:
+			}
+		}
+	}
+}
+
+func addrStrings(addrs []api.WarehouseAddr) []string {
+	if addrs == nil {
+		return nil
+	}
+	result := make([]string, len(addrs))
+	for i, addr := range addrs {
+		result[i] = string(addr)
+	}
+	return result
+}
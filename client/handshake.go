@@ -0,0 +1,60 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package rioexecclient
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	The version of the event stream (`rio --format=json`) this client parses.
+	It must match the "eventFormat" the child reports from `rio version`.
+*/
+const EventFormat = 1
+
+/*
+	What `rio version --format=json` reports.
+*/
+type Version struct {
+	Version     string `json:"version"`
+	EventFormat int    `json:"eventFormat"`
+}
+
+/*
+	Checks that the child rio speaks an event format we can parse,
+	by asking it with `rio version`.  Done once per Client; the funcs
+	call this before anything else, so there's no need to call it
+	yourself, except to find out early.
+*/
+func (c *Client) Handshake() error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshake()
+	})
+	return c.handshakeErr
+}
+
+func (c *Client) handshake() error {
+	cmd := c.command("version", "--format=json")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Errorf(rio.ErrRPCBreakdown, "fork rio: %q failed to report its version (is it too old to have `rio version`?): %s (stderr: %q)", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	var v Version
+	if err := stdjson.Unmarshal(stdout.Bytes(), &v); err != nil {
+		return Errorf(rio.ErrRPCBreakdown, "fork rio: %q reported its version unintelligibly: %s (stdout: %q)", cmd.Path, err, stdout.String())
+	}
+	if v.EventFormat != EventFormat {
+		return Errorf(rio.ErrRPCBreakdown, "fork rio: %q (version %s) speaks event format %d, but this client only understands event format %d", cmd.Path, v.Version, v.EventFormat, EventFormat)
+	}
+	return nil
+}
@@ -102,3 +102,69 @@ func PackArgs(
 	// Done!
 	return args, nil
 }
+
+func ScanArgs(
+	packType api.PackType,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	addr api.WarehouseAddr,
+	monitor rio.Monitor,
+) ([]string, error) {
+	// Required args.
+	args := []string{"scan", "--format=json"}
+
+	// Append filters if specified.
+	//  (We could just pass 'em all even when emptystr, but let's be nice to readers of 'ps'.)
+	if filters.Uid != "" {
+		args = append(args, "--uid="+filters.Uid)
+	}
+	if filters.Gid != "" {
+		args = append(args, "--gid="+filters.Gid)
+	}
+	if filters.Mtime != "" {
+		args = append(args, "--mtime="+filters.Mtime)
+	}
+	if filters.Sticky != "" {
+		args = append(args, "--sticky="+filters.Sticky)
+	}
+
+	// Placement mode is not used: the CLI only scans, it never places.
+
+	// Append warehouse.
+	if addr != "" {
+		args = append(args, "--source="+string(addr))
+	}
+
+	// Suffix the main bits.
+	args = append(args, "--", string(packType))
+
+	// Done!
+	return args, nil
+}
+
+func MirrorArgs(
+	wareID api.WareID,
+	target api.WarehouseAddr,
+	sources []api.WarehouseAddr,
+	monitor rio.Monitor,
+) ([]string, error) {
+	// Required args.
+	args := []string{"mirror", "--format=json"}
+
+	// Append target warehouse.
+	if target != "" {
+		args = append(args, "--target="+string(target))
+	}
+
+	// Append source warehouses.
+	//  Giving this argument repeatedly forms a list in the rio CLI.
+	for _, wh := range sources {
+		args = append(args, "--source="+string(wh))
+	}
+
+	// Suffix the main bits.
+	args = append(args, "--", wareID.String())
+
+	// Done!
+	return args, nil
+}
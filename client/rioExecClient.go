@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"time"
 
 	"github.com/polydawn/refmt"
@@ -23,9 +24,37 @@ import (
 var (
 	_ rio.UnpackFunc = UnpackFunc
 	_ rio.PackFunc   = PackFunc
+	_ rio.ScanFunc   = ScanFunc
 	_ rio.MirrorFunc = MirrorFunc
 )
 
+/*
+	Runs rio as a child process, for each call.
+
+	The zero value runs "rio" from $PATH, in our working dir, with our env.
+	Relative paths in args are relative to Dir, if it's set.
+	A Client must not be copied after first use.
+*/
+type Client struct {
+	Binary string    // Path to the rio binary.  If empty, "rio" is found on $PATH.
+	Env    []string  // Extra env vars for the child ("KEY=value"), on top of ours.
+	Dir    string    // Working dir for the child.  If empty, ours.
+	Stderr io.Writer // If set, the child's stderr is copied here, as it's written.
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+}
+
+var (
+	_ rio.UnpackFunc = (&Client{}).Unpack
+	_ rio.PackFunc   = (&Client{}).Pack
+	_ rio.ScanFunc   = (&Client{}).Scan
+	_ rio.MirrorFunc = (&Client{}).Mirror
+)
+
+// The client used by the package-level funcs: "rio" from $PATH.
+var Default = &Client{}
+
 func UnpackFunc(
 	ctx context.Context,
 	wareID api.WareID,
@@ -34,6 +63,50 @@ func UnpackFunc(
 	placementMode rio.PlacementMode,
 	warehouses []api.WarehouseAddr,
 	monitor rio.Monitor,
+) (gotWareID api.WareID, err error) {
+	return Default.Unpack(ctx, wareID, path, filters, placementMode, warehouses, monitor)
+}
+
+func PackFunc(
+	ctx context.Context,
+	packType api.PackType,
+	path string,
+	filters api.FilesetFilters,
+	warehouse api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	return Default.Pack(ctx, packType, path, filters, warehouse, monitor)
+}
+
+func ScanFunc(
+	ctx context.Context,
+	packType api.PackType,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	addr api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	return Default.Scan(ctx, packType, filters, placementMode, addr, monitor)
+}
+
+func MirrorFunc(
+	ctx context.Context,
+	wareID api.WareID,
+	target api.WarehouseAddr,
+	sources []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	return Default.Mirror(ctx, wareID, target, sources, monitor)
+}
+
+func (c *Client) Unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	monitor rio.Monitor,
 ) (gotWareID api.WareID, err error) {
 	// Marshal args.
 	args, err := UnpackArgs(wareID, path, filters, placementMode, warehouses, monitor)
@@ -41,10 +114,10 @@ func UnpackFunc(
 		return api.WareID{}, err
 	}
 	// Bulk of invoking and handling process messages is shared code.
-	return packOrUnpack(ctx, args, monitor)
+	return c.run(ctx, args, monitor)
 }
 
-func PackFunc(
+func (c *Client) Pack(
 	ctx context.Context,
 	packType api.PackType,
 	path string,
@@ -58,12 +131,59 @@ func PackFunc(
 		return api.WareID{}, err
 	}
 	// Bulk of invoking and handling process messages is shared code.
-	return packOrUnpack(ctx, args, monitor)
+	return c.run(ctx, args, monitor)
+}
+
+func (c *Client) Scan(
+	ctx context.Context,
+	packType api.PackType,
+	filters api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	addr api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	// Marshal args.
+	args, err := ScanArgs(packType, filters, placementMode, addr, monitor)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	// Bulk of invoking and handling process messages is shared code.
+	return c.run(ctx, args, monitor)
+}
+
+func (c *Client) Mirror(
+	ctx context.Context,
+	wareID api.WareID,
+	target api.WarehouseAddr,
+	sources []api.WarehouseAddr,
+	monitor rio.Monitor,
+) (api.WareID, error) {
+	// Marshal args.
+	args, err := MirrorArgs(wareID, target, sources, monitor)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	// Bulk of invoking and handling process messages is shared code.
+	return c.run(ctx, args, monitor)
+}
+
+// Builds the command to run rio with the given args, per the client's config.
+func (c *Client) command(args ...string) *exec.Cmd {
+	binary := c.Binary
+	if binary == "" {
+		binary = "rio"
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = c.Dir
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd
 }
 
-// internal implementation of message parsing for both pack and unpack.
+// internal implementation of message parsing for all the funcs.
 // (they "conincidentally" have the same API.)
-func packOrUnpack(
+func (c *Client) run(
 	ctx context.Context,
 	args []string,
 	monitor rio.Monitor,
@@ -72,14 +192,22 @@ func packOrUnpack(
 		defer close(monitor.Chan)
 	}
 
+	// Make sure the child speaks our language before we try to parse it.
+	if err := c.Handshake(); err != nil {
+		return api.WareID{}, err
+	}
+
 	// Spawn process.
-	cmd := exec.Command("rio", args...)
+	cmd := c.command(args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: failed to start: %s", err)
 	}
 	var stderrBuf bytes.Buffer
 	cmd.Stderr = &stderrBuf
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderrBuf, c.Stderr)
+	}
 	if err = cmd.Start(); err != nil {
 		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: failed to start: %s", err)
 	}
@@ -87,11 +215,21 @@ func packOrUnpack(
 	// Set up reaction to ctx.done: send a sig to the child proc.
 	//  (No, you couldn't set this up without a goroutine -- you can't select with the IO we're about to do;
 	//  and No, you couldn't do it until after cmd.Start -- the Process handle doesn't exist until then.)
+	//  The exited channel releases this goroutine when the process ends gracefully.
+	exited := make(chan struct{})
+	defer close(exited)
 	go func() {
-		<-ctx.Done() // FIXME goroutine leak occurs when the process ends gracefully
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
 		cmd.Process.Signal(os.Interrupt)
-		time.Sleep(100 * time.Millisecond)
-		cmd.Process.Signal(os.Kill)
+		select {
+		case <-time.After(100 * time.Millisecond):
+			cmd.Process.Signal(os.Kill)
+		case <-exited:
+		}
 	}()
 
 	// Consume stdout, converting it to Monitor.Chan sends.
@@ -140,16 +278,16 @@ func packOrUnpack(
 	if code == 0 {
 		// If the exit code was success, we'd sure better have gotten the rightly formatted result message.
 		if msgSlot.Result == nil {
-			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: exited zero, but no clear result?! (stderr: %q)", err, stderrBuf.String())
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: exited zero, but no clear result?! (stderr: %q)", stderrBuf.String())
 		}
 		if msgSlot.Result.Error != nil {
-			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: exited zero, but result had error, category=%s: %s", msgSlot.Result.Error.Category, msgSlot.Result.Error)
+			return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "fork rio: exited zero, but result had error, category=%s: %s", msgSlot.Result.Error.Category(), msgSlot.Result.Error)
 		}
 		return msgSlot.Result.WareID, nil // This is the happy path return!
 	}
 	// For non-zero exits: Check match for sanity.
 	exitCategory := rio.CategoryForExitCode(code)
-	if msgSlot.Result == nil {
+	if msgSlot.Result == nil || msgSlot.Result.Error == nil {
 		return api.WareID{}, Errorf(exitCategory, "no message available (stderr: %q)", stderrBuf.String())
 	}
 	if msgSlot.Result.Error.Category() != exitCategory {
@@ -157,14 +295,3 @@ func packOrUnpack(
 	}
 	return api.WareID{}, msgSlot.Result.Error // This is the clean error path!
 }
-
-func MirrorFunc(
-	ctx context.Context,
-	wareID api.WareID,
-	target api.WarehouseAddr,
-	sources []api.WarehouseAddr,
-	monitor rio.Monitor,
-) (api.WareID, error) {
-	// TODO all of it
-	return api.WareID{}, nil
-}
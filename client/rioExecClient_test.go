@@ -6,7 +6,10 @@ Sniperkit-Bot
 package rioexecclient_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -14,8 +17,10 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/cache"
 	"go.polydawn.net/rio/client"
 	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/testutil"
 	"go.polydawn.net/rio/transmat/mixins/tests"
 )
@@ -33,6 +38,8 @@ func Test(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
+	riobin := filepath.Join(cwd, "../bin/rio")
+	withBaseWareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
 
 	Convey("Spec compliance: exec-RPC Tar pack", t,
 		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
@@ -40,6 +47,25 @@ func Test(t *testing.T) {
 			tests.CheckPackHashVariesOnVariations("tar", rioexecclient.PackFunc)
 		}),
 	)
+	Convey("Spec compliance: exec-RPC Tar unpack", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+				tests.CheckRoundTrip("tar", rioexecclient.PackFunc, rioexecclient.UnpackFunc, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+			})
+		}),
+	)
+	Convey("Spec compliance: exec-RPC Tar mirror", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755)
+				osfs.New(tmpDir).Mkdir(fs.MustRelPath("dst"), 0755)
+				srcAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/src", tmpDir))
+				dstAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/dst", tmpDir))
+				tests.CheckMirror("tar", rioexecclient.MirrorFunc, rioexecclient.PackFunc, rioexecclient.UnpackFunc, dstAddr, srcAddr)
+			})
+		}),
+	)
 
 	Convey("exec client tests", t, func() {
 		Convey("unpacking tar fixtures (happy path)",
@@ -47,7 +73,7 @@ func Test(t *testing.T) {
 				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
 					_, err := rioexecclient.UnpackFunc(
 						context.Background(),
-						api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"},
+						withBaseWareID,
 						tmpDir.String(),
 						api.Filter_NoMutation,
 						rio.Placement_Direct,
@@ -63,7 +89,7 @@ func Test(t *testing.T) {
 				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
 					_, err := rioexecclient.UnpackFunc(
 						context.Background(),
-						api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"},
+						withBaseWareID,
 						tmpDir.String(),
 						api.Filter_NoMutation,
 						rio.Placement_Direct,
@@ -74,5 +100,115 @@ func Test(t *testing.T) {
 				})
 			},
 		)
+		Convey("scanning tar fixtures", func() {
+			gotWareID, err := rioexecclient.ScanFunc(
+				context.Background(),
+				"tar",
+				api.FilesetFilters{},
+				rio.Placement_Direct,
+				"file://../transmat/tar/fixtures/tar_withBase.tgz",
+				rio.Monitor{},
+			)
+			So(err, ShouldBeNil)
+			So(gotWareID, ShouldResemble, withBaseWareID)
+		})
+		Convey("events are passed to the monitor, which is closed at the end", func() {
+			monChan := make(chan rio.Event, 100)
+			_, err := rioexecclient.ScanFunc(
+				context.Background(),
+				"tar",
+				api.FilesetFilters{},
+				rio.Placement_Direct,
+				"file://../transmat/tar/fixtures/tar_withBase.tgz",
+				rio.Monitor{monChan},
+			)
+			So(err, ShouldBeNil)
+			var evts []rio.Event
+			for evt := range monChan {
+				evts = append(evts, evt)
+			}
+			So(evts, ShouldNotBeEmpty)
+		})
+	})
+
+	Convey("exec client configuration", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			Convey("the binary can be anywhere, and the working dir can be set", func() {
+				client := &rioexecclient.Client{
+					Binary: riobin,
+					Dir:    filepath.Join(cwd, "../transmat/tar/fixtures"),
+				}
+				gotWareID, err := client.Scan(
+					context.Background(),
+					"tar",
+					api.FilesetFilters{},
+					rio.Placement_Direct,
+					"file://./tar_withBase.tgz",
+					rio.Monitor{},
+				)
+				So(err, ShouldBeNil)
+				So(gotWareID, ShouldResemble, withBaseWareID)
+			})
+			Convey("env can be added, e.g. to pick the cache",
+				testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+					client := &rioexecclient.Client{
+						Binary: riobin,
+						Env:    []string{"RIO_CACHE=" + tmpDir.Join(fs.MustRelPath("cache")).String()},
+					}
+					_, err := client.Unpack(
+						context.Background(),
+						withBaseWareID,
+						"-",
+						api.Filter_NoMutation,
+						rio.Placement_None,
+						[]api.WarehouseAddr{"file://../transmat/tar/fixtures/tar_withBase.tgz"},
+						rio.Monitor{},
+					)
+					So(err, ShouldBeNil)
+					_, err = os.Stat(tmpDir.Join(fs.MustRelPath("cache")).Join(cache.ShelfFor(withBaseWareID)).String())
+					So(err, ShouldBeNil)
+				}),
+			)
+			Convey("stderr can be collected", func() {
+				var stderr bytes.Buffer
+				client := &rioexecclient.Client{Binary: riobin, Stderr: &stderr}
+				_, err := client.Unpack(
+					context.Background(),
+					withBaseWareID,
+					tmpDir.String(),
+					api.Filter_NoMutation,
+					rio.Placement_Direct,
+					nil,
+					rio.Monitor{},
+				)
+				So(err, ShouldNotBeNil)
+				So(stderr.String(), ShouldContainSubstring, "no warehouses were available!")
+			})
+			Convey("the handshake passes with the real thing", func() {
+				So((&rioexecclient.Client{Binary: riobin}).Handshake(), ShouldBeNil)
+			})
+			Convey("the handshake fails clearly on an incompatible event format", func() {
+				fakebin := tmpDir.Join(fs.MustRelPath("rio-future")).String()
+				So(ioutil.WriteFile(fakebin, []byte("#!/bin/sh\necho '{\"version\":\"v9\",\"eventFormat\":9}'\n"), 0755), ShouldBeNil)
+				client := &rioexecclient.Client{Binary: fakebin}
+				_, err := client.Scan(
+					context.Background(),
+					"tar",
+					api.FilesetFilters{},
+					rio.Placement_Direct,
+					"file://../transmat/tar/fixtures/tar_withBase.tgz",
+					rio.Monitor{},
+				)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, fmt.Sprintf("speaks event format 9, but this client only understands event format %d", rioexecclient.EventFormat))
+			})
+			Convey("the handshake fails clearly on a rio too old to say", func() {
+				fakebin := tmpDir.Join(fs.MustRelPath("rio-past")).String()
+				So(ioutil.WriteFile(fakebin, []byte("#!/bin/sh\necho 'error parsing args: expected command but got \"version\"' >&2\nexit 1\n"), 0755), ShouldBeNil)
+				err := (&rioexecclient.Client{Binary: fakebin}).Handshake()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "failed to report its version")
+			})
+		})
 	})
 }
@@ -9,6 +9,7 @@ import (
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/transmat/git"
+	"go.polydawn.net/rio/transmat/oci"
 	"go.polydawn.net/rio/transmat/tar"
 )
 
@@ -27,6 +28,8 @@ func demuxUnpackTool(packType string) (rio.UnpackFunc, error) {
 		return tartrans.Unpack, nil
 	case "git":
 		return git.Unpack, nil
+	case "oci":
+		return ocitrans.Unpack, nil
 	default:
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
@@ -45,6 +48,8 @@ func demuxMirrorTool(packType string) (rio.MirrorFunc, error) {
 	switch packType {
 	case "tar":
 		return tartrans.Mirror, nil
+	case "git":
+		return git.Mirror, nil
 	default:
 		return nil, Errorf(rio.ErrUsage, "unsupported packtype %q", packType)
 	}
@@ -6,22 +6,43 @@ Sniperkit-Bot
 package main
 
 import (
+	"bufio"
 	"context"
+	stdjson "encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/polydawn/refmt"
 	"github.com/polydawn/refmt/json"
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/client"
+	"go.polydawn.net/rio/client/daemon"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/daemon"
+	"go.polydawn.net/rio/doctor"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/serve"
+	"go.polydawn.net/rio/transmat/git"
+	"go.polydawn.net/rio/transmat/mixins/drift"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/policy"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/warehouse/impl/kvenc"
+	"go.polydawn.net/rio/warehouse/signature"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -55,6 +76,16 @@ const (
 	format_Json = "json"
 )
 
+// Set at build time, with `-ldflags "-X main.version=..."`.
+var version = "dev"
+
+/*
+	The version of the events we print with --format=json.
+	Bump this (and rioexecclient.EventFormat) on any incompatible change,
+	so exec clients fail clearly, rather than misreading us.
+*/
+const eventFormat = 1
+
 func Main(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	bhv := Parse(ctx, args, stdin, stdout, stderr)
 	err := bhv.action()
@@ -90,6 +121,9 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Path                string             // Pack target path, abs or rel
 			Filters             api.FilesetFilters // Filters for pack
 			TargetWarehouseAddr string             // Warehouse address to push to
+			Hash                string             // Hash algorithm name
+			Index               string             // Stat-cache file path
+			Manifest            string             // Manifest file path to write
 		}{}
 		cmd.Arg("pack", "Pack type").
 			Required().
@@ -99,6 +133,11 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			StringVar(&args.Path)
 		cmd.Flag("target", "Warehouse in which to place the ware").
 			StringVar(&args.TargetWarehouseAddr)
+		hashFlag(cmd, &args.Hash)
+		cmd.Flag("index", "Stat-cache file, to skip rehashing unchanged files (only when packing without a target)").
+			StringVar(&args.Index)
+		cmd.Flag("manifest", "File to write a manifest of the packed fileset to, for use with `rio check`").
+			StringVar(&args.Manifest)
 		cmd.Flag("uid", "Set UID filter [keep, <int>]").
 			StringVar(&args.Filters.Uid)
 		cmd.Flag("gid", "Set GID filter [keep, <int>]").
@@ -116,16 +155,37 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			if args.Hash != "" || args.Index != "" || args.Manifest != "" {
+				opts := tartrans.PackOptions{}
+				if args.Hash != "" {
+					opts.Algorithm, _ = fshash.LookupAlgorithm(args.Hash)
+				}
+				if args.Index != "" {
+					if opts.Index, err = filepath.Abs(args.Index); err != nil {
+						return Recategorize(rio.ErrUsage, err)
+					}
+				}
+				if args.Manifest != "" {
+					if opts.Manifest, err = filepath.Abs(args.Manifest); err != nil {
+						return Recategorize(rio.ErrUsage, err)
+					}
+				}
+				packFunc = tartrans.PackWithOptions(opts)
+			}
 			path, err := filepath.Abs(args.Path)
 			if err != nil {
 				return Recategorize(rio.ErrUsage, err)
 			}
+			target, err := resolveWarehouse(args.TargetWarehouseAddr)
+			if err != nil {
+				return err
+			}
 			resultWareID, err := packFunc(
 				ctx,
 				api.PackType(args.PackType),
 				path,
 				args.Filters,
-				api.WarehouseAddr(args.TargetWarehouseAddr),
+				target,
 				oc.WireMonitor(ctx, rio.Monitor{}),
 			)
 			if err != nil {
@@ -143,6 +203,16 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Filters              api.FilesetFilters // Filters for unpack
 			PlacementMode        string             // Placement mode enum
 			SourcesWarehouseAddr []string           // Warehouse address to fetch from
+			GitMtime             string             // Mtime source enum, for git only
+			GitUid               uint32             // Uid to unpack files with, for git only
+			GitGid               uint32             // Gid to unpack files with, for git only
+			GitPerms             string             // Perms for non-executable files (octal), for git only
+			GitArchive           bool               // Apply .gitattributes export rules, for git only
+			Manifest             string             // Manifest file path to write, for tar only
+			Transactional        bool               // Stage and verify before replacing the target, for tar only
+			PolicySkip           []string           // Policy classes to skip, for tar only
+			PolicyReject         []string           // Policy classes to reject, for tar only
+			RequireSignature     string             // Public key or keyring to require a signature from, for tar only
 		}{}
 		cmd.Arg("ware", "Ware ID").
 			Required().
@@ -150,10 +220,10 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 		cmd.Arg("path", "Target path").
 			Required().
 			StringVar(&args.Path)
-		cmd.Flag("placer", "Placement mode to use [copy, direct, mount, none]").
+		cmd.Flag("placer", "Placement mode to use [copy, direct, mount, none, sync]; sync (tar only) changes only what differs from what's already at the path.  Defaults to \"placer\" in config, if set").
 			EnumVar(&args.PlacementMode,
-				string(rio.Placement_Copy), string(rio.Placement_Direct), string(rio.Placement_Mount), string(rio.Placement_None))
-		cmd.Flag("source", "Warehouses from which to fetch the ware").
+				string(rio.Placement_Copy), string(rio.Placement_Direct), string(rio.Placement_Mount), string(rio.Placement_None), string(tartrans.Placement_Sync))
+		cmd.Flag("source", "Warehouses from which to fetch the ware (or \"@name\" for a warehouse named in config; defaults to \"sources\" in config)").
 			StringsVar(&args.SourcesWarehouseAddr)
 		cmd.Flag("uid", "Set UID filter [keep, mine, <int>]").
 			Default("mine").
@@ -168,6 +238,31 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			Default("zero").
 			EnumVar(&args.Filters.Sticky,
 				"keep", "zero")
+		cmd.Flag("git-mtime", "For git wares: where to get file mtimes from, before filters [default, commit, last-change]").
+			Default("default").
+			EnumVar(&args.GitMtime,
+				"default", string(git.MtimeSource_Commit), string(git.MtimeSource_LastChange))
+		cmd.Flag("git-uid", "For git wares: UID to give files, before filters").
+			Default(strconv.Itoa(int(git.DefaultUnpackOptions.Uid))).
+			Uint32Var(&args.GitUid)
+		cmd.Flag("git-gid", "For git wares: GID to give files, before filters").
+			Default(strconv.Itoa(int(git.DefaultUnpackOptions.Gid))).
+			Uint32Var(&args.GitGid)
+		cmd.Flag("git-perms", "For git wares: permissions (octal) to give non-executable files").
+			Default(fmt.Sprintf("%#o", git.DefaultUnpackOptions.Perms)).
+			StringVar(&args.GitPerms)
+		cmd.Flag("git-archive", "For git wares: produce the same tree as `git archive` (honors export-ignore and export-subst in .gitattributes)").
+			BoolVar(&args.GitArchive)
+		cmd.Flag("manifest", "For tar wares: file to write a manifest of the unpacked fileset to, for use with `rio check`").
+			StringVar(&args.Manifest)
+		cmd.Flag("transactional", "For tar wares with direct placement: unpack beside the target path, and only replace it once the ware is verified").
+			BoolVar(&args.Transactional)
+		cmd.Flag("skip", "For tar wares: kinds of entries to leave out, with a warning [devices, fifos, setid, abs-symlinks, escaping-symlinks, all]").
+			StringsVar(&args.PolicySkip)
+		cmd.Flag("reject", "For tar wares: kinds of entries to refuse, failing the unpack [devices, fifos, setid, abs-symlinks, escaping-symlinks, all]").
+			StringsVar(&args.PolicyReject)
+		cmd.Flag("require-signature", "For tar wares: public key (or keyring file) which must have signed the ware (see `rio sign`); checked before unpacking").
+			StringVar(&args.RequireSignature)
 		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
 			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -179,21 +274,80 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
-			path, err := filepath.Abs(args.Path)
+			if wareID.Type == git.PackType {
+				perms, err := strconv.ParseUint(args.GitPerms, 8, 16)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "invalid git perms %q: must be octal", args.GitPerms)
+				}
+				gitOpts := git.UnpackOptions{
+					Uid:     args.GitUid,
+					Gid:     args.GitGid,
+					Perms:   fs.Perms(perms),
+					Archive: args.GitArchive,
+				}
+				if args.GitMtime != "default" {
+					gitOpts.Mtime = git.MtimeSource(args.GitMtime)
+				}
+				unpackFunc = git.UnpackWithOptions(gitOpts)
+			}
+			if args.PlacementMode == "" {
+				if args.PlacementMode, err = configuredPlacer(); err != nil {
+					return err
+				}
+			}
+			pol := policy.Policy{}
+			for _, classes := range args.PolicySkip {
+				if err := pol.Set(policy.Action_Skip, classes); err != nil {
+					return err
+				}
+			}
+			for _, classes := range args.PolicyReject {
+				if err := pol.Set(policy.Action_Reject, classes); err != nil {
+					return err
+				}
+			}
+			if args.Manifest != "" || args.Transactional || !pol.AllowsAll() {
+				if wareID.Type != tartrans.PackType {
+					return Errorf(rio.ErrUsage, "manifests, transactional unpacks, and unpack policies are only supported for %q wares", tartrans.PackType)
+				}
+				if args.Transactional && rio.PlacementMode(args.PlacementMode) != rio.Placement_Direct {
+					return Errorf(rio.ErrUsage, "transactional unpacks require %q placement", rio.Placement_Direct)
+				}
+				tarOpts := tartrans.UnpackOptions{Transactional: args.Transactional, Policy: pol}
+				if args.Manifest != "" {
+					tarOpts.Manifest, err = filepath.Abs(args.Manifest)
+					if err != nil {
+						return Recategorize(rio.ErrUsage, err)
+					}
+				}
+				unpackFunc = tartrans.UnpackWithOptions(tarOpts)
+			}
+			if rio.PlacementMode(args.PlacementMode) == tartrans.Placement_Sync && wareID.Type != tartrans.PackType {
+				return Errorf(rio.ErrUsage, "sync placement is only supported for %q wares", tartrans.PackType)
+			}
+			sources, err := resolveSources(args.SourcesWarehouseAddr)
 			if err != nil {
-				return Recategorize(rio.ErrInoperablePath, err)
+				return err
+			}
+			if args.RequireSignature != "" {
+				if err := requireSignature(wareID, args.RequireSignature, sources); err != nil {
+					return err
+				}
 			}
-			err = fsOp.RemoveDirContent(osfs.New(fs.MustAbsolutePath(path)), fs.RelPath{})
+			path, err := filepath.Abs(args.Path)
 			if err != nil {
 				return Recategorize(rio.ErrInoperablePath, err)
 			}
+			if err := prepareUnpackTarget(path, rio.PlacementMode(args.PlacementMode), args.Transactional); err != nil {
+				return err
+			}
 			resultWareID, err := unpackFunc(
 				ctx,
 				wareID,
 				path,
 				args.Filters,
 				rio.PlacementMode(args.PlacementMode),
-				convertWarehouseSlice(args.SourcesWarehouseAddr),
+				sources,
 				oc.WireMonitor(ctx, rio.Monitor{}),
 			)
 			if err != nil {
@@ -209,12 +363,14 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			PackType            string             // Pack type
 			Filters             api.FilesetFilters // Filters for pack
 			SourceWarehouseAddr string             // Warehouse address of data to scan
+			Hash                string             // Hash algorithm name
 		}{}
 		cmd.Arg("pack", "Pack type").
 			Required().
 			StringVar(&args.PackType)
 		cmd.Flag("source", "Address to of the data to scan.").
 			StringVar(&args.SourceWarehouseAddr)
+		hashFlag(cmd, &args.Hash)
 		cmd.Flag("uid", "Set UID filter [keep, <int>]").
 			StringVar(&args.Filters.Uid)
 		cmd.Flag("gid", "Set GID filter [keep, <int>]").
@@ -232,12 +388,20 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			if args.Hash != "" {
+				algo, _ := fshash.LookupAlgorithm(args.Hash)
+				scanFunc = tartrans.ScanWithAlgorithm(algo)
+			}
+			source, err := resolveWarehouse(args.SourceWarehouseAddr)
+			if err != nil {
+				return err
+			}
 			resultWareID, err := scanFunc(
 				ctx,
 				api.PackType(args.PackType),
 				args.Filters,
 				rio.Placement_Direct,
-				api.WarehouseAddr(args.SourceWarehouseAddr),
+				source,
 				oc.WireMonitor(ctx, rio.Monitor{}),
 			)
 			if err != nil {
@@ -247,20 +411,254 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			return nil
 		}}
 	}
+	{
+		cmd := app.Command("ls", "List a Fileset on your local filesystem as it would be packed.  (Output is always plain text.)")
+		args := struct {
+			Path       string             // Target path, abs or rel
+			Filters    api.FilesetFilters // Filters, as for pack
+			TreeHashes bool               // List dirs with subtree hashes instead
+			Hash       string             // Hash algorithm name
+		}{}
+		cmd.Arg("path", "Target path").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("uid", "Set UID filter [keep, <int>]").
+			StringVar(&args.Filters.Uid)
+		cmd.Flag("gid", "Set GID filter [keep, <int>]").
+			StringVar(&args.Filters.Gid)
+		cmd.Flag("mtime", "Set mtime filter [keep, <@UNIX>, <RFC3339>]. Will be set to a date if not specified.").
+			StringVar(&args.Filters.Mtime)
+		cmd.Flag("sticky", "Keep setuid, setgid, and sticky bits [keep, zero]").
+			Default("keep").
+			EnumVar(&args.Filters.Sticky,
+				"keep", "zero")
+		cmd.Flag("tree-hashes", "List only dirs, each with the WareID it would have if packed alone (with the same filters)").
+			BoolVar(&args.TreeHashes)
+		hashFlag(cmd, &args.Hash)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			path, err := filepath.Abs(args.Path)
+			if err != nil {
+				return Recategorize(rio.ErrUsage, err)
+			}
+			algo, _ := fshash.LookupAlgorithm(args.Hash)
+			if !args.TreeHashes {
+				_, err = tartrans.Ls(ctx, path, args.Filters, algo, func(fmeta fs.Metadata) {
+					fmt.Fprintf(stdout, "%-7s %04o %5d %5d %10d %s %s\n",
+						fmeta.Type, fmeta.Perms, fmeta.Uid, fmeta.Gid, fmeta.Size,
+						fmeta.Mtime.UTC().Format(time.RFC3339), fmeta.Name)
+				}, nil)
+				return err
+			}
+			// Trees are reported bottom-up; collect them so we can list top-down.
+			var trees []treeHash
+			_, err = tartrans.Ls(ctx, path, args.Filters, algo, nil, func(dir fs.RelPath, wareID api.WareID) {
+				trees = append(trees, treeHash{dir.String(), wareID})
+			})
+			if err != nil {
+				return err
+			}
+			sort.Slice(trees, func(i, j int) bool { return trees[i].dir < trees[j].dir })
+			for _, tree := range trees {
+				fmt.Fprintf(stdout, "%s\t%s\n", tree.wareID, tree.dir)
+			}
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("prove", "Produce a proof that a file or dir is part of a Ware, which can be checked later with only the WareID.  (Output is always the proof, as JSON.)")
+		args := struct {
+			WareID               string   // Ware id string "<kind>:<hash>"
+			Path                 string   // Path within the ware
+			SourcesWarehouseAddr []string // Warehouse address to fetch from
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("path", "Path within the ware").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("source", "Warehouses from which to fetch the ware (or \"@name\" for a warehouse named in config; defaults to \"sources\" in config)").
+			StringsVar(&args.SourcesWarehouseAddr)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			if wareID.Type != tartrans.PackType {
+				return Errorf(rio.ErrUsage, "proofs are only supported for %q wares", tartrans.PackType)
+			}
+			sources, err := resolveSources(args.SourcesWarehouseAddr)
+			if err != nil {
+				return err
+			}
+			proof, err := tartrans.Prove(
+				ctx,
+				wareID,
+				args.Path,
+				sources,
+				rio.Monitor{},
+			)
+			if err != nil {
+				return err
+			}
+			msg, err := stdjson.MarshalIndent(proof, "", "\t")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(stdout, "%s\n", msg)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("verify-proof", "Check a proof made by `rio prove` against a WareID.  No warehouses are needed.")
+		args := struct {
+			WareID    string // Ware id string "<kind>:<hash>"
+			ProofPath string // Path to the proof file, or "-" for stdin
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Arg("proof", "Proof file (or \"-\" for stdin)").
+			Required().
+			StringVar(&args.ProofPath)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			var msg []byte
+			if args.ProofPath == "-" {
+				msg, err = ioutil.ReadAll(stdin)
+			} else {
+				msg, err = ioutil.ReadFile(args.ProofPath)
+			}
+			if err != nil {
+				return Errorf(rio.ErrUsage, "cannot read proof: %s", err)
+			}
+			var proof fshash.Proof
+			if err := stdjson.Unmarshal(msg, &proof); err != nil {
+				return Errorf(rio.ErrUsage, "cannot parse proof: %s", err)
+			}
+			if err := tartrans.VerifyProof(wareID, proof); err != nil {
+				return err
+			}
+			oc.EmitResult(wareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("check", "Check a directory for drift from the ware it was unpacked from, or from a manifest, listing each differing path and field.  (Output is always plain text.)")
+		args := struct {
+			Path                 string             // Target path, abs or rel
+			Manifest             string             // Manifest file to compare against
+			WareID               string             // Ware to compare against
+			Filters              api.FilesetFilters // Filters used for unpack, if comparing to a ware
+			SourcesWarehouseAddr []string           // Warehouse address to fetch from, if comparing to a ware
+		}{}
+		cmd.Arg("path", "Target path").
+			Required().
+			StringVar(&args.Path)
+		cmd.Flag("manifest", "Manifest to compare against (as written by `rio pack --manifest` or `rio unpack --manifest`)").
+			StringVar(&args.Manifest)
+		cmd.Flag("ware", "Ware ID to compare against (the directory is compared to it as unpacked with the given filters)").
+			StringVar(&args.WareID)
+		cmd.Flag("source", "Warehouses from which to fetch the ware (or \"@name\" for a warehouse named in config; defaults to \"sources\" in config)").
+			StringsVar(&args.SourcesWarehouseAddr)
+		cmd.Flag("uid", "Set UID filter [keep, mine, <int>]").
+			Default("mine").
+			StringVar(&args.Filters.Uid)
+		cmd.Flag("gid", "Set GID filter [keep, mine, <int>]").
+			Default("mine").
+			StringVar(&args.Filters.Gid)
+		cmd.Flag("mtime", "Set mtime filter [keep, <@UNIX>, <RFC3339>]").
+			Default("keep").
+			StringVar(&args.Filters.Mtime)
+		cmd.Flag("sticky", "Keep setuid, setgid, and sticky bits [keep, zero]").
+			Default("zero").
+			EnumVar(&args.Filters.Sticky,
+				"keep", "zero")
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			if (args.Manifest == "") == (args.WareID == "") {
+				return Errorf(rio.ErrUsage, "check requires exactly one of --manifest or --ware")
+			}
+			path, err := filepath.Abs(args.Path)
+			if err != nil {
+				return Recategorize(rio.ErrUsage, err)
+			}
+			report := func(d drift.Difference) {
+				fmt.Fprintln(stdout, d)
+			}
+			var n int
+			if args.Manifest != "" {
+				f, err := os.Open(args.Manifest)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "cannot read manifest: %s", err)
+				}
+				defer f.Close()
+				afs := osfs.New(fs.MustAbsolutePath(path))
+				if _, err := afs.Stat(fs.RelPath{}); err != nil {
+					return Errorf(rio.ErrInoperablePath, "cannot read path for checking: %s", err)
+				}
+				n, err = drift.CheckManifest(ctx, afs, bufio.NewReader(f), report)
+				if err != nil {
+					return err
+				}
+			} else {
+				wareID, err := api.ParseWareID(args.WareID)
+				if err != nil {
+					return err
+				}
+				if wareID.Type != tartrans.PackType {
+					return Errorf(rio.ErrUsage, "check is only supported for %q wares", tartrans.PackType)
+				}
+				sources, err := resolveSources(args.SourcesWarehouseAddr)
+				if err != nil {
+					return err
+				}
+				n, err = tartrans.Check(
+					ctx,
+					path,
+					wareID,
+					args.Filters,
+					sources,
+					report,
+					rio.Monitor{},
+				)
+				if err != nil {
+					return err
+				}
+			}
+			if n > 0 {
+				return Errorf(rio.ErrWareHashMismatch, "%d differences found", n)
+			}
+			return nil
+		}}
+	}
 	{
 		cmd := app.Command("mirror", "Store already-packed wares in one warehouse, copying from other warehouses.")
 		args := struct {
 			WareID               string   // WareID to mirror
 			TargetWarehouseAddr  string   // Warehouse to mirror into
 			SourceWarehouseAddrs []string // Warehouses we can fetch from
+			RequireSignature     string   // Public key or keyring to require a signature from
 		}{}
 		cmd.Arg("ware", "Ware ID").
 			Required().
 			StringVar(&args.WareID)
 		cmd.Flag("target", "Warehouse in which to place the ware").
 			StringVar(&args.TargetWarehouseAddr)
-		cmd.Flag("source", "Warehouses from which to fetch the ware").
+		cmd.Flag("source", "Warehouses from which to fetch the ware (or \"@name\" for a warehouse named in config; defaults to \"sources\" in config)").
 			StringsVar(&args.SourceWarehouseAddrs)
+		cmd.Flag("require-signature", "For tar wares: public key (or keyring file) which must have signed the ware (see `rio sign`); checked before mirroring").
+			StringVar(&args.RequireSignature)
 		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
 			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
@@ -272,11 +670,24 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			if err != nil {
 				return err
 			}
+			target, err := resolveWarehouse(args.TargetWarehouseAddr)
+			if err != nil {
+				return err
+			}
+			sources, err := resolveSources(args.SourceWarehouseAddrs)
+			if err != nil {
+				return err
+			}
+			if args.RequireSignature != "" {
+				if err := requireSignature(wareID, args.RequireSignature, sources); err != nil {
+					return err
+				}
+			}
 			resultWareID, err := mirrorFunc(
 				ctx,
 				wareID,
-				api.WarehouseAddr(args.TargetWarehouseAddr),
-				convertWarehouseSlice(args.SourceWarehouseAddrs),
+				target,
+				sources,
 				oc.WireMonitor(ctx, rio.Monitor{}),
 			)
 			if err != nil {
@@ -286,14 +697,236 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 			return nil
 		}}
 	}
+	{
+		cmd := app.Command("sign", "Sign a Ware, storing the signature beside it in a warehouse, for checking with `--require-signature`.")
+		args := struct {
+			WareID              string // Ware id string "<kind>:<hash>"
+			KeyPath             string // Private key file
+			TargetWarehouseAddr string // Warehouse holding the ware
+		}{}
+		cmd.Arg("ware", "Ware ID").
+			Required().
+			StringVar(&args.WareID)
+		cmd.Flag("key", "Private key file to sign with (see `rio keygen`)").
+			Required().
+			StringVar(&args.KeyPath)
+		cmd.Flag("target", "Warehouse holding the ware, in which to store the signature").
+			Required().
+			StringVar(&args.TargetWarehouseAddr)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			wareID, err := api.ParseWareID(args.WareID)
+			if err != nil {
+				return err
+			}
+			if wareID.Type != tartrans.PackType {
+				return Errorf(rio.ErrUsage, "signatures are only supported for %q wares", tartrans.PackType)
+			}
+			key, err := signature.LoadPrivateKey(args.KeyPath)
+			if err != nil {
+				return err
+			}
+			target, err := resolveWarehouse(args.TargetWarehouseAddr)
+			if err != nil {
+				return err
+			}
+			if err := signature.Store(wareID, signature.Sign(key, wareID), target); err != nil {
+				return err
+			}
+			oc.EmitResult(wareID, nil)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("keygen", "Generate a key for `rio sign` (or with --encryption, for 'enc+' warehouses), writing the private key to a file.  (Output is always the public key, as plain text, or nothing for encryption keys.)")
+		args := struct {
+			KeyPath    string // Private key file to create
+			Encryption bool   // Make an encryption key rather than a signing key
+		}{}
+		cmd.Arg("path", "Private key file to create").
+			Required().
+			StringVar(&args.KeyPath)
+		cmd.Flag("encryption", "Generate a key for encrypted warehouses (use it by setting RIO_ENCRYPTION_KEYFILE)").
+			BoolVar(&args.Encryption)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			var priv, pub fmt.Stringer
+			if args.Encryption {
+				priv, err = kvenc.GenerateKey()
+			} else {
+				pub, priv, err = signature.GenerateKey()
+			}
+			if err != nil {
+				panic(err) // only if the system's randomness source fails.
+			}
+			f, err := os.OpenFile(args.KeyPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+			if err != nil {
+				return Errorf(rio.ErrInoperablePath, "cannot write private key: %s", err)
+			}
+			_, err = fmt.Fprintf(f, "%s\n", priv)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return Errorf(rio.ErrInoperablePath, "cannot write private key: %s", err)
+			}
+			if pub != nil {
+				fmt.Fprintf(stdout, "%s\n", pub)
+			}
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("config", "Inspect rio's config.").
+			Command("show", "Print the effective config, merged from the config files and environment, with inline secrets redacted.  (Output is always JSON.)")
+		args := struct{}{}
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			effective, loaded, err := config.Effective()
+			if err != nil {
+				return Errorf(rio.ErrUsage, "%s", err)
+			}
+			for name, wh := range effective.Warehouses {
+				wh.Auth = wh.Auth.Redacted()
+				effective.Warehouses[name] = wh
+			}
+			if loaded == nil {
+				loaded = []string{}
+			}
+			msg, err := stdjson.MarshalIndent(struct {
+				Files []string `json:"files"` // The config files found, in the order they were applied.
+				config.File
+			}{loaded, effective}, "", "\t")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(stdout, "%s\n", msg)
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("doctor", "Report on this host: capabilities, which placers can work (and why not), whether rio's directories are writable, the cache's filesystem, and whether the warehouses in config are reachable.  (Output is plain text, or JSON with --format=json.)")
+		args := struct{}{}
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			report := doctor.Examine()
+			switch oc.format {
+			case format_Json:
+				msg, err := stdjson.MarshalIndent(report, "", "\t")
+				if err != nil {
+					panic(err)
+				}
+				fmt.Fprintf(stdout, "%s\n", msg)
+			default:
+				fmt.Fprint(stdout, report)
+			}
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("version", "Print rio's version, and the version of the event format it speaks with --format=json (which exec clients check before talking to it).")
+		args := struct{}{}
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			switch oc.format {
+			case format_Json:
+				msg, err := stdjson.Marshal(rioexecclient.Version{Version: version, EventFormat: eventFormat})
+				if err != nil {
+					panic(err)
+				}
+				fmt.Fprintf(stdout, "%s\n", msg)
+			default:
+				fmt.Fprintf(stdout, "rio %s (event format %d)\n", version, eventFormat)
+			}
+			return nil
+		}}
+	}
+	{
+		cmd := app.Command("daemon", "Serve pack, unpack, scan, and mirror to other processes over a unix socket, until interrupted.  Concurrent requests for the same ware are done only once.")
+		args := struct {
+			Listen string // Address to listen on
+		}{}
+		cmd.Flag("listen", "Address to listen on (\"unix:///path/to.sock\")").
+			Default(riodaemonclient.DefaultAddr).
+			StringVar(&args.Listen)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			listener, err := daemon.Listen(args.Listen)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(stderr, "rio daemon: listening on %s\n", args.Listen)
+			return daemon.NewServer(daemonTools).Serve(ctx, listener)
+		}}
+	}
+	{
+		cmd := app.Command("serve", "Serve a local warehouse over HTTP, in the layout 'ca+http' warehouses read, until interrupted.  Uploads (PUTs) are accepted only with a token, and only once they're verified to be the ware they claim to be.  Also serves a listing at '/_list' and a health check at '/_health'.")
+		args := struct {
+			Warehouse    string // Warehouse to serve
+			Listen       string // Address to listen on
+			PutTokenFile string // File holding the token uploads must bear
+		}{}
+		cmd.Flag("warehouse", "Warehouse to serve (a 'ca+file' URL, or '@name' from config)").
+			Required().
+			StringVar(&args.Warehouse)
+		cmd.Flag("listen", "Address to listen on (\"host:port\")").
+			Default(":8080").
+			StringVar(&args.Listen)
+		cmd.Flag("put-token-file", "File holding a token; if given, uploads bearing it (as 'Authorization: Bearer <token>') are accepted").
+			StringVar(&args.PutTokenFile)
+		bhvs[cmd.FullCommand()] = &behavior{&args, func() (err error) {
+			defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+			addr, err := resolveWarehouse(args.Warehouse)
+			if err != nil {
+				return err
+			}
+			var putToken string
+			if args.PutTokenFile != "" {
+				bs, err := ioutil.ReadFile(args.PutTokenFile)
+				if err != nil {
+					return Errorf(rio.ErrUsage, "cannot read put token file: %s", err)
+				}
+				putToken = strings.TrimSpace(string(bs))
+				if putToken == "" {
+					return Errorf(rio.ErrUsage, "put token file %q is empty", args.PutTokenFile)
+				}
+			}
+			server, err := serve.New(addr, putToken)
+			if err != nil {
+				return err
+			}
+			listener, err := net.Listen("tcp", args.Listen)
+			if err != nil {
+				return Errorf(rio.ErrInoperablePath, "cannot listen on %s: %s", args.Listen, err)
+			}
+			fmt.Fprintf(stderr, "rio serve: serving %s on %s\n", addr, listener.Addr())
+			return server.Serve(ctx, listener)
+		}}
+	}
 	// Okay now let's be clear: actually all of these behaviors should, end of day,
 	//  actually send their errors through our output control.
 	//  We still also return it, both so you can write tests around this
 	//  method as a whole, and so the top of the program can choose an exit code!
-	for _, bhv := range bhvs {
+	//  Invalid config files are reported before doing anything, too
+	//  (except by the commands which are for looking into config).
+	for cmdStr, bhv := range bhvs {
 		_action := bhv.action
+		checkConfig := cmdStr != "config show" && cmdStr != "doctor"
 		bhv.action = func() error {
-			err := _action()
+			var err error
+			if checkConfig {
+				err = config.Load()
+			}
+			if err == nil {
+				err = _action()
+			}
 			if err != nil {
 				oc.EmitResult(api.WareID{}, err)
 			}
@@ -321,6 +954,21 @@ func Parse(ctx context.Context, args []string, stdin io.Reader, stdout, stderr i
 	panic("unreachable, cli parser must error on unknown commands")
 }
 
+/*
+	Declares the "--hash" flag for picking a hash algorithm.
+	Leaves the value blank if not given, meaning the default.
+*/
+func hashFlag(cmd *kingpin.CmdClause, value *string) {
+	names := fshash.AlgorithmNames()
+	cmd.Flag("hash", fmt.Sprintf("Hash algorithm for the WareID [%s] (default %s)", strings.Join(names, ", "), names[0])).
+		EnumVar(value, names...)
+}
+
+type treeHash struct {
+	dir    string
+	wareID api.WareID
+}
+
 type outputController struct {
 	format         format
 	stdout, stderr io.Writer
@@ -361,8 +1009,17 @@ func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.
 	m.Chan = oc.monChan
 	switch oc.format {
 	case "", format_Dumb:
+		// Progress is only shown on a terminal; anywhere else, a line
+		//  redrawn in place is just noise.
+		var progress *progressLine
+		if isTerminal(oc.stderr) {
+			progress = &progressLine{w: oc.stderr}
+		}
 		go func() {
 			defer oc.monWg.Done()
+			if progress != nil {
+				defer progress.Clear()
+			}
 			for {
 				select {
 				case evt, ok := <-oc.monChan:
@@ -371,9 +1028,14 @@ func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.
 					}
 					switch {
 					case evt.Log != nil:
+						if progress != nil {
+							progress.Clear()
+						}
 						fmt.Fprintf(oc.stderr, "log: lvl=%s msg=%s\n", evt.Log.Level, evt.Log.Msg)
 					case evt.Progress != nil:
-						// pass... for now
+						if progress != nil {
+							progress.Update(evt.Progress)
+						}
 					case evt.Result != nil:
 						// pass
 					}
@@ -408,10 +1070,95 @@ func (oc *outputController) WireMonitor(ctx context.Context, m rio.Monitor) rio.
 	return m
 }
 
-func convertWarehouseSlice(slice []string) []api.WarehouseAddr {
+/*
+	The tools the daemon serves with: the same transmats the CLI uses,
+	and the same preparation of unpack targets.
+*/
+var daemonTools = daemon.Tools{
+	Pack:   demuxPackTool,
+	Unpack: demuxUnpackTool,
+	Scan:   demuxScanTool,
+	Mirror: demuxMirrorTool,
+	PrepareUnpack: func(path string, placementMode rio.PlacementMode) error {
+		return prepareUnpackTarget(path, placementMode, false)
+	},
+}
+
+/*
+	Readies the target path for an unpack.  Syncing needs what's there;
+	transactional unpacks replace it only at the end; placement mode none
+	doesn't touch it at all; anything else starts from empty.
+	(The daemon does this for its unpacks, too.)
+*/
+func prepareUnpackTarget(path string, placementMode rio.PlacementMode, transactional bool) error {
+	switch {
+	case placementMode == rio.Placement_None, placementMode == tartrans.Placement_Sync, transactional:
+		return nil
+	}
+	target, err := fs.ParseAbsolutePath(path)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "unpack must be called with absolute path: %s", err)
+	}
+	if err := fsOp.RemoveDirContent(osfs.New(target), fs.RelPath{}); err != nil {
+		return Recategorize(rio.ErrInoperablePath, err)
+	}
+	return nil
+}
+
+/*
+	Checks the ware has a signature from the given public key (or from a key
+	in the given keyring file) in one of the warehouses.
+*/
+func requireSignature(wareID api.WareID, keyring string, warehouses []api.WarehouseAddr) error {
+	if wareID.Type != tartrans.PackType {
+		return Errorf(rio.ErrUsage, "signatures are only supported for %q wares", tartrans.PackType)
+	}
+	kr, err := signature.LoadKeyring(keyring)
+	if err != nil {
+		return err
+	}
+	return signature.Require(wareID, kr, warehouses, rio.Monitor{})
+}
+
+/*
+	Resolves a warehouse given by name ("@name") to its address, per config.
+	Anything else is returned as is.
+*/
+func resolveWarehouse(s string) (api.WarehouseAddr, error) {
+	addr, err := config.ResolveWarehouse(s)
+	if err != nil {
+		return "", Errorf(rio.ErrUsage, "%s", err)
+	}
+	return api.WarehouseAddr(addr), nil
+}
+
+/*
+	Resolves warehouses to fetch from, using the default sources from
+	config if none are given.
+*/
+func resolveSources(slice []string) ([]api.WarehouseAddr, error) {
+	if len(slice) == 0 {
+		slice = config.GetDefaultSources()
+	}
 	result := make([]api.WarehouseAddr, len(slice))
 	for idx, item := range slice {
-		result[idx] = api.WarehouseAddr(item)
+		addr, err := resolveWarehouse(item)
+		if err != nil {
+			return nil, err
+		}
+		result[idx] = addr
+	}
+	return result, nil
+}
+
+/*
+	Returns the placement mode preferred in config, if any.
+*/
+func configuredPlacer() (string, error) {
+	switch placer := config.GetPlacer(); rio.PlacementMode(placer) {
+	case "", rio.Placement_Copy, rio.Placement_Direct, rio.Placement_Mount, rio.Placement_None, tartrans.Placement_Sync:
+		return placer, nil
+	default:
+		return "", Errorf(rio.ErrUsage, "invalid placer %q in config (valid options are 'copy', 'direct', 'mount', 'none', or 'sync')", placer)
 	}
-	return result
 }
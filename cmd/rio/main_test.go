@@ -10,16 +10,21 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/client/daemon"
+	"go.polydawn.net/rio/daemon"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
 )
 
 func stdBuffers() (stdin, stdout, stderr *bytes.Buffer) {
@@ -64,6 +69,120 @@ func TestUnpackBogusFlag(t *testing.T) {
 	})
 }
 
+func TestUnpackGitBadPerms(t *testing.T) {
+	Convey("rio: git perms must be octal", t, func() {
+		args := []string{"rio", "unpack", "git:86a7bda1e3a9b9ceceb7678aa77710db5c3f2b12", "/nonexistent", "--git-perms=0999"}
+		stdin, stdout, stderr := stdBuffers()
+
+		ctx := context.Background()
+		exitCode := Main(ctx, args, stdin, stdout, stderr)
+		So(string(stdout.Bytes()), ShouldBeBlank)
+		So(string(stderr.Bytes()), ShouldResemble, "invalid git perms \"0999\": must be octal\n")
+		So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+	})
+}
+
+func TestInvalidConfig(t *testing.T) {
+	Convey("rio: invalid config files are a usage error, before doing anything", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			cfgPath := tmpDir.String() + "/config.json"
+			So(ioutil.WriteFile(cfgPath, []byte(`{"cache": 4}`), 0644), ShouldBeNil)
+			defer os.Setenv("RIO_CONFIG", os.Getenv("RIO_CONFIG"))
+			os.Setenv("RIO_CONFIG", cfgPath)
+			defer os.Setenv("RIO_SYSTEM_CONFIG", os.Getenv("RIO_SYSTEM_CONFIG"))
+			os.Setenv("RIO_SYSTEM_CONFIG", tmpDir.String()+"/none")
+
+			args := []string{"rio", "unpack", "tar:4z9DCTxoKkStqXQRwtf9nimpfQQ36dbndDsAPCQgECfbXt3edanUrsVKCjE9TkX2v9", tmpDir.String() + "/out"}
+			stdin, stdout, stderr := stdBuffers()
+			ctx := context.Background()
+			exitCode := Main(ctx, args, stdin, stdout, stderr)
+			So(string(stdout.Bytes()), ShouldBeBlank)
+			So(string(stderr.Bytes()), ShouldContainSubstring, "invalid config file")
+			So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+		})
+	})
+}
+
+func TestConfiguredPlacer(t *testing.T) {
+	Convey("rio: the configured placer counts when checking flags that need a particular one", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.MkdirAll(tmpDir.String()+"/data", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/data/file", []byte("content"), 0644), ShouldBeNil)
+				So(os.MkdirAll(tmpDir.String()+"/wh", 0755), ShouldBeNil)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String()+"/data", api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				cfgPath := tmpDir.String() + "/config.json"
+				defer os.Setenv("RIO_CONFIG", os.Getenv("RIO_CONFIG"))
+				os.Setenv("RIO_CONFIG", cfgPath)
+				defer os.Setenv("RIO_SYSTEM_CONFIG", os.Getenv("RIO_SYSTEM_CONFIG"))
+				os.Setenv("RIO_SYSTEM_CONFIG", tmpDir.String()+"/none")
+				args := []string{"rio", "unpack", "--transactional", "--source", string(whAddr), wareID.String(), tmpDir.String() + "/out"}
+
+				Convey("a configured direct placer allows transactional unpacks", func() {
+					So(ioutil.WriteFile(cfgPath, []byte(`{"placer": "direct"}`), 0644), ShouldBeNil)
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(context.Background(), args, stdin, stdout, stderr)
+					So(string(stderr.Bytes()), ShouldNotContainSubstring, "require")
+					So(exitCode, ShouldEqual, 0)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/file")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "content")
+				})
+				Convey("a configured copy placer doesn't", func() {
+					So(ioutil.WriteFile(cfgPath, []byte(`{"placer": "copy"}`), 0644), ShouldBeNil)
+					stdin, stdout, stderr := stdBuffers()
+					exitCode := Main(context.Background(), args, stdin, stdout, stderr)
+					So(string(stderr.Bytes()), ShouldContainSubstring, "transactional unpacks require \"direct\" placement")
+					So(exitCode, ShouldEqual, rio.ExitCodeForCategory(rio.ErrUsage))
+				})
+			})
+		}),
+	)
+}
+
+func TestDaemonUnpack(t *testing.T) {
+	Convey("rio daemon: unpacks are prepared as the CLI prepares them", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				So(os.MkdirAll(tmpDir.String()+"/data", 0755), ShouldBeNil)
+				So(ioutil.WriteFile(tmpDir.String()+"/data/file", []byte("content"), 0644), ShouldBeNil)
+				So(os.MkdirAll(tmpDir.String()+"/wh", 0755), ShouldBeNil)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String()+"/data", api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				addr := fmt.Sprintf("unix://%s/rio.sock", tmpDir)
+				listener, err := daemon.Listen(addr)
+				So(err, ShouldBeNil)
+				ctx, cancel := context.WithCancel(context.Background())
+				served := make(chan error)
+				go func() { served <- daemon.NewServer(daemonTools).Serve(ctx, listener) }()
+				client := riodaemonclient.Client{addr}
+
+				Convey("placement mode none doesn't need a path", func() {
+					gotWareID, err := client.Unpack(context.Background(), wareID, "-", api.Filter_NoMutation, rio.Placement_None, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+				})
+				Convey("other placement modes still unpack to the path", func() {
+					gotWareID, err := client.Unpack(context.Background(), wareID, tmpDir.String()+"/out", api.Filter_NoMutation, rio.Placement_Copy, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					body, err := ioutil.ReadFile(tmpDir.String() + "/out/file")
+					So(err, ShouldBeNil)
+					So(string(body), ShouldEqual, "content")
+				})
+
+				cancel()
+				So(<-served, ShouldBeNil)
+			})
+		}),
+	)
+}
+
 /*
 	Tests against pre-generated, known fixtures of tar binary blobs.
 
@@ -0,0 +1,96 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+// How often the progress line is redrawn (except on phase changes, which are shown at once).
+const progressRedrawInterval = 250 * time.Millisecond
+
+/*
+	Whether w is a terminal, so it's sensible to redraw a line on it.
+*/
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+/*
+	A single line of progress, redrawn in place on a terminal.
+	Anything else written to the terminal should call Clear first,
+	so the line doesn't get tangled up with it; the next Update redraws it.
+*/
+type progressLine struct {
+	w     io.Writer
+	phase string
+	last  time.Time
+	shown bool
+}
+
+func (pl *progressLine) Update(evt *rio.Event_Progress) {
+	if evt.Phase == pl.phase && time.Since(pl.last) < progressRedrawInterval {
+		return
+	}
+	pl.phase = evt.Phase
+	pl.last = time.Now()
+	fmt.Fprintf(pl.w, "\r\x1b[K%s", formatProgress(evt))
+	pl.shown = true
+}
+
+func (pl *progressLine) Clear() {
+	if !pl.shown {
+		return
+	}
+	fmt.Fprint(pl.w, "\r\x1b[K")
+	pl.shown = false
+}
+
+/*
+	Formats a progress event like "extracting: 1.2 MiB of 3.4 MiB (35%), 120 entries".
+*/
+func formatProgress(evt *rio.Event_Progress) string {
+	s := evt.Phase + ":"
+	switch {
+	case evt.TotalWork > 0:
+		s += fmt.Sprintf(" %s of %s (%d%%)", formatBytes(evt.TotalProg), formatBytes(evt.TotalWork), int64(evt.TotalProg)*100/int64(evt.TotalWork))
+	case evt.TotalProg > 0:
+		s += " " + formatBytes(evt.TotalProg)
+	}
+	if evt.Desc != "" {
+		if evt.TotalProg > 0 {
+			s += ","
+		}
+		s += " " + evt.Desc
+	}
+	return s
+}
+
+func formatBytes(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -13,13 +13,24 @@ Sniperkit-Bot
 	because it wouldn't be correct to do so when using commands via remote RPC; in
 	such a situation, the *remote* Rio will read its *local* config in order to
 	comply with the operator's rules there on that machine and environment.)
+
+	Config comes from layers, each overriding the last: built-in defaults,
+	the system config file, the user's config file (see File), and
+	environment variables.  (Command line flags, where there are any,
+	override all of these.)
 */
 package config
 
 import (
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/fs"
 )
 
@@ -27,10 +38,15 @@ import (
 	Return the path that is the root for rio's fileset caches.
 
 	The default value is `"$RIO_BASE/cache"`;
-	this can be overriden by the `RIO_CACHE` environment variable.
+	this can be overriden by "cache" in a config file,
+	or the `RIO_CACHE` environment variable.
 */
 func GetCacheBasePath() fs.AbsolutePath {
 	pth := os.Getenv("RIO_CACHE")
+	if pth == "" {
+		f, _ := files()
+		pth = f.Cache
+	}
 	if pth == "" {
 		return GetRioBasePath().Join(fs.MustRelPath("cache"))
 	}
@@ -45,10 +61,15 @@ func GetCacheBasePath() fs.AbsolutePath {
 	Return the path prefix that will be used as a workspace for mount subsystems.
 
 	The default value is `"$RIO_BASE/mount"`;
-	this can be overriden by the `RIO_MOUNT_WORKDIR` environment variable.
+	this can be overriden by "mountWorkdir" in a config file,
+	or the `RIO_MOUNT_WORKDIR` environment variable.
 */
 func GetMountWorkPath() fs.AbsolutePath {
 	pth := os.Getenv("RIO_MOUNT_WORKDIR")
+	if pth == "" {
+		f, _ := files()
+		pth = f.MountWorkdir
+	}
 	if pth == "" {
 		return GetRioBasePath().Join(fs.MustRelPath("mount"))
 	}
@@ -63,10 +84,15 @@ func GetMountWorkPath() fs.AbsolutePath {
 	Return the home-base path prefix that is the default root for all other Rio paths.
 
 	The default value is `"/var/lib/timeless/rio"`;
-	this can be overriden by the `RIO_BASE` environment variable.
+	this can be overriden by "base" in a config file,
+	or the `RIO_BASE` environment variable.
 */
 func GetRioBasePath() fs.AbsolutePath {
 	pth := os.Getenv("RIO_BASE")
+	if pth == "" {
+		f, _ := files()
+		pth = f.Base
+	}
 	if pth == "" {
 		pth = "/var/lib/timeless/rio"
 	}
@@ -76,3 +102,126 @@ func GetRioBasePath() fs.AbsolutePath {
 	}
 	return fs.MustAbsolutePath(pth)
 }
+
+/*
+	Return how many file records a fileset hash may hold in memory before
+	spilling sorted runs of them to disk (see `fshash.DiskBucket`).
+
+	The default value is `250000`;
+	this can be overriden by the `RIO_BUCKET_SPILL` environment variable.
+	It's read (and checked) only once; if it's invalid, every call
+	returns an error of category `rio.ErrUsage`.
+*/
+func GetBucketSpillThreshold() (int, error) {
+	bucketSpill.once.Do(func() {
+		str := os.Getenv("RIO_BUCKET_SPILL")
+		if str == "" {
+			bucketSpill.n = 250000
+			return
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 {
+			bucketSpill.err = Errorf(rio.ErrUsage, "RIO_BUCKET_SPILL must be a positive integer (got %q)", str)
+			return
+		}
+		bucketSpill.n = n
+	})
+	return bucketSpill.n, bucketSpill.err
+}
+
+var bucketSpill struct {
+	once sync.Once
+	n    int
+	err  error
+}
+
+/*
+	Return the dir under which spilled fileset hash records are kept while packing or unpacking.
+
+	The default value is the system temp dir (e.g. `"$TMPDIR"` or `"/tmp"`);
+	this can be overriden by the `RIO_BUCKET_SPILL_DIR` environment variable
+	(useful if your temp dir is a ramdisk, which would defeat the purpose).
+*/
+func GetBucketSpillPath() string {
+	pth := os.Getenv("RIO_BUCKET_SPILL_DIR")
+	if pth == "" {
+		return os.TempDir()
+	}
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		panic(err)
+	}
+	return pth
+}
+
+/*
+	Return the limits on how much any single unpack may write (see `limits.Limits`),
+	which keep a hostile or broken ware from filling the disk.
+	Each is zero (no limit) by default; they can be set by the environment variables
+	`RIO_LIMIT_BYTES` (total content bytes), `RIO_LIMIT_FILE_BYTES` (content bytes of
+	any one file), `RIO_LIMIT_ENTRIES`, `RIO_LIMIT_PATH_DEPTH`, and `RIO_LIMIT_PATH_LENGTH`.
+	The byte limits may have a "K", "M", "G", or "T" suffix (powers of 1024).
+*/
+func GetUnpackLimits() (totalBytes, fileBytes, entries, pathDepth, pathLength int64, err error) {
+	if totalBytes, err = getLimit("RIO_LIMIT_BYTES", true); err != nil {
+		return
+	}
+	if fileBytes, err = getLimit("RIO_LIMIT_FILE_BYTES", true); err != nil {
+		return
+	}
+	if entries, err = getLimit("RIO_LIMIT_ENTRIES", false); err != nil {
+		return
+	}
+	if pathDepth, err = getLimit("RIO_LIMIT_PATH_DEPTH", false); err != nil {
+		return
+	}
+	pathLength, err = getLimit("RIO_LIMIT_PATH_LENGTH", false)
+	return
+}
+
+func getLimit(name string, isSize bool) (int64, error) {
+	str := os.Getenv(name)
+	if str == "" {
+		return 0, nil
+	}
+	digits, scale := str, int64(1)
+	if isSize {
+		for i, suffix := range []string{"K", "M", "G", "T"} {
+			if strings.HasSuffix(str, suffix) {
+				digits, scale = strings.TrimSuffix(str, suffix), 1<<(10*uint(i+1))
+			}
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, Errorf(rio.ErrUsage, "%s must be a non-negative integer (got %q)", name, str)
+	}
+	if n > math.MaxInt64/scale {
+		return 0, Errorf(rio.ErrUsage, "%s is too large (got %q)", name, str)
+	}
+	return n * scale, nil
+}
+
+/*
+	Return the path of the key file for encrypted ("enc+") warehouses,
+	or empty if none is configured.
+
+	There is no default; set "encryptionKeyfile" in a config file,
+	or the `RIO_ENCRYPTION_KEYFILE` environment variable.
+	(Keys are never taken from warehouse addresses, which tend to end up in logs.)
+*/
+func GetEncryptionKeyPath() string {
+	pth := os.Getenv("RIO_ENCRYPTION_KEYFILE")
+	if pth == "" {
+		f, _ := files()
+		pth = f.EncryptionKeyfile
+	}
+	if pth == "" {
+		return ""
+	}
+	pth, err := filepath.Abs(pth)
+	if err != nil {
+		panic(err)
+	}
+	return pth
+}
@@ -0,0 +1,91 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package config
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestBucketSpillThreshold(t *testing.T) {
+	Convey("The bucket spill threshold", t, func() {
+		defer os.Setenv("RIO_BUCKET_SPILL", os.Getenv("RIO_BUCKET_SPILL"))
+		check := func(str string) (int, error) {
+			bucketSpill.once = sync.Once{}
+			bucketSpill.n, bucketSpill.err = 0, nil
+			os.Setenv("RIO_BUCKET_SPILL", str)
+			return GetBucketSpillThreshold()
+		}
+
+		Convey("has a default", func() {
+			n, err := check("")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 250000)
+		})
+		Convey("can be set", func() {
+			n, err := check("12")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 12)
+		})
+		Convey("is a usage error if invalid, every time", func() {
+			for _, str := range []string{"lots", "0", "-4"} {
+				_, err := check(str)
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+				_, err = GetBucketSpillThreshold()
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+			}
+		})
+	})
+}
+
+func TestUnpackLimits(t *testing.T) {
+	Convey("The unpack limits", t, func() {
+		defer os.Setenv("RIO_LIMIT_BYTES", os.Getenv("RIO_LIMIT_BYTES"))
+		defer os.Setenv("RIO_LIMIT_ENTRIES", os.Getenv("RIO_LIMIT_ENTRIES"))
+		os.Setenv("RIO_LIMIT_BYTES", "")
+		os.Setenv("RIO_LIMIT_ENTRIES", "")
+
+		Convey("default to none", func() {
+			totalBytes, _, entries, _, _, err := GetUnpackLimits()
+			So(err, ShouldBeNil)
+			So(totalBytes, ShouldEqual, 0)
+			So(entries, ShouldEqual, 0)
+		})
+		Convey("can be set, with size suffixes for bytes", func() {
+			os.Setenv("RIO_LIMIT_BYTES", "3G")
+			os.Setenv("RIO_LIMIT_ENTRIES", "100")
+			totalBytes, _, entries, _, _, err := GetUnpackLimits()
+			So(err, ShouldBeNil)
+			So(totalBytes, ShouldEqual, 3<<30)
+			So(entries, ShouldEqual, 100)
+		})
+		Convey("are a usage error if invalid", func() {
+			for _, str := range []string{"lots", "-1", "1.5K"} {
+				os.Setenv("RIO_LIMIT_BYTES", str)
+				_, _, _, _, _, err := GetUnpackLimits()
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+			}
+			os.Setenv("RIO_LIMIT_BYTES", "")
+			os.Setenv("RIO_LIMIT_ENTRIES", "1K")
+			_, _, _, _, _, err := GetUnpackLimits()
+			So(Category(err), ShouldEqual, rio.ErrUsage)
+		})
+		Convey("are a usage error if they overflow", func() {
+			os.Setenv("RIO_LIMIT_BYTES", "9000000000T")
+			_, _, _, _, _, err := GetUnpackLimits()
+			So(Category(err), ShouldEqual, rio.ErrUsage)
+			os.Setenv("RIO_LIMIT_BYTES", "8388607T")
+			totalBytes, _, _, _, _, err := GetUnpackLimits()
+			So(err, ShouldBeNil)
+			So(totalBytes, ShouldEqual, int64(8388607)<<40)
+		})
+	})
+}
@@ -0,0 +1,440 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	The contents of a config file.
+
+	Config files are JSON.  Every field is optional; fields which are set
+	override those from files loaded earlier (see LoadFiles), and the
+	environment variables override them all.  Relative paths are relative
+	to the file they're in.
+
+	For example:
+
+		{
+			"cache": "/fast/rio-cache",
+			"placer": "mount",
+			"sources": ["@corp-mirror", "ca+https://public.example.org/wares"],
+			"warehouses": {
+				"corp-mirror": {
+					"addr": "ca+https://mirror.corp.example/wares",
+					"auth": {"tokenFile": "/etc/rio/corp-token"},
+					"timeout": "30s",
+					"retries": 3
+				}
+			}
+		}
+*/
+type File struct {
+	Base              string               `json:"base,omitempty"`              // As `RIO_BASE`.
+	Cache             string               `json:"cache,omitempty"`             // As `RIO_CACHE`.
+	MountWorkdir      string               `json:"mountWorkdir,omitempty"`      // As `RIO_MOUNT_WORKDIR`.
+	EncryptionKeyfile string               `json:"encryptionKeyfile,omitempty"` // As `RIO_ENCRYPTION_KEYFILE`.
+	Placer            string               `json:"placer,omitempty"`            // Placement mode to unpack with, if not given.
+	Sources           []string             `json:"sources,omitempty"`           // Warehouses to fetch from, if none are given.
+	Warehouses        map[string]Warehouse `json:"warehouses,omitempty"`        // Named warehouses, used as "@name".
+}
+
+/*
+	Settings for one named warehouse.
+	Auth, timeouts, and retries apply to every use of the warehouse's address,
+	whether it's given by name or not.
+*/
+type Warehouse struct {
+	Addr    string `json:"addr,omitempty"`
+	Auth    *Auth  `json:"auth,omitempty"`
+	Timeout string `json:"timeout,omitempty"` // A duration, like "30s".  Zero means no timeout.
+	Retries int    `json:"retries,omitempty"` // How many more times to try, if a request fails in a way that might not happen again.
+}
+
+/*
+	Credentials for a warehouse: either a bearer token, or a username and password.
+	Secrets can be given inline, or (better) in a file, which is read when needed.
+*/
+type Auth struct {
+	Token        string `json:"token,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+/*
+	Return the path of the system config file.
+
+	The default value is `"/etc/rio/config.json"`;
+	this can be overriden by the `RIO_SYSTEM_CONFIG` environment variable.
+*/
+func GetSystemConfigPath() string {
+	pth := os.Getenv("RIO_SYSTEM_CONFIG")
+	if pth == "" {
+		return "/etc/rio/config.json"
+	}
+	return pth
+}
+
+/*
+	Return the path of the user's config file.
+
+	The default value is `"$XDG_CONFIG_HOME/rio/config.json"` (with
+	`XDG_CONFIG_HOME` defaulting to `"$HOME/.config"`);
+	this can be overriden by the `RIO_CONFIG` environment variable.
+*/
+func GetUserConfigPath() string {
+	if pth := os.Getenv("RIO_CONFIG"); pth != "" {
+		return pth
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "rio", "config.json")
+}
+
+/*
+	Loads the system config file, then the user's, each overriding the last,
+	and returns the merged result, and the paths of the files which existed.
+	It's not an error for either file not to exist.
+*/
+func LoadFiles() (merged File, loaded []string, err error) {
+	for _, pth := range []string{GetSystemConfigPath(), GetUserConfigPath()} {
+		if pth == "" {
+			continue
+		}
+		f, err := loadFile(pth)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return File{}, loaded, err
+		}
+		merged = merged.merge(f)
+		loaded = append(loaded, pth)
+	}
+	return merged, loaded, nil
+}
+
+func loadFile(pth string) (f File, err error) {
+	bs, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return f, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return f, fmt.Errorf("invalid config file %q: %s", pth, err)
+	}
+	if err := f.validate(); err != nil {
+		return f, fmt.Errorf("invalid config file %q: %s", pth, err)
+	}
+	f.resolvePaths(filepath.Dir(pth))
+	return f, nil
+}
+
+func (f File) validate() error {
+	for name, wh := range f.Warehouses {
+		if name == "" || strings.ContainsAny(name, "@/: ") {
+			return fmt.Errorf("invalid warehouse name %q", name)
+		}
+		if _, err := wh.TimeoutDuration(); err != nil {
+			return fmt.Errorf("warehouse %q: %s", name, err)
+		}
+		if wh.Retries < 0 {
+			return fmt.Errorf("warehouse %q: retries must not be negative", name)
+		}
+		if a := wh.Auth; a != nil {
+			hasToken := a.Token != "" || a.TokenFile != ""
+			hasPassword := a.Username != "" || a.Password != "" || a.PasswordFile != ""
+			if hasToken && hasPassword {
+				return fmt.Errorf("warehouse %q: auth may have a token or a username and password, not both", name)
+			}
+		}
+	}
+	for _, src := range f.Sources {
+		if strings.HasPrefix(src, "@") {
+			// Names may be defined in a later file; checked when resolved.
+			continue
+		}
+		if !strings.Contains(src, "://") {
+			return fmt.Errorf("invalid source %q: must be a warehouse address or \"@name\"", src)
+		}
+	}
+	return nil
+}
+
+func (f *File) resolvePaths(dir string) {
+	abs := func(pth *string) {
+		if *pth != "" && !filepath.IsAbs(*pth) {
+			*pth = filepath.Join(dir, *pth)
+		}
+	}
+	abs(&f.Base)
+	abs(&f.Cache)
+	abs(&f.MountWorkdir)
+	abs(&f.EncryptionKeyfile)
+	for name, wh := range f.Warehouses {
+		if wh.Auth != nil {
+			auth := *wh.Auth
+			abs(&auth.TokenFile)
+			abs(&auth.PasswordFile)
+			wh.Auth = &auth
+		}
+		f.Warehouses[name] = wh
+	}
+}
+
+/*
+	Returns f with every field set in f2 overriding it.
+	Warehouses are merged by name, and field by field.
+*/
+func (f File) merge(f2 File) File {
+	str := func(a *string, b string) {
+		if b != "" {
+			*a = b
+		}
+	}
+	str(&f.Base, f2.Base)
+	str(&f.Cache, f2.Cache)
+	str(&f.MountWorkdir, f2.MountWorkdir)
+	str(&f.EncryptionKeyfile, f2.EncryptionKeyfile)
+	str(&f.Placer, f2.Placer)
+	if f2.Sources != nil {
+		f.Sources = f2.Sources
+	}
+	if len(f2.Warehouses) > 0 {
+		whs := make(map[string]Warehouse, len(f.Warehouses)+len(f2.Warehouses))
+		for name, wh := range f.Warehouses {
+			whs[name] = wh
+		}
+		for name, wh2 := range f2.Warehouses {
+			wh := whs[name]
+			str(&wh.Addr, wh2.Addr)
+			str(&wh.Timeout, wh2.Timeout)
+			if wh2.Auth != nil {
+				wh.Auth = wh2.Auth
+			}
+			if wh2.Retries != 0 {
+				wh.Retries = wh2.Retries
+			}
+			whs[name] = wh
+		}
+		f.Warehouses = whs
+	}
+	return f
+}
+
+/*
+	The config files, as loaded by the getters: once for each pair of paths
+	(which only change in tests), rather than on every call.
+*/
+var loadedFiles struct {
+	sync.Mutex
+	byPaths map[[2]string]*onceFile
+}
+
+type onceFile struct {
+	once sync.Once
+	file File
+	err  error
+}
+
+/*
+	Loads the config files (if they haven't been already), returning any
+	problem with them as an ErrUsage error.  Commands call this when they
+	start, so an invalid config file is reported then; after that, the
+	getters which use the files treat them as empty if they're invalid.
+*/
+func Load() error {
+	_, err := files()
+	return err
+}
+
+func files() (File, error) {
+	key := [2]string{GetSystemConfigPath(), GetUserConfigPath()}
+	loadedFiles.Lock()
+	if loadedFiles.byPaths == nil {
+		loadedFiles.byPaths = map[[2]string]*onceFile{}
+	}
+	of := loadedFiles.byPaths[key]
+	if of == nil {
+		of = &onceFile{}
+		loadedFiles.byPaths[key] = of
+	}
+	loadedFiles.Unlock()
+	of.once.Do(func() {
+		f, _, err := LoadFiles()
+		if err != nil {
+			of.err = Errorf(rio.ErrUsage, "%s", err)
+			return
+		}
+		of.file = f
+	})
+	return of.file, of.err
+}
+
+/*
+	Returns the fully merged config: the config files,
+	overridden by the environment, with defaults filled in.
+	(This is what `rio config show` prints.)
+*/
+func Effective() (f File, loaded []string, err error) {
+	f, loaded, err = LoadFiles()
+	if err != nil {
+		return f, loaded, err
+	}
+	f.Base = GetRioBasePath().String()
+	f.Cache = GetCacheBasePath().String()
+	f.MountWorkdir = GetMountWorkPath().String()
+	f.EncryptionKeyfile = GetEncryptionKeyPath()
+	return f, loaded, nil
+}
+
+func (wh Warehouse) TimeoutDuration() (time.Duration, error) {
+	if wh.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(wh.Timeout)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must be a duration like \"30s\"", wh.Timeout)
+	}
+	return d, nil
+}
+
+/*
+	Returns the value for an http "Authorization" header, reading any
+	secret files, or empty if there's no auth.
+*/
+func (a *Auth) Header() (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	secret := func(inline, pth string) (string, error) {
+		if pth == "" {
+			return inline, nil
+		}
+		bs, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return "", fmt.Errorf("cannot read warehouse credentials: %s", err)
+		}
+		return strings.TrimSpace(string(bs)), nil
+	}
+	if a.Token != "" || a.TokenFile != "" {
+		token, err := secret(a.Token, a.TokenFile)
+		return "Bearer " + token, err
+	}
+	if a.Username != "" {
+		password, err := secret(a.Password, a.PasswordFile)
+		return basicAuth(a.Username, password), err
+	}
+	return "", nil
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+/*
+	Returns a copy with any inline secrets replaced, so it can be shown.
+*/
+func (a *Auth) Redacted() *Auth {
+	if a == nil {
+		return nil
+	}
+	a2 := *a
+	if a2.Token != "" {
+		a2.Token = "(redacted)"
+	}
+	if a2.Password != "" {
+		a2.Password = "(redacted)"
+	}
+	return &a2
+}
+
+/*
+	Returns the address of a warehouse given by name ("@name"),
+	or the string itself if it's not a name.
+	Returns an error if there's no warehouse by that name.
+*/
+func ResolveWarehouse(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	f, err := files()
+	if err != nil {
+		return "", err
+	}
+	whs := f.Warehouses
+	wh, ok := whs[s[1:]]
+	if !ok || wh.Addr == "" {
+		names := make([]string, 0, len(whs))
+		for name := range whs {
+			names = append(names, "@"+name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("no warehouse named %q in config (known names: %s)", s, strings.Join(names, ", "))
+	}
+	return wh.Addr, nil
+}
+
+/*
+	Returns the settings for the warehouse with the given address, if it's
+	one of the named warehouses in config.  An "enc+" prefix on either
+	address is ignored, since it doesn't change where the warehouse is.
+*/
+func GetWarehouseSettings(addr string) (Warehouse, bool) {
+	addr = strings.TrimPrefix(addr, "enc+")
+	f, _ := files()
+	for _, wh := range f.Warehouses {
+		if strings.TrimPrefix(wh.Addr, "enc+") == addr {
+			return wh, true
+		}
+	}
+	return Warehouse{}, false
+}
+
+/*
+	Return the warehouses to fetch from when none are given
+	(may include names, which still need ResolveWarehouse).
+
+	The default is none; set "sources" in a config file.
+*/
+func GetDefaultSources() []string {
+	f, _ := files()
+	return f.Sources
+}
+
+/*
+	Return the placement mode to unpack with when none is given,
+	or empty for the transmat's default.
+
+	Set "placer" in a config file.
+*/
+func GetPlacer() string {
+	f, _ := files()
+	return f.Placer
+}
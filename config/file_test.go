@@ -0,0 +1,132 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestConfigFiles(t *testing.T) {
+	Convey("Config files", t, func() {
+		tmpDir, err := ioutil.TempDir("", "rio-config-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpDir)
+		systemPath := filepath.Join(tmpDir, "system.json")
+		userPath := filepath.Join(tmpDir, "user", "config.json")
+		So(os.Mkdir(filepath.Join(tmpDir, "user"), 0755), ShouldBeNil)
+		for env, value := range map[string]string{
+			"RIO_SYSTEM_CONFIG": systemPath,
+			"RIO_CONFIG":        userPath,
+			"RIO_BASE":          "",
+			"RIO_CACHE":         "",
+		} {
+			defer os.Setenv(env, os.Getenv(env))
+			os.Setenv(env, value)
+		}
+
+		Convey("are optional", func() {
+			f, loaded, err := LoadFiles()
+			So(err, ShouldBeNil)
+			So(loaded, ShouldBeEmpty)
+			So(f, ShouldResemble, File{})
+			So(GetRioBasePath().String(), ShouldEqual, "/var/lib/timeless/rio")
+		})
+		Convey("are layered: system, then user, then env", func() {
+			So(ioutil.WriteFile(systemPath, []byte(`{
+				"base": "/sys/base",
+				"cache": "/sys/cache",
+				"placer": "copy",
+				"sources": ["@corp"],
+				"warehouses": {
+					"corp": {"addr": "ca+https://corp.example/wh", "timeout": "10s", "retries": 2},
+					"other": {"addr": "ca+file:///other"}
+				}
+			}`), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(userPath, []byte(`{
+				"cache": "cache",
+				"warehouses": {
+					"corp": {"auth": {"username": "me", "passwordFile": "pw"}}
+				}
+			}`), 0644), ShouldBeNil)
+			So(ioutil.WriteFile(filepath.Join(tmpDir, "user", "pw"), []byte("secret\n"), 0600), ShouldBeNil)
+
+			f, loaded, err := LoadFiles()
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, []string{systemPath, userPath})
+			So(f.Base, ShouldEqual, "/sys/base")
+			So(f.Cache, ShouldEqual, filepath.Join(tmpDir, "user", "cache"))
+			So(f.Placer, ShouldEqual, "copy")
+			So(f.Warehouses["corp"].Addr, ShouldEqual, "ca+https://corp.example/wh")
+			So(f.Warehouses["corp"].Retries, ShouldEqual, 2)
+			So(f.Warehouses["corp"].Auth.PasswordFile, ShouldEqual, filepath.Join(tmpDir, "user", "pw"))
+
+			So(GetCacheBasePath().String(), ShouldEqual, filepath.Join(tmpDir, "user", "cache"))
+			os.Setenv("RIO_CACHE", "/env/cache")
+			So(GetCacheBasePath().String(), ShouldEqual, "/env/cache")
+			f, _, err = Effective()
+			So(err, ShouldBeNil)
+			So(f.Cache, ShouldEqual, "/env/cache")
+			So(f.MountWorkdir, ShouldEqual, "/sys/base/mount")
+
+			Convey("named warehouses resolve", func() {
+				addr, err := ResolveWarehouse("@corp")
+				So(err, ShouldBeNil)
+				So(addr, ShouldEqual, "ca+https://corp.example/wh")
+				addr, err = ResolveWarehouse("ca+file:///plain")
+				So(err, ShouldBeNil)
+				So(addr, ShouldEqual, "ca+file:///plain")
+				_, err = ResolveWarehouse("@nope")
+				So(err, ShouldNotBeNil)
+			})
+			Convey("warehouse settings are found by address", func() {
+				wh, ok := GetWarehouseSettings("enc+ca+https://corp.example/wh")
+				So(ok, ShouldBeTrue)
+				timeout, err := wh.TimeoutDuration()
+				So(err, ShouldBeNil)
+				So(timeout.Seconds(), ShouldEqual, 10)
+				header, err := wh.Auth.Header()
+				So(err, ShouldBeNil)
+				So(header, ShouldEqual, "Basic bWU6c2VjcmV0")
+				So(wh.Auth.Redacted().PasswordFile, ShouldEqual, wh.Auth.PasswordFile)
+
+				_, ok = GetWarehouseSettings("ca+https://elsewhere.example/wh")
+				So(ok, ShouldBeFalse)
+			})
+		})
+		Convey("are rejected if invalid", func() {
+			for _, content := range []string{
+				`{"cache": 4}`,
+				`{"unknown": "field"}`,
+				`{"sources": ["not-an-addr"]}`,
+				`{"warehouses": {"a": {"timeout": "soon"}}}`,
+				`{"warehouses": {"a": {"auth": {"token": "t", "username": "u"}}}}`,
+				`{"warehouses": {"a/b": {}}}`,
+			} {
+				So(ioutil.WriteFile(userPath, []byte(content), 0644), ShouldBeNil)
+				_, _, err := LoadFiles()
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("are loaded once for the getters, which don't panic if they're invalid", func() {
+			So(ioutil.WriteFile(userPath, []byte(`{"cache": 4}`), 0644), ShouldBeNil)
+			So(Category(Load()), ShouldEqual, rio.ErrUsage)
+			So(GetCacheBasePath().String(), ShouldEqual, "/var/lib/timeless/rio/cache")
+			So(GetPlacer(), ShouldEqual, "")
+			_, err := ResolveWarehouse("@corp")
+			So(Category(err), ShouldEqual, rio.ErrUsage)
+
+			So(ioutil.WriteFile(userPath, []byte(`{"placer": "copy"}`), 0644), ShouldBeNil)
+			So(Category(Load()), ShouldEqual, rio.ErrUsage)
+		})
+	})
+}
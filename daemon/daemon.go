@@ -0,0 +1,325 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The rio daemon: serves pack, unpack, scan, and mirror over a unix socket,
+	so many processes can share one rio (and one view of the cache).
+
+	See the `client/daemon` package for the protocol, and a client.
+	Concurrent requests for the same ware are serialized, so a ware that's
+	already on its way into the cache is fetched only once.
+*/
+package daemon
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/polydawn/refmt"
+	"github.com/polydawn/refmt/json"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/client/daemon"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+/*
+	The transmats the daemon uses, by pack type.
+	(The CLI's demux funcs fit here; tests can use anything.)
+*/
+type Tools struct {
+	Pack   func(packType string) (rio.PackFunc, error)
+	Unpack func(packType string) (rio.UnpackFunc, error)
+	Scan   func(packType string) (rio.ScanFunc, error)
+	Mirror func(packType string) (rio.MirrorFunc, error)
+
+	// Readies an unpack's target path before unpacking, as the CLI does.  Optional.
+	PrepareUnpack func(path string, placementMode rio.PlacementMode) error
+}
+
+type Server struct {
+	tools Tools
+	locks wareLocks
+}
+
+func NewServer(tools Tools) *Server {
+	return &Server{tools: tools}
+}
+
+/*
+	Listens on a daemon address (see riodaemonclient.ParseAddr).
+
+	If there's a socket at the path already, but nobody's listening on it
+	(e.g. a previous daemon crashed), it's removed first.
+*/
+func Listen(addr string) (net.Listener, error) {
+	pth, err := riodaemonclient.ParseAddr(addr)
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "%s", err)
+	}
+	if fi, err := os.Lstat(pth); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", pth); err == nil {
+			conn.Close()
+			return nil, Errorf(rio.ErrInoperablePath, "a daemon is already listening at %s", pth)
+		}
+		os.Remove(pth)
+	}
+	l, err := net.Listen("unix", pth)
+	if err != nil {
+		return nil, Errorf(rio.ErrInoperablePath, "cannot listen at %s: %s", pth, err)
+	}
+	return l, nil
+}
+
+/*
+	Serves requests from the listener until ctx is done (then returns nil),
+	or accepting fails.  Each connection is handled in its own goroutine.
+	Ops still running when ctx is done are cancelled.
+*/
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return Errorf(rio.ErrInoperablePath, "cannot accept connections: %s", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	marshaller := refmt.NewMarshallerAtlased(json.EncodeOptions{}, conn, rio.Atlas)
+	send := func(evt rio.Event) error {
+		if err := marshaller.Marshal(evt); err != nil {
+			return err
+		}
+		_, err := conn.Write([]byte{'\n'})
+		return err
+	}
+
+	// Read the request.  Anything after that -- a cancel, or hanging up -- cancels.
+	dec := stdjson.NewDecoder(conn)
+	var req riodaemonclient.Request
+	if err := dec.Decode(&req); err != nil {
+		sendResult(send, api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: cannot parse request: %s", err))
+		return
+	}
+	go func() {
+		var next riodaemonclient.Request
+		dec.Decode(&next)
+		cancel()
+	}()
+
+	// Forward events until the transmat closes the channel; then send the result.
+	//  If the connection breaks, keep draining, so the transmat isn't stuck;
+	//  it'll see the cancellation soon enough.
+	monChan := make(chan rio.Event)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for evt := range monChan {
+			if err := send(evt); err != nil {
+				cancel()
+			}
+		}
+	}()
+	wareID, err := s.run(ctx, req, rio.Monitor{monChan})
+	<-forwarded
+	sendResult(send, wareID, err)
+}
+
+func sendResult(send func(rio.Event) error, wareID api.WareID, err error) {
+	result := &rio.Event_Result{}
+	result.WareID = wareID
+	result.SetError(err)
+	send(rio.Event{Result: result})
+}
+
+/*
+	Runs the request.  Like the transmats it calls, closes the monitor
+	channel when done (whether or not it got as far as calling one).
+
+	A panic while running is reported as an ErrRPCBreakdown result, so one
+	bad request doesn't take down the whole daemon.
+*/
+func (s *Server) run(ctx context.Context, req riodaemonclient.Request, mon rio.Monitor) (_ api.WareID, err error) {
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			close(mon.Chan)
+		}
+	}()
+	defer func() {
+		if rcvr := recover(); rcvr != nil {
+			err = Errorf(rio.ErrRPCBreakdown, "rio daemon: %s failed unexpectedly: %v", req.Op, rcvr)
+		}
+	}()
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	if req.Version != riodaemonclient.ProtocolVersion {
+		return api.WareID{}, Errorf(rio.ErrRPCBreakdown, "rio daemon: protocol version %d not supported (this daemon speaks version %d)", req.Version, riodaemonclient.ProtocolVersion)
+	}
+	switch req.Op {
+	case riodaemonclient.Op_Pack:
+		packFunc, err := s.tools.Pack(req.PackType)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		target, err := resolveWarehouse(req.Target)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		handedOff = true
+		return packFunc(ctx, api.PackType(req.PackType), req.Path, req.Filters, target, mon)
+
+	case riodaemonclient.Op_Unpack:
+		wareID, err := api.ParseWareID(req.WareID)
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+		}
+		if err := checkPlacementMode(wareID.Type, rio.PlacementMode(req.PlacementMode)); err != nil {
+			return api.WareID{}, err
+		}
+		unpackFunc, err := s.tools.Unpack(string(wareID.Type))
+		if err != nil {
+			return api.WareID{}, err
+		}
+		sources, err := resolveSources(req.Sources)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		// Direct placement doesn't involve the cache, so there's nothing to share.
+		if rio.PlacementMode(req.PlacementMode) != rio.Placement_Direct {
+			key := fmt.Sprintf("unpack %s %#v", wareID, req.Filters)
+			unlock, err := s.locks.Lock(ctx, key, func() { log.WaitingForWare(mon, wareID, "unpack") })
+			if err != nil {
+				return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+			}
+			defer unlock()
+		}
+		if s.tools.PrepareUnpack != nil {
+			if err := s.tools.PrepareUnpack(req.Path, rio.PlacementMode(req.PlacementMode)); err != nil {
+				return api.WareID{}, err
+			}
+		}
+		handedOff = true
+		return unpackFunc(ctx, wareID, req.Path, req.Filters, rio.PlacementMode(req.PlacementMode), sources, mon)
+
+	case riodaemonclient.Op_Scan:
+		if len(req.Sources) != 1 {
+			return api.WareID{}, Errorf(rio.ErrUsage, "scan needs exactly one source warehouse")
+		}
+		scanFunc, err := s.tools.Scan(req.PackType)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		source, err := resolveWarehouse(req.Sources[0])
+		if err != nil {
+			return api.WareID{}, err
+		}
+		handedOff = true
+		return scanFunc(ctx, api.PackType(req.PackType), req.Filters, rio.PlacementMode(req.PlacementMode), source, mon)
+
+	case riodaemonclient.Op_Mirror:
+		wareID, err := api.ParseWareID(req.WareID)
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrUsage, "%s", err)
+		}
+		mirrorFunc, err := s.tools.Mirror(string(wareID.Type))
+		if err != nil {
+			return api.WareID{}, err
+		}
+		target, err := resolveWarehouse(req.Target)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		sources, err := resolveSources(req.Sources)
+		if err != nil {
+			return api.WareID{}, err
+		}
+		key := fmt.Sprintf("mirror %s %s", wareID, target)
+		unlock, err := s.locks.Lock(ctx, key, func() { log.WaitingForWare(mon, wareID, "mirror") })
+		if err != nil {
+			return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		defer unlock()
+		handedOff = true
+		return mirrorFunc(ctx, wareID, target, sources, mon)
+
+	default:
+		return api.WareID{}, Errorf(rio.ErrUsage, "rio daemon: unknown op %q", req.Op)
+	}
+}
+
+/*
+	Checks the placement mode is one the transmat for the pack type handles,
+	as the CLI's flag parsing does; the transmats don't expect anything else.
+*/
+func checkPlacementMode(packType api.PackType, placementMode rio.PlacementMode) error {
+	switch placementMode {
+	case "", rio.Placement_Copy, rio.Placement_Direct, rio.Placement_Mount, rio.Placement_None:
+		return nil
+	case tartrans.Placement_Sync:
+		if packType != tartrans.PackType {
+			return Errorf(rio.ErrUsage, "sync placement is only supported for %q wares", tartrans.PackType)
+		}
+		return nil
+	default:
+		return Errorf(rio.ErrUsage, "unknown placement mode %q", placementMode)
+	}
+}
+
+/*
+	Resolves a warehouse given by name ("@name") to its address, per
+	the daemon's config.  Anything else is returned as is.
+*/
+func resolveWarehouse(s string) (api.WarehouseAddr, error) {
+	addr, err := config.ResolveWarehouse(s)
+	if err != nil {
+		return "", Errorf(rio.ErrUsage, "%s", err)
+	}
+	return api.WarehouseAddr(addr), nil
+}
+
+/*
+	Resolves warehouses to fetch from, using the default sources from
+	the daemon's config if none are given.
+*/
+func resolveSources(slice []string) ([]api.WarehouseAddr, error) {
+	if len(slice) == 0 {
+		slice = config.GetDefaultSources()
+	}
+	result := make([]api.WarehouseAddr, len(slice))
+	for idx, item := range slice {
+		addr, err := resolveWarehouse(item)
+		if err != nil {
+			return nil, err
+		}
+		result[idx] = addr
+	}
+	return result, nil
+}
@@ -0,0 +1,268 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package daemon_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/client/daemon"
+	"go.polydawn.net/rio/daemon"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+var tarTools = daemon.Tools{
+	Pack:   func(string) (rio.PackFunc, error) { return tartrans.Pack, nil },
+	Unpack: func(string) (rio.UnpackFunc, error) { return tartrans.Unpack, nil },
+	Scan:   func(string) (rio.ScanFunc, error) { return tartrans.Scan, nil },
+	Mirror: func(string) (rio.MirrorFunc, error) { return tartrans.Mirror, nil },
+}
+
+// Runs a daemon with the given tools on a socket in tmpDir, for the duration of fn.
+func withDaemon(tmpDir fs.AbsolutePath, tools daemon.Tools, fn func(riodaemonclient.Client)) {
+	addr := fmt.Sprintf("unix://%s/rio.sock", tmpDir)
+	listener, err := daemon.Listen(addr)
+	So(err, ShouldBeNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- daemon.NewServer(tools).Serve(ctx, listener) }()
+	defer func() {
+		cancel()
+		So(<-served, ShouldBeNil)
+	}()
+	fn(riodaemonclient.Client{addr})
+}
+
+func TestDaemon(t *testing.T) {
+	Convey("Spec compliance: daemon client, with tar", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				withDaemon(tmpDir, tarTools, func(client riodaemonclient.Client) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755)
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("dst"), 0755)
+					srcAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/src", tmpDir))
+					dstAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/dst", tmpDir))
+					tests.CheckRoundTrip(tartrans.PackType, client.Pack, client.Unpack, srcAddr)
+					tests.CheckMirror(tartrans.PackType, client.Mirror, client.Pack, client.Unpack, dstAddr, srcAddr)
+					Convey("Scan works too", func() {
+						gotWareID, err := client.Scan(
+							context.Background(),
+							tartrans.PackType,
+							api.FilesetFilters{},
+							rio.Placement_Direct,
+							"file://../transmat/tar/fixtures/tar_withBase.tgz",
+							rio.Monitor{},
+						)
+						So(err, ShouldBeNil)
+						So(gotWareID, ShouldResemble, api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"})
+					})
+				})
+			})
+		}),
+	)
+
+	Convey("Daemon plumbing", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			wareID := api.WareID{"tar", "abcd"}
+			Convey("Events are streamed back, and errors keep their category", func() {
+				tools := tarTools
+				tools.Unpack = func(string) (rio.UnpackFunc, error) {
+					return func(ctx context.Context, wareID api.WareID, _ string, _ api.FilesetFilters, _ rio.PlacementMode, _ []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						defer close(mon.Chan)
+						mon.Chan <- rio.Event{Log: &rio.Event_Log{Time: time.Now(), Level: rio.LogInfo, Msg: "hello"}}
+						return api.WareID{}, Errorf(rio.ErrWareNotFound, "no such ware %q", wareID)
+					}, nil
+				}
+				withDaemon(tmpDir, tools, func(client riodaemonclient.Client) {
+					monChan := make(chan rio.Event, 10)
+					_, err := client.Unpack(context.Background(), wareID, "-", api.FilesetFilters{}, rio.Placement_None, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{monChan})
+					So(Category(err), ShouldEqual, rio.ErrWareNotFound)
+					So(err.Error(), ShouldEqual, `no such ware "tar:abcd"`)
+					evt := <-monChan
+					So(evt.Log.Msg, ShouldEqual, "hello")
+					_, open := <-monChan
+					So(open, ShouldBeFalse)
+				})
+			})
+			Convey("Unpack targets are prepared first, if the tools say how", func() {
+				var mu sync.Mutex
+				var calls []string
+				record := func(format string, args ...interface{}) {
+					mu.Lock()
+					defer mu.Unlock()
+					calls = append(calls, fmt.Sprintf(format, args...))
+				}
+				tools := tarTools
+				tools.PrepareUnpack = func(path string, placementMode rio.PlacementMode) error {
+					record("prepare %s %s", path, placementMode)
+					if path == "/bad" {
+						return Errorf(rio.ErrInoperablePath, "cannot clear %s", path)
+					}
+					return nil
+				}
+				tools.Unpack = func(string) (rio.UnpackFunc, error) {
+					return func(ctx context.Context, wareID api.WareID, path string, _ api.FilesetFilters, _ rio.PlacementMode, _ []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						defer close(mon.Chan)
+						record("unpack %s", path)
+						return wareID, nil
+					}, nil
+				}
+				withDaemon(tmpDir, tools, func(client riodaemonclient.Client) {
+					gotWareID, err := client.Unpack(context.Background(), wareID, "/good", api.FilesetFilters{}, rio.Placement_Direct, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					_, err = client.Unpack(context.Background(), wareID, "/bad", api.FilesetFilters{}, rio.Placement_Direct, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{})
+					So(Category(err), ShouldEqual, rio.ErrInoperablePath)
+				})
+				So(calls, ShouldResemble, []string{"prepare /good direct", "unpack /good", "prepare /bad direct"})
+			})
+			Convey("Cancelling the client's context cancels the op in the daemon", func() {
+				tools := tarTools
+				tools.Unpack = func(string) (rio.UnpackFunc, error) {
+					return func(ctx context.Context, _ api.WareID, _ string, _ api.FilesetFilters, _ rio.PlacementMode, _ []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						defer close(mon.Chan)
+						mon.Chan <- rio.Event{Log: &rio.Event_Log{Time: time.Now(), Level: rio.LogInfo, Msg: "started"}}
+						<-ctx.Done()
+						return api.WareID{}, Errorf(rio.ErrCancelled, "cancelled")
+					}, nil
+				}
+				withDaemon(tmpDir, tools, func(client riodaemonclient.Client) {
+					ctx, cancel := context.WithCancel(context.Background())
+					monChan := make(chan rio.Event)
+					go func() {
+						<-monChan // once it's started...
+						cancel()
+						for range monChan {
+						}
+					}()
+					_, err := client.Unpack(ctx, wareID, "-", api.FilesetFilters{}, rio.Placement_None, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{monChan})
+					So(Category(err), ShouldEqual, rio.ErrCancelled)
+				})
+			})
+			Convey("Concurrent unpacks of the same ware happen one at a time", func() {
+				var mu sync.Mutex
+				running, maxRunning := 0, 0
+				tools := tarTools
+				tools.Unpack = func(string) (rio.UnpackFunc, error) {
+					return func(ctx context.Context, wareID api.WareID, _ string, _ api.FilesetFilters, _ rio.PlacementMode, _ []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						defer close(mon.Chan)
+						mu.Lock()
+						running++
+						if running > maxRunning {
+							maxRunning = running
+						}
+						mu.Unlock()
+						time.Sleep(50 * time.Millisecond)
+						mu.Lock()
+						running--
+						mu.Unlock()
+						return wareID, nil
+					}, nil
+				}
+				withDaemon(tmpDir, tools, func(client riodaemonclient.Client) {
+					unpackAll := func(wareIDs ...api.WareID) (logs []string) {
+						var wg sync.WaitGroup
+						var logMu sync.Mutex
+						errs := make(chan error, len(wareIDs))
+						for _, wareID := range wareIDs {
+							wg.Add(1)
+							go func(wareID api.WareID) {
+								defer wg.Done()
+								monChan := make(chan rio.Event)
+								drained := make(chan struct{})
+								go func() {
+									defer close(drained)
+									for evt := range monChan {
+										logMu.Lock()
+										logs = append(logs, evt.Log.Msg)
+										logMu.Unlock()
+									}
+								}()
+								gotWareID, err := client.Unpack(context.Background(), wareID, "-", api.FilesetFilters{}, rio.Placement_None, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{monChan})
+								<-drained
+								if err == nil && gotWareID != wareID {
+									err = fmt.Errorf("got %s, expected %s", gotWareID, wareID)
+								}
+								errs <- err
+							}(wareID)
+						}
+						wg.Wait()
+						close(errs)
+						for err := range errs {
+							So(err, ShouldBeNil)
+						}
+						return
+					}
+					logs := unpackAll(wareID, wareID, wareID)
+					So(maxRunning, ShouldEqual, 1)
+					So(logs, ShouldContain, `waiting for another unpack of ware "tar:abcd" to finish`)
+
+					Convey("but different wares can go at once", func() {
+						maxRunning = 0
+						unpackAll(wareID, api.WareID{"tar", "efgh"})
+						So(maxRunning, ShouldEqual, 2)
+					})
+				})
+			})
+			Convey("Requests from an incompatible client are refused", func() {
+				withDaemon(tmpDir, tarTools, func(client riodaemonclient.Client) {
+					conn, err := net.Dial("unix", tmpDir.String()+"/rio.sock")
+					So(err, ShouldBeNil)
+					defer conn.Close()
+					fmt.Fprintf(conn, `{"version":9000,"op":"unpack"}`+"\n")
+					buf := make([]byte, 1024)
+					n, _ := conn.Read(buf)
+					So(string(buf[:n]), ShouldContainSubstring, "protocol version 9000 not supported")
+				})
+			})
+			Convey("Placement modes the transmat can't do are refused", func() {
+				withDaemon(tmpDir, tarTools, func(client riodaemonclient.Client) {
+					_, err := client.Unpack(context.Background(), wareID, "/out", api.FilesetFilters{}, "bogus", []api.WarehouseAddr{"file:///nope"}, rio.Monitor{})
+					So(Category(err), ShouldEqual, rio.ErrUsage)
+					So(err.Error(), ShouldContainSubstring, `unknown placement mode "bogus"`)
+					_, err = client.Unpack(context.Background(), api.WareID{"git", "abcd"}, "/out", api.FilesetFilters{}, tartrans.Placement_Sync, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{})
+					So(Category(err), ShouldEqual, rio.ErrUsage)
+					So(err.Error(), ShouldContainSubstring, "sync placement is only supported")
+				})
+			})
+			Convey("A panicking op is reported, and the daemon carries on", func() {
+				tools := tarTools
+				tools.Unpack = func(string) (rio.UnpackFunc, error) {
+					return func(ctx context.Context, wareID api.WareID, path string, _ api.FilesetFilters, _ rio.PlacementMode, _ []api.WarehouseAddr, mon rio.Monitor) (api.WareID, error) {
+						defer close(mon.Chan)
+						panic("unreachable")
+					}, nil
+				}
+				withDaemon(tmpDir, tools, func(client riodaemonclient.Client) {
+					for i := 0; i < 2; i++ {
+						_, err := client.Unpack(context.Background(), wareID, "/out", api.FilesetFilters{}, rio.Placement_Direct, []api.WarehouseAddr{"file:///nope"}, rio.Monitor{})
+						So(Category(err), ShouldEqual, rio.ErrRPCBreakdown)
+						So(err.Error(), ShouldContainSubstring, "unpack failed unexpectedly: unreachable")
+					}
+				})
+			})
+			Convey("A stale socket is replaced", func() {
+				l, err := net.Listen("unix", tmpDir.String()+"/rio.sock")
+				So(err, ShouldBeNil)
+				l.(*net.UnixListener).SetUnlinkOnClose(false)
+				l.Close()
+				withDaemon(tmpDir, tarTools, func(client riodaemonclient.Client) {})
+			})
+		})
+	})
+}
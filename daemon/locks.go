@@ -0,0 +1,60 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package daemon
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+	Locks by key, for serializing operations on the same ware.
+
+	The second unpack of a ware waits for the first, and then finds it in
+	the cache, rather than fetching and unpacking it all over again (and
+	racing the first to commit it to the cache).
+*/
+type wareLocks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{} // closed on unlock.
+}
+
+/*
+	Takes the lock for key, waiting as long as needed (or until ctx is done,
+	in which case it returns ctx.Err()).  If it has to wait, it calls waiting
+	(once) first.  Call the returned func to unlock.
+*/
+func (l *wareLocks) Lock(ctx context.Context, key string, waiting func()) (unlock func(), err error) {
+	for {
+		l.mu.Lock()
+		if l.held == nil {
+			l.held = map[string]chan struct{}{}
+		}
+		ch, ok := l.held[key]
+		if !ok {
+			ch = make(chan struct{})
+			l.held[key] = ch
+			l.mu.Unlock()
+			return func() {
+				l.mu.Lock()
+				delete(l.held, key)
+				l.mu.Unlock()
+				close(ch)
+			}, nil
+		}
+		l.mu.Unlock()
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+		select {
+		case <-ch:
+			// Try again; somebody else may beat us to it.
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
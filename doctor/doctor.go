@@ -0,0 +1,374 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Examines the host rio is running on -- capabilities, placers, the
+	directories rio keeps its state in, and the warehouses in config --
+	and reports what works and what doesn't, and why.
+
+	This is what `rio doctor` prints.  Every check is made even if others
+	fail; the Report is meant to be collected from many hosts (as JSON)
+	and compared, so it states facts rather than passing judgement.
+*/
+package doctor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/caps"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/stitch/placer"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/git"
+	"go.polydawn.net/rio/warehouse/impl/kvenc"
+	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+	"go.polydawn.net/rio/warehouse/impl/oci"
+)
+
+type Report struct {
+	Caps        []Check               `json:"caps"`
+	Placers     []placer.Availability `json:"placers"`
+	Dirs        []Dir                 `json:"dirs"`
+	Cache       Filesystem            `json:"cacheFilesystem"`
+	Warehouses  []Warehouse           `json:"warehouses"`
+	ConfigError string                `json:"configError,omitempty"` // If the config files can't be loaded, no dirs, filesystems, or warehouses are checked.
+}
+
+/*
+	The result of one `caps.Fulcrum` check.
+*/
+type Check struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+}
+
+/*
+	One of the directories rio keeps state in.
+
+	If the dir doesn't exist yet, rio will try to create it on first use;
+	Writable then reports whether that should work (i.e. whether the
+	nearest existing parent is writable).
+*/
+type Dir struct {
+	Role     string `json:"role"` // "cache" or "mountWorkdir".
+	Path     string `json:"path"`
+	Exists   bool   `json:"exists"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+/*
+	The filesystem a dir is on.  Path is where it was examined, which is the
+	nearest existing parent if the dir doesn't exist yet.
+
+	Reflinks are only tested if the path is writable (the test clones a
+	temporary file); otherwise ReflinksError says so.
+*/
+type Filesystem struct {
+	Path          string `json:"path"`
+	Type          string `json:"type"`
+	Reflinks      bool   `json:"reflinks"`
+	ReflinksError string `json:"reflinksError,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+/*
+	One warehouse from config: each named warehouse, and each default source.
+*/
+type Warehouse struct {
+	Name      string `json:"name,omitempty"` // As "@name", if it's a named warehouse.
+	Addr      string `json:"addr"`
+	Source    bool   `json:"source"` // Whether it's one of the default sources.
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+/*
+	Runs every check.
+
+	This has a few side effects (exactly as rio's normal operations would):
+	detecting the mount placers may modprobe filesystem modules;
+	and checking git warehouses contacts them.
+	Temporary files made to test writability are removed.
+*/
+func Examine() Report {
+	var r Report
+	fulcrum := caps.Scan()
+	for _, c := range []struct {
+		name string
+		fn   func() bool
+	}{
+		{"CanShareIOCache", fulcrum.CanShareIOCache},
+		{"CanManageOwnership", fulcrum.CanManageOwnership},
+		{"CanMountBind", fulcrum.CanMountBind},
+		{"CanMountAny", fulcrum.CanMountAny},
+		{"CanMakeDevices", fulcrum.CanMakeDevices},
+	} {
+		r.Caps = append(r.Caps, Check{c.name, c.fn()})
+	}
+	r.Placers = placer.ExplainPlacers(fulcrum)
+
+	// Everything else depends on the config files, so they have to load first.
+	files, _, err := config.LoadFiles()
+	if err != nil {
+		r.ConfigError = err.Error()
+		return r
+	}
+	r.Dirs = []Dir{
+		examineDir("cache", config.GetCacheBasePath().String()),
+		examineDir("mountWorkdir", config.GetMountWorkPath().String()),
+	}
+	r.Cache = examineFilesystem(config.GetCacheBasePath().String())
+	r.Warehouses = examineWarehouses(files)
+	return r
+}
+
+func examineDir(role, pth string) Dir {
+	d := Dir{Role: role, Path: pth}
+	existing, err := nearestExisting(pth)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Exists = existing == pth
+	if err := probeWritable(existing); err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Writable = true
+	return d
+}
+
+/*
+	Returns pth, or the nearest of its parents which exists.
+	It's an error if that isn't a dir.
+*/
+func nearestExisting(pth string) (string, error) {
+	for {
+		stat, err := os.Stat(pth)
+		switch {
+		case err == nil && !stat.IsDir():
+			return pth, fmt.Errorf("%s is not a dir", pth)
+		case err == nil:
+			return pth, nil
+		case !os.IsNotExist(err) || pth == "/":
+			return pth, err
+		}
+		pth = filepath.Dir(pth)
+	}
+}
+
+func probeWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".rio-doctor.")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func examineFilesystem(pth string) Filesystem {
+	existing, err := nearestExisting(pth)
+	fsys := Filesystem{Path: existing}
+	if err != nil {
+		fsys.Error = err.Error()
+		return fsys
+	}
+	fsys.Type, err = filesystemType(existing)
+	if err != nil {
+		fsys.Error = err.Error()
+		return fsys
+	}
+	if err := probeReflinks(existing); err != nil {
+		fsys.ReflinksError = err.Error()
+	} else {
+		fsys.Reflinks = true
+	}
+	return fsys
+}
+
+/*
+	Lists the named warehouses (sorted by name), then any default sources
+	that aren't named, and checks each.  A source given as "@name" marks
+	that named warehouse as a source.
+*/
+func examineWarehouses(files config.File) []Warehouse {
+	whs := []Warehouse{}
+	byName := map[string]int{}
+	for _, name := range sortedNames(files.Warehouses) {
+		byName[name] = len(whs)
+		wh := Warehouse{Name: "@" + name, Addr: files.Warehouses[name].Addr}
+		if wh.Addr == "" {
+			wh.Error = "no address in config"
+		}
+		whs = append(whs, wh)
+	}
+	for _, src := range files.Sources {
+		if !strings.HasPrefix(src, "@") {
+			whs = append(whs, Warehouse{Addr: src, Source: true})
+		} else if i, ok := byName[src[1:]]; ok {
+			whs[i].Source = true
+		} else {
+			whs = append(whs, Warehouse{Name: src, Source: true, Error: fmt.Sprintf("no warehouse named %q in config", src)})
+		}
+	}
+	for i, wh := range whs {
+		if wh.Error != "" {
+			continue
+		}
+		if err := probeWarehouse(api.WarehouseAddr(wh.Addr)); err != nil {
+			whs[i].Error = err.Error()
+		} else {
+			whs[i].Reachable = true
+		}
+	}
+	return whs
+}
+
+func sortedNames(whs map[string]config.Warehouse) []string {
+	names := make([]string, 0, len(whs))
+	for name := range whs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Looked up in every blobstore warehouse checked; it's fine for it to be missing.
+var probeWareID = api.WareID{"tar", "riodoctorprobe"}
+
+/*
+	Checks a warehouse answers.  Blobstore warehouses are asked for a ware
+	(which needn't exist: "not found" is an answer); anything else is
+	assumed to be a git warehouse, and is asked for its refs.
+*/
+func probeWarehouse(addr api.WarehouseAddr) error {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	var whCtrl warehouse.BlobstoreController
+	switch u.Scheme {
+	case "file", "ca+file":
+		whCtrl, err = kvfs.NewController(addr)
+	case "http", "https", "ca+http", "ca+https":
+		whCtrl, err = kvhttp.NewController(addr)
+	case "enc+file", "enc+ca+file", "enc+http", "enc+https", "enc+ca+http", "enc+ca+https":
+		whCtrl, err = kvenc.NewController(addr)
+	case "ca+oci+http", "ca+oci+https":
+		whCtrl, err = oci.NewBlobstoreController(addr)
+	default:
+		return probeGitWarehouse(addr)
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := whCtrl.OpenReader(probeWareID)
+	switch Category(err) {
+	case nil:
+		reader.Close()
+		return nil
+	case rio.ErrWareNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+func probeGitWarehouse(addr api.WarehouseAddr) error {
+	tmpDir, err := ioutil.TempDir("", "rio-doctor-git")
+	if err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "cannot make temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = git.NewController(osfs.New(fs.MustAbsolutePath(tmpDir)), addr)
+	return err
+}
+
+/*
+	Plain text rendering of the report, for people.
+*/
+func (r Report) String() string {
+	var buf bytes.Buffer
+	yesno := func(b bool, yes, no string) string {
+		if b {
+			return yes
+		}
+		return no
+	}
+	fmt.Fprintf(&buf, "caps:\n")
+	for _, c := range r.Caps {
+		fmt.Fprintf(&buf, "\t%-20s %s\n", c.Name, yesno(c.OK, "yes", "no"))
+	}
+	fmt.Fprintf(&buf, "placers:\n")
+	for _, p := range r.Placers {
+		line := yesno(p.Available, "available", "unavailable")
+		if p.Selected {
+			line += " (used for mount placements)"
+		}
+		if p.Reason != "" {
+			line += ": " + p.Reason
+		}
+		fmt.Fprintf(&buf, "\t%-20s %s\n", p.Placer, line)
+	}
+	fmt.Fprintf(&buf, "dirs:\n")
+	if r.ConfigError != "" {
+		fmt.Fprintf(&buf, "\tnot checked: %s\n", r.ConfigError)
+	}
+	for _, d := range r.Dirs {
+		line := yesno(d.Writable, "writable", "not writable")
+		if !d.Exists {
+			line = "does not exist yet; parent " + line
+		}
+		if d.Error != "" {
+			line += ": " + d.Error
+		}
+		fmt.Fprintf(&buf, "\t%-20s %s (%s)\n", d.Role, d.Path, line)
+	}
+	fmt.Fprintf(&buf, "cache filesystem:\n")
+	if r.ConfigError != "" {
+		fmt.Fprintf(&buf, "\tnot checked: %s\n", r.ConfigError)
+	} else if r.Cache.Error != "" {
+		fmt.Fprintf(&buf, "\t%-20s unknown: %s\n", "type", r.Cache.Error)
+	} else {
+		fmt.Fprintf(&buf, "\t%-20s %s (at %s)\n", "type", r.Cache.Type, r.Cache.Path)
+		reflinks := yesno(r.Cache.Reflinks, "supported", "unsupported")
+		if r.Cache.ReflinksError != "" {
+			reflinks += ": " + r.Cache.ReflinksError
+		}
+		fmt.Fprintf(&buf, "\t%-20s %s\n", "reflinks", reflinks)
+	}
+	fmt.Fprintf(&buf, "warehouses:\n")
+	if r.ConfigError != "" {
+		fmt.Fprintf(&buf, "\tnot checked: %s\n", r.ConfigError)
+	} else if len(r.Warehouses) == 0 {
+		fmt.Fprintf(&buf, "\tnone configured\n")
+	}
+	for _, wh := range r.Warehouses {
+		name := wh.Name
+		if wh.Source {
+			name += " (source)"
+		}
+		line := yesno(wh.Reachable, "reachable", "unreachable")
+		if wh.Error != "" {
+			line += ": " + wh.Error
+		}
+		fmt.Fprintf(&buf, "\t%s %s\n\t\t%s\n", strings.TrimSpace(name), wh.Addr, line)
+	}
+	return buf.String()
+}
@@ -0,0 +1,84 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package doctor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestDoctor(t *testing.T) {
+	Convey("Doctor reports", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			cachePath := filepath.Join(tmpDir.String(), "cache")
+			cfgPath := filepath.Join(tmpDir.String(), "config.json")
+			So(os.Mkdir(filepath.Join(tmpDir.String(), "wh"), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(cfgPath, []byte(fmt.Sprintf(`{
+				"sources": ["@here", "@nowhere", "ca+file://%[1]s/missing"],
+				"warehouses": {
+					"here": {"addr": "ca+file://%[1]s/wh"}
+				}
+			}`, tmpDir)), 0644), ShouldBeNil)
+			for env, value := range map[string]string{
+				"RIO_SYSTEM_CONFIG": filepath.Join(tmpDir.String(), "none"),
+				"RIO_CONFIG":        cfgPath,
+				"RIO_CACHE":         cachePath,
+				"RIO_MOUNT_WORKDIR": filepath.Join(tmpDir.String(), "mount"),
+			} {
+				defer os.Setenv(env, os.Getenv(env))
+				os.Setenv(env, value)
+			}
+
+			r := Examine()
+			So(r.ConfigError, ShouldEqual, "")
+			So(r.Caps, ShouldHaveLength, 5)
+			So(r.Placers[0].Placer, ShouldEqual, "copy")
+			So(r.Placers[0].Available, ShouldBeTrue)
+
+			Convey("whether dirs exist and are writable", func() {
+				So(r.Dirs[0], ShouldResemble, Dir{Role: "cache", Path: cachePath, Exists: false, Writable: true})
+				So(os.Mkdir(cachePath, 0755), ShouldBeNil)
+				So(examineDir("cache", cachePath), ShouldResemble, Dir{Role: "cache", Path: cachePath, Exists: true, Writable: true})
+				So(r.Cache.Path, ShouldEqual, tmpDir.String())
+				So(r.Cache.Error, ShouldEqual, "")
+				So(r.Cache.Type, ShouldNotEqual, "")
+				So(r.Cache.Reflinks, ShouldEqual, r.Cache.ReflinksError == "")
+			})
+			Convey("whether each warehouse is reachable", func() {
+				So(r.Warehouses, ShouldHaveLength, 3)
+				So(r.Warehouses[0].Name, ShouldEqual, "@here")
+				So(r.Warehouses[0].Source, ShouldBeTrue)
+				So(r.Warehouses[0].Reachable, ShouldBeTrue)
+				So(r.Warehouses[1].Name, ShouldEqual, "@nowhere")
+				So(r.Warehouses[1].Reachable, ShouldBeFalse)
+				So(r.Warehouses[1].Error, ShouldContainSubstring, "no warehouse named")
+				So(r.Warehouses[2].Addr, ShouldEqual, fmt.Sprintf("ca+file://%s/missing", tmpDir))
+				So(r.Warehouses[2].Reachable, ShouldBeFalse)
+				So(r.Warehouses[2].Error, ShouldContainSubstring, "does not exist")
+			})
+			Convey("in plain text too", func() {
+				So(r.String(), ShouldContainSubstring, "@here (source) ca+file://")
+			})
+			Convey("an invalid config file, skipping what depends on it", func() {
+				So(ioutil.WriteFile(cfgPath, []byte(`{"cache": 4}`), 0644), ShouldBeNil)
+				r := Examine()
+				So(r.ConfigError, ShouldContainSubstring, "invalid config file")
+				So(r.Caps, ShouldHaveLength, 5)
+				So(r.Dirs, ShouldBeEmpty)
+				So(r.Cache, ShouldResemble, Filesystem{})
+				So(r.Warehouses, ShouldBeEmpty)
+				So(r.String(), ShouldContainSubstring, "not checked: invalid config file")
+			})
+		})
+	})
+}
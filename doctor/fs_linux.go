@@ -0,0 +1,73 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// +build linux
+
+package doctor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// Filesystem magic numbers, from statfs(2), for the filesystems rio is likely to meet.
+var filesystemNames = map[int64]string{
+	0x9123683e: "btrfs",
+	0xca451a4e: "bcachefs",
+	0xef53:     "ext4", // or ext2 or ext3; they share a magic number.
+	0xf2f52010: "f2fs",
+	0x65735546: "fuse",
+	0x6969:     "nfs",
+	0x794c7630: "overlay",
+	0x61756673: "aufs",
+	0x858458f6: "ramfs",
+	0x73717368: "squashfs",
+	0x01021994: "tmpfs",
+	0x58465342: "xfs",
+	0x2fc12fc1: "zfs",
+}
+
+func filesystemType(pth string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(pth, &st); err != nil {
+		return "", fmt.Errorf("cannot statfs %s: %s", pth, err)
+	}
+	magic := int64(st.Type) & 0xffffffff
+	if name, ok := filesystemNames[magic]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("unknown (0x%x)", magic), nil
+}
+
+const ioctl_FICLONE = 0x40049409
+
+/*
+	Tests whether the filesystem at dir supports reflinks, by cloning
+	a small temporary file with the FICLONE ioctl (as `cp --reflink` does).
+*/
+func probeReflinks(dir string) error {
+	src, err := ioutil.TempFile(dir, ".rio-doctor.")
+	if err != nil {
+		return fmt.Errorf("cannot test: %s is not writable: %s", dir, err)
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, ".rio-doctor.")
+	if err != nil {
+		return fmt.Errorf("cannot test: %s is not writable: %s", dir, err)
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	if _, err := src.Write([]byte("reflink probe\n")); err != nil {
+		return fmt.Errorf("cannot test: %s", err)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ioctl_FICLONE, src.Fd())
+	if errno != 0 {
+		return fmt.Errorf("clone failed: %s", errno)
+	}
+	return nil
+}
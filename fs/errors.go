@@ -65,6 +65,10 @@ func NormalizeIOError(ioe error) error {
 	case io.ErrShortWrite:
 		return Recategorize(ErrShortWrite, ioe)
 	}
+	// Errors we've already categorized pass through unchanged.
+	if _, ok := Category(ioe).(ErrorCategory); ok {
+		return ioe
+	}
 	// Complicated things there are no stdlib predicates for.
 	switch e2 := ioe.(type) {
 	case *os.PathError:
@@ -54,6 +54,10 @@ type FS interface {
 
 	Readlink(path RelPath) (target string, isSymlink bool, err error)
 
+	// Removes a file, or an empty dir.
+	// A symlink in the last position is removed, not followed.
+	Remove(path RelPath) error
+
 	/*
 		Resolve a symlink (within the confines of the basepath!), returning
 		the path to the final result.
@@ -0,0 +1,149 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package memfs
+
+import (
+	"io"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+var _ fs.File = &memFile{}
+
+/*
+	An open handle on a file node.
+
+	Like a real file descriptor, the handle keeps referring to the same node
+	even if the path it was opened by is later replaced.
+*/
+type memFile struct {
+	afs      *memFS
+	node     *node
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Close() error {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return Errorf(fs.ErrMisc, "file already closed")
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Read(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	n, err := f.readAt(bs, off)
+	if err == nil && n < len(bs) {
+		// ReaderAt must not return short reads without an error.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(bs []byte, off int64) (int, error) {
+	switch {
+	case f.closed:
+		return 0, Errorf(fs.ErrMisc, "file already closed")
+	case !f.readable:
+		return 0, Errorf(fs.ErrPermission, "file not open for reading")
+	case off < 0:
+		return 0, Errorf(fs.ErrMisc, "negative offset")
+	case off >= int64(len(f.node.content)):
+		if len(bs) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(bs, f.node.content[off:]), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.closed {
+		return 0, Errorf(fs.ErrMisc, "file already closed")
+	}
+	switch whence {
+	case io.SeekStart:
+		// pass
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.content))
+	default:
+		return 0, Errorf(fs.ErrMisc, "invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, Errorf(fs.ErrMisc, "negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Write(bs []byte) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.content))
+	}
+	n, err := f.writeAt(bs, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(bs []byte, off int64) (int, error) {
+	f.afs.mu.Lock()
+	defer f.afs.mu.Unlock()
+	if f.append {
+		// Same as the os package: positional writes make no sense here.
+		return 0, Errorf(fs.ErrMisc, "invalid use of WriteAt on file opened with %s", "O_APPEND")
+	}
+	return f.writeAt(bs, off)
+}
+
+func (f *memFile) writeAt(bs []byte, off int64) (int, error) {
+	switch {
+	case f.closed:
+		return 0, Errorf(fs.ErrMisc, "file already closed")
+	case !f.writable:
+		return 0, Errorf(fs.ErrPermission, "file not open for writing")
+	case off < 0:
+		return 0, Errorf(fs.ErrMisc, "negative offset")
+	}
+	end := off + int64(len(bs))
+	if l := int64(len(f.node.content)); end > l {
+		// Grow; any gap between the old end and the offset reads as zeros.
+		if end > int64(cap(f.node.content)) {
+			grown := make([]byte, l, end+end/4)
+			copy(grown, f.node.content)
+			f.node.content = grown
+		}
+		f.node.content = f.node.content[:end]
+		for i := l; i < off; i++ {
+			f.node.content[i] = 0
+		}
+	}
+	copy(f.node.content[off:], bs)
+	f.node.mtime = time.Now()
+	return len(bs), nil
+}
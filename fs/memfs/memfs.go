@@ -0,0 +1,449 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	An in-memory implementation of `fs.FS`.
+
+	memfs supports all the file types and operations osfs does, and resolves
+	paths and symlinks with exactly the same semantics (see `fs.FS.ResolveLink`):
+	the root of the memfs is treated as the root of the world, so neither
+	rooted symlinks nor excessive '..' segments can escape it.
+
+	Permission bits and ownership are recorded faithfully but never enforced;
+	every operation behaves as if performed by a fully privileged user.
+	Atimes are accepted and discarded, just as `fs.Metadata` has no field for them.
+
+	Useful for tests, and for packing and unpacking entirely in memory.
+*/
+package memfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Returns a new, empty memfs containing only its root dir.
+
+	The basepath is '/' (the zero AbsolutePath), since there's nothing
+	on the host it refers to.
+*/
+func New() fs.FS {
+	return &memFS{
+		root: &node{
+			typ:      fs.Type_Dir,
+			perms:    0755,
+			mtime:    time.Now(),
+			children: map[string]*node{},
+		},
+	}
+}
+
+type memFS struct {
+	mu   sync.Mutex // guards every node, and content access through files.
+	root *node
+}
+
+type node struct {
+	typ      fs.Type
+	perms    fs.Perms
+	uid      uint32
+	gid      uint32
+	mtime    time.Time
+	linkname string           // if symlink.
+	devmajor int64            // if device.
+	devminor int64            // if device.
+	content  []byte           // if file.
+	children map[string]*node // if dir.
+}
+
+func (afs *memFS) BasePath() fs.AbsolutePath {
+	return fs.AbsolutePath{}
+}
+
+func (afs *memFS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	// Opening follows a symlink in the last position, even if it dangles:
+	//  when creating, we create at the link target (as the kernel would).
+	if n, err := afs.lookup(rpath); err == nil && n.typ == fs.Type_Symlink {
+		rpath, err = afs.resolveLink(n.linkname, rpath, map[fs.RelPath]struct{}{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	parent, err := afs.lookupParent(rpath)
+	if err != nil {
+		return nil, err
+	}
+	n, exists := parent.children[rpath.Last()]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, errAlreadyExists(rpath)
+	case exists && n.typ == fs.Type_Dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, ErrorDetailed(fs.ErrMisc, fmt.Sprintf("%s: is a directory", rpath), map[string]string{"path": rpath.String()})
+	case exists && n.typ != fs.Type_File:
+		return nil, ErrorDetailed(fs.ErrMisc, fmt.Sprintf("%s: not a regular file", rpath), map[string]string{"path": rpath.String()})
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, errNotExists(rpath)
+	case !exists:
+		n = &node{typ: fs.Type_File, perms: perms & 07777}
+		afs.link(parent, rpath.Last(), n)
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		n.content = nil
+		n.mtime = time.Now()
+	}
+	return &memFile{
+		afs:      afs,
+		node:     n,
+		readable: flag&os.O_WRONLY == 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (afs *memFS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	return afs.mknode(path, &node{typ: fs.Type_Dir, perms: perms & 07777, children: map[string]*node{}})
+}
+
+func (afs *memFS) Mklink(path fs.RelPath, target string) error {
+	return afs.mknode(path, &node{typ: fs.Type_Symlink, perms: 0777, linkname: target})
+}
+
+func (afs *memFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return afs.mknode(path, &node{typ: fs.Type_NamedPipe, perms: perms & 07777})
+}
+
+func (afs *memFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknode(path, &node{typ: fs.Type_Device, perms: perms & 07777, devmajor: major, devminor: minor})
+}
+
+func (afs *memFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknode(path, &node{typ: fs.Type_CharDevice, perms: perms & 07777, devmajor: major, devminor: minor})
+}
+
+func (afs *memFS) mknode(path fs.RelPath, n *node) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	if rpath == (fs.RelPath{}) {
+		return errAlreadyExists(rpath)
+	}
+	parent, err := afs.lookupParent(rpath)
+	if err != nil {
+		return err
+	}
+	if _, exists := parent.children[rpath.Last()]; exists {
+		return errAlreadyExists(rpath)
+	}
+	afs.link(parent, rpath.Last(), n)
+	return nil
+}
+
+// link a new node into its parent dir, stamping times like a kernel would.
+func (afs *memFS) link(parent *node, name string, n *node) {
+	now := time.Now()
+	n.mtime = now
+	parent.children[name] = n
+	parent.mtime = now
+}
+
+func (afs *memFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	return afs.update(path, false, func(n *node) {
+		n.uid, n.gid = uid, gid
+	})
+}
+
+func (afs *memFS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	return afs.update(path, true, func(n *node) {
+		n.perms = perms & 07777
+	})
+}
+
+func (afs *memFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.update(path, false, func(n *node) {
+		n.mtime = mtime
+	})
+}
+
+func (afs *memFS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	return afs.update(path, true, func(n *node) {
+		n.mtime = mtime
+	})
+}
+
+func (afs *memFS) update(path fs.RelPath, resolveLast bool, fn func(*node)) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, resolveLast)
+	if err != nil {
+		return err
+	}
+	n, err := afs.lookup(rpath)
+	if err != nil {
+		return err
+	}
+	fn(n)
+	return nil
+}
+
+func (afs *memFS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, true)
+}
+
+func (afs *memFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false)
+}
+
+func (afs *memFS) stat(path fs.RelPath, resolveLast bool) (*fs.Metadata, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, resolveLast)
+	if err != nil {
+		return nil, err
+	}
+	n, err := afs.lookup(rpath)
+	if err != nil {
+		return nil, err
+	}
+	fmeta := &fs.Metadata{
+		Name:     path,
+		Type:     n.typ,
+		Perms:    n.perms,
+		Uid:      n.uid,
+		Gid:      n.gid,
+		Linkname: n.linkname,
+		Devmajor: n.devmajor,
+		Devminor: n.devminor,
+		Mtime:    n.mtime,
+	}
+	// Size only for file types; same as osfs.
+	if n.typ == fs.Type_File {
+		fmeta.Size = int64(len(n.content))
+	}
+	return fmeta, nil
+}
+
+/*
+	Returns the names in a dir.
+
+	Unlike osfs, the names are always sorted; but don't rely on it.
+*/
+func (afs *memFS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, true)
+	if err != nil {
+		return nil, err
+	}
+	n, err := afs.lookup(rpath)
+	if err != nil {
+		return nil, err
+	}
+	if n.typ != fs.Type_Dir {
+		return nil, errNotDir(rpath)
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (afs *memFS) Readlink(path fs.RelPath) (string, bool, error) {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return "", false, err
+	}
+	return afs.readlink(rpath)
+}
+func (afs *memFS) Remove(path fs.RelPath) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	if rpath == (fs.RelPath{}) {
+		return ErrorDetailed(fs.ErrPermission, fmt.Sprintf("%s: cannot remove the root", rpath), map[string]string{"path": rpath.String()})
+	}
+	parent, err := afs.lookupParent(rpath)
+	if err != nil {
+		return err
+	}
+	n, exists := parent.children[rpath.Last()]
+	if !exists {
+		return errNotExists(rpath)
+	}
+	if len(n.children) > 0 {
+		return ErrorDetailed(fs.ErrMisc, fmt.Sprintf("%s: directory not empty", rpath), map[string]string{"path": rpath.String()})
+	}
+	delete(parent.children, rpath.Last())
+	parent.mtime = time.Now()
+	return nil
+}
+
+func (afs *memFS) readlink(path fs.RelPath) (string, bool, error) {
+	n, err := afs.lookup(path)
+	switch {
+	case err != nil:
+		return "", false, err
+	case n.typ == fs.Type_Symlink:
+		return n.linkname, true, nil
+	default:
+		return "", false, nil
+	}
+}
+
+// Finds the node at a path, without following any symlinks.
+// Paths given must already be resolved (e.g. by `realpath`); any
+//  symlink in an intermediate position is treated as a non-dir.
+func (afs *memFS) lookup(path fs.RelPath) (*node, error) {
+	n := afs.root
+	if path == (fs.RelPath{}) {
+		return n, nil
+	}
+	segments := strings.Split(path.String(), "/")[1:]
+	for i, segment := range segments {
+		if n.typ != fs.Type_Dir {
+			return nil, errNotDir(fs.MustRelPath(strings.Join(segments[:i], "/")))
+		}
+		child, ok := n.children[segment]
+		if !ok {
+			return nil, errNotExists(path)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// Finds the dir a path should be placed in.
+func (afs *memFS) lookupParent(path fs.RelPath) (*node, error) {
+	parent, err := afs.lookup(path.Dir())
+	if err != nil {
+		return nil, err
+	}
+	if parent.typ != fs.Type_Dir {
+		return nil, errNotDir(path.Dir())
+	}
+	return parent, nil
+}
+
+// resolves a path.
+// Same semantics as osfs; the only difference is we look at nodes rather than
+//  asking the kernel to readlink.
+func (afs *memFS) realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+	if path.GoesUp() {
+		return path, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	}
+	if path == (fs.RelPath{}) {
+		return path, nil
+	}
+	segments := strings.Split(path.String(), "/")[1:]
+	iLast := len(segments) - 1
+	resolved := fs.RelPath{}
+	for i, segment := range segments {
+		resolved = resolved.Join(fs.MustRelPath(segment))
+		if i == iLast && !resolveLast {
+			return resolved, nil
+		}
+		morelink, isLink, err := afs.readlink(resolved)
+		if err != nil {
+			return resolved, err
+		}
+		if isLink {
+			resolved, err = afs.resolveLink(morelink, resolved, map[fs.RelPath]struct{}{})
+			if err != nil {
+				return resolved, err
+			}
+		}
+	}
+	return resolved, nil
+}
+
+func (afs *memFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if startingAt.GoesUp() {
+		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
+}
+func (afs *memFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
+	if _, isSeen := seen[startingAt]; isSeen {
+		return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+	}
+	seen[startingAt] = struct{}{}
+	segments := strings.Split(symlink, "/")
+	path := startingAt
+	if segments[0] == "" { // rooted
+		path = fs.RelPath{}
+		segments = segments[1:]
+	} else {
+		path = startingAt.Dir() // drop the link node itself
+	}
+	iLast := len(segments) - 1
+	for i, s := range segments {
+		// Identity segments can simply be skipped.
+		if s == "" || s == "." {
+			continue
+		}
+		// Excessive up segements aren't an error; they simply no-op when already at root.
+		if s == ".." && path == (fs.RelPath{}) {
+			continue
+		}
+		// Okay, join the segment and peek at it.
+		path = path.Join(fs.MustRelPath(s))
+		// Bail on cycles before considering recursion!
+		if path == startingAt {
+			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
+		}
+		// Check if this is a symlink; if so we must recurse on it.
+		morelink, isLink, err := afs.readlink(path)
+		if err != nil {
+			if i == iLast && Category(err) == fs.ErrNotExists {
+				return path, nil
+			}
+			return startingAt, err
+		}
+		if isLink {
+			path, err = afs.resolveLink(morelink, path, seen)
+			if err != nil {
+				return startingAt, err
+			}
+		}
+	}
+	return path, nil
+}
+
+func errNotExists(path fs.RelPath) error {
+	return ErrorDetailed(fs.ErrNotExists, fmt.Sprintf("%s: no such file or directory", path), map[string]string{"path": path.String()})
+}
+
+func errAlreadyExists(path fs.RelPath) error {
+	return ErrorDetailed(fs.ErrAlreadyExists, fmt.Sprintf("%s: file exists", path), map[string]string{"path": path.String()})
+}
+
+func errNotDir(path fs.RelPath) error {
+	return ErrorDetailed(fs.ErrNotDir, fmt.Sprintf("%s: not a directory", path), map[string]string{"path": path.String()})
+}
@@ -0,0 +1,36 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package memfs
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs/tests"
+)
+
+func TestAll(t *testing.T) {
+	Convey("memfs spec compliance tests", t, func() {
+		afs := New()
+
+		tests.CheckBaseLstat(afs)
+		tests.CheckMkdirLstatRoundtrip(afs)
+		tests.CheckDeepMkdirError(afs)
+		tests.CheckMklinkLstatRoundtrip(afs)
+		tests.CheckSymlinks(afs)
+		tests.CheckPerniciousSymlinks(afs)
+		tests.CheckOpsTraversingSymlinks(afs)
+		tests.CheckMkdirErrors(afs)
+		tests.CheckFileRoundtrip(afs)
+		tests.CheckReadDirNames(afs)
+		tests.CheckChmodRoundtrip(afs)
+		tests.CheckSetTimesRoundtrip(afs)
+		tests.CheckFifoRoundtrip(afs)
+		tests.CheckBreakoutPaths(afs)
+		tests.CheckLchownRoundtrip(afs)
+		tests.CheckDevicesRoundtrip(afs)
+	})
+}
@@ -136,6 +136,14 @@ func (afs *nilFS) Readlink(path fs.RelPath) (string, bool, error) {
 	return "", false, nil
 }
 
+func (afs *nilFS) Remove(path fs.RelPath) error {
+	_, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // resolves a path.
 // resolving a path can have errors traversing things and still return nil error,
 //  because failure to resolve the path doesn't necessarily mean you shouldn't try.
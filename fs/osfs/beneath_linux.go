@@ -0,0 +1,433 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// +build linux
+
+package osfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+// These are not currently available in syscall.
+// The syscall number is the same on every arch (it's from after the great unification).
+const (
+	sys_OPENAT2 = 437
+
+	o_PATH = 0x200000 // (except on alpha, parisc, and sparc; which we don't build for.)
+
+	resolve_NO_SYMLINKS = 0x04
+	resolve_BENEATH     = 0x08
+
+	at_REMOVEDIR = 0x200
+)
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// Returns a raw errno, for the caller to normalize.
+func openat2(dirfd int, path string, flags int, mode uint32, resolve uint64) (int, error) {
+	_path, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{uint64(flags), uint64(mode), resolve}
+	for {
+		fd, _, errno := syscall.Syscall6(sys_OPENAT2, uintptr(dirfd), uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		switch errno {
+		case 0:
+			return int(fd), nil
+		case syscall.EAGAIN, syscall.EINTR:
+			// EAGAIN means something was renamed concurrently and the kernel
+			//  couldn't be sure it stayed beneath; it asks us to just try again.
+			continue
+		default:
+			return -1, errno
+		}
+	}
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	_name, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return "", err
+	}
+	for size := 256; ; size *= 2 {
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(_name)), uintptr(unsafe.Pointer(&buf[0])), uintptr(size), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(n) < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+func symlinkat(target string, dirfd int, name string) error {
+	_target, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	_name, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(_target)), uintptr(dirfd), uintptr(unsafe.Pointer(_name))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	_name, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(_name)), uintptr(flags)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+var beneathProbe struct {
+	sync.Once
+	supported bool
+}
+
+func newBeneath(basePath fs.AbsolutePath) fs.FS {
+	beneathProbe.Do(func() {
+		// Old kernels say ENOSYS; seccomp filters that haven't heard of
+		//  openat2 typically say EPERM.  Either way: no dice.
+		fd, err := openat2(at_FDCWD, "/", o_PATH|syscall.O_CLOEXEC, 0, 0)
+		if err == nil {
+			syscall.Close(fd)
+			beneathProbe.supported = true
+		}
+	})
+	if !beneathProbe.supported {
+		return nil
+	}
+	return &beneathFS{basePath: basePath, walk: osFS{basePath}}
+}
+
+/*
+	An osfs where every operation on a path below the basepath is done
+	relative to a dirfd for the basepath, and reaches its target with
+	`openat2(RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS)`.
+
+	The basepath's dirfd is opened afresh for each operation (and closed
+	after), so that if the basepath is replaced (e.g. by Swap), we follow.
+
+	We still resolve symlinks ourselves, with the same semantics as the
+	walk mode; the kernel then refuses if the path we resolved has
+	grown a symlink (or anything else leading outside) by the time we use it.
+
+	Operations which must follow a final symlink (Chmod and SetTimesNano)
+	are done via `/proc/self/fd` on an O_PATH fd, so that the thing
+	we modify is the thing we resolved.  If `/proc` isn't mounted, they
+	fall back to following the name in its (held) parent dir.
+*/
+type beneathFS struct {
+	basePath fs.AbsolutePath
+	walk     osFS // used only for making the basepath itself.
+}
+
+func (afs *beneathFS) confinement() Confinement {
+	return Confinement_Beneath
+}
+
+func (afs *beneathFS) BasePath() fs.AbsolutePath {
+	return afs.basePath
+}
+
+// Opens a path beneath the root.  Errors are raw (see rawError).
+func (afs *beneathFS) open(rel fs.RelPath, flags int, mode uint32) (int, error) {
+	root, err := openat2(at_FDCWD, afs.basePath.String(), o_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: afs.basePath.String(), Err: err}
+	}
+	defer syscall.Close(root)
+	fd, err := openat2(root, rel.String(), flags|syscall.O_CLOEXEC, mode, resolve_BENEATH|resolve_NO_SYMLINKS)
+	return fd, afs.rawError("open", rel, err)
+}
+
+// Performs an op on a path with one of the *at syscalls, relative to its parent.
+func (afs *beneathFS) at(rel fs.RelPath, op string, fn func(dirfd int, name string) error) error {
+	dirfd, err := afs.open(rel.Dir(), o_PATH|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	defer syscall.Close(dirfd)
+	return fs.NormalizeIOError(afs.rawError(op, rel, fn(dirfd, rel.Last())))
+}
+
+// Performs an op on the file a path refers to via its magic link in /proc,
+// falling back to an *at syscall if /proc isn't around.
+func (afs *beneathFS) viaProc(rel fs.RelPath, op string, fn func(procPath string) error, fallback func(dirfd int, name string) error) error {
+	fd, err := afs.open(rel, o_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	defer syscall.Close(fd)
+	err = fn("/proc/self/fd/" + strconv.Itoa(fd))
+	if err == syscall.ENOENT {
+		return afs.at(rel, op, fallback)
+	}
+	return fs.NormalizeIOError(afs.rawError(op, rel, err))
+}
+
+// Errors are left raw (as *os.PathError), so `os.IsNotExist` and friends work;
+// except for the kernel telling us it refused to leave the basepath or follow
+// a symlink, which become ErrBreakout immediately.
+func (afs *beneathFS) rawError(op string, rel fs.RelPath, err error) error {
+	switch err {
+	case nil:
+		return nil
+	case syscall.ELOOP, syscall.EXDEV:
+		return ErrorDetailed(
+			fs.ErrBreakout,
+			fmt.Sprintf("breakout error: refusing to traverse symlink while resolving %q in %q (was it modified concurrently?)", rel, afs.basePath),
+			map[string]string{
+				"opArea": afs.basePath.String(),
+				"opPath": rel.String(),
+			},
+		)
+	default:
+		return &os.PathError{Op: op, Path: afs.basePath.Join(rel).String(), Err: err}
+	}
+}
+
+func (afs *beneathFS) OpenFile(path fs.RelPath, flag int, perms fs.Perms) (fs.File, error) {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return nil, err
+	}
+	// The kernel would follow a symlink in the last position (even a dangling
+	//  one, when creating), so we must too.
+	if target, isLink, _ := afs.readlinkRel(rel); isLink {
+		rel, err = resolveLink(target, rel, map[fs.RelPath]struct{}{}, afs.readlinkRel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var mode uint32
+	if flag&os.O_CREATE != 0 {
+		mode = uint32(perms & 07777)
+	}
+	fd, err := afs.open(rel, flag, mode)
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	return os.NewFile(uintptr(fd), afs.basePath.Join(rel).String()), nil
+}
+
+func (afs *beneathFS) Mkdir(path fs.RelPath, perms fs.Perms) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	if rel == (fs.RelPath{}) {
+		// The basepath itself isn't beneath anything; and may not exist yet.
+		return afs.walk.Mkdir(rel, perms)
+	}
+	return afs.at(rel, "mkdir", func(dirfd int, name string) error {
+		return syscall.Mkdirat(dirfd, name, uint32(perms&07777))
+	})
+}
+
+func (afs *beneathFS) Mklink(path fs.RelPath, target string) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	return afs.at(rel, "symlink", func(dirfd int, name string) error {
+		return symlinkat(target, dirfd, name)
+	})
+}
+
+func (afs *beneathFS) Mkfifo(path fs.RelPath, perms fs.Perms) error {
+	return afs.mknod(path, uint32(perms&07777)|syscall.S_IFIFO, 0)
+}
+
+func (afs *beneathFS) MkdevBlock(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknod(path, uint32(perms&07777)|syscall.S_IFBLK, int(devModesJoin(major, minor)))
+}
+
+func (afs *beneathFS) MkdevChar(path fs.RelPath, major int64, minor int64, perms fs.Perms) error {
+	return afs.mknod(path, uint32(perms&07777)|syscall.S_IFCHR, int(devModesJoin(major, minor)))
+}
+
+func (afs *beneathFS) mknod(path fs.RelPath, mode uint32, dev int) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	return afs.at(rel, "mknod", func(dirfd int, name string) error {
+		return syscall.Mknodat(dirfd, name, mode, dev)
+	})
+}
+
+func (afs *beneathFS) Lchown(path fs.RelPath, uid uint32, gid uint32) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	return afs.at(rel, "lchown", func(dirfd int, name string) error {
+		return syscall.Fchownat(dirfd, name, int(uid), int(gid), at_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (afs *beneathFS) Chmod(path fs.RelPath, perms fs.Perms) error {
+	rel, err := realpath(path, true, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	mode := uint32(perms & 07777)
+	return afs.viaProc(rel, "chmod",
+		func(procPath string) error {
+			return syscall.Chmod(procPath, mode)
+		},
+		func(dirfd int, name string) error {
+			return syscall.Fchmodat(dirfd, name, mode, 0)
+		},
+	)
+}
+
+func (afs *beneathFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	return afs.at(rel, "utimes", func(dirfd int, name string) error {
+		return utimensat(dirfd, name, mtime, atime, at_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (afs *beneathFS) SetTimesNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	rel, err := realpath(path, true, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	return afs.viaProc(rel, "utimes",
+		func(procPath string) error {
+			return utimensat(at_FDCWD, procPath, mtime, atime, 0)
+		},
+		func(dirfd int, name string) error {
+			return utimensat(dirfd, name, mtime, atime, 0)
+		},
+	)
+}
+
+func (afs *beneathFS) Stat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, true)
+}
+
+func (afs *beneathFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
+	return afs.stat(path, false)
+}
+
+func (afs *beneathFS) stat(path fs.RelPath, resolveLast bool) (*fs.Metadata, error) {
+	rel, err := realpath(path, resolveLast, afs.readlinkRel)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := afs.open(rel, o_PATH|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	f := os.NewFile(uintptr(fd), afs.basePath.Join(rel).String())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	return convertFileinfo(path, fi, func() (string, error) {
+		// An empty name reads the link the O_PATH fd itself refers to.
+		target, err := readlinkat(fd, "")
+		return target, fs.NormalizeIOError(afs.rawError("readlink", rel, err))
+	})
+}
+
+func (afs *beneathFS) ReadDirNames(path fs.RelPath) ([]string, error) {
+	rel, err := realpath(path, true, afs.readlinkRel)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := afs.open(rel, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fs.NormalizeIOError(err)
+	}
+	f := os.NewFile(uintptr(fd), afs.basePath.Join(rel).String())
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return names, fs.NormalizeIOError(err)
+	}
+	return names, nil
+}
+
+func (afs *beneathFS) Readlink(path fs.RelPath) (string, bool, error) {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return "", false, err
+	}
+	target, isLink, err := afs.readlinkRel(rel)
+	return target, isLink, fs.NormalizeIOError(err)
+}
+func (afs *beneathFS) Remove(path fs.RelPath) error {
+	rel, err := realpath(path, false, afs.readlinkRel)
+	if err != nil {
+		return err
+	}
+	if rel == (fs.RelPath{}) {
+		// The basepath itself isn't beneath anything.
+		return afs.walk.Remove(rel)
+	}
+	return afs.at(rel, "remove", func(dirfd int, name string) error {
+		err := unlinkat(dirfd, name, 0)
+		if err == syscall.EISDIR {
+			err = unlinkat(dirfd, name, at_REMOVEDIR)
+		}
+		return err
+	})
+}
+
+func (afs *beneathFS) readlinkRel(rel fs.RelPath) (string, bool, error) {
+	dirfd, err := afs.open(rel.Dir(), o_PATH|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return "", false, err
+	}
+	defer syscall.Close(dirfd)
+	target, err := readlinkat(dirfd, rel.Last())
+	switch err {
+	case nil:
+		return target, true, nil
+	case syscall.EINVAL:
+		// EINVAL means "not a symlink".  Same as in walk mode.
+		return "", false, nil
+	default:
+		return "", false, afs.rawError("readlink", rel, err)
+	}
+}
+
+func (afs *beneathFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if startingAt.GoesUp() {
+		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	}
+	return resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{}, afs.readlinkRel)
+}
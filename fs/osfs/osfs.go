@@ -22,10 +22,62 @@ func New(basePath fs.AbsolutePath) fs.FS {
 	return &osFS{basePath}
 }
 
+/*
+	Like New, but if the kernel supports it, returns a filesystem which has
+	the kernel enforce that no operation can escape the basepath -- even if
+	the filesystem is concurrently modified by someone else.
+
+	Every operation is performed relative to a dirfd held for the basepath,
+	using `openat2(RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS)` to reach the path
+	after we've resolved any symlinks ourselves.  If a symlink appears
+	along the way (that is, someone raced us), the operation fails with
+	ErrBreakout rather than following it.
+
+	The basepath itself doesn't have to exist yet; the dirfd is opened
+	the first time something below it is touched.
+
+	On kernels without openat2 (linux < 5.6, or other platforms), this
+	falls back to exactly the same behavior as New.
+	Use `ConfinementOf` to find out which you got.
+*/
+func NewConfined(basePath fs.AbsolutePath) fs.FS {
+	if afs := newBeneath(basePath); afs != nil {
+		return afs
+	}
+	return New(basePath)
+}
+
+/*
+	Describes how an osfs keeps operations from escaping its basepath.
+*/
+type Confinement string
+
+const (
+	Confinement_None    Confinement = ""        // Not an osfs at all.
+	Confinement_Walk    Confinement = "walk"    // Symlinks are checked in userland.  Best-effort: racy if the filesystem is concurrently modified.
+	Confinement_Beneath Confinement = "beneath" // Enforced by the kernel with openat2.  Race-free.
+)
+
+/*
+	Reports which confinement mode the filesystem is using.
+*/
+func ConfinementOf(afs fs.FS) Confinement {
+	if cfs, ok := afs.(interface {
+		confinement() Confinement
+	}); ok {
+		return cfs.confinement()
+	}
+	return Confinement_None
+}
+
 type osFS struct {
 	basePath fs.AbsolutePath
 }
 
+func (afs *osFS) confinement() Confinement {
+	return Confinement_Walk
+}
+
 func (afs *osFS) BasePath() fs.AbsolutePath {
 	return afs.basePath
 }
@@ -113,7 +165,10 @@ func (afs *osFS) Stat(path fs.RelPath) (*fs.Metadata, error) {
 	if err != nil {
 		return nil, fs.NormalizeIOError(err)
 	}
-	return afs.convertFileinfo(path, fi)
+	return convertFileinfo(path, fi, func() (string, error) {
+		target, _, err := afs.readlink(rpath)
+		return target, err
+	})
 }
 
 func (afs *osFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
@@ -125,10 +180,15 @@ func (afs *osFS) LStat(path fs.RelPath) (*fs.Metadata, error) {
 	if err != nil {
 		return nil, fs.NormalizeIOError(err)
 	}
-	return afs.convertFileinfo(path, fi)
+	return convertFileinfo(path, fi, func() (string, error) {
+		target, _, err := afs.readlink(rpath)
+		return target, err
+	})
 }
 
-func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata, error) {
+// Converts to our metadata types.
+// The linkname func is only called if the file is a symlink.
+func convertFileinfo(path fs.RelPath, fi os.FileInfo, linkname func() (string, error)) (*fs.Metadata, error) {
 	// Copy over the easy 1-to-1 parts.
 	fmeta := &fs.Metadata{
 		Name:  path,
@@ -146,7 +206,7 @@ func (afs *osFS) convertFileinfo(path fs.RelPath, fi os.FileInfo) (*fs.Metadata,
 		fmeta.Type = fs.Type_Symlink
 		// If it's a symlink, get that info.
 		//  It's an extra syscall, but we almost always want it.
-		if target, _, err := afs.readlink(afs.basePath.Join(path).String()); err == nil {
+		if target, err := linkname(); err == nil {
 			fmeta.Linkname = target
 		} else {
 			return nil, err
@@ -222,6 +282,15 @@ func (afs *osFS) Readlink(path fs.RelPath) (string, bool, error) {
 	err = fs.NormalizeIOError(err)
 	return target, isLink, err
 }
+func (afs *osFS) Remove(path fs.RelPath) error {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(rpath)
+	return fs.NormalizeIOError(err)
+}
+
 func (afs *osFS) readlink(path string) (string, bool, error) {
 	target, err := os.Readlink(path)
 	switch {
@@ -242,13 +311,34 @@ func (afs *osFS) readlink(path string) (string, bool, error) {
 //  because failure to resolve the path doesn't necessarily mean you shouldn't try.
 // (it does however return real errors in case of ErrRecurse and ErrBreakout.)
 func (afs *osFS) realpath(path fs.RelPath, resolveLast bool) (string, error) {
-	if path.GoesUp() {
-		return "", Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
-	}
-	path, err := afs._realpath(path, resolveLast)
+	path, err := realpath(path, resolveLast, afs.readlinkRel)
 	return afs.BasePath().Join(path).String(), err
 }
-func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error) {
+func (afs *osFS) readlinkRel(path fs.RelPath) (string, bool, error) {
+	return afs.readlink(afs.BasePath().Join(path).String())
+}
+
+func (afs *osFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
+	if startingAt.GoesUp() {
+		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
+	}
+	return resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{}, afs.readlinkRel)
+}
+
+/*
+	Reads a symlink at a path relative to the basepath.
+	Returns false and a nil error if the path is not a symlink;
+	other errors are returned raw (not normalized), so `os.IsNotExist` works.
+
+	This is all the path resolution logic needs to know about the filesystem,
+	so it's shared by all our confinement modes.
+*/
+type readlinkFunc func(path fs.RelPath) (target string, isSymlink bool, err error)
+
+func realpath(path fs.RelPath, resolveLast bool, readlink readlinkFunc) (fs.RelPath, error) {
+	if path.GoesUp() {
+		return path, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", path)
+	}
 	segments := strings.Split(path.String(), "/")[1:]
 	iLast := len(segments) - 1
 	resolved := fs.RelPath{}
@@ -257,12 +347,12 @@ func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error
 		if i == iLast && !resolveLast {
 			return resolved, nil
 		}
-		morelink, isLink, err := afs.readlink(afs.BasePath().Join(resolved).String())
+		morelink, isLink, err := readlink(resolved)
 		if err != nil {
 			return resolved, fs.NormalizeIOError(err)
 		}
 		if isLink {
-			resolved, err = afs.resolveLink(morelink, resolved, map[fs.RelPath]struct{}{})
+			resolved, err = resolveLink(morelink, resolved, map[fs.RelPath]struct{}{}, readlink)
 			if err != nil {
 				return resolved, fs.NormalizeIOError(err) // maybe cat and nil
 			}
@@ -271,13 +361,7 @@ func (afs *osFS) _realpath(path fs.RelPath, resolveLast bool) (fs.RelPath, error
 	return resolved, nil
 }
 
-func (afs *osFS) ResolveLink(symlink string, startingAt fs.RelPath) (fs.RelPath, error) {
-	if startingAt.GoesUp() {
-		return startingAt, Errorf(fs.ErrBreakout, "fs: invalid path %q: must not depart basepath", startingAt)
-	}
-	return afs.resolveLink(symlink, startingAt, map[fs.RelPath]struct{}{})
-}
-func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}) (fs.RelPath, error) {
+func resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.RelPath]struct{}, readlink readlinkFunc) (fs.RelPath, error) {
 	if _, isSeen := seen[startingAt]; isSeen {
 		return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
 	}
@@ -307,7 +391,7 @@ func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.
 			return startingAt, Errorf(fs.ErrRecursion, "cyclic symlinks detected from %q", startingAt)
 		}
 		// Check if this is a symlink; if so we must recurse on it.
-		morelink, isLink, err := afs.readlink(afs.BasePath().Join(path).String())
+		morelink, isLink, err := readlink(path)
 		if err != nil {
 			if i == iLast && os.IsNotExist(err) {
 				return path, nil
@@ -315,7 +399,7 @@ func (afs *osFS) resolveLink(symlink string, startingAt fs.RelPath, seen map[fs.
 			return startingAt, fs.NormalizeIOError(err)
 		}
 		if isLink {
-			path, err = afs.resolveLink(morelink, path, seen)
+			path, err = resolveLink(morelink, path, seen, readlink)
 			if err != nil {
 				return startingAt, err
 			}
@@ -6,29 +6,103 @@ Sniperkit-Bot
 package osfs
 
 import (
+	"fmt"
+	"os"
+	"syscall"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/tests"
 	"go.polydawn.net/rio/testutil"
 )
 
 func TestAll(t *testing.T) {
-	Convey("osfs spec compliance tests", t, func() {
+	for _, mode := range []struct {
+		name      string
+		construct func(fs.AbsolutePath) fs.FS
+	}{
+		{"walk", New},
+		{"confined", NewConfined},
+	} {
+		Convey(fmt.Sprintf("osfs spec compliance tests (%s)", mode.name), t, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				tfs := New(tmpDir)
+				boxPath := fs.MustRelPath("sandbox")
+				tfs.Mkdir(boxPath, 0755)
+				afs := mode.construct(tmpDir.Join(boxPath))
+
+				tests.CheckBaseLstat(afs)
+				tests.CheckMkdirLstatRoundtrip(afs)
+				tests.CheckDeepMkdirError(afs)
+				tests.CheckMklinkLstatRoundtrip(afs)
+				tests.CheckSymlinks(afs)
+				tests.CheckPerniciousSymlinks(afs)
+				tests.CheckOpsTraversingSymlinks(afs)
+				tests.CheckMkdirErrors(afs)
+				tests.CheckFileRoundtrip(afs)
+				tests.CheckReadDirNames(afs)
+				tests.CheckChmodRoundtrip(afs)
+				tests.CheckSetTimesRoundtrip(afs)
+				tests.CheckFifoRoundtrip(afs)
+				tests.CheckBreakoutPaths(afs)
+				Convey("with privileges:", testutil.Requires(
+					testutil.RequiresCanManageOwnership,
+					testutil.RequiresCanMakeDevices,
+					func() {
+						tests.CheckLchownRoundtrip(afs)
+						tests.CheckDevicesRoundtrip(afs)
+					},
+				))
+			})
+		})
+	}
+}
+
+func TestConfined(t *testing.T) {
+	Convey("confined osfs", t, func() {
 		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
-			tfs := New(tmpDir)
-			boxPath := fs.MustRelPath("sandbox")
-			tfs.Mkdir(boxPath, 0755)
-			afs := New(tmpDir.Join(boxPath))
-
-			tests.CheckBaseLstat(afs)
-			tests.CheckMkdirLstatRoundtrip(afs)
-			tests.CheckDeepMkdirError(afs)
-			tests.CheckMklinkLstatRoundtrip(afs)
-			tests.CheckSymlinks(afs)
-			tests.CheckPerniciousSymlinks(afs)
-			tests.CheckOpsTraversingSymlinks(afs)
+			afs := NewConfined(tmpDir)
+			So(ConfinementOf(afs), ShouldBeIn, Confinement_Walk, Confinement_Beneath)
+			So(ConfinementOf(New(tmpDir)), ShouldEqual, Confinement_Walk)
+
+			Convey("can create its own basepath", func() {
+				afs := NewConfined(tmpDir.Join(fs.MustRelPath("box")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				So(afs.Mkdir(fs.MustRelPath("d1"), 0755), ShouldBeNil)
+				stat, err := afs.LStat(fs.MustRelPath("d1"))
+				So(err, ShouldBeNil)
+				So(stat.Type, ShouldEqual, fs.Type_Dir)
+			})
+
+			Convey("follows its basepath when that's replaced", func() {
+				afs := NewConfined(tmpDir.Join(fs.MustRelPath("box")))
+				So(afs.Mkdir(fs.RelPath{}, 0755), ShouldBeNil)
+				So(afs.Mkdir(fs.MustRelPath("d1"), 0755), ShouldBeNil)
+				So(os.Rename(tmpDir.String()+"/box", tmpDir.String()+"/box.old"), ShouldBeNil)
+				So(os.Mkdir(tmpDir.String()+"/box", 0755), ShouldBeNil)
+				So(afs.Mkdir(fs.MustRelPath("d2"), 0755), ShouldBeNil)
+				_, err := os.Lstat(tmpDir.String() + "/box/d2")
+				So(err, ShouldBeNil)
+				_, err = os.Lstat(tmpDir.String() + "/box.old/d2")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			// Simulate losing a race: the path was resolved while it was clean,
+			//  and then someone swapped in a symlink before we used it.
+			Convey("refuses to follow symlinks that appear after resolution", testutil.Requires(
+				testutil.ConveyRequirement{"kernel supports openat2", func() bool { return ConfinementOf(afs) == Confinement_Beneath }},
+				func() {
+					So(afs.Mklink(fs.MustRelPath("lnk"), "/"), ShouldBeNil)
+					err := afs.(*beneathFS).at(fs.MustRelPath("lnk/tmp"), "mkdir", func(dirfd int, name string) error {
+						return syscall.Mkdirat(dirfd, name, 0755)
+					})
+					So(err, errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+					_, err = afs.(*beneathFS).open(fs.MustRelPath("lnk"), o_PATH, 0)
+					So(errcat.Category(err), ShouldEqual, fs.ErrBreakout)
+				},
+			))
 		})
 	})
 }
@@ -0,0 +1,97 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// +build linux
+
+package osfs
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"go.polydawn.net/rio/fs"
+)
+
+// Not currently available in syscall, and (unlike openat2) the number varies by arch.
+// Arches not listed here get zero, and fall back as if the kernel said ENOSYS.
+var sys_RENAMEAT2 = map[string]uintptr{
+	"386":     353,
+	"amd64":   316,
+	"arm":     382,
+	"arm64":   276,
+	"ppc64":   357,
+	"ppc64le": 357,
+	"riscv64": 276,
+	"s390x":   347,
+}[runtime.GOARCH]
+
+const rename_EXCHANGE = 0x2
+
+// Returns a raw errno, for the caller to normalize.
+func renameExchange(a, b string) error {
+	if sys_RENAMEAT2 == 0 {
+		return syscall.ENOSYS
+	}
+	_a, err := syscall.BytePtrFromString(a)
+	if err != nil {
+		return err
+	}
+	_b, err := syscall.BytePtrFromString(b)
+	if err != nil {
+		return err
+	}
+	dirfd := at_FDCWD
+	_, _, errno := syscall.Syscall6(sys_RENAMEAT2, uintptr(dirfd), uintptr(unsafe.Pointer(_a)), uintptr(dirfd), uintptr(unsafe.Pointer(_b)), rename_EXCHANGE, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/*
+	Moves `replacement` to `target`.  If something already exists at `target`,
+	the two are swapped, and the old one is left for the caller to dispose of;
+	`swapped` reports whether this happened, and `old` says where it was left.
+	That's normally `replacement`; but if the swap is done and only moving
+	the old entry there fails, it's left at `replacement` + ".old" instead,
+	since the swap itself still succeeded.
+
+	The swap is atomic where the kernel and filesystem support
+	renameat2(RENAME_EXCHANGE).  Elsewhere, the old entry is renamed aside
+	first, so there's a brief moment where nothing is at `target` (but if
+	the second rename fails, the old entry is put back).
+
+	Both paths must be on the same filesystem, as for any rename.
+*/
+func Swap(target, replacement fs.AbsolutePath) (old fs.AbsolutePath, swapped bool, err error) {
+	if _, err := os.Lstat(target.String()); os.IsNotExist(err) {
+		if err := os.Rename(replacement.String(), target.String()); err != nil {
+			return fs.AbsolutePath{}, false, fs.NormalizeIOError(err)
+		}
+		return fs.AbsolutePath{}, false, nil
+	}
+	switch err := renameExchange(target.String(), replacement.String()); err {
+	case nil:
+		return replacement, true, nil
+	case syscall.ENOSYS, syscall.EINVAL:
+		// Old kernel, or a filesystem that can't; do it the long way.
+	default:
+		return fs.AbsolutePath{}, false, fs.NormalizeIOError(&os.LinkError{"renameat2", target.String(), replacement.String(), err})
+	}
+	aside := fs.MustAbsolutePath(replacement.String() + ".old")
+	if err := os.Rename(target.String(), aside.String()); err != nil {
+		return fs.AbsolutePath{}, false, fs.NormalizeIOError(err)
+	}
+	if err := os.Rename(replacement.String(), target.String()); err != nil {
+		os.Rename(aside.String(), target.String())
+		return fs.AbsolutePath{}, false, fs.NormalizeIOError(err)
+	}
+	if err := os.Rename(aside.String(), replacement.String()); err != nil {
+		return aside, true, nil
+	}
+	return replacement, true, nil
+}
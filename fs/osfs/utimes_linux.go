@@ -19,28 +19,37 @@ import (
 	"go.polydawn.net/rio/fs"
 )
 
-func (afs *osFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
-	rpath, err := afs.realpath(path, false)
-	if err != nil {
-		return err
-	}
+// These are not currently available in syscall
+const (
+	at_FDCWD            = -100
+	at_SYMLINK_NOFOLLOW = 0x100
+)
 
+// Returns a raw errno, for the caller to normalize.
+func utimensat(dirfd int, path string, mtime time.Time, atime time.Time, flags int) error {
 	var utimes [2]syscall.Timespec
 	utimes[0] = syscall.NsecToTimespec(atime.UnixNano())
 	utimes[1] = syscall.NsecToTimespec(mtime.UnixNano())
 
-	// These are not currently available in syscall
-	AT_FDCWD := -100
-	AT_SYMLINK_NOFOLLOW := 0x100
-
-	var _path *byte
-	_path, err = syscall.BytePtrFromString(rpath)
+	_path, err := syscall.BytePtrFromString(path)
 	if err != nil { // EINVAL if the path string contains NUL bytes.
-		return fs.NormalizeIOError(err)
+		return err
 	}
 
 	// Note this does depend on kernel 2.6.22 or newer.  Fallbacks are available but we haven't implemented them and they lose nano precision.
-	if _, _, err := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(AT_FDCWD), uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(&utimes[0])), uintptr(AT_SYMLINK_NOFOLLOW), 0, 0); err != 0 {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(_path)), uintptr(unsafe.Pointer(&utimes[0])), uintptr(flags), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (afs *osFS) SetTimesLNano(path fs.RelPath, mtime time.Time, atime time.Time) error {
+	rpath, err := afs.realpath(path, false)
+	if err != nil {
+		return err
+	}
+
+	if err := utimensat(at_FDCWD, rpath, mtime, atime, at_SYMLINK_NOFOLLOW); err != nil {
 		return fs.NormalizeIOError(err)
 	}
 
@@ -6,7 +6,10 @@ Sniperkit-Bot
 package tests
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/warpfork/go-errcat"
@@ -244,6 +247,220 @@ func CheckOpsTraversingSymlinks(afs fs.FS) {
 	})
 }
 
+func CheckMkdirErrors(afs fs.FS) {
+	Convey("SPEC: mkdir over existing things should error", func() {
+		d1 := fs.MustRelPath("d1")
+		So(afs.Mkdir(d1, 0755), ShouldBeNil)
+		So(afs.Mkdir(d1, 0755), errcat.ErrorShouldHaveCategory, fs.ErrAlreadyExists)
+		So(afs.Mklink(d1, "./target"), errcat.ErrorShouldHaveCategory, fs.ErrAlreadyExists)
+	})
+	Convey("SPEC: mkdir inside a file should error", func() {
+		f1 := fs.MustRelPath("f1")
+		So(makeFile(afs, f1, "body"), ShouldBeNil)
+		So(afs.Mkdir(f1.Join(fs.MustRelPath("d2")), 0755), errcat.ErrorShouldHaveCategory, fs.ErrNotDir)
+	})
+}
+
+func CheckFileRoundtrip(afs fs.FS) {
+	Convey("SPEC: files should roundtrip", func() {
+		f1 := fs.MustRelPath("f1")
+		So(makeFile(afs, f1, "body"), ShouldBeNil)
+		stat, err := afs.LStat(f1)
+		So(err, ShouldBeNil)
+		So(stat.Type, ShouldEqual, fs.Type_File)
+		So(stat.Perms, ShouldEqual, fs.Perms(0644))
+		So(stat.Size, ShouldEqual, 4)
+		So(readFile(afs, f1), ShouldEqual, "body")
+
+		Convey("truncating and appending should work", func() {
+			f, err := afs.OpenFile(f1, os.O_WRONLY|os.O_TRUNC, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("new"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			f, err = afs.OpenFile(f1, os.O_WRONLY|os.O_APPEND, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("er"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			So(readFile(afs, f1), ShouldEqual, "newer")
+		})
+		Convey("exclusive create of an existing file should error", func() {
+			_, err := afs.OpenFile(f1, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			So(err, errcat.ErrorShouldHaveCategory, fs.ErrAlreadyExists)
+		})
+		Convey("seeks and positional reads should work", func() {
+			f, err := afs.OpenFile(f1, os.O_RDONLY, 0)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			pos, err := f.Seek(2, io.SeekStart)
+			So(err, ShouldBeNil)
+			So(pos, ShouldEqual, 2)
+			bs := make([]byte, 2)
+			n, err := f.Read(bs)
+			So(err, ShouldBeNil)
+			So(string(bs[:n]), ShouldEqual, "dy")
+			n, err = f.ReadAt(bs, 1)
+			So(err, ShouldBeNil)
+			So(string(bs[:n]), ShouldEqual, "od")
+		})
+	})
+	Convey("SPEC: opening a nonexistent file should error", func() {
+		_, err := afs.OpenFile(fs.MustRelPath("nope"), os.O_RDONLY, 0)
+		So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+	})
+	Convey("SPEC: creating a file through a dangling symlink creates the target", func() {
+		So(afs.Mklink(fs.MustRelPath("l1"), "./target"), ShouldBeNil)
+		So(makeFile(afs, fs.MustRelPath("l1"), "body"), ShouldBeNil)
+		stat, err := afs.LStat(fs.MustRelPath("target"))
+		So(err, ShouldBeNil)
+		So(stat.Type, ShouldEqual, fs.Type_File)
+		So(readFile(afs, fs.MustRelPath("l1")), ShouldEqual, "body")
+	})
+}
+
+func CheckReadDirNames(afs fs.FS) {
+	Convey("SPEC: readdirnames should list children", func() {
+		d1 := fs.MustRelPath("d1")
+		So(afs.Mkdir(d1, 0755), ShouldBeNil)
+		So(afs.Mkdir(d1.Join(fs.MustRelPath("a")), 0755), ShouldBeNil)
+		So(makeFile(afs, d1.Join(fs.MustRelPath("b")), "body"), ShouldBeNil)
+		So(afs.Mklink(d1.Join(fs.MustRelPath("c")), "a"), ShouldBeNil)
+		names, err := afs.ReadDirNames(d1)
+		So(err, ShouldBeNil)
+		So(names, ShouldHaveLength, 3)
+		So(names, ShouldContain, "a")
+		So(names, ShouldContain, "b")
+		So(names, ShouldContain, "c")
+
+		Convey("readdirnames on a symlink to a dir should follow it", func() {
+			So(afs.Mklink(fs.MustRelPath("l1"), "d1"), ShouldBeNil)
+			names, err := afs.ReadDirNames(fs.MustRelPath("l1"))
+			So(err, ShouldBeNil)
+			So(names, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func CheckChmodRoundtrip(afs fs.FS) {
+	Convey("SPEC: chmod and lstat should roundtrip", func() {
+		f1 := fs.MustRelPath("f1")
+		So(makeFile(afs, f1, "body"), ShouldBeNil)
+		So(afs.Chmod(f1, 0750), ShouldBeNil)
+		stat, err := afs.LStat(f1)
+		So(err, ShouldBeNil)
+		So(stat.Perms, ShouldEqual, fs.Perms(0750))
+
+		Convey("chmod through a symlink should affect the target", func() {
+			So(afs.Mklink(fs.MustRelPath("l1"), "f1"), ShouldBeNil)
+			So(afs.Chmod(fs.MustRelPath("l1"), 0600), ShouldBeNil)
+			stat, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Perms, ShouldEqual, fs.Perms(0600))
+		})
+	})
+}
+
+func CheckSetTimesRoundtrip(afs fs.FS) {
+	Convey("SPEC: settimes and lstat should roundtrip", func() {
+		f1 := fs.MustRelPath("f1")
+		l1 := fs.MustRelPath("l1")
+		So(makeFile(afs, f1, "body"), ShouldBeNil)
+		So(afs.Mklink(l1, "f1"), ShouldBeNil)
+		t1 := time.Date(2010, 10, 10, 10, 10, 10, 1234, time.UTC)
+		t2 := time.Date(2012, 12, 12, 12, 12, 12, 5678, time.UTC)
+
+		Convey("settimes should follow symlinks", func() {
+			So(afs.SetTimesNano(l1, t1, t1), ShouldBeNil)
+			stat, err := afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, t1)
+		})
+		Convey("settimesl should not follow symlinks", func() {
+			So(afs.SetTimesNano(f1, t1, t1), ShouldBeNil)
+			So(afs.SetTimesLNano(l1, t2, t2), ShouldBeNil)
+			stat, err := afs.LStat(l1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, t2)
+			stat, err = afs.LStat(f1)
+			So(err, ShouldBeNil)
+			So(stat.Mtime.UTC(), ShouldResemble, t1)
+		})
+	})
+}
+
+func CheckFifoRoundtrip(afs fs.FS) {
+	Convey("SPEC: mkfifo and lstat should roundtrip", func() {
+		p1 := fs.MustRelPath("p1")
+		So(afs.Mkfifo(p1, 0640), ShouldBeNil)
+		stat, err := afs.LStat(p1)
+		So(err, ShouldBeNil)
+		So(stat.Type, ShouldEqual, fs.Type_NamedPipe)
+		So(stat.Perms, ShouldEqual, fs.Perms(0640))
+	})
+}
+
+/*
+	Device nodes need privileges on most real filesystems;
+	callers should only run this check when appropriate.
+*/
+func CheckDevicesRoundtrip(afs fs.FS) {
+	Convey("SPEC: mkdev and lstat should roundtrip", func() {
+		c1 := fs.MustRelPath("c1")
+		So(afs.MkdevChar(c1, 1, 3, 0666), ShouldBeNil)
+		stat, err := afs.LStat(c1)
+		So(err, ShouldBeNil)
+		So(stat.Type, ShouldEqual, fs.Type_CharDevice)
+		So(stat.Devmajor, ShouldEqual, 1)
+		So(stat.Devminor, ShouldEqual, 3)
+		So(stat.Perms, ShouldEqual, fs.Perms(0666))
+
+		b1 := fs.MustRelPath("b1")
+		So(afs.MkdevBlock(b1, 7, 300, 0600), ShouldBeNil)
+		stat, err = afs.LStat(b1)
+		So(err, ShouldBeNil)
+		So(stat.Type, ShouldEqual, fs.Type_Device)
+		So(stat.Devmajor, ShouldEqual, 7)
+		So(stat.Devminor, ShouldEqual, 300)
+	})
+}
+
+/*
+	Chown needs privileges on most real filesystems;
+	callers should only run this check when appropriate.
+*/
+func CheckLchownRoundtrip(afs fs.FS) {
+	Convey("SPEC: lchown and lstat should roundtrip", func() {
+		f1 := fs.MustRelPath("f1")
+		l1 := fs.MustRelPath("l1")
+		So(makeFile(afs, f1, "body"), ShouldBeNil)
+		So(afs.Mklink(l1, "f1"), ShouldBeNil)
+		So(afs.Lchown(f1, 4000, 5000), ShouldBeNil)
+		So(afs.Lchown(l1, 4001, 5001), ShouldBeNil)
+		stat, err := afs.LStat(f1)
+		So(err, ShouldBeNil)
+		So(stat.Uid, ShouldEqual, 4000)
+		So(stat.Gid, ShouldEqual, 5000)
+		stat, err = afs.LStat(l1)
+		So(err, ShouldBeNil)
+		So(stat.Uid, ShouldEqual, 4001)
+		So(stat.Gid, ShouldEqual, 5001)
+	})
+}
+
+func CheckBreakoutPaths(afs fs.FS) {
+	Convey("SPEC: paths departing the basepath should error", func() {
+		up := fs.MustRelPath("../d1")
+		So(afs.Mkdir(up, 0755), errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+		_, err := afs.LStat(up)
+		So(err, errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+		_, err = afs.OpenFile(up, os.O_CREATE|os.O_WRONLY, 0644)
+		So(err, errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+		_, err = afs.ResolveLink("./target", up)
+		So(err, errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+	})
+}
+
 func makeFile(afs fs.FS, path fs.RelPath, body string) error {
 	f, err := afs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -253,3 +470,16 @@ func makeFile(afs fs.FS, path fs.RelPath, body string) error {
 	_, err = f.Write([]byte(body))
 	return err
 }
+
+func readFile(afs fs.FS, path fs.RelPath) string {
+	f, err := afs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err.Error()
+	}
+	return string(bs)
+}
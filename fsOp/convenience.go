@@ -6,8 +6,6 @@ Sniperkit-Bot
 package fsOp
 
 import (
-	"os"
-
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/rio/fs"
 )
@@ -148,8 +146,6 @@ func RepairMtime(afs fs.FS, path fs.RelPath) func() {
 	a dir in this path (aka, target an unpack here) when this function returns).
 */
 func RemoveDirContent(afs fs.FS, path fs.RelPath) error {
-	// Lazy implementation... assumes osfs, and slinks back out to stdlib, because
-	// it so happens all of our real usage is fine with that.
 	children, err := afs.ReadDirNames(path)
 	switch Category(err) {
 	case nil:
@@ -160,10 +156,48 @@ func RemoveDirContent(afs fs.FS, path fs.RelPath) error {
 		return err
 	}
 	for _, child := range children {
-		err := os.RemoveAll(afs.BasePath().Join(path).String() + "/" + child)
-		if err != nil {
-			return fs.NormalizeIOError(err)
+		if err := removeAll(afs, path.Join(fs.MustRelPath(child))); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+/*
+	Remove a path and everything under it (if it exists; if not, no-op).
+	Symlinks are removed, not followed.
+
+	Like PlaceFile, this refuses with a BreakoutError if any of the path's
+	parents is a symlink, since removing through one could reach outside
+	the filesystem's base path.
+*/
+func RemoveAll(afs fs.FS, path fs.RelPath) error {
+	if err := requireNoSymlinks(afs, path, path.Dir()); err != nil {
+		return err
+	}
+	return removeAll(afs, path)
+}
+
+func removeAll(afs fs.FS, path fs.RelPath) error {
+	fmeta, err := afs.LStat(path)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return nil // great
+	default:
+		return err
+	}
+	if fmeta.Type == fs.Type_Dir {
+		children, err := afs.ReadDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := removeAll(afs, path.Join(fs.MustRelPath(child))); err != nil {
+				return err
+			}
+		}
+	}
+	return afs.Remove(path)
+}
@@ -161,6 +161,53 @@ func TestMkdirUsable(t *testing.T) {
 	)
 }
 
+func TestRemoveAll(t *testing.T) {
+	// Note that all of these are assuming PlaceFile already works just fine.
+	Convey("RemoveAll:", t, func() {
+		WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			afs := osfs.New(tmpDir.Join(fs.MustRelPath("base")))
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("dir"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("dir/a"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("dir/a/file"), Type: fs.Type_File, Perms: 0644}, nil)
+			outside := osfs.New(tmpDir)
+			mustPlaceFile(outside, fs.Metadata{Name: fs.MustRelPath("outside"), Type: fs.Type_Dir, Perms: 0755}, nil)
+			mustPlaceFile(outside, fs.Metadata{Name: fs.MustRelPath("outside/file"), Type: fs.Type_File, Perms: 0644}, nil)
+
+			Convey("RemoveAll on a tree should remove all of it...", func() {
+				So(RemoveAll(afs, fs.MustRelPath("dir")), ShouldBeNil)
+				_, err := afs.LStat(fs.MustRelPath("dir"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+			})
+			Convey("RemoveAll on a path that doesn't exist should be a no-op...", func() {
+				So(RemoveAll(afs, fs.MustRelPath("nope")), ShouldBeNil)
+			})
+			Convey("RemoveAll on a symlink should remove the link, not its target...", func() {
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("lnk"), Type: fs.Type_Symlink, Linkname: "../outside"}, nil)
+
+				So(RemoveAll(afs, fs.MustRelPath("lnk")), ShouldBeNil)
+				_, err := afs.LStat(fs.MustRelPath("lnk"))
+				So(err, errcat.ErrorShouldHaveCategory, fs.ErrNotExists)
+				_, err = outside.LStat(fs.MustRelPath("outside/file"))
+				So(err, ShouldBeNil)
+			})
+			Convey("RemoveAll through a symlink should error...", func() {
+				mustPlaceFile(afs, fs.Metadata{Name: fs.MustRelPath("lnk"), Type: fs.Type_Symlink, Linkname: "../outside"}, nil)
+
+				So(RemoveAll(afs, fs.MustRelPath("lnk/file")), errcat.ErrorShouldHaveCategory, fs.ErrBreakout)
+				_, err := outside.LStat(fs.MustRelPath("outside/file"))
+				So(err, ShouldBeNil)
+			})
+			Convey("RemoveDirContent should remove everything but the dir...", func() {
+				So(RemoveDirContent(afs, fs.MustRelPath("dir")), ShouldBeNil)
+				names, err := afs.ReadDirNames(fs.MustRelPath("dir"))
+				So(err, ShouldBeNil)
+				So(names, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
 func mustPlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader) {
 	if fmeta.Type == fs.Type_File && body == nil {
 		body = &bytes.Buffer{}
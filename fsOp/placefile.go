@@ -33,6 +33,8 @@ import (
 	Please note that like all filesystem operations within a lightyear of
 	symlinks, all validations are best-effort, but are only capable of
 	correctness in the absense of concurrent modifications inside `destBasePath`.
+	(Unless the filesystem enforces confinement itself: see `osfs.NewConfined`,
+	which makes the kernel reject any symlink that appears after we've checked.)
 
 	Device files *will* be created, with their maj/min numbers.
 	This may be considered a security concern; you should whitelist inputs
@@ -49,25 +51,8 @@ import (
 */
 func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) error {
 	// First, no part of the path may be a symlink.
-	for path := fmeta.Name; ; path = path.Dir() {
-		if path == (fs.RelPath{}) {
-			break // success
-		}
-		target, isSymlink, err := afs.Readlink(path)
-		if isSymlink {
-			return fs.NewBreakoutError(
-				afs.BasePath(),
-				fmeta.Name,
-				path,
-				target,
-			)
-		} else if err == nil {
-			continue // regular paths are fine.
-		} else if Category(err) == fs.ErrNotExists {
-			continue // not existing is fine.
-		} else {
-			return err // any other unknown error means we lack perms or something: reject.
-		}
+	if err := requireNoSymlinks(afs, fmeta.Name, fmeta.Name); err != nil {
+		return err
 	}
 
 	// Fill in the content.  (Attribs come later.)
@@ -168,3 +153,30 @@ func PlaceFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) err
 	// Success!
 	return nil
 }
+
+/*
+	Returns a BreakoutError if `path` or any of its parents is a symlink.
+	`name` is the path being placed, for the error message.
+*/
+func requireNoSymlinks(afs fs.FS, name fs.RelPath, path fs.RelPath) error {
+	for ; ; path = path.Dir() {
+		if path == (fs.RelPath{}) {
+			return nil // success
+		}
+		target, isSymlink, err := afs.Readlink(path)
+		if isSymlink {
+			return fs.NewBreakoutError(
+				afs.BasePath(),
+				name,
+				path,
+				target,
+			)
+		} else if err == nil {
+			continue // regular paths are fine.
+		} else if Category(err) == fs.ErrNotExists {
+			continue // not existing is fine.
+		} else {
+			return err // any other unknown error means we lack perms or something: reject.
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fsOp
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Like PlaceFile, but the path may already exist: only what differs from
+	the metadata (and body) is changed, the way rsync would.
+
+	An existing entry of the same type (and, for symlinks and devices, the
+	same target or numbers) is kept, and only chmod'd, chown'd, and retimed
+	as needed.  An existing file of the same size has its content compared
+	as the body is read, and is only rewritten if they differ.  Anything else
+	in the way is removed (recursively, if it's a dir), and the entry placed
+	as by PlaceFile.
+
+	The body is always read to the end, so a hashing reader sees all of it.
+
+	The same rules about symlinks apply as for PlaceFile, with the one
+	exception that the entry itself may be an existing symlink: it'll be
+	replaced (never traversed) if it's not the symlink we want.
+*/
+func SyncFile(afs fs.FS, fmeta fs.Metadata, body io.Reader, skipChown bool) error {
+	// No parent may be a symlink.  (The entry itself is checked below.)
+	if fmeta.Name != (fs.RelPath{}) {
+		if err := requireNoSymlinks(afs, fmeta.Name, fmeta.Name.Dir()); err != nil {
+			return err
+		}
+	}
+
+	// Look at what's there now.  If nothing, this is just a placement.
+	existing, err := afs.LStat(fmeta.Name)
+	switch Category(err) {
+	case nil:
+		// pass
+	case fs.ErrNotExists:
+		return PlaceFile(afs, fmeta, body, skipChown)
+	default:
+		return err
+	}
+
+	// If it's the wrong kind of thing, replace it outright.
+	if !sameKind(*existing, fmeta) || (fmeta.Type == fs.Type_File && existing.Size != fmeta.Size) {
+		if err := RemoveAll(afs, fmeta.Name); err != nil {
+			return err
+		}
+		return PlaceFile(afs, fmeta, body, skipChown)
+	}
+
+	// Files of the right size: compare content, and rewrite from the first difference.
+	if fmeta.Type == fs.Type_File {
+		if err := syncContent(afs, fmeta, body); err != nil {
+			return err
+		}
+		if existing, err = afs.LStat(fmeta.Name); err != nil {
+			return err
+		}
+	}
+
+	// Fix up whatever attributes differ.
+	//  Same order as PlaceFile: perms, ownership (which may clear setuid and setgid), then times.
+	if fmeta.Type != fs.Type_Symlink && existing.Perms != fmeta.Perms {
+		if err := afs.Chmod(fmeta.Name, fmeta.Perms); err != nil {
+			return err
+		}
+	}
+	if !skipChown && (existing.Uid != fmeta.Uid || existing.Gid != fmeta.Gid) {
+		if err := afs.Lchown(fmeta.Name, fmeta.Uid, fmeta.Gid); err != nil {
+			return err
+		}
+		if fmeta.Perms&(fs.Perms_Setuid|fs.Perms_Setgid) != 0 {
+			if err := afs.Chmod(fmeta.Name, fmeta.Perms); err != nil {
+				return err
+			}
+		}
+	}
+	if !existing.Mtime.Equal(fmeta.Mtime) {
+		switch fmeta.Type {
+		case fs.Type_Symlink:
+			if err := afs.SetTimesLNano(fmeta.Name, fmeta.Mtime, fs.DefaultAtime); err != nil {
+				return err
+			}
+		default:
+			if err := afs.SetTimesNano(fmeta.Name, fmeta.Mtime, fs.DefaultAtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+	True if the existing entry can be kept (modulo attributes) in place of the wanted one.
+*/
+func sameKind(existing, want fs.Metadata) bool {
+	if existing.Type != want.Type {
+		return false
+	}
+	switch want.Type {
+	case fs.Type_Symlink:
+		return existing.Linkname == want.Linkname
+	case fs.Type_Device, fs.Type_CharDevice:
+		return existing.Devmajor == want.Devmajor && existing.Devminor == want.Devminor
+	default:
+		return true
+	}
+}
+
+/*
+	Compares the existing file's content to the body as it's read.
+	If they differ, the file is replaced by a new one, which reuses the
+	matching prefix from the old one and takes the rest from the body.
+	(A new file, rather than writing in place, so that anything hardlinked
+	to the old one is left alone.)
+*/
+func syncContent(afs fs.FS, fmeta fs.Metadata, body io.Reader) error {
+	existing, err := afs.OpenFile(fmeta.Name, os.O_RDONLY, 0)
+	if err != nil {
+		// If we can't read it, we can't keep it.
+		if err := RemoveAll(afs, fmeta.Name); err != nil {
+			return err
+		}
+		return PlaceFile(afs, fmeta, body, true)
+	}
+	defer existing.Close()
+	bodyBuf := make([]byte, 32*1024)
+	fileBuf := make([]byte, len(bodyBuf))
+	var offset int64
+	for {
+		n, err := io.ReadFull(body, bodyBuf)
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF:
+			// pass
+		default:
+			return fs.NormalizeIOError(err)
+		}
+		m, _ := io.ReadFull(existing, fileBuf[:n])
+		if m != n || !bytes.Equal(bodyBuf[:n], fileBuf[:n]) {
+			rest := io.MultiReader(bytes.NewReader(bodyBuf[:n]), body)
+			return replaceContent(afs, fmeta, io.NewSectionReader(existing, 0, offset), rest)
+		}
+		if err != nil {
+			return nil // all the same, all the way to the end.
+		}
+		offset += int64(n)
+	}
+}
+
+func replaceContent(afs fs.FS, fmeta fs.Metadata, prefix io.Reader, rest io.Reader) error {
+	// The old file stays readable through its open handle after unlinking.
+	if err := RemoveAll(afs, fmeta.Name); err != nil {
+		return err
+	}
+	file, err := afs.OpenFile(fmeta.Name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fmeta.Perms)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, prefix); err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	if _, err := io.Copy(file, rest); err != nil {
+		return fs.NormalizeIOError(err)
+	}
+	return nil
+}
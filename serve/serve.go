@@ -0,0 +1,307 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Serves a local content-addressable warehouse ("ca+file") over HTTP,
+	in the layout the http warehouse ("ca+http") reads, so other hosts can
+	fetch from it with no more infrastructure than `rio serve`.
+
+	Wares are at "/<chunkA>/<chunkB>/<hash>" (and sidecars, like signatures,
+	beside them at "/<chunkA>/<chunkB>/<hash><suffix>").  Uploads are PUTs
+	to the same paths, if enabled; each is checked by hashing it as it's
+	received, and only committed if it's the ware it claims to be.
+	There's also "/_list" (every ware, as JSON) and "/_health".
+*/
+package serve
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	"go.polydawn.net/rio/warehouse/util"
+)
+
+type Server struct {
+	addr     api.WarehouseAddr
+	basePath string
+	whCtrl   warehouse.BlobstoreController
+	sidecars warehouse.SidecarController
+	putToken string // uploads are refused if empty.
+}
+
+var _ http.Handler = &Server{}
+
+/*
+	Makes a server for the given warehouse, which must be "ca+file".
+	If putToken is set, uploads are accepted from requests bearing it
+	(as "Authorization: Bearer <token>"); otherwise the server is readonly.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+	  - `rio.ErrWarehouseUnavailable` -- if the warehouse doesn't exist
+*/
+func New(addr api.WarehouseAddr, putToken string) (*Server, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if u.Scheme != "ca+file" {
+		return nil, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (only 'ca+file' warehouses can be served)", u.Scheme)
+	}
+	basePath, err := filepath.Abs(filepath.Join(u.Host, u.Path))
+	if err != nil {
+		panic(err)
+	}
+	whCtrl, err := kvfs.NewController(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		addr:     addr,
+		basePath: basePath,
+		whCtrl:   whCtrl,
+		sidecars: whCtrl.(warehouse.SidecarController),
+		putToken: putToken,
+	}, nil
+}
+
+/*
+	Serves on the listener until ctx is done (then returns nil, once
+	requests in flight finish), or serving fails.
+*/
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	hs := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		hs.Shutdown(context.Background())
+	}()
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		return Errorf(rio.ErrInoperablePath, "cannot serve: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/_health":
+		s.serveHealth(w, r)
+		return
+	case "/_list":
+		s.serveList(w, r)
+		return
+	}
+	hash, suffix, ok := parseWarePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	wareID := api.WareID{tartrans.PackType, hash}
+	switch r.Method {
+	case "GET", "HEAD":
+		s.serveWare(w, r, wareID, suffix)
+	case "PUT":
+		if suffix != "" {
+			http.Error(w, "only wares can be uploaded, not sidecars", http.StatusMethodNotAllowed)
+			return
+		}
+		s.acceptWare(w, r, wareID)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	Parses "/<chunkA>/<chunkB>/<hash><suffix>", checking the chunks are
+	the right ones for the hash (so there's exactly one path for each ware).
+*/
+func parseWarePath(pth string) (hash, suffix string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(pth, "/"), "/")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	hash = parts[2]
+	if i := strings.IndexByte(hash, '.'); i >= 0 {
+		hash, suffix = hash[:i], hash[i:]
+		if len(suffix) < 2 {
+			return "", "", false
+		}
+	}
+	if hash == "" || strings.IndexFunc(hash, isNotHashRune) >= 0 || strings.IndexFunc(suffix[min(1, len(suffix)):], isNotHashRune) >= 0 {
+		return "", "", false
+	}
+	chunkA, chunkB, _ := util.ChunkifyHash(api.WareID{tartrans.PackType, hash})
+	if parts[0] != chunkA || parts[1] != chunkB {
+		return "", "", false
+	}
+	return hash, suffix, true
+}
+
+// Hashes are base58, maybe with an algorithm tag ("sha256-..."); suffixes are as plain.
+func isNotHashRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-')
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (s *Server) serveWare(w http.ResponseWriter, r *http.Request, wareID api.WareID, suffix string) {
+	var reader io.ReadCloser
+	var err error
+	if suffix == "" {
+		reader, err = s.whCtrl.OpenReader(wareID)
+	} else {
+		reader, err = s.sidecars.OpenSidecarReader(wareID, suffix)
+	}
+	switch Category(err) {
+	case nil:
+		// pass
+	case rio.ErrWareNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	// Files can seek, which gets us ranges and a Content-Length.
+	if rs, ok := reader.(io.ReadSeeker); ok {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method != "HEAD" {
+		io.Copy(w, reader)
+	}
+}
+
+/*
+	Accepts an upload: hashes it as it's written to temp space in the
+	warehouse, and only commits it if it's the ware named by the path.
+*/
+func (s *Server) acceptWare(w http.ResponseWriter, r *http.Request, wareID api.WareID) {
+	if s.putToken == "" {
+		http.Error(w, "uploads are not enabled on this server", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.putToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "uploads require a valid token", http.StatusUnauthorized)
+		return
+	}
+
+	// Wares are immutable; if we have it already, there's nothing to do.
+	if reader, err := s.whCtrl.OpenReader(wareID); err == nil {
+		reader.Close()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	wc, err := s.whCtrl.OpenWriter()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := io.TeeReader(r.Body, wc)
+	err = tartrans.VerifyStream(r.Context(), wareID, body, rio.Monitor{})
+	if err == nil {
+		// The tar may be followed by padding; keep that too, so the blob is exactly what was sent.
+		_, err = io.Copy(ioutil.Discard, body)
+	}
+	if err != nil {
+		wc.Close()
+		switch Category(err) {
+		case rio.ErrWareHashMismatch, rio.ErrWareCorrupt:
+			http.Error(w, fmt.Sprintf("upload rejected: %s", err), http.StatusUnprocessableEntity)
+		case rio.ErrUsage:
+			http.Error(w, fmt.Sprintf("upload rejected: %s", err), http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("upload failed: %s", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := wc.Commit(wareID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// One ware, as listed by "/_list".
+type ListEntry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+/*
+	Lists every ware in the warehouse, sorted by hash.
+	(Sidecars and uploads in progress aren't listed.)
+*/
+func (s *Server) serveList(w http.ResponseWriter, r *http.Request) {
+	list := []ListEntry{}
+	matches, err := filepath.Glob(filepath.Join(s.basePath, "*", "*", "*"))
+	if err != nil {
+		panic(err) // only for malformed patterns.
+	}
+	for _, match := range matches {
+		hash, _, ok := parseWarePath(strings.TrimPrefix(match, s.basePath))
+		if !ok || strings.Contains(filepath.Base(match), ".") {
+			continue
+		}
+		fi, err := os.Stat(match)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		list = append(list, ListEntry{hash, fi.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hash < list[j].Hash })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// What "/_health" reports.
+type Health struct {
+	OK      bool   `json:"ok"`
+	Uploads bool   `json:"uploads"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := Health{OK: true, Uploads: s.putToken != ""}
+	if fi, err := os.Stat(s.basePath); err != nil {
+		h.OK, h.Error = false, err.Error()
+	} else if !fi.IsDir() {
+		h.OK, h.Error = false, fmt.Sprintf("%s is not a dir", s.basePath)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !h.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
@@ -0,0 +1,177 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package serve_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/serve"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+)
+
+func TestServe(t *testing.T) {
+	withBaseWareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+	withBasePath := "/5y6/NvK/" + withBaseWareID.Hash
+	fixture, err := ioutil.ReadFile("../transmat/tar/fixtures/tar_withBase.tgz")
+	if err != nil {
+		panic(err)
+	}
+
+	Convey("Serving a warehouse over HTTP", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755)
+			whPath := tmpDir.String() + "/wh"
+			withServer := func(putToken string, fn func(url string)) {
+				server, err := serve.New(api.WarehouseAddr("ca+file://"+whPath), putToken)
+				So(err, ShouldBeNil)
+				srv := httptest.NewServer(server)
+				defer srv.Close()
+				fn(srv.URL)
+			}
+			do := func(method, url, token string, body []byte) (int, string) {
+				req, err := http.NewRequest(method, url, bytes.NewReader(body))
+				So(err, ShouldBeNil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+				bs, _ := ioutil.ReadAll(resp.Body)
+				return resp.StatusCode, string(bs)
+			}
+
+			Convey("only ca+file warehouses can be served", func() {
+				_, err := serve.New(api.WarehouseAddr("file://"+whPath), "")
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+			})
+
+			Convey("uploads are refused if no token is configured", func() {
+				withServer("", func(url string) {
+					code, _ := do("PUT", url+withBasePath, "hunter2", fixture)
+					So(code, ShouldEqual, http.StatusMethodNotAllowed)
+				})
+			})
+
+			withServer("hunter2", func(url string) {
+				Convey("uploads without the token are refused", func() {
+					code, _ := do("PUT", url+withBasePath, "", fixture)
+					So(code, ShouldEqual, http.StatusUnauthorized)
+					code, _ = do("PUT", url+withBasePath, "hunter3", fixture)
+					So(code, ShouldEqual, http.StatusUnauthorized)
+				})
+				Convey("uploads that aren't the ware they claim to be are refused, and not kept", func() {
+					otherHash := "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhY"
+					code, body := do("PUT", url+"/5y6/NvK/"+otherHash, "hunter2", fixture)
+					So(code, ShouldEqual, http.StatusUnprocessableEntity)
+					So(body, ShouldContainSubstring, "upload rejected")
+					code, _ = do("GET", url+"/5y6/NvK/"+otherHash, "", nil)
+					So(code, ShouldEqual, http.StatusNotFound)
+					code, _ = do("PUT", url+withBasePath, "hunter2", []byte("not a tar at all"))
+					So(code, ShouldEqual, http.StatusUnprocessableEntity)
+					entries, err := ioutil.ReadDir(whPath)
+					So(err, ShouldBeNil)
+					So(entries, ShouldBeEmpty)
+				})
+				Convey("uploads that check out are kept, and served back", func() {
+					code, _ := do("PUT", url+withBasePath, "hunter2", fixture)
+					So(code, ShouldEqual, http.StatusCreated)
+					code, body := do("GET", url+withBasePath, "", nil)
+					So(code, ShouldEqual, http.StatusOK)
+					So(body, ShouldEqual, string(fixture))
+
+					Convey("uploading it again is fine", func() {
+						code, _ := do("PUT", url+withBasePath, "hunter2", fixture)
+						So(code, ShouldEqual, http.StatusOK)
+					})
+					Convey("and it's listed", func() {
+						code, body := do("GET", url+"/_list", "", nil)
+						So(code, ShouldEqual, http.StatusOK)
+						var list []serve.ListEntry
+						So(json.Unmarshal([]byte(body), &list), ShouldBeNil)
+						So(list, ShouldResemble, []serve.ListEntry{{withBaseWareID.Hash, int64(len(fixture))}})
+					})
+					Convey("and rio can read it as a ca+http warehouse", func() {
+						whCtrl, err := kvhttp.NewController(api.WarehouseAddr("ca+" + url))
+						So(err, ShouldBeNil)
+						reader, err := whCtrl.OpenReader(withBaseWareID)
+						So(err, ShouldBeNil)
+						defer reader.Close()
+						So(tartrans.VerifyStream(context.Background(), withBaseWareID, reader, rio.Monitor{}), ShouldBeNil)
+					})
+				})
+				Convey("paths that aren't in the CA layout aren't found", func() {
+					So(ioutil.WriteFile(filepath.Join(whPath, "secret"), []byte("!"), 0644), ShouldBeNil)
+					for _, pth := range []string{
+						"/secret",
+						"/5y6/NvK/../../secret",
+						"/abc/def/" + withBaseWareID.Hash,
+						"/5y6/NvK/" + withBaseWareID.Hash + "/more",
+					} {
+						code, _ := do("GET", url+pth, "", nil)
+						So(code, ShouldEqual, http.StatusNotFound)
+					}
+				})
+				Convey("the listing starts empty", func() {
+					code, body := do("GET", url+"/_list", "", nil)
+					So(code, ShouldEqual, http.StatusOK)
+					So(body, ShouldEqual, "[]\n")
+				})
+				Convey("health is reported", func() {
+					code, body := do("GET", url+"/_health", "", nil)
+					So(code, ShouldEqual, http.StatusOK)
+					So(body, ShouldEqual, `{"ok":true,"uploads":true}`+"\n")
+
+					So(os.RemoveAll(whPath), ShouldBeNil)
+					code, _ = do("GET", url+"/_health", "", nil)
+					So(code, ShouldEqual, http.StatusServiceUnavailable)
+				})
+			})
+		})
+	})
+
+	Convey("Spec compliance: packing to and unpacking from rio serve", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755)
+				server, err := serve.New(api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir)), "hunter2")
+				So(err, ShouldBeNil)
+				srv := httptest.NewServer(server)
+				defer srv.Close()
+				addr := api.WarehouseAddr("ca+" + srv.URL)
+
+				cfgPath := tmpDir.String() + "/config.json"
+				So(ioutil.WriteFile(cfgPath, []byte(fmt.Sprintf(
+					`{"warehouses": {"test": {"addr": %q, "auth": {"token": "hunter2"}}}}`, addr,
+				)), 0644), ShouldBeNil)
+				defer os.Setenv("RIO_CONFIG", os.Getenv("RIO_CONFIG"))
+				os.Setenv("RIO_CONFIG", cfgPath)
+				defer os.Setenv("RIO_SYSTEM_CONFIG", os.Getenv("RIO_SYSTEM_CONFIG"))
+				os.Setenv("RIO_SYSTEM_CONFIG", tmpDir.String()+"/none")
+
+				tests.CheckRoundTrip(tartrans.PackType, tartrans.Pack, tartrans.Unpack, addr)
+			})
+		}),
+	)
+}
@@ -6,12 +6,14 @@ Sniperkit-Bot
 package placer
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os/exec"
 	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/caps"
 	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/fs"
 )
@@ -22,28 +24,34 @@ import (
 	The placer used to handle "mount"-mode placements may vary drastically, however.
 */
 
+/*
+	The mounting placers, in order of preference, by the filesystem each needs.
+*/
+var mountPlacers = []struct {
+	fs  string
+	new func(workDir fs.AbsolutePath) (Placer, error)
+}{
+	{"overlay", NewOverlayPlacer},
+	{"aufs", NewAufsPlacer},
+}
+
 /*
 	Returns the most reasonable mounting placer implementation available on this platform.
 
-	In order, the attempted systems are: overlayfs, aufs.
+	In order, the attempted systems are: overlayfs, aufs (see mountPlacers).
 	(Bind mounts are not considered a valid substitution by default, because their
 	behavior on "writable=true" is very different.)
-
-	If the environment var RIO_MOUNT_PLACER is set, we'll either return that or
-	an error explaing why it's not available;
-	otherwise, autodetection will examine what filesystem drivers and capabilities
-	are available, and try to pick the most performant/reliable/sensible thing available.
+	Autodetection examines what filesystem drivers are available,
+	and picks the first of those.
 
 	For placers that need a working dir, one will be created under RIO_MOUNT_WORKDIR
 	if set,	or RIO_BASE/wrk.
 */
 func GetMountPlacer() (Placer, error) {
-	// TODO the switch for explicit RIO_MOUNT_PLACER
-	if isFSAvailable("overlay") {
-		return NewOverlayPlacer(config.GetMountWorkPath().Join(fs.MustRelPath("overlay")))
-	}
-	if isFSAvailable("aufs") {
-		return NewAufsPlacer(config.GetMountWorkPath().Join(fs.MustRelPath("aufs")))
+	for _, mp := range mountPlacers {
+		if isFSAvailable(mp.fs) {
+			return mp.new(config.GetMountWorkPath().Join(fs.MustRelPath(mp.fs)))
+		}
 	}
 	return nil, Errorf(rio.ErrAssemblyInvalid, "placer: no power (cannot find usable mount placer)")
 }
@@ -57,6 +65,13 @@ func GetMountPlacer() (Placer, error) {
 	pretty likely being what the user wants, so we consider it sensible to do that load ourselves.
 */
 func isFSAvailable(fs string) bool {
+	return checkFSAvailable(fs) == nil
+}
+
+/*
+	As isFSAvailable, but returns an error explaining why not, if not.
+*/
+func checkFSAvailable(fs string) error {
 	// Arguably the greatest thing to do would of course just be to issue the syscall once and see if it flies...
 	// but that's a distrubingly stateful and messy operation so we're gonna check a bunch of next-best-things instead.
 
@@ -70,7 +85,7 @@ func isFSAvailable(fs string) bool {
 				continue
 			}
 			if parts[1] == fs {
-				return true
+				return nil
 			}
 		}
 	}
@@ -83,8 +98,53 @@ func isFSAvailable(fs string) bool {
 	if err := exec.Command(
 		"modprobe", fs,
 	).Run(); err != nil {
-		return false
+		return fmt.Errorf("%s is not in /proc/filesystems, and loading the module failed (modprobe: %s)", fs, err)
 	}
 
-	return true
+	return nil
+}
+
+/*
+	Whether one placer can be used here, and if not, why not.
+*/
+type Availability struct {
+	Placer    string `json:"placer"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"` // Why not, if not; or a caveat.
+	Selected  bool   `json:"selected,omitempty"`
+}
+
+/*
+	Reports on every placer: copy and bind, and each that GetMountPlacer
+	considers, in the order it considers them.  The mount placer that
+	GetMountPlacer would pick is marked as Selected.
+
+	GetMountPlacer only checks the kernel supports the filesystem;
+	if we don't have the caps to mount, that's given as the Reason
+	(mounting would fail later, at placement time).
+*/
+func ExplainPlacers(fulcrum *caps.Fulcrum) []Availability {
+	avails := []Availability{
+		{Placer: "copy", Available: true},
+		{Placer: "bind", Available: fulcrum.CanMountBind()},
+	}
+	if !avails[1].Available {
+		avails[1].Reason = "lacking caps for bind mounts (CAP_SYS_ADMIN)"
+	}
+	selected := false
+	for _, mp := range mountPlacers {
+		avail := Availability{Placer: mp.fs}
+		if err := checkFSAvailable(mp.fs); err != nil {
+			avail.Reason = err.Error()
+		} else {
+			avail.Available = true
+			avail.Selected = !selected
+			selected = true
+			if !fulcrum.CanMountAny() {
+				avail.Reason = "lacking caps for mounts (CAP_SYS_ADMIN); placement will fail"
+			}
+		}
+		avails = append(avails, avail)
+	}
+	return avails
 }
@@ -31,6 +31,11 @@ var RequiresLongRun = ConveyRequirement{"run long tests", func() bool { return !
 */
 var RequiresCanManageOwnership = ConveyRequirement{"have caps for managing file ownership", caps.Scan().CanManageOwnership}
 
+/*
+	Require that the test process is running with enough capabilities to be able to make device nodes.
+*/
+var RequiresCanMakeDevices = ConveyRequirement{"have caps for making device nodes", caps.Scan().CanMakeDevices}
+
 /*
 	Require that the test process is running with enough capabilities to be able to make bind mounts.
 */
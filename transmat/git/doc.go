@@ -7,7 +7,7 @@ Sniperkit-Bot
 	The git transmat can unpack filesystems from the Git version control system.
 
 	The features of this are intentionally limited for rio's purposes:
-	the git transmat is read-only (unpack; no pack);
+	the git transmat can unpack and mirror, but not pack;
 	`rio unpack git` must specify a hash (this should come as no surprise, since
 	it's the rule for all Rio pack types, but it is different than git-checkout.
 	Neither git branches nor tags are acceptable, being indirect and mutable);
@@ -21,6 +21,16 @@ Sniperkit-Bot
 	nor is it valid to store a single commit in git without a branch or tag name,
 	and therefore the `api.PackFunc` signiture is almost totally incongruent.
 	Git is designed for version control; not object storage.  This is okay.
+
+	An "archive mode" unpack (see UnpackOptions) produces the same tree
+	`git archive` would, honoring the export-ignore and export-subst
+	attributes from `.gitattributes`.  Since that tree isn't the commit,
+	the resulting WareID is the hash of the filtered fileset, not the commit.
+
+	Mirroring copies a commit from one git repository to another, pushing it
+	under a `refs/rio/<hash>` ref in the target so that it won't be
+	garbage collected.  That ref gives the commit the name git insists on,
+	and unlike packing, there's no question of what the hash will be.
 */
 package git
 
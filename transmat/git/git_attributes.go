@@ -0,0 +1,262 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const gitattributesFile = ".gitattributes"
+
+const (
+	attr_ExportIgnore = "export-ignore"
+	attr_ExportSubst  = "export-subst"
+)
+
+/*
+	The attributes from all the `.gitattributes` files in a tree,
+	as far as archive mode cares about them.
+
+	Patterns are matched the way git matches them for attributes:
+	a pattern with no slash matches the basename at any depth below the
+	`.gitattributes` file it came from; a pattern with a slash is matched
+	against the whole path relative to that file's directory.
+	A trailing slash limits a pattern to directories.  (Git doesn't ignore
+	such patterns: it checks a directory's attributes as "dir/", which they
+	match; and `git archive` leaves out all of an export-ignored directory.
+	TestArchiveMatchesGitArchive checks we agree with it.)
+	Deeper `.gitattributes` files take precedence over shallower ones,
+	and later lines over earlier ones.
+
+	Macros and the `**` wildcard are not supported.
+*/
+type gitAttributes struct {
+	rules []attrRule // in order of increasing precedence.
+}
+
+type attrRule struct {
+	dir      string // dir of the `.gitattributes` file this came from; "" for the root.
+	pattern  string
+	anchored bool            // if the pattern had a slash in it.
+	dirOnly  bool            // if the pattern had a trailing slash.
+	attrs    map[string]bool // true for set, false for unset or unspecified.
+}
+
+func readGitAttributes(tr *object.Tree) (*gitAttributes, error) {
+	ga := &gitAttributes{}
+	tw := object.NewTreeWalker(tr, true, nil)
+	defer tw.Close()
+	for {
+		name, te, err := tw.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
+		}
+		if path.Base(name) != gitattributesFile || te.Mode == filemode.Dir {
+			continue
+		}
+		tf, err := tr.TreeEntryFile(&te)
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
+		}
+		body, err := tf.Contents()
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "found but could not read %s", name)
+		}
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		ga.rules = append(ga.rules, parseGitAttributes(dir, body)...)
+	}
+	// Shallower files first, so deeper ones override them.
+	//  Stable, so lines within each file keep their order.
+	sort.SliceStable(ga.rules, func(i, j int) bool {
+		return depth(ga.rules[i].dir) < depth(ga.rules[j].dir)
+	})
+	return ga, nil
+}
+
+func parseGitAttributes(dir string, body string) (rules []attrRule) {
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule := attrRule{dir: dir, pattern: fields[0], attrs: map[string]bool{}}
+		if strings.HasSuffix(rule.pattern, "/") {
+			rule.dirOnly = true
+			rule.pattern = strings.TrimSuffix(rule.pattern, "/")
+		}
+		if strings.Contains(rule.pattern, "/") {
+			rule.anchored = true
+			rule.pattern = strings.TrimPrefix(rule.pattern, "/")
+		}
+		for _, attr := range fields[1:] {
+			switch {
+			case strings.HasPrefix(attr, "-"), strings.HasPrefix(attr, "!"):
+				rule.attrs[attr[1:]] = false
+			default:
+				// "attr=value" forms are truthy for our purposes.
+				rule.attrs[strings.SplitN(attr, "=", 2)[0]] = true
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func depth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+/*
+	Returns true if the attribute is set for the given path.
+*/
+func (ga *gitAttributes) Has(name string, isDir bool, attr string) bool {
+	result := false
+	for _, rule := range ga.rules {
+		val, ok := rule.attrs[attr]
+		if !ok {
+			continue
+		}
+		if rule.matches(name, isDir) {
+			result = val
+		}
+	}
+	return result
+}
+
+func (rule attrRule) matches(name string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	rel := name
+	if rule.dir != "" {
+		if !strings.HasPrefix(name, rule.dir+"/") {
+			return false
+		}
+		rel = name[len(rule.dir)+1:]
+	}
+	if !rule.anchored {
+		rel = path.Base(rel)
+	}
+	matched, _ := path.Match(rule.pattern, rel)
+	return matched
+}
+
+var substPattern = regexp.MustCompile(`\$Format:([^$\n]*)\$`)
+
+/*
+	Expand `$Format:...$` placeholders the way `git archive` does for
+	files with the export-subst attribute.
+
+	Only the commonly used subset of git's pretty formats is supported;
+	ref names (`%d`, `%D`) are always empty, since a commit doesn't know them.
+	Unknown placeholders are left as-is.
+*/
+func expandSubst(body []byte, commit *object.Commit) []byte {
+	return substPattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		format := string(substPattern.FindSubmatch(match)[1])
+		return []byte(expandFormat(format, commit))
+	})
+}
+
+func expandFormat(format string, commit *object.Commit) string {
+	var sb bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			sb.WriteByte(format[i])
+			continue
+		}
+		// Two-letter placeholders first (author and committer details).
+		if i+2 < len(format) && (format[i+1] == 'a' || format[i+1] == 'c') {
+			sig := commit.Author
+			if format[i+1] == 'c' {
+				sig = commit.Committer
+			}
+			if s, ok := expandSignature(format[i+2], sig); ok {
+				sb.WriteString(s)
+				i += 2
+				continue
+			}
+		}
+		switch format[i+1] {
+		case 'H':
+			sb.WriteString(commit.Hash.String())
+		case 'h':
+			sb.WriteString(commit.Hash.String()[:7])
+		case 'T':
+			sb.WriteString(commit.TreeHash.String())
+		case 't':
+			sb.WriteString(commit.TreeHash.String()[:7])
+		case 'P', 'p':
+			parents := make([]string, len(commit.ParentHashes))
+			for j, h := range commit.ParentHashes {
+				parents[j] = h.String()
+				if format[i+1] == 'p' {
+					parents[j] = parents[j][:7]
+				}
+			}
+			sb.WriteString(strings.Join(parents, " "))
+		case 's':
+			sb.WriteString(strings.SplitN(commit.Message, "\n", 2)[0])
+		case 'B':
+			sb.WriteString(commit.Message)
+		case 'd', 'D':
+			// ref names: nothing to say.
+		case 'n':
+			sb.WriteByte('\n')
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteString(format[i : i+2])
+		}
+		i++
+	}
+	return sb.String()
+}
+
+func expandSignature(c byte, sig object.Signature) (string, bool) {
+	when := sig.When
+	switch c {
+	case 'n':
+		return sig.Name, true
+	case 'e':
+		return sig.Email, true
+	case 'd':
+		return when.Format("Mon Jan 2 15:04:05 2006 -0700"), true
+	case 'D':
+		return when.Format(time.RFC1123Z), true
+	case 'i':
+		return when.Format("2006-01-02 15:04:05 -0700"), true
+	case 'I':
+		return when.Format(time.RFC3339), true
+	case 't':
+		return strconv.FormatInt(when.Unix(), 10), true
+	default:
+		return "", false
+	}
+}
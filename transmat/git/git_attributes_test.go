@@ -0,0 +1,181 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+func TestGitAttributes(t *testing.T) {
+	Convey("Given some gitattributes rules", t, func() {
+		ga := &gitAttributes{}
+		ga.rules = append(ga.rules, parseGitAttributes("", `
+# comment lines are ignored
+*.md         export-ignore
+/fixtures    export-ignore
+docs/        export-ignore
+version.go   export-subst
+README.md    -export-ignore
+`)...)
+		ga.rules = append(ga.rules, parseGitAttributes("sub", `
+keep.md      !export-ignore
+/version.go  -export-subst
+`)...)
+		Convey("unanchored patterns match basenames at any depth", func() {
+			So(ga.Has("a.md", false, attr_ExportIgnore), ShouldBeTrue)
+			So(ga.Has("deep/er/a.md", false, attr_ExportIgnore), ShouldBeTrue)
+			So(ga.Has("a.go", false, attr_ExportIgnore), ShouldBeFalse)
+		})
+		Convey("anchored patterns match only from their dir", func() {
+			So(ga.Has("fixtures", true, attr_ExportIgnore), ShouldBeTrue)
+			So(ga.Has("deep/fixtures", true, attr_ExportIgnore), ShouldBeFalse)
+		})
+		Convey("trailing slash patterns only match dirs", func() {
+			So(ga.Has("docs", true, attr_ExportIgnore), ShouldBeTrue)
+			So(ga.Has("docs", false, attr_ExportIgnore), ShouldBeFalse)
+		})
+		Convey("later and deeper rules win", func() {
+			So(ga.Has("README.md", false, attr_ExportIgnore), ShouldBeFalse)
+			So(ga.Has("sub/keep.md", false, attr_ExportIgnore), ShouldBeFalse)
+			So(ga.Has("sub/other.md", false, attr_ExportIgnore), ShouldBeTrue)
+			So(ga.Has("version.go", false, attr_ExportSubst), ShouldBeTrue)
+			So(ga.Has("sub/version.go", false, attr_ExportSubst), ShouldBeFalse)
+			So(ga.Has("sub/deeper/version.go", false, attr_ExportSubst), ShouldBeTrue)
+		})
+	})
+}
+
+func TestArchiveMatchesGitArchive(t *testing.T) {
+	Convey("Archive mode leaves out the same paths `git archive` does", t,
+		testutil.Requires(
+			testutil.RequiresCanManageOwnership,
+			testutil.ConveyRequirement{"git is installed", func() bool { _, err := exec.LookPath("git"); return err == nil }},
+			func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					defer os.Setenv("RIO_CACHE", os.Getenv("RIO_CACHE"))
+					os.Setenv("RIO_CACHE", tmpDir.String()+"/cache")
+					repoPath := tmpDir.String() + "/repo"
+					for name, body := range map[string]string{
+						".gitattributes": "" +
+							"docs/        export-ignore\n" +
+							"/build/      export-ignore\n" +
+							"notes        export-ignore\n" +
+							"*.md         export-ignore\n" +
+							"README.md    -export-ignore\n" +
+							"sub/*.txt    export-ignore\n",
+						"README.md":          "readme",
+						"CHANGES.md":         "changes",
+						"docs/a":             "a",
+						"deep/docs/b":        "b",
+						"docs.txt":           "not a dir",
+						"build/out":          "out",
+						"deep/build/out":     "out",
+						"notes/x":            "x",
+						"deep/notes":         "a file",
+						"sub/a.txt":          "a",
+						"sub/deeper/b.txt":   "b",
+						"sub/.gitattributes": "keep.md -export-ignore\n",
+						"sub/keep.md":        "keep",
+					} {
+						So(os.MkdirAll(filepath.Dir(filepath.Join(repoPath, name)), 0755), ShouldBeNil)
+						So(ioutil.WriteFile(filepath.Join(repoPath, name), []byte(body), 0644), ShouldBeNil)
+					}
+					git := func(args ...string) []byte {
+						cmd := exec.Command("git", append([]string{"-C", repoPath, "-c", "user.name=rio", "-c", "user.email=rio@example.com"}, args...)...)
+						var stderr bytes.Buffer
+						cmd.Stderr = &stderr
+						out, err := cmd.Output()
+						So(stderr.String(), ShouldBeBlank)
+						So(err, ShouldBeNil)
+						return out
+					}
+					git("init", "-q")
+					git("add", "-A")
+					git("commit", "-q", "-m", "fixture")
+					hash := strings.TrimSpace(string(git("rev-parse", "HEAD")))
+
+					var expect []string
+					tr := tar.NewReader(bytes.NewReader(git("archive", "HEAD")))
+					for {
+						hdr, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						So(err, ShouldBeNil)
+						if hdr.Typeflag == tar.TypeXGlobalHeader {
+							continue
+						}
+						expect = append(expect, strings.TrimSuffix(hdr.Name, "/"))
+					}
+					sort.Strings(expect)
+
+					opts := DefaultUnpackOptions
+					opts.Archive = true
+					outPath := tmpDir.String() + "/out"
+					_, err := UnpackWithOptions(opts)(context.Background(), api.WareID{"git", hash}, outPath, api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{api.WarehouseAddr("file://" + repoPath + "/.git")}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					var got []string
+					So(filepath.Walk(outPath, func(pth string, _ os.FileInfo, err error) error {
+						if pth != outPath {
+							got = append(got, pth[len(outPath)+1:])
+						}
+						return err
+					}), ShouldBeNil)
+					sort.Strings(got)
+
+					So(got, ShouldResemble, expect)
+				})
+			},
+		),
+	)
+}
+
+func TestExpandSubst(t *testing.T) {
+	Convey("Given a commit", t, func() {
+		when := time.Date(2017, 10, 18, 12, 30, 00, 0, time.UTC)
+		commit := &object.Commit{
+			Hash:         plumbing.NewHash("86a7bda1e3a9b9ceceb7678aa77710db5c3f2b12"),
+			Author:       object.Signature{Name: "Author", Email: "author@example.net", When: when},
+			Committer:    object.Signature{Name: "Committer", Email: "committer@example.net", When: when},
+			Message:      "subject line\n\nbody text\n",
+			TreeHash:     plumbing.NewHash("f0e549c50372ac71af894309db05a63695e460a3"),
+			ParentHashes: []plumbing.Hash{plumbing.NewHash("b64afb86af7150438beb62ac1b832e8a3ba831b9")},
+		}
+		Convey("placeholders are expanded", func() {
+			So(string(expandSubst([]byte(`v = "$Format:%H$"`), commit)), ShouldEqual,
+				`v = "86a7bda1e3a9b9ceceb7678aa77710db5c3f2b12"`)
+			So(string(expandSubst([]byte(`$Format:%h %p %s$`), commit)), ShouldEqual,
+				`86a7bda b64afb8 subject line`)
+			So(string(expandSubst([]byte(`$Format:%an <%ae> %ct$`), commit)), ShouldEqual,
+				`Author <author@example.net> 1508329800`)
+			So(string(expandSubst([]byte(`$Format:%ci%n%%$`), commit)), ShouldEqual,
+				"2017-10-18 12:30:00 +0000\n%")
+		})
+		Convey("unknown placeholders and unformatted text are left alone", func() {
+			So(string(expandSubst([]byte(`$Format:%Q$ and $NotFormat$`), commit)), ShouldEqual,
+				`%Q and $NotFormat$`)
+		})
+	})
+}
@@ -0,0 +1,130 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"context"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	gitWarehouse "go.polydawn.net/rio/warehouse/impl/git"
+)
+
+var (
+	_ rio.MirrorFunc = Mirror
+)
+
+/*
+	Mirror a commit into another git repository.
+
+	The commit is fetched into the object cache, along with the commits of
+	all its submodules (recursively), then pushed to the target under
+	a ref named `refs/rio/<hash>` so that it won't be garbage collected.
+
+	Submodule commits are fetched to make sure the whole ware is actually
+	available before we vouch for it, but they are not pushed to the target:
+	the `.gitmodules` file in the commit still names the submodules' own
+	repositories, and that's where unpacking will look for them.
+
+	The target repository must already exist.
+*/
+func Mirror(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to mirror.
+	target api.WarehouseAddr, // Warehouse to ensure the ware is mirrored into.
+	sources []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if _, err := gitWarehouse.StringToHash(wareID.Hash); err != nil {
+		return api.WareID{}, err
+	}
+
+	// Connect to the target first; if it already has the commit, no-op out.
+	//  No workdir: we never need to fetch from the target, only push to it.
+	targetCtrl, err := openController(nil, target)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	has, err := targetCtrl.RemoteContains(wareID.Hash)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if has {
+		log.MirrorNoop(mon, target, wareID)
+		return wareID, nil
+	}
+
+	// Fetch the commit, and all of its submodules, into the object cache.
+	objcache := osfs.New(config.GetCacheBasePath().Join(fs.MustRelPath("git/objs")))
+	prog := log.NewProgress(mon, log.PhaseFetching, 0)
+	whCtrl, err := pick(ctx, wareID, sources, objcache, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	if err := fetchSubmodules(ctx, whCtrl, wareID.Hash, objcache, map[string]struct{}{}, mon); err != nil {
+		return api.WareID{}, err
+	}
+
+	// Push!
+	prog.Phase(log.PhaseCommitting, 0)
+	if err := whCtrl.Push(ctx, wareID.Hash, targetCtrl); err != nil {
+		return api.WareID{}, err
+	}
+	prog.Done()
+	return wareID, nil
+}
+
+// Fetch the commits of all submodules of the given commit into the object cache,
+// recursing into their submodules in turn.
+//
+// The seen set is keyed by commit hash; it keeps us from fetching the same
+// submodule twice when it's reachable by several paths.
+func fetchSubmodules(
+	ctx context.Context,
+	whCtrl *gitWarehouse.Controller,
+	hash string,
+	objcacheWorkdir fs.FS,
+	seen map[string]struct{},
+	mon rio.Monitor,
+) error {
+	submodules, err := whCtrl.Submodules(hash)
+	if err != nil {
+		return err
+	}
+	for _, submCfg := range submodules {
+		if _, ok := seen[submCfg.Hash]; ok {
+			continue
+		}
+		seen[submCfg.Hash] = struct{}{}
+		submCtrl, err := pick(ctx,
+			api.WareID{PackType, submCfg.Hash},
+			[]api.WarehouseAddr{api.WarehouseAddr(submCfg.URL)},
+			objcacheWorkdir,
+			mon,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fetchSubmodules(ctx, submCtrl, submCfg.Hash, objcacheWorkdir, seen, mon); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	srcd_git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+func TestMirror(t *testing.T) {
+	Convey("Mirroring git commits", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			defer os.Setenv("RIO_CACHE", os.Getenv("RIO_CACHE"))
+			os.Setenv("RIO_CACHE", tmpDir.String()+"/cache")
+			ctx := context.Background()
+
+			// A repo with a submodule, the repo that submodule points to,
+			//  and an empty repo to mirror into.
+			subPath := tmpDir.String() + "/sub"
+			when := time.Date(2017, 10, 18, 12, 30, 00, 0, time.UTC)
+			subHash := fixtureCommit(fixtureRepo(subPath), when, "", map[string]string{"file": "sub"}, nil)
+			superPath := tmpDir.String() + "/super"
+			superHash := fixtureCommit(fixtureRepo(superPath), when, "", map[string]string{
+				".gitmodules": "[submodule \"sub\"]\n\tpath = sub\n\turl = file://" + subPath + "\n",
+			}, map[string]string{"sub": subHash})
+			targetPath := tmpDir.String() + "/target"
+			_, err := srcd_git.PlainInit(targetPath, true)
+			So(err, ShouldBeNil)
+			target := api.WarehouseAddr("file://" + targetPath)
+
+			Convey("commits and their submodules are fetched, then pushed", func() {
+				wareID := api.WareID{"git", superHash}
+				gotWareID, err := Mirror(ctx, wareID, target, []api.WarehouseAddr{api.WarehouseAddr("file://" + superPath)}, rio.Monitor{})
+				So(err, ShouldBeNil)
+				So(gotWareID, ShouldResemble, wareID)
+
+				targetCtrl, err := openController(nil, target)
+				So(err, ShouldBeNil)
+				So(targetCtrl.Contains(superHash), ShouldBeTrue)
+				// The submodule commit was fetched into the object cache (but not pushed).
+				objcache := osfs.New(tmpDir.Join(fs.MustRelPath("cache/git/objs")))
+				subCtrl, err := openController(objcache, api.WarehouseAddr("file://"+subPath))
+				So(err, ShouldBeNil)
+				So(subCtrl.Contains(subHash), ShouldBeTrue)
+				So(targetCtrl.Contains(subHash), ShouldBeFalse)
+
+				Convey("and mirroring again is a no-op, needing no sources", func() {
+					evts := make(chan rio.Event, 10)
+					gotWareID, err := Mirror(ctx, wareID, target, nil, rio.Monitor{Chan: evts})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					var msgs []string
+					for evt := range evts {
+						if evt.Log != nil {
+							msgs = append(msgs, evt.Log.Msg)
+						}
+					}
+					So(msgs, ShouldHaveLength, 1)
+					So(msgs[0], ShouldStartWith, "mirror skip:")
+				})
+			})
+			Convey("missing submodules fail the mirror", func() {
+				So(os.RemoveAll(subPath), ShouldBeNil)
+				_, err := Mirror(ctx, api.WareID{"git", superHash}, target, []api.WarehouseAddr{api.WarehouseAddr("file://" + superPath)}, rio.Monitor{})
+				So(err, ShouldNotBeNil)
+
+				targetCtrl, err := openController(nil, target)
+				So(err, ShouldBeNil)
+				So(targetCtrl.Contains(superHash), ShouldBeFalse)
+			})
+			Convey("unsupported schemes are rejected", func() {
+				_, err := Mirror(ctx, api.WareID{"git", superHash}, "ca+"+target, []api.WarehouseAddr{api.WarehouseAddr("file://" + superPath)}, rio.Monitor{})
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+				_, err = Mirror(ctx, api.WareID{"git", superHash}, "s3://bucket/repo", []api.WarehouseAddr{api.WarehouseAddr("file://" + superPath)}, rio.Monitor{})
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+			})
+			Convey("other packtypes are rejected", func() {
+				_, err := Mirror(ctx, api.WareID{"tar", superHash}, target, []api.WarehouseAddr{api.WarehouseAddr("file://" + superPath)}, rio.Monitor{})
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+			})
+		})
+	})
+}
+
+/*
+	Makes a bare repo at the path, for fixtureCommit to commit into.
+*/
+func fixtureRepo(path string) *srcd_git.Repository {
+	repo, err := srcd_git.PlainInit(path, true)
+	So(err, ShouldBeNil)
+	return repo
+}
+
+/*
+	Commits the given files and submodule entries (by path, to commit hash)
+	on master, atop the parent (if not blank); returns the commit's hash.
+	Only flat trees: paths with slashes aren't supported.
+*/
+func fixtureCommit(repo *srcd_git.Repository, when time.Time, parent string, files map[string]string, submodules map[string]string) string {
+	tree := &object.Tree{}
+	for name, body := range files {
+		obj := repo.Storer.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		So(err, ShouldBeNil)
+		_, err = w.Write([]byte(body))
+		So(err, ShouldBeNil)
+		So(w.Close(), ShouldBeNil)
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: storeObject(repo.Storer, obj)})
+	}
+	for name, hash := range submodules {
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Submodule, Hash: plumbing.NewHash(hash)})
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+	obj := repo.Storer.NewEncodedObject()
+	So(tree.Encode(obj), ShouldBeNil)
+	sig := object.Signature{Name: "rio", Email: "rio@example.com", When: when}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "fixture\n", TreeHash: storeObject(repo.Storer, obj)}
+	if parent != "" {
+		commit.ParentHashes = []plumbing.Hash{plumbing.NewHash(parent)}
+	}
+	obj = repo.Storer.NewEncodedObject()
+	So(commit.Encode(obj), ShouldBeNil)
+	hash := storeObject(repo.Storer, obj)
+	So(repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/master", hash)), ShouldBeNil)
+	return hash.String()
+}
+
+func storeObject(s storer.EncodedObjectStorer, obj plumbing.EncodedObject) plumbing.Hash {
+	hash, err := s.SetEncodedObject(obj)
+	So(err, ShouldBeNil)
+	return hash
+}
@@ -0,0 +1,180 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"context"
+	"io"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+/*
+	Git doesn't store most of the metadata a filesystem has, so when unpacking
+	we have to make some of it up.  UnpackOptions control what we make up.
+
+	Any options other than the defaults will produce a fileset which is
+	no longer described by the commit hash; the unpack will then report
+	a "tar" WareID for what was actually placed, exactly as if hash-altering
+	filters had been used.
+*/
+type UnpackOptions struct {
+	Mtime MtimeSource // Where to get mtimes from.
+	Uid   uint32      // The uid files are unpacked with (before filters).
+	Gid   uint32      // The gid files are unpacked with (before filters).
+	Perms fs.Perms    // Perms for non-executable files (executables and dirs are always 0755).
+
+	// If true, produce the tree `git archive` would: paths with the
+	// export-ignore attribute are skipped, and files with the export-subst
+	// attribute have their `$Format:...$` placeholders expanded.
+	Archive bool
+}
+
+type MtimeSource string
+
+const (
+	MtimeSource_Default    MtimeSource = ""            // Always `apiutil.DefaultMtime`.
+	MtimeSource_Commit     MtimeSource = "commit"      // The commit time of the commit being unpacked.
+	MtimeSource_LastChange MtimeSource = "last-change" // The commit time of the last commit (following first parents) that changed each file.
+)
+
+var DefaultUnpackOptions = UnpackOptions{
+	Mtime: MtimeSource_Default,
+	Uid:   1000,
+	Gid:   1000,
+	Perms: 0644,
+}
+
+func (opts UnpackOptions) validate() error {
+	switch opts.Mtime {
+	case MtimeSource_Default, MtimeSource_Commit, MtimeSource_LastChange:
+		// pass
+	default:
+		return Errorf(rio.ErrUsage, "invalid git mtime source %q (valid options are 'default', 'commit', or 'last-change')", opts.Mtime)
+	}
+	if opts.Perms&^0777 != 0 {
+		return Errorf(rio.ErrUsage, "invalid git file perms %#o (setuid, setgid, and sticky bits are not allowed)", opts.Perms)
+	}
+	return nil
+}
+
+/*
+	Picks the mtime for each path in one repo's tree, per the MtimeSource.
+*/
+type mtimer struct {
+	fallback time.Time
+	times    map[fs.RelPath]time.Time // only set for MtimeSource_LastChange.
+}
+
+func (m mtimer) For(name fs.RelPath) time.Time {
+	if t, ok := m.times[name]; ok {
+		return t
+	}
+	return m.fallback
+}
+
+func newMtimer(ctx context.Context, commit *object.Commit, src MtimeSource) (mtimer, error) {
+	switch src {
+	case MtimeSource_Default:
+		return mtimer{fallback: apiutil.DefaultMtime}, nil
+	case MtimeSource_Commit:
+		return mtimer{fallback: commitTime(commit)}, nil
+	case MtimeSource_LastChange:
+		times, err := lastChangeTimes(ctx, commit)
+		return mtimer{fallback: commitTime(commit), times: times}, err
+	default:
+		panic("unreachable")
+	}
+}
+
+// Git times are only precise to the second anyway; make sure we
+// don't wander off into some timezone, so the fshash is stable.
+func commitTime(commit *object.Commit) time.Time {
+	return commit.Committer.When.UTC().Truncate(time.Second)
+}
+
+/*
+	Walk the first-parent history of a commit to find, for each path in its tree,
+	the time of the most recent commit that changed it.
+
+	Directories get the latest time of anything inside them.
+	Submodules are just a path here (a change of the gitlink is a change);
+	their own contents are accounted for by their own history.
+*/
+func lastChangeTimes(ctx context.Context, commit *object.Commit) (map[fs.RelPath]time.Time, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "commit missing tree: %s", err)
+	}
+
+	// Gather up every non-dir path that needs a time.
+	pending := map[string]struct{}{}
+	tw := object.NewTreeWalker(tree, true, nil)
+	defer tw.Close()
+	for {
+		name, te, err := tw.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
+		}
+		if te.Mode != filemode.Dir {
+			pending[name] = struct{}{}
+		}
+	}
+
+	// Walk back through history until everything's accounted for.
+	times := map[fs.RelPath]time.Time{}
+	assign := func(name string, t time.Time) {
+		delete(pending, name)
+		path := fs.MustRelPath(name)
+		times[path] = t
+		for _, parent := range path.SplitParent() {
+			if t.After(times[parent]) {
+				times[parent] = t
+			}
+		}
+	}
+	for len(pending) > 0 {
+		if ctx.Err() != nil {
+			return nil, Errorf(rio.ErrCancelled, "cancelled")
+		}
+		when := commitTime(commit)
+		// Root commit: whatever's left was introduced here.
+		if commit.NumParents() == 0 {
+			for name := range pending {
+				assign(name, when)
+			}
+			break
+		}
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "missing parent commit: %s", err)
+		}
+		parentTree, err := parent.Tree()
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "commit missing tree: %s", err)
+		}
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "failed to diff git trees: %s", err)
+		}
+		for _, change := range changes {
+			if _, ok := pending[change.To.Name]; ok {
+				assign(change.To.Name, when)
+			}
+		}
+		commit, tree = parent, parentTree
+	}
+	return times, nil
+}
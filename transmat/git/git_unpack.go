@@ -6,10 +6,12 @@ Sniperkit-Bot
 package git
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
@@ -22,6 +24,9 @@ import (
 	"go.polydawn.net/rio/transmat/mixins/cache"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/limits"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/util"
 	gitWarehouse "go.polydawn.net/rio/warehouse/impl/git"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -40,23 +45,58 @@ func Unpack(
 	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
 ) (_ api.WareID, err error) {
-	if mon.Chan != nil {
-		defer close(mon.Chan)
-	}
-	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+	return UnpackWithOptions(DefaultUnpackOptions)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
 
-	// Sanitize arguments.
-	if wareID.Type != PackType {
-		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
-	}
-	if placementMode == "" {
-		placementMode = rio.Placement_Copy
+/*
+	Returns an unpack func which uses the given git-specific options.
+	(Unpack itself is simply this with DefaultUnpackOptions.)
+*/
+func UnpackWithOptions(opts UnpackOptions) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != PackType {
+			return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+		}
+		if err := opts.validate(); err != nil {
+			return api.WareID{}, err
+		}
+		if placementMode == "" {
+			placementMode = rio.Placement_Copy
+		}
+		// Wrap the direct unpack func with cache behavior; call that.
+		//  Non-default options alter the result just like filters can,
+		//  so the cache needs to know not to look it up by wareID.
+		unpackFn := limits.RollbackOnExceeded(func(
+			ctx context.Context,
+			wareID api.WareID,
+			path string,
+			filt api.FilesetFilters,
+			placementMode rio.PlacementMode,
+			warehouses []api.WarehouseAddr,
+			mon rio.Monitor,
+		) (api.WareID, error) {
+			return unpack(ctx, wareID, path, filt, opts, warehouses, mon)
+		})
+		cacheFs := osfs.New(config.GetCacheBasePath())
+		if opts != DefaultUnpackOptions {
+			return cache.Lrn2CacheAltered(cacheFs, unpackFn)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+		}
+		return cache.Lrn2Cache(cacheFs, unpackFn)(ctx, wareID, path, filt, placementMode, warehouses, mon)
 	}
-	// Wrap the direct unpack func with cache behavior; call that.
-	return cache.Lrn2Cache(
-		osfs.New(config.GetCacheBasePath()),
-		unpack,
-	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
 }
 
 func unpack(
@@ -64,7 +104,7 @@ func unpack(
 	wareID api.WareID,
 	path string,
 	filt api.FilesetFilters,
-	placementMode rio.PlacementMode,
+	opts UnpackOptions,
 	warehouses []api.WarehouseAddr,
 	mon rio.Monitor,
 ) (_ api.WareID, err error) {
@@ -76,12 +116,17 @@ func unpack(
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
+	lims, err := limits.FromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
 
 	// Pick a warehouse and get a reader.
 	//  This is a *very* expensive operation for git.  It's less
 	//  of "pick a warehouse" and more "download the whole thing and hope we
 	//  get what we wanted" (which is very ironic for a system that has
 	//  a CAS system on its inside, yes).
+	prog := log.NewProgress(mon, log.PhaseFetching, 0)
 	whCtrl, err := pick(ctx,
 		wareID,
 		warehouses,
@@ -113,47 +158,96 @@ func unpack(
 		submoduleCtrls[submCfg.Path] = whCtrl
 	}
 
-	// Open a tree to walk in the main repo.
+	// Open the commit to walk in the main repo.
 	//  We'll do submodule checkouts somewhere deep in the middle of this.
-	tr, err := whCtrl.GetTree(wareID.Hash)
+	commit, err := whCtrl.GetCommit(wareID.Hash)
 	if err != nil {
-		panic(err)
+		return api.WareID{}, err
 	}
 
 	// Construct filesystem wrapper to use for all our ops.
-	afs := osfs.New(path2)
+	afs := osfs.NewConfined(path2)
+	log.FilesystemConfinement(mon, path2, string(osfs.ConfinementOf(afs)))
+
+	// Allocate bucket for keeping each metadata entry and content hash.
+	//  If we've filtered or otherwise altered anything, the commit hash no longer
+	//  describes what we placed, and we'll compute a hash from this instead.
+	bucket := &fshash.MemoryBucket{}
+	algo := fshash.DefaultAlgorithm
 
 	// Walk.
-	if err := unpackOneRepo(ctx, tr, afs, true, filt2, submoduleCtrls, mon); err != nil {
+	//  Submodules count against the same limits as the repo they're in.
+	tracker := lims.Track()
+	prog.Phase(log.PhaseExtracting, 0)
+	if err := unpackOneRepo(ctx, commit, afs, fs.RelPath{}, true, filt2, opts, submoduleCtrls, bucket, algo, tracker, mon, prog); err != nil {
 		return api.WareID{}, err
 	}
+	prog.Done()
 
-	// That's it.  Checkout should have already checked the hash, so we just return it.
-	return wareID, nil
+	// If nothing was altered, checkout should have already checked the hash, so we just return it.
+	//  Otherwise, return the hash of what we actually placed, as it would be packed.
+	if opts == DefaultUnpackOptions && !filt2.IsHashAltering() {
+		return wareID, nil
+	}
+	return api.WareID{"tar", algo.Format(fshash.HashBucket(bucket, algo.New))}, nil
 }
 
 func unpackOneRepo(
 	ctx context.Context,
-	tr *object.Tree,
+	commit *object.Commit,
 	afs fs.FS,
+	prefix fs.RelPath, // where in afs this repo goes; submodules go deeper.
 	isRoot bool, // if true, will recurse for submodules (with this set to false).
 	filt apiutil.FilesetFilters,
+	opts UnpackOptions,
 	submoduleCtrls map[string]*gitWarehouse.Controller,
+	bucket fshash.Bucket,
+	algo fshash.Algorithm,
+	tracker *limits.Tracker,
 	mon rio.Monitor,
+	prog *log.Progress,
 ) (err error) {
+	tr, err := commit.Tree()
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "commit missing tree: %s", err)
+	}
 	tw := object.NewTreeWalker(tr, true, nil)
+	mtimes, err := newMtimer(ctx, commit, opts.Mtime)
+	if err != nil {
+		return err
+	}
+	var attrs *gitAttributes // only set in archive mode.
+	if opts.Archive {
+		attrs, err = readGitAttributes(tr)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Make the root dir.  Git doesn't have metadata for the tree root.
+	//  With the default options it's root's, as it's always been (so filtered
+	//  unpacks keep the same hash); otherwise it's owned like everything else.
 	conjuredFmeta := fshash.DefaultDirMetadata()
+	conjuredFmeta.Name = prefix
+	if opts != DefaultUnpackOptions {
+		conjuredFmeta.Uid = opts.Uid
+		conjuredFmeta.Gid = opts.Gid
+	}
+	conjuredFmeta.Mtime = mtimes.For(fs.RelPath{})
 	filters.Apply(filt, &conjuredFmeta)
+	if err := tracker.Entry(conjuredFmeta); err != nil {
+		return err
+	}
 	if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, filt.SkipChown); err != nil {
 		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 	}
+	bucket.AddRecord(conjuredFmeta, nil)
 
 	// Extract.
 	// Iterate over each entry, mutating filesystem as we go.
-	dirs := make([]fs.RelPath, 1, 200) // Keep for dir time repair at end.
-	dirs[0] = fs.RelPath{}
+	dirs := make([]fs.Metadata, 1, 200) // Keep for dir time repair at end.
+	dirs[0] = conjuredFmeta
+	var ignored []string // Dirs skipped by export-ignore; everything under them is too.
 	for {
 		fmeta := fs.Metadata{}
 		name, te, err := tw.Next()
@@ -170,18 +264,32 @@ func unpackOneRepo(
 		}
 		//fmt.Fprintf(os.Stderr, "walking git tree %s -- %#v\n", name, te)
 
+		// In archive mode, skip anything export-ignored.
+		if attrs != nil {
+			if underAny(name, ignored) {
+				continue
+			}
+			isDir := te.Mode == filemode.Dir || te.Mode == filemode.Submodule
+			if attrs.Has(name, isDir, attr_ExportIgnore) {
+				if isDir {
+					ignored = append(ignored, name)
+				}
+				continue
+			}
+		}
+
 		// Reshuffle metainfo to our default format.
-		fmeta.Name = fs.MustRelPath(name)
-		fmeta.Uid = 1000
-		fmeta.Gid = 1000
+		fmeta.Name = prefix.Join(fs.MustRelPath(name))
+		fmeta.Uid = opts.Uid
+		fmeta.Gid = opts.Gid
+		fmeta.Mtime = mtimes.For(fs.MustRelPath(name))
 		switch te.Mode {
 		case filemode.Dir:
 			fmeta.Type = fs.Type_Dir
 			fmeta.Perms = 0755
-			dirs = append(dirs, fmeta.Name)
 		case filemode.Regular:
 			fmeta.Type = fs.Type_File
-			fmeta.Perms = 0644
+			fmeta.Perms = opts.Perms
 		case filemode.Executable:
 			fmeta.Type = fs.Type_File
 			fmeta.Perms = 0755
@@ -209,19 +317,17 @@ func unpackOneRepo(
 				// Like git, we will make the empty dir, though.
 				fmeta.Type = fs.Type_Dir
 				fmeta.Perms = 0755
-				dirs = append(dirs, fmeta.Name)
 				break
 			}
 			submCtrl, ok := submoduleCtrls[name]
 			if !ok {
 				return Errorf(rio.ErrWareCorrupt, "gitlink found at path %q but no matching config in .gitmodules", name)
 			}
-			submTr, err := submCtrl.GetTree(te.Hash.String())
+			submCommit, err := submCtrl.GetCommit(te.Hash.String())
 			if err != nil {
-				panic(err)
+				return err
 			}
-			submFs := osfs.New(afs.BasePath().Join(fmeta.Name))
-			if err := unpackOneRepo(ctx, submTr, submFs, false, filt, nil, mon); err != nil {
+			if err := unpackOneRepo(ctx, submCommit, afs, fmeta.Name, false, filt, opts, nil, bucket, algo, tracker, mon, prog); err != nil {
 				return err
 			}
 			continue
@@ -232,10 +338,13 @@ func unpackOneRepo(
 		default:
 			panic(fmt.Errorf("unknown git filemode %#v", te.Mode))
 		}
-		fmeta.Mtime = apiutil.DefaultMtime // git doesn't have time info
 
 		// Apply filters.
 		filters.Apply(filt, &fmeta)
+		if err := tracker.Entry(fmeta); err != nil {
+			return err
+		}
+		prog.Entry()
 
 		// Place the file.
 		switch fmeta.Type {
@@ -244,28 +353,58 @@ func unpackOneRepo(
 			if err != nil {
 				return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
 			}
-			reader, err := tf.Blob.Reader()
+			blobReader, err := tf.Blob.Reader()
 			if err != nil {
 				return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
 			}
+			var body io.Reader = blobReader
+			// In archive mode, expand placeholders if asked.
+			//  These are meant for small files like version stamps, so we just slurp it.
+			if attrs != nil && attrs.Has(name, false, attr_ExportSubst) {
+				blob, err := ioutil.ReadAll(blobReader)
+				if err != nil {
+					return Errorf(rio.ErrWareCorrupt, "corrupt git tree: %s", err)
+				}
+				body = bytes.NewReader(expandSubst(blob, commit))
+			}
+			reader := &util.HashingReader{tracker.Body(fmeta.Name, prog.Reader(body)), algo.New()}
 			if err := fsOp.PlaceFile(afs, fmeta, reader, filt.SkipChown); err != nil {
+				blobReader.Close()
+				if err := tracker.Err(); err != nil {
+					return err
+				}
 				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
-			reader.Close()
+			blobReader.Close()
+			bucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
+		case fs.Type_Dir:
+			dirs = append(dirs, fmeta)
+			fallthrough
 		default:
 			if err := fsOp.PlaceFile(afs, fmeta, nil, filt.SkipChown); err != nil {
 				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
+			bucket.AddRecord(fmeta, nil)
 		}
 	}
 
 	// Cleanup dir times with a post-order traversal over the bucket.
 	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
 	for i := len(dirs) - 1; i >= 0; i-- {
-		if err := afs.SetTimesNano(dirs[i], fs.DefaultAtime, fs.DefaultAtime); err != nil {
+		if err := afs.SetTimesNano(dirs[i].Name, dirs[i].Mtime, fs.DefaultAtime); err != nil {
 			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 		}
 	}
 
 	return nil
 }
+
+// Returns true if the name is inside any of the given dirs.
+func underAny(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
+)
+
+func TestUnpackOptions(t *testing.T) {
+	Convey("Unpacking git commits with options", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Setenv("RIO_CACHE", os.Getenv("RIO_CACHE"))
+				os.Setenv("RIO_CACHE", tmpDir.String()+"/cache")
+
+				// Two commits: "a" is last changed by the first, "b" by the second.
+				//  "sub" is a submodule, added by the second; its one commit is older.
+				when1 := time.Date(2017, 10, 18, 12, 30, 00, 0, time.UTC)
+				when2 := time.Date(2017, 10, 19, 12, 30, 00, 0, time.UTC)
+				subPath := tmpDir.String() + "/sub"
+				subHash := fixtureCommit(fixtureRepo(subPath), when1, "", map[string]string{"file": "sub"}, nil)
+				repoPath := tmpDir.String() + "/repo"
+				repo := fixtureRepo(repoPath)
+				hash1 := fixtureCommit(repo, when1, "", map[string]string{"a": "alpha", "b": "beta"}, nil)
+				hash2 := fixtureCommit(repo, when2, hash1, map[string]string{
+					"a":           "alpha",
+					"b":           "beta2",
+					".gitmodules": "[submodule \"sub\"]\n\tpath = sub\n\turl = file://" + subPath + "\n",
+				}, map[string]string{"sub": subHash})
+				wareID := api.WareID{"git", hash2}
+				warehouses := []api.WarehouseAddr{api.WarehouseAddr("file://" + repoPath)}
+
+				n := 0
+				unpack := func(opts UnpackOptions) (fs.AbsolutePath, api.WareID) {
+					n++
+					dir := tmpDir.Join(fs.MustRelPath(fmt.Sprintf("out%d", n)))
+					gotWareID, err := UnpackWithOptions(opts)(context.Background(), wareID, dir.String(), api.Filter_NoMutation, rio.Placement_Direct, warehouses, rio.Monitor{})
+					So(err, ShouldBeNil)
+					return dir, gotWareID
+				}
+				stat := func(dir fs.AbsolutePath, name string) fs.Metadata {
+					fmeta, err := osfs.New(dir).LStat(fs.MustRelPath(name))
+					So(err, ShouldBeNil)
+					return *fmeta
+				}
+				// The wareID reported for altered unpacks should be just what packing the result gives.
+				scan := func(dir fs.AbsolutePath) api.WareID {
+					scannedWareID, err := tartrans.Pack(context.Background(), tartrans.PackType, dir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					return scannedWareID
+				}
+
+				Convey("the defaults give the commit's wareID", func() {
+					dir, gotWareID := unpack(DefaultUnpackOptions)
+					So(gotWareID, ShouldResemble, wareID)
+					So(stat(dir, "a").Mtime, ShouldEqual, apiutil.DefaultMtime)
+					So(stat(dir, "a").Uid, ShouldEqual, 1000)
+					So(stat(dir, "a").Perms, ShouldEqual, 0644)
+					So(stat(dir, ".").Uid, ShouldEqual, 0)
+				})
+				Convey("mtimes can be the commit time", func() {
+					opts := DefaultUnpackOptions
+					opts.Mtime = MtimeSource_Commit
+					dir, gotWareID := unpack(opts)
+					So(gotWareID.Type, ShouldEqual, tartrans.PackType)
+					So(gotWareID, ShouldResemble, scan(dir))
+					for _, name := range []string{".", "a", "b"} {
+						So(stat(dir, name).Mtime, ShouldEqual, when2)
+					}
+					// The submodule's contents go by its own commit.
+					So(stat(dir, "sub").Mtime, ShouldEqual, when1)
+					So(stat(dir, "sub/file").Mtime, ShouldEqual, when1)
+				})
+				Convey("mtimes can be the time each path last changed", func() {
+					opts := DefaultUnpackOptions
+					opts.Mtime = MtimeSource_LastChange
+					dir, gotWareID := unpack(opts)
+					So(gotWareID, ShouldResemble, scan(dir))
+					So(stat(dir, "a").Mtime, ShouldEqual, when1)
+					So(stat(dir, "b").Mtime, ShouldEqual, when2)
+					So(stat(dir, ".").Mtime, ShouldEqual, when2)
+					// The submodule's contents go by its own history.
+					So(stat(dir, "sub").Mtime, ShouldEqual, when1)
+					So(stat(dir, "sub/file").Mtime, ShouldEqual, when1)
+
+					Convey("and options other than the defaults give different wareIDs", func() {
+						opts.Mtime = MtimeSource_Commit
+						_, otherWareID := unpack(opts)
+						So(otherWareID, ShouldNotResemble, gotWareID)
+					})
+				})
+				Convey("ownership and perms apply to everything, conjured dirs included", func() {
+					opts := DefaultUnpackOptions
+					opts.Uid = 1234
+					opts.Gid = 5678
+					opts.Perms = 0600
+					dir, gotWareID := unpack(opts)
+					So(gotWareID, ShouldResemble, scan(dir))
+					for _, name := range []string{".", "a", "b", "sub", "sub/file"} {
+						So(stat(dir, name).Uid, ShouldEqual, 1234)
+						So(stat(dir, name).Gid, ShouldEqual, 5678)
+					}
+					So(stat(dir, "a").Perms, ShouldEqual, 0600)
+					So(stat(dir, "sub/file").Perms, ShouldEqual, 0600)
+					So(stat(dir, ".").Perms, ShouldEqual, 0755)
+					So(stat(dir, "sub").Perms, ShouldEqual, 0755)
+				})
+			})
+		}),
+	)
+}
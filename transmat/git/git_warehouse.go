@@ -34,22 +34,7 @@ func pick(
 
 	var anyWarehouses bool // for clarity in final error messages
 	for _, addr := range warehouses {
-		u, err := url.Parse(string(addr))
-		if err != nil {
-			return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
-		}
-		switch u.Scheme {
-		case "git":
-			fallthrough
-		case "ssh":
-			fallthrough
-		case "http", "https":
-			fallthrough
-		case "file":
-			whCtrl, err = gitWarehouse.NewController(objcacheWorkdir, addr)
-		default:
-			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'git', 'ssh', 'http', 'https', or 'file')", u.Scheme)
-		}
+		whCtrl, err = openController(objcacheWorkdir, addr)
 		switch Category(err) {
 		case nil:
 			anyWarehouses = true
@@ -94,3 +79,26 @@ func pick(
 	}
 	return nil, Errorf(rio.ErrWareNotFound, "none of the available warehouses have ware %q!", wareID)
 }
+
+// Check the scheme of a warehouse address, and open a controller for it.
+//
+// The workdir is where the controller will keep its object cache;
+// it may be nil if we don't expect to fetch anything.
+func openController(workdir fs.FS, addr api.WarehouseAddr) (*gitWarehouse.Controller, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "git":
+		fallthrough
+	case "ssh":
+		fallthrough
+	case "http", "https":
+		fallthrough
+	case "file":
+		return gitWarehouse.NewController(workdir, addr)
+	default:
+		return nil, Errorf(rio.ErrUsage, "this operation doesn't support %q scheme (valid options are 'git', 'ssh', 'http', 'https', or 'file')", u.Scheme)
+	}
+}
@@ -7,6 +7,7 @@ package cache
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 
 	. "github.com/warpfork/go-errcat"
@@ -25,12 +26,22 @@ import (
 var ShelfFor = cacheapi.ShelfFor
 
 func Lrn2Cache(cacheFs fs.FS, unpackTool rio.UnpackFunc) rio.UnpackFunc {
-	return cache{cacheFs, unpackTool}.Unpack
+	return cache{cacheFs, unpackTool, false}.Unpack
+}
+
+/*
+	Like Lrn2Cache, but for unpack tools that have been configured in some way
+	(other than filters) which makes their results differ from the plain ware.
+	Lookups are treated the same as if hash-altering filters were in use.
+*/
+func Lrn2CacheAltered(cacheFs fs.FS, unpackTool rio.UnpackFunc) rio.UnpackFunc {
+	return cache{cacheFs, unpackTool, true}.Unpack
 }
 
 type cache struct {
 	fs         fs.FS
 	unpackTool rio.UnpackFunc
+	altered    bool // if true, always treat as hash-altering.
 }
 
 /*
@@ -61,8 +72,11 @@ func (c cache) Unpack(
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
-	if filt2.IsHashAltering() {
+	altered := filt2.IsHashAltering() || c.altered
+	if altered {
 		resultWareID = api.WareID{"-", "-"} // This value forces cache miss.
+	} else if aliased, ok := c.readAlias(wareID); ok {
+		resultWareID = aliased // Unpacked before, and shelved under another ID.
 	}
 
 	// First thing: Check if we already have the ware in cache and can jump to placement ASAP.
@@ -83,6 +97,13 @@ func (c cache) Unpack(
 		if err != nil {
 			return resultWareID, err
 		}
+		// If the tool gave back another ID (e.g. the tar hash of a flattened image),
+		//  remember which, so the next lookup by this ID finds it.
+		if !altered && resultWareID != wareID {
+			if err := c.writeAlias(wareID, resultWareID); err != nil {
+				return resultWareID, err
+			}
+		}
 		// Now place it from the cache shelf.
 		return resultWareID, c.place(ctx, placementMode, shelf, path)
 	case nil: // Cache has it!  Reaction varies.
@@ -163,16 +184,64 @@ func (c cache) populate(
 	//  This may also require mkdir'ing the prefix dirs of the shelf.
 	//  In case of race: accept our fate, assume the racing party acted in good faith,
 	//  return the shelf path anyway, and our defer'd rm will act on our wasted copy.
+	//  The result may not be the same type as the ware we were asked for
+	//  (e.g. a filtered git checkout is hashed as a tar), so make sure that root exists too.
+	prog := log.NewProgress(monitor, log.PhaseCommitting, 0)
 	shelf := ShelfFor(resultWareID)
+	if err := fsOp.MkdirAll(c.fs, fs.MustRelPath(string(resultWareID.Type)+"/fileset"), 0700); err != nil {
+		return resultWareID, shelf, Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
 	c.fs.Mkdir(shelf.Dir().Dir(), 0755)
 	c.fs.Mkdir(shelf.Dir(), 0755)
 	if err := os.Rename(tmpPathStr, c.fs.BasePath().Join(shelf).String()); err != nil {
 		if _, ok := err.(*os.LinkError); ok && os.IsExist(err) {
 			// Oh, fine.  Somebody raced us to it.
+			prog.Done()
 			return resultWareID, shelf, nil
 		}
 		// Any other error: sad.
 		return resultWareID, shelf, Errorf(rio.ErrLocalCacheProblem, "error commiting %q into cache: %s", resultWareID, err)
 	}
+	prog.Done()
 	return resultWareID, shelf, nil
 }
+
+/*
+	Returns the wareID a ware's fileset is shelved under, if an unpack
+	recorded that it's not shelved under its own ID (see cacheapi.AliasFor),
+	and that shelf is still there.
+*/
+func (c cache) readAlias(wareID api.WareID) (api.WareID, bool) {
+	body, err := ioutil.ReadFile(c.fs.BasePath().Join(cacheapi.AliasFor(wareID)).String())
+	if err != nil {
+		return api.WareID{}, false
+	}
+	aliased, err := api.ParseWareID(string(body))
+	if err != nil {
+		return api.WareID{}, false
+	}
+	if _, err := c.fs.Stat(ShelfFor(aliased)); err != nil {
+		return api.WareID{}, false
+	}
+	return aliased, true
+}
+
+/*
+	Records that a ware's fileset is shelved under another wareID.
+	Written to a temp file and renamed, so readers never see half of it.
+*/
+func (c cache) writeAlias(wareID, aliased api.WareID) error {
+	alias := cacheapi.AliasFor(wareID)
+	if err := fsOp.MkdirAll(c.fs, alias.Dir(), 0755); err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "cannot initialize cache dirs: %s", err)
+	}
+	tmpPath := c.fs.BasePath().Join(fs.MustRelPath("./.tmp.alias." + guid.New())).String()
+	if err := ioutil.WriteFile(tmpPath, []byte(aliased.String()), 0644); err != nil {
+		return Errorf(rio.ErrLocalCacheProblem, "error recording %q in cache: %s", wareID, err)
+	}
+	if err := os.Rename(tmpPath, c.fs.BasePath().Join(alias).String()); err != nil {
+		os.Remove(tmpPath)
+		return Errorf(rio.ErrLocalCacheProblem, "error recording %q in cache: %s", wareID, err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Compares a live filesystem against the records of what it should contain
+	(e.g. from a manifest, or from the ware it was unpacked from),
+	and reports every path and field which has drifted.
+
+	This reads every file, but writes nothing, and never needs the whole
+	fileset in any other form: it's a lot cheaper than packing the
+	directory again just to see the WareID change, and says *what* changed.
+*/
+package drift
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	One difference between the expected records and the filesystem.
+
+	Field is the name of the differing metadata field ("type", "perms", "uid",
+	"gid", "size", "linkname", "devmajor", "devminor", "mtime"), or "content"
+	if a file's content hash differs, or "entry" if the path is missing or
+	unexpected entirely (in which case Expected or Actual is "absent").
+*/
+type Difference struct {
+	Path     fs.RelPath
+	Field    string
+	Expected string
+	Actual   string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s %s: expected %s, found %s", d.Path, d.Field, d.Expected, d.Actual)
+}
+
+/*
+	Walks the filesystem and compares it to the records in the bucket,
+	calling `report` with every difference found (in walk order, then any
+	missing paths in sorted order).  Returns the number of differences.
+
+	Content hashes are computed with `algo`, which must be the algorithm the
+	bucket's content hashes were made with.  Mtimes are compared to the
+	second, since that's all tar keeps.  Xattrs are not compared, since
+	they're not unpacked.  Hardlinks are only checked to be regular files.
+*/
+func Check(
+	ctx context.Context,
+	afs fs.FS,
+	expect fshash.Bucket,
+	algo fshash.Algorithm,
+	report func(Difference),
+) (n int, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Index the expected records by path.
+	//  Walk order of the bucket and the filesystem aren't quite guaranteed
+	//  to agree, and we need random access to notice what's missing anyway.
+	records := make(map[fs.RelPath]fshash.Record, expect.Length())
+	if err := treewalk.Walk(expect.Iterator(), func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		records[record.Metadata.Name] = record
+		return nil
+	}, nil); err != nil {
+		return 0, err
+	}
+	emit := func(d Difference) {
+		n++
+		report(d)
+	}
+
+	// Walk the filesystem, comparing as we go.
+	preVisit := func(filenode *fs.FilewalkNode) error {
+		if filenode.Err != nil {
+			return filenode.Err
+		}
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+		record, ok := records[filenode.Info.Name]
+		if !ok {
+			emit(Difference{filenode.Info.Name, "entry", "absent", "present"})
+			return nil
+		}
+		delete(records, filenode.Info.Name)
+		fmeta, file, err := fsOp.ScanFile(afs, filenode.Info.Name)
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			defer file.Close()
+		}
+		for _, d := range compareMetadata(record.Metadata, *fmeta) {
+			emit(d)
+		}
+		if file == nil || record.Metadata.Type != fs.Type_File {
+			return nil
+		}
+		if record.Metadata.Size != fmeta.Size {
+			// No need to read it; we already know.
+			emit(Difference{fmeta.Name, "content", "hash " + algo.Format(record.ContentHash), "different size"})
+			return nil
+		}
+		hasher := algo.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return err
+		}
+		if hash := hasher.Sum(nil); string(hash) != string(record.ContentHash) {
+			emit(Difference{fmeta.Name, "content", "hash " + algo.Format(record.ContentHash), "hash " + algo.Format(hash)})
+		}
+		return nil
+	}
+	if err := fs.Walk(afs, preVisit, nil); err != nil {
+		switch Category(err) {
+		case rio.ErrCancelled:
+			return n, err
+		default:
+			return n, Errorf(rio.ErrInoperablePath, "error while checking: %s", err)
+		}
+	}
+
+	// Anything left over is missing.
+	missing := make([]fs.RelPath, 0, len(records))
+	for path := range records {
+		missing = append(missing, path)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].String() < missing[j].String() })
+	for _, path := range missing {
+		emit(Difference{path, "entry", "present", "absent"})
+	}
+	return n, nil
+}
+
+/*
+	Reads a manifest (see fshash.WriteManifest) and checks the filesystem against it.
+*/
+func CheckManifest(
+	ctx context.Context,
+	afs fs.FS,
+	manifest io.Reader,
+	report func(Difference),
+) (n int, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	threshold, err := config.GetBucketSpillThreshold()
+	if err != nil {
+		return 0, err
+	}
+	bucket := fshash.NewDiskBucket(config.GetBucketSpillPath(), threshold)
+	defer bucket.Close()
+	algo, err := fshash.ReadManifest(manifest, bucket)
+	if err != nil {
+		return 0, Errorf(rio.ErrUsage, "%s", err)
+	}
+	if err := bucket.Err(); err != nil {
+		return 0, Errorf(rio.ErrLocalCacheProblem, "error while reading manifest: %s", err)
+	}
+	// Buckets panic on walking records that don't form a tree.
+	//  That's an invariant for buckets we fill ourselves, but a manifest is user input.
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+			// pass
+		case fshash.ErrInvalidFilesystem:
+			n, err = 0, Errorf(rio.ErrUsage, "invalid manifest: %s", e)
+		default:
+			panic(e)
+		}
+	}()
+	return Check(ctx, afs, bucket, algo, report)
+}
+
+func compareMetadata(expect, actual fs.Metadata) (ds []Difference) {
+	add := func(field string, e, a string) {
+		if e != a {
+			ds = append(ds, Difference{expect.Name, field, e, a})
+		}
+	}
+	// Hardlinks are files on disk, and their other properties are the target's.
+	if expect.Type == fs.Type_Hardlink {
+		add("type", fs.Type_File.String(), actual.Type.String())
+		return
+	}
+	if expect.Type != actual.Type {
+		// Nothing else is comparable if the type's wrong.
+		add("type", expect.Type.String(), actual.Type.String())
+		return
+	}
+	add("perms", fmt.Sprintf("%04o", expect.Perms), fmt.Sprintf("%04o", actual.Perms))
+	add("uid", fmt.Sprint(expect.Uid), fmt.Sprint(actual.Uid))
+	add("gid", fmt.Sprint(expect.Gid), fmt.Sprint(actual.Gid))
+	if expect.Type == fs.Type_File {
+		add("size", fmt.Sprint(expect.Size), fmt.Sprint(actual.Size))
+	}
+	add("linkname", expect.Linkname, actual.Linkname)
+	if expect.Type == fs.Type_Device || expect.Type == fs.Type_CharDevice {
+		add("devmajor", fmt.Sprint(expect.Devmajor), fmt.Sprint(actual.Devmajor))
+		add("devminor", fmt.Sprint(expect.Devminor), fmt.Sprint(actual.Devminor))
+	}
+	add("mtime",
+		expect.Mtime.Truncate(time.Second).UTC().Format(time.RFC3339),
+		actual.Mtime.Truncate(time.Second).UTC().Format(time.RFC3339))
+	return
+}
@@ -0,0 +1,140 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/polydawn/refmt/misc"
+)
+
+/*
+	An Algorithm is a hash function we can use for both file contents and
+	the tree hash over a whole fileset, plus the tag that names it in hash strings.
+
+	Hash strings (the part of a WareID after the type) are of the form
+	"<tag>-<base58 digest>", e.g. "sha256-3rrT3EnF...".
+	The default algorithm (sha384) has no tag and no dash, and is just the
+	base58 digest, exactly as hashes have always been written;
+	all the other algorithms must be tagged.
+	(Base58 never contains a dash, so this is never ambiguous.)
+
+	The rest of the scheme (what's hashed, and how it's serialized; see
+	HashBucket) is the same regardless of algorithm.
+*/
+type Algorithm struct {
+	Tag string           // The prefix naming this algorithm in hash strings.  Empty for the default.
+	New func() hash.Hash // Hasher factory.
+}
+
+var (
+	Algorithm_SHA384 = Algorithm{"", sha512.New384} // The default.  Always untagged.
+	Algorithm_SHA256 = Algorithm{"sha256", sha256.New}
+	Algorithm_SHA512 = Algorithm{"sha512", sha512.New}
+
+	DefaultAlgorithm = Algorithm_SHA384
+)
+
+var algorithms = struct {
+	sync.RWMutex
+	m map[string]Algorithm
+}{m: map[string]Algorithm{
+	Algorithm_SHA256.Tag: Algorithm_SHA256,
+	Algorithm_SHA512.Tag: Algorithm_SHA512,
+}}
+
+/*
+	Registers another algorithm, so it can be named in hash strings and picked
+	by name in LookupAlgorithm.  (E.g. a build which includes a BLAKE3
+	implementation can register it here as "blake3".)
+
+	Tags must be nonblank, and may only contain lowercase letters and digits.
+	Panics if the tag is invalid or already registered.
+*/
+func RegisterAlgorithm(tag string, factory func() hash.Hash) {
+	if tag == "" || strings.TrimLeft(tag, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		panic(fmt.Errorf("fshash: invalid algorithm tag %q", tag))
+	}
+	algorithms.Lock()
+	defer algorithms.Unlock()
+	if _, exists := algorithms.m[tag]; exists {
+		panic(fmt.Errorf("fshash: algorithm %q already registered", tag))
+	}
+	algorithms.m[tag] = Algorithm{tag, factory}
+}
+
+/*
+	Returns the algorithm with the given name.
+	The default may be named either by a blank string or "sha384".
+*/
+func LookupAlgorithm(name string) (Algorithm, bool) {
+	if name == "" || name == "sha384" {
+		return DefaultAlgorithm, true
+	}
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	algo, ok := algorithms.m[name]
+	return algo, ok
+}
+
+/*
+	Returns the names of all known algorithms, for listing in usage.
+*/
+func AlgorithmNames() []string {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	names := []string{"sha384"}
+	for name := range algorithms.m {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+/*
+	Returns the algorithm a hash string was made with.
+	Errors if it's tagged with an algorithm we don't know.
+*/
+func AlgorithmOf(hashStr string) (Algorithm, error) {
+	i := strings.IndexByte(hashStr, '-')
+	if i < 0 {
+		return DefaultAlgorithm, nil
+	}
+	tag := hashStr[:i]
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+	algo, ok := algorithms.m[tag]
+	if !ok {
+		return Algorithm{}, fmt.Errorf("unknown hash algorithm %q", tag)
+	}
+	return algo, nil
+}
+
+/*
+	Encodes a digest made by this algorithm as a hash string.
+*/
+func (a Algorithm) Format(digest []byte) string {
+	if a.Tag == "" {
+		return misc.Base58Encode(digest)
+	}
+	return a.Tag + "-" + misc.Base58Encode(digest)
+}
+
+/*
+	Returns the name of the algorithm, as accepted by LookupAlgorithm.
+*/
+func (a Algorithm) Name() string {
+	if a.Tag == "" {
+		return "sha384"
+	}
+	return a.Tag
+}
@@ -0,0 +1,60 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"crypto/sha512"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/polydawn/refmt/misc"
+)
+
+func TestAlgorithms(t *testing.T) {
+	Convey("Hash algorithms", t, func() {
+		digest := []byte{1, 2, 3, 4}
+		Convey("the default is untagged, for compatibility", func() {
+			str := DefaultAlgorithm.Format(digest)
+			So(str, ShouldEqual, misc.Base58Encode(digest))
+			algo, err := AlgorithmOf(str)
+			So(err, ShouldBeNil)
+			So(algo.Tag, ShouldEqual, "")
+		})
+		Convey("others are tagged, and detected by their tag", func() {
+			str := Algorithm_SHA256.Format(digest)
+			So(str, ShouldEqual, "sha256-"+misc.Base58Encode(digest))
+			algo, err := AlgorithmOf(str)
+			So(err, ShouldBeNil)
+			So(algo.Tag, ShouldEqual, "sha256")
+			So(algo.New().Size(), ShouldEqual, 32)
+		})
+		Convey("unknown tags are rejected", func() {
+			_, err := AlgorithmOf("md5-abcd")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("lookup by name", func() {
+			algo, ok := LookupAlgorithm("sha384")
+			So(ok, ShouldBeTrue)
+			So(algo.Tag, ShouldEqual, "")
+			_, ok = LookupAlgorithm("md5")
+			So(ok, ShouldBeFalse)
+			So(AlgorithmNames(), ShouldResemble, []string{"sha384", "sha256", "sha512"})
+		})
+		Convey("registering more", func() {
+			RegisterAlgorithm("testalgo", sha512.New512_256)
+			defer func() {
+				algorithms.Lock()
+				delete(algorithms.m, "testalgo")
+				algorithms.Unlock()
+			}()
+			algo, err := AlgorithmOf("testalgo-abcd")
+			So(err, ShouldBeNil)
+			So(algo.Tag, ShouldEqual, "testalgo")
+			So(func() { RegisterAlgorithm("testalgo", sha512.New) }, ShouldPanic)
+			So(func() { RegisterAlgorithm("Bad-Tag", sha512.New) }, ShouldPanic)
+		})
+	})
+}
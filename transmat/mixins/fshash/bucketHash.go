@@ -40,6 +40,21 @@ import (
 	is computed deterministically and unambiguously.
 */
 func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
+	return HashBucketTrees(bucket, hasherFactory, nil)
+}
+
+/*
+	Does the same as HashBucket, and also calls `visit` with the hash of every
+	directory's subtree (in post-order, so the root is last).
+
+	Each subtree hash is the hash that directory's contents would have
+	if they were hashed alone: i.e. as if the directory were the root,
+	so it is equal to the hash you'd get from packing just that directory.
+	(The root's subtree hash is simply the same as the returned root hash.)
+	Since metadata hashes contain only basenames, all of a directory's
+	children hash identically either way; only the directory's own name differs.
+*/
+func HashBucketTrees(bucket Bucket, hasherFactory func() hash.Hash, visit func(dir fs.RelPath, hash []byte)) []byte {
 	// At every point in the visitation, children need to submit their hashes back up the tree.
 	// Prime the pump with a special reaction for when the root returns; every directory preVisit attaches hoppers for children thereon.
 	upsubs := make(upsubStack, 0)
@@ -49,6 +64,9 @@ func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
 	})
 	// Also keep a stack of hashers in use because they jump across the pre/post visit gap.
 	hashers := make(hasherStack, 0)
+	// And if we're reporting subtrees, a parallel stack of hashers for each dir as if it were the root.
+	//  (It's nil for the root itself, since it already is.)
+	rootedHashers := make(hasherStack, 0)
 	// Keep a count of how many nodes visited in total.  Cheap sanity check.
 	var visitCount int
 
@@ -83,10 +101,29 @@ func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
 			//  The array will eventually be closed in the postVisit hook.
 			enc.Step(&tok.Token{Type: tok.TString, Str: "l"})
 			enc.Step(&tok.Token{Type: tok.TArrOpen, Length: -1})
+			// If reporting subtrees, start the same thing over again, but with the root's name.
+			//  Children's hashes go to both.
+			var rootedHasher hash.Hash
+			var rootedEnc *cbor.Encoder
+			if visit != nil && record.Metadata.Name != (fs.RelPath{}) {
+				rootedHasher = hasherFactory()
+				rootedEnc = cbor.NewEncoder(rootedHasher)
+				rootedMeta := record.Metadata
+				rootedMeta.Name = fs.RelPath{}
+				rootedEnc.Step(&tok.Token{Type: tok.TMapOpen, Length: 2})
+				rootedEnc.Step(&tok.Token{Type: tok.TString, Str: "m"})
+				marshalMetadata(rootedEnc, rootedMeta)
+				rootedEnc.Step(&tok.Token{Type: tok.TString, Str: "l"})
+				rootedEnc.Step(&tok.Token{Type: tok.TArrOpen, Length: -1})
+			}
 			upsubs.Push(func(x []byte) {
 				enc.Step(&tok.Token{Type: tok.TBytes, Bytes: x})
+				if rootedEnc != nil {
+					rootedEnc.Step(&tok.Token{Type: tok.TBytes, Bytes: x})
+				}
 			})
 			hashers.Push(hasher)
+			rootedHashers.Push(rootedHasher)
 		case fs.Type_File:
 			// heap the object's content hash in
 			enc.Step(&tok.Token{Type: tok.TString, Str: "h"})
@@ -110,6 +147,13 @@ func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
 			upsubs.Pop()
 			// hash and upsub
 			upsubs.Peek()(hash)
+			// report the subtree, if anyone's listening
+			if rootedHasher := rootedHashers.Pop(); rootedHasher != nil {
+				rootedHasher.Write([]byte{0xff})
+				visit(record.Metadata.Name, rootedHasher.Sum(nil))
+			} else if visit != nil {
+				visit(record.Metadata.Name, hash)
+			}
 		default:
 		}
 		return nil
@@ -120,7 +164,7 @@ func HashBucket(bucket Bucket, hasherFactory func() hash.Hash) []byte {
 	}
 	// Sanity check no node left behind
 	_ = upsubs.Pop()
-	if !upsubs.Empty() || !hashers.Empty() {
+	if !upsubs.Empty() || !hashers.Empty() || !rootedHashers.Empty() {
 		panic(fmt.Errorf("invariant failed after bucket records walk: stacks not empty"))
 	}
 	if visitCount != bucket.Length() {
@@ -0,0 +1,424 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/lib/treewalk"
+)
+
+var _ Bucket = &DiskBucket{}
+
+/*
+	DiskBucket is a Bucket for filesets too large to comfortably hold
+	in memory.
+
+	Records are buffered in memory until there are `runLength` of them;
+	then the buffer is sorted and spilled to a file in a temp dir as a "run".
+	Iteration does a merge of all the runs (plus whatever is still buffered),
+	so the walk is in exactly the same order as MemoryBucket's, and the
+	same checks for repeated paths and missing trees are applied.
+	HashBucket will thus produce the same hash from either.
+
+	If fewer than `runLength` records are ever added, nothing touches disk
+	and this behaves just like a MemoryBucket.
+
+	AddRecord has no error return, so any error while spilling is kept and
+	reported by `Err`; check it before iterating.  (Iterating a bucket with
+	an error will panic with it.)  Errors reading back a spilled run during
+	iteration will also panic, like the other invariant checks in iteration.
+
+	Call `Close` when done to remove the temp files.
+*/
+type DiskBucket struct {
+	dir       string   // parent for our tempdir.  Empty string means the os default.
+	runLength int      // records to buffer before spilling.
+	tmpDir    string   // created on first spill.
+	runs      []string // paths of spilled runs.
+	lines     []Record // records not yet spilled.
+	length    int
+	root      Record
+	open      []*os.File // run files open for the most recent iteration.
+	err       error
+}
+
+/*
+	Returns a new DiskBucket which will spill runs of `runLength` records
+	into a new temp dir under `dir` (or the os default temp dir, if `dir` is blank).
+*/
+func NewDiskBucket(dir string, runLength int) *DiskBucket {
+	if runLength < 1 {
+		runLength = 1
+	}
+	return &DiskBucket{dir: dir, runLength: runLength}
+}
+
+func (b *DiskBucket) AddRecord(metadata fs.Metadata, contentHash []byte) {
+	name := metadata.Name.String()
+	if metadata.Type == fs.Type_Dir {
+		name += "/"
+	}
+	if b.length == 0 {
+		b.root = Record{name, metadata, contentHash}
+	}
+	b.length++
+	b.lines = append(b.lines, Record{name, metadata, contentHash})
+	if len(b.lines) >= b.runLength && b.err == nil {
+		b.err = b.spill()
+	}
+}
+
+/*
+	Sort the buffered records and write them out as a new run.
+*/
+func (b *DiskBucket) spill() error {
+	if b.tmpDir == "" {
+		tmpDir, err := ioutil.TempDir(b.dir, "rio-fshash-")
+		if err != nil {
+			return fmt.Errorf("cannot create dir for spilling fshash bucket: %s", err)
+		}
+		b.tmpDir = tmpDir
+	}
+	sort.Sort(recordsByFilename(b.lines))
+	pth := filepath.Join(b.tmpDir, fmt.Sprintf("run-%d", len(b.runs)))
+	f, err := os.OpenFile(pth, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot spill fshash bucket: %s", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, record := range b.lines {
+		writeRecord(w, record)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("cannot spill fshash bucket: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot spill fshash bucket: %s", err)
+	}
+	b.runs = append(b.runs, pth)
+	b.lines = b.lines[:0]
+	return nil
+}
+
+/*
+	Returns the first error encountered while spilling records to disk, if any.
+*/
+func (b *DiskBucket) Err() error {
+	return b.err
+}
+
+/*
+	Get a `treewalk.Node` that starts at the root of the bucket.
+	The walk will be in deterministic, sorted order (and thus is appropriate
+	for hashing).  See MemoryBucket.Iterator for the same contract.
+
+	Unlike MemoryBucket, each Iterator call starts a fresh merge, so
+	it's fine to iterate more than once, but not to interleave iterators.
+*/
+func (b *DiskBucket) Iterator() RecordIterator {
+	if b.err != nil {
+		panic(b.err)
+	}
+	b.closeRuns()
+	sort.Sort(recordsByFilename(b.lines))
+	cursor := &mergeCursor{}
+	cursor.sources = append(cursor.sources, &sliceSource{lines: b.lines})
+	for _, pth := range b.runs {
+		f, err := os.Open(pth)
+		if err != nil {
+			panic(fmt.Errorf("cannot read spilled fshash bucket: %s", err))
+		}
+		b.open = append(b.open, f)
+		cursor.sources = append(cursor.sources, &runSource{r: bufio.NewReader(f)})
+	}
+	cursor.init()
+	root, ok := cursor.pop()
+	if !ok {
+		// Empty bucket.  Same as MemoryBucket, the walk will blow up if you try it.
+		return &diskBucketIterator{Record{}, cursor}
+	}
+	if root.Metadata.Name != (fs.RelPath{}) {
+		panic(ErrInvalidFilesystem{fmt.Sprintf("missing root (first entry: %q)", root.Metadata.Name)})
+	}
+	b.root = root
+	cursor.last = root
+	return &diskBucketIterator{root, cursor}
+}
+
+func (b *DiskBucket) Root() Record {
+	return b.root
+}
+
+func (b *DiskBucket) Length() int {
+	return b.length
+}
+
+/*
+	Removes any spilled runs.  The bucket must not be used after this.
+*/
+func (b *DiskBucket) Close() error {
+	b.closeRuns()
+	b.lines = nil
+	if b.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tmpDir)
+}
+
+func (b *DiskBucket) closeRuns() {
+	for _, f := range b.open {
+		f.Close()
+	}
+	b.open = nil
+}
+
+type diskBucketIterator struct {
+	record Record
+	cursor *mergeCursor // shared by all nodes in one walk; same trick as memoryBucketIterator's `that`.
+}
+
+func (i *diskBucketIterator) NextChild() treewalk.Node {
+	next, ok := i.cursor.peek()
+	if !ok {
+		return nil
+	}
+	thisName := i.record.Name
+	// is the next one still a child?
+	if strings.HasPrefix(next.Name, thisName) {
+		// check for repeated names
+		if i.cursor.last.Name == next.Name {
+			panic(ErrInvalidFilesystem{fmt.Sprintf("repeated path: %q", next.Name)})
+		}
+		// check for missing trees
+		if strings.ContainsRune(next.Name[len(thisName):len(next.Name)-1], '/') {
+			panic(ErrInvalidFilesystem{fmt.Sprintf("missing tree: %q followed %q", next.Name, thisName)})
+		}
+		// step forward
+		i.cursor.pop()
+		i.cursor.last = next
+		return &diskBucketIterator{next, i.cursor}
+	}
+	return nil
+}
+
+func (i *diskBucketIterator) Record() Record {
+	return i.record
+}
+
+/*
+	A source of records in sorted order: either a spilled run, or the in-memory remainder.
+*/
+type recordSource interface {
+	next() (Record, bool)
+}
+
+type sliceSource struct {
+	lines []Record
+	i     int
+}
+
+func (s *sliceSource) next() (Record, bool) {
+	if s.i >= len(s.lines) {
+		return Record{}, false
+	}
+	s.i++
+	return s.lines[s.i-1], true
+}
+
+type runSource struct {
+	r *bufio.Reader
+}
+
+func (s *runSource) next() (Record, bool) {
+	record, err := readRecord(s.r)
+	if err == io.EOF {
+		return Record{}, false
+	} else if err != nil {
+		panic(fmt.Errorf("cannot read spilled fshash bucket: %s", err))
+	}
+	return record, true
+}
+
+/*
+	Does a k-way merge over sorted sources.
+	Keeps the head record of every non-exhausted source in a heap.
+*/
+type mergeCursor struct {
+	sources []recordSource
+	heads   mergeHeap
+	last    Record // the last record popped by the walk; for spotting repeats.
+}
+
+type mergeHead struct {
+	record Record
+	source recordSource
+}
+
+func (c *mergeCursor) init() {
+	for _, src := range c.sources {
+		if record, ok := src.next(); ok {
+			c.heads = append(c.heads, mergeHead{record, src})
+		}
+	}
+	heap.Init(&c.heads)
+}
+
+func (c *mergeCursor) peek() (Record, bool) {
+	if len(c.heads) == 0 {
+		return Record{}, false
+	}
+	return c.heads[0].record, true
+}
+
+func (c *mergeCursor) pop() (Record, bool) {
+	if len(c.heads) == 0 {
+		return Record{}, false
+	}
+	head := c.heads[0]
+	if record, ok := head.source.next(); ok {
+		c.heads[0].record = record
+		heap.Fix(&c.heads, 0)
+	} else {
+		heap.Pop(&c.heads)
+	}
+	return head.record, true
+}
+
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].record.Name < h[j].record.Name }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
+
+// Serial form for spilled records.
+//  This is private to one process and one bucket, so it's as dumb as it can be:
+//  fields in struct order, ints as varints, strings and bytes length-prefixed.
+//  The content hash has a length of -1 to distinguish nil.
+
+func writeRecord(w *bufio.Writer, r Record) {
+	m := r.Metadata
+	writeString(w, r.Name)
+	writeString(w, m.Name.String())
+	writeVarint(w, int64(m.Type))
+	writeVarint(w, int64(m.Perms))
+	writeVarint(w, int64(m.Uid))
+	writeVarint(w, int64(m.Gid))
+	writeVarint(w, m.Size)
+	writeString(w, m.Linkname)
+	writeVarint(w, m.Devmajor)
+	writeVarint(w, m.Devminor)
+	writeVarint(w, m.Mtime.Unix())
+	writeVarint(w, int64(m.Mtime.Nanosecond()))
+	writeVarint(w, int64(len(m.Xattrs)))
+	for k, v := range m.Xattrs {
+		writeString(w, k)
+		writeString(w, v)
+	}
+	if r.ContentHash == nil {
+		writeVarint(w, -1)
+	} else {
+		writeVarint(w, int64(len(r.ContentHash)))
+		w.Write(r.ContentHash)
+	}
+}
+
+func readRecord(r *bufio.Reader) (Record, error) {
+	var rr recordReader
+	rr.r = r
+	var record Record
+	record.Name = rr.string()
+	if rr.err != nil {
+		return Record{}, rr.err // includes a clean io.EOF if there are no more records.
+	}
+	m := &record.Metadata
+	m.Name = fs.MustRelPath(rr.string())
+	m.Type = fs.Type(rr.varint())
+	m.Perms = fs.Perms(rr.varint())
+	m.Uid = uint32(rr.varint())
+	m.Gid = uint32(rr.varint())
+	m.Size = rr.varint()
+	m.Linkname = rr.string()
+	m.Devmajor = rr.varint()
+	m.Devminor = rr.varint()
+	sec := rr.varint()
+	nsec := rr.varint()
+	m.Mtime = time.Unix(sec, nsec).UTC()
+	if n := rr.varint(); n > 0 {
+		m.Xattrs = make(map[string]string, n)
+		for ; n > 0; n-- {
+			k := rr.string()
+			m.Xattrs[k] = rr.string()
+		}
+	}
+	if n := rr.varint(); n >= 0 {
+		record.ContentHash = rr.bytes(n)
+	}
+	if rr.err == io.EOF {
+		rr.err = io.ErrUnexpectedEOF
+	}
+	return record, rr.err
+}
+
+func writeVarint(w *bufio.Writer, x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutVarint(buf[:], x)])
+}
+
+func writeString(w *bufio.Writer, s string) {
+	writeVarint(w, int64(len(s)))
+	w.WriteString(s)
+}
+
+// Keeps the first error and makes every later read a no-op, so readRecord can check once.
+type recordReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (rr *recordReader) varint() int64 {
+	if rr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(rr.r)
+	rr.err = err
+	return x
+}
+
+func (rr *recordReader) bytes(n int64) []byte {
+	if rr.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	_, rr.err = io.ReadFull(rr.r, buf)
+	return buf
+}
+
+func (rr *recordReader) string() string {
+	n := rr.varint()
+	if rr.err != nil {
+		return ""
+	}
+	return string(rr.bytes(n))
+}
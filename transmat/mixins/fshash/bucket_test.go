@@ -4,3 +4,153 @@ Sniperkit-Bot
 */
 
 package fshash
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	Some dirs and files, with a few of every kind of field that gets spilled,
+	in a random order.  Every path is under `prefix`; the root is always included.
+*/
+func fixtureRecords(prefix string) []Record {
+	name := func(format string, args ...interface{}) fs.RelPath {
+		return fs.MustRelPath(path.Join(prefix, fmt.Sprintf(format, args...)))
+	}
+	var records []Record
+	for _, dirName := range fs.MustRelPath(prefix).Split() {
+		dir := DefaultDirMetadata()
+		dir.Name = dirName
+		records = append(records, Record{Metadata: dir})
+	}
+	for i := 0; i < 10; i++ {
+		dir := DefaultDirMetadata()
+		dir.Name = name("d%d", i)
+		records = append(records, Record{Metadata: dir})
+		for j := 0; j < 10; j++ {
+			records = append(records, Record{
+				Metadata: fs.Metadata{
+					Name:   name("d%d/f%d", i, j),
+					Type:   fs.Type_File,
+					Perms:  0644,
+					Uid:    uint32(i),
+					Gid:    uint32(j),
+					Size:   int64(i * j),
+					Mtime:  time.Unix(int64(1000*i), int64(j)),
+					Xattrs: map[string]string{"user.a": "1", "user.b": fmt.Sprint(j)},
+				},
+				ContentHash: []byte{byte(i), byte(j)},
+			})
+		}
+		records = append(records, Record{Metadata: fs.Metadata{
+			Name:     name("d%d/lnk", i),
+			Type:     fs.Type_Symlink,
+			Linkname: "../elsewhere",
+			Mtime:    time.Unix(-1, 0),
+		}})
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+	return records
+}
+
+func fill(b Bucket, records []Record) {
+	for _, r := range records {
+		b.AddRecord(r.Metadata, r.ContentHash)
+	}
+}
+
+func TestDiskBucket(t *testing.T) {
+	records := fixtureRecords(".")
+	tmpDir, err := ioutil.TempDir("", "rio-test-fshash-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	Convey("DiskBucket hashes the same as MemoryBucket", t, func() {
+		mb := &MemoryBucket{}
+		fill(mb, records)
+		expect := HashBucket(mb, sha512.New384)
+		for _, runLength := range []int{1, 7, 1000} {
+			Convey(fmt.Sprintf("with runs of %d", runLength), func() {
+				db := NewDiskBucket(tmpDir, runLength)
+				defer db.Close()
+				fill(db, records)
+				So(db.Err(), ShouldBeNil)
+				So(db.Length(), ShouldEqual, mb.Length())
+				So(HashBucket(db, sha512.New384), ShouldResemble, expect)
+				So(db.Root().Metadata.Name, ShouldResemble, fs.RelPath{})
+
+				Convey("and again on a second iteration", func() {
+					So(HashBucket(db, sha512.New384), ShouldResemble, expect)
+				})
+			})
+		}
+		Convey("and cleans up after itself", func() {
+			db := NewDiskBucket(tmpDir, 3)
+			fill(db, records)
+			HashBucket(db, sha512.New384)
+			So(db.Close(), ShouldBeNil)
+			names, err := ioutil.ReadDir(tmpDir)
+			So(err, ShouldBeNil)
+			So(names, ShouldHaveLength, 0)
+		})
+	})
+
+	Convey("DiskBucket rejects invalid filesystems", t, func() {
+		db := NewDiskBucket(tmpDir, 5)
+		defer db.Close()
+		Convey("with a repeated path", func() {
+			dup := fs.Metadata{Name: fs.MustRelPath("d3/f4"), Type: fs.Type_File}
+			fill(db, append(records, Record{Metadata: dup}))
+			So(hashPanic(db), ShouldResemble, ErrInvalidFilesystem{`repeated path: "./d3/f4"`})
+		})
+		Convey("with a missing tree", func() {
+			orphan := fs.Metadata{Name: fs.MustRelPath("nope/f"), Type: fs.Type_File}
+			fill(db, append(records, Record{Metadata: orphan}))
+			So(hashPanic(db), ShouldResemble, ErrInvalidFilesystem{`missing tree: "./nope/f" followed "./"`})
+		})
+		Convey("with a missing root", func() {
+			db.AddRecord(fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File}, nil)
+			So(func() { db.Iterator() }, ShouldPanic)
+		})
+	})
+}
+
+func hashPanic(b Bucket) (e interface{}) {
+	defer func() { e = recover() }()
+	HashBucket(b, sha512.New384)
+	return nil
+}
+
+func TestHashBucketTrees(t *testing.T) {
+	Convey("Subtree hashes equal the hashes of the subtrees alone", t, func() {
+		b := &MemoryBucket{}
+		fill(b, fixtureRecords("deep/er"))
+		trees := map[fs.RelPath][]byte{}
+		root := HashBucketTrees(b, sha512.New384, func(dir fs.RelPath, hash []byte) {
+			trees[dir] = hash
+		})
+		So(trees, ShouldHaveLength, 13)
+		So(trees[fs.RelPath{}], ShouldResemble, root)
+		So(root, ShouldResemble, HashBucket(b, sha512.New384))
+
+		alone := &MemoryBucket{}
+		fill(alone, fixtureRecords("."))
+		So(trees[fs.MustRelPath("deep/er")], ShouldResemble, HashBucket(alone, sha512.New384))
+		So(trees[fs.MustRelPath("deep")], ShouldNotResemble, trees[fs.MustRelPath("deep/er")])
+		So(trees[fs.MustRelPath("deep/er/d1")], ShouldNotResemble, trees[fs.MustRelPath("deep/er/d2")])
+	})
+}
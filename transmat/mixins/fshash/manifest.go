@@ -0,0 +1,103 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/polydawn/refmt/misc"
+	"go.polydawn.net/rio/lib/treewalk"
+)
+
+/*
+	A manifest is the records of a bucket written out in a stable serial form,
+	so they can be kept alongside a fileset and compared with it later
+	(or loaded back into a bucket and hashed, giving the same WareID).
+
+	The format is JSON lines: first a header naming the format version and
+	hash algorithm, then one line per record in the bucket's (sorted) walk order.
+	Records use the same fields as proofs, plus the size and content hash.
+	The same records always produce byte-identical manifests.
+*/
+const manifestVersion = 1
+
+type manifestHeader struct {
+	Manifest  int    `json:"manifest"`
+	Algorithm string `json:"algorithm"`
+}
+
+type manifestRecord struct {
+	serialMetadata
+	Size        int64  `json:"size,omitempty"`
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+/*
+	Writes a manifest of all the records in the bucket.
+	`algo` should be the algorithm the content hashes were made with.
+*/
+func WriteManifest(w io.Writer, bucket Bucket, algo Algorithm) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(manifestHeader{manifestVersion, algo.Name()}); err != nil {
+		return err
+	}
+	return treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		mr := manifestRecord{
+			serialMetadata: serializeMetadata(record.Metadata),
+			Size:           record.Metadata.Size,
+		}
+		if record.ContentHash != nil {
+			mr.ContentHash = misc.Base58Encode(record.ContentHash)
+		}
+		return enc.Encode(mr)
+	}, nil)
+}
+
+/*
+	Reads a manifest, adding each of its records to the bucket.
+	Returns the algorithm the manifest's content hashes were made with.
+*/
+func ReadManifest(r io.Reader, bucket Bucket) (Algorithm, error) {
+	dec := json.NewDecoder(r)
+	var hdr manifestHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return Algorithm{}, fmt.Errorf("invalid manifest: %s", err)
+	}
+	if hdr.Manifest != manifestVersion {
+		return Algorithm{}, fmt.Errorf("invalid manifest: unsupported version %d", hdr.Manifest)
+	}
+	algo, ok := LookupAlgorithm(hdr.Algorithm)
+	if !ok {
+		return Algorithm{}, fmt.Errorf("invalid manifest: unknown hash algorithm %q", hdr.Algorithm)
+	}
+	for line := 2; ; line++ {
+		var mr manifestRecord
+		switch err := dec.Decode(&mr); err {
+		case nil:
+			// pass
+		case io.EOF:
+			return algo, nil
+		default:
+			return Algorithm{}, fmt.Errorf("invalid manifest: line %d: %s", line, err)
+		}
+		fmeta, err := deserializeMetadata(mr.serialMetadata)
+		if err != nil {
+			return Algorithm{}, fmt.Errorf("invalid manifest: line %d: %s", line, err)
+		}
+		fmeta.Size = mr.Size
+		var contentHash []byte
+		if mr.ContentHash != "" {
+			if contentHash, err = decodeHash(mr.ContentHash); err != nil {
+				return Algorithm{}, fmt.Errorf("invalid manifest: line %d: %s", line, err)
+			}
+		}
+		bucket.AddRecord(fmeta, contentHash)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManifests(t *testing.T) {
+	Convey("Manifests round-trip buckets", t, func() {
+		b := &MemoryBucket{}
+		fill(b, fixtureRecords("deep/er"))
+		var buf bytes.Buffer
+		So(WriteManifest(&buf, b, Algorithm_SHA256), ShouldBeNil)
+		So(strings.SplitN(buf.String(), "\n", 2)[0], ShouldEqual, `{"manifest":1,"algorithm":"sha256"}`)
+
+		b2 := &MemoryBucket{}
+		algo, err := ReadManifest(bytes.NewReader(buf.Bytes()), b2)
+		So(err, ShouldBeNil)
+		So(algo.Tag, ShouldEqual, "sha256")
+		So(b2.Length(), ShouldEqual, b.Length())
+		So(HashBucket(b2, sha512.New384), ShouldResemble, HashBucket(b, sha512.New384))
+
+		Convey("and are stable", func() {
+			var buf2 bytes.Buffer
+			So(WriteManifest(&buf2, b2, Algorithm_SHA256), ShouldBeNil)
+			So(buf2.String(), ShouldEqual, buf.String())
+		})
+	})
+
+	Convey("Invalid manifests are rejected", t, func() {
+		for _, tr := range []struct{ name, manifest string }{
+			{"empty", ``},
+			{"wrong version", `{"manifest":2,"algorithm":"sha384"}`},
+			{"unknown algorithm", `{"manifest":1,"algorithm":"md5"}`},
+			{"bad record", "{\"manifest\":1,\"algorithm\":\"sha384\"}\n{\"name\":\"/abs\",\"type\":\"f\",\"mtime\":\"2010-01-01T00:00:00Z\"}"},
+			{"bad hash", "{\"manifest\":1,\"algorithm\":\"sha384\"}\n{\"name\":\"f\",\"type\":\"f\",\"mtime\":\"2010-01-01T00:00:00Z\",\"contentHash\":\"0OIl\"}"},
+		} {
+			Convey(tr.name, func() {
+				_, err := ReadManifest(strings.NewReader(tr.manifest), &MemoryBucket{})
+				So(err, ShouldNotBeNil)
+			})
+		}
+	})
+}
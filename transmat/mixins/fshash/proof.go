@@ -0,0 +1,285 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/polydawn/refmt/cbor"
+	"github.com/polydawn/refmt/misc"
+	"github.com/polydawn/refmt/tok"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/lib/treewalk"
+)
+
+/*
+	A Proof shows that a single entry (with exactly the given metadata and
+	content hash) is part of a fileset with a certain tree hash, without
+	needing the rest of the fileset.
+
+	It holds the entry itself, and then for each directory from the entry's
+	parent up to the root: that directory's metadata, and the hashes of its
+	other children (the siblings of the path), split around the position
+	where the path's own child hash goes.  That's everything needed to
+	recompute each node hash in turn, exactly as HashBucket does, up to the root.
+
+	Only what the tree hash covers is proven: in particular, sizes aren't
+	part of the hash, so they aren't in the proof either.  Nor are entries
+	other than files and dirs: HashBucket doesn't include them in their
+	parent dir's hash, so there's nothing to prove them with.
+*/
+type Proof struct {
+	Entry       fs.Metadata // The entry proven.  Its name is the full path.
+	ContentHash []byte      // If the entry is a file: the hash of its content.
+	Children    [][]byte    // If the entry is a dir: the hashes of its own children.
+	Steps       []ProofStep // One per parent dir, from the entry's parent to the root.
+}
+
+type ProofStep struct {
+	Metadata fs.Metadata // The directory.  Its name is the full path.
+	Before   [][]byte    // Hashes of the children sorted before the path.
+	After    [][]byte    // Hashes of the children sorted after the path.
+}
+
+/*
+	Walks the tree of files in the bucket exactly as HashBucket does,
+	and returns a proof that the entry at `path` is included in it.
+
+	Errors if there's no entry at that path, or if it's not a file or dir.
+*/
+func ProveBucket(bucket Bucket, hasherFactory func() hash.Hash, path fs.RelPath) (Proof, error) {
+	// Each dir on the stack gathers its children's hashes.
+	//  For dirs on the path, we also note where the path's child landed.
+	type frame struct {
+		hashes [][]byte
+		onPath int // Index in hashes of the path's child, or -1.
+	}
+	var stack []*frame
+	var rootHash []byte
+	var proof Proof
+	var found bool
+	onPath := func(name fs.RelPath) bool {
+		return name == path || name == (fs.RelPath{}) || strings.HasPrefix(path.String(), name.String()+"/")
+	}
+	upsub := func(name fs.RelPath, x []byte) {
+		if len(stack) == 0 {
+			rootHash = x
+			return
+		}
+		top := stack[len(stack)-1]
+		if onPath(name) {
+			top.onPath = len(top.hashes)
+		}
+		top.hashes = append(top.hashes, x)
+	}
+
+	preVisit := func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		switch record.Metadata.Type {
+		case fs.Type_Dir:
+			stack = append(stack, &frame{onPath: -1})
+		case fs.Type_File:
+			if record.Metadata.Name == path {
+				proof.Entry = record.Metadata
+				proof.ContentHash = record.ContentHash
+				found = true
+			}
+			upsub(record.Metadata.Name, hashEntry(hasherFactory, record.Metadata, record.ContentHash, nil))
+		default:
+			// Not part of the tree hash (see HashBucket), so no upsub.
+			if record.Metadata.Name == path {
+				proof.Entry = record.Metadata
+				found = true
+			}
+		}
+		return nil
+	}
+	postVisit := func(node treewalk.Node) error {
+		record := node.(RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch {
+		case record.Metadata.Name == path:
+			proof.Entry = record.Metadata
+			proof.Children = top.hashes
+			found = true
+		case top.onPath >= 0:
+			proof.Steps = append(proof.Steps, ProofStep{
+				Metadata: record.Metadata,
+				Before:   top.hashes[:top.onPath],
+				After:    top.hashes[top.onPath+1:],
+			})
+		}
+		upsub(record.Metadata.Name, hashEntry(hasherFactory, record.Metadata, nil, top.hashes))
+		return nil
+	}
+	if err := treewalk.Walk(bucket.Iterator(), preVisit, postVisit); err != nil {
+		panic(err) // none of our code has known believable error returns.
+	}
+	if rootHash == nil {
+		panic(fmt.Errorf("invariant failed after bucket records walk: no root hash"))
+	}
+	switch {
+	case !found:
+		return Proof{}, fmt.Errorf("no entry at path %q", path)
+	case proof.Entry.Type != fs.Type_File && proof.Entry.Type != fs.Type_Dir:
+		return Proof{}, fmt.Errorf("entry at path %q is a %s; only files and dirs are covered by the tree hash", path, proof.Entry.Type)
+	}
+	return proof, nil
+}
+
+/*
+	Recomputes the root hash of the fileset the proof claims the entry is in.
+
+	Errors if the proof isn't shaped correctly: e.g. the steps don't name
+	each successive parent directory of the entry, or the last isn't the root.
+	A well-shaped proof isn't necessarily a true one, of course:
+	compare the result to the tree hash you expected.
+*/
+func (p Proof) Root(hasherFactory func() hash.Hash) ([]byte, error) {
+	if p.Entry.Type != fs.Type_File && p.Entry.Type != fs.Type_Dir {
+		return nil, fmt.Errorf("invalid proof: entry must be a file or dir")
+	}
+	if p.Entry.Name.GoesUp() {
+		return nil, fmt.Errorf("invalid proof: entry path %q leaves the fileset", p.Entry.Name)
+	}
+	parents := p.Entry.Name.SplitParent()
+	if len(p.Steps) != len(parents) {
+		return nil, fmt.Errorf("invalid proof: %d steps for entry %q, which has %d parents", len(p.Steps), p.Entry.Name, len(parents))
+	}
+	if p.Entry.Type == fs.Type_File && len(p.Children) > 0 {
+		return nil, fmt.Errorf("invalid proof: entry %q has children but isn't a dir", p.Entry.Name)
+	}
+	if p.Entry.Type == fs.Type_Dir && p.ContentHash != nil {
+		return nil, fmt.Errorf("invalid proof: entry %q has a content hash but isn't a file", p.Entry.Name)
+	}
+	x := hashEntry(hasherFactory, p.Entry, p.ContentHash, p.Children)
+	for i, step := range p.Steps {
+		if want := parents[len(parents)-1-i]; step.Metadata.Name != want {
+			return nil, fmt.Errorf("invalid proof: step %d is for %q, expected %q", i, step.Metadata.Name, want)
+		}
+		if step.Metadata.Type != fs.Type_Dir {
+			return nil, fmt.Errorf("invalid proof: step %d (%q) isn't a dir", i, step.Metadata.Name)
+		}
+		children := make([][]byte, 0, len(step.Before)+1+len(step.After))
+		children = append(children, step.Before...)
+		children = append(children, x)
+		children = append(children, step.After...)
+		x = hashEntry(hasherFactory, step.Metadata, nil, children)
+	}
+	return x, nil
+}
+
+/*
+	Hashes a single node of the tree, given its metadata and either its content
+	hash (for files) or its children's hashes (for dirs).
+	This is the same as HashBucket does in a streaming fashion.
+*/
+func hashEntry(hasherFactory func() hash.Hash, m fs.Metadata, contentHash []byte, children [][]byte) []byte {
+	hasher := hasherFactory()
+	enc := cbor.NewEncoder(hasher)
+	switch m.Type {
+	case fs.Type_Dir, fs.Type_File:
+		enc.Step(&tok.Token{Type: tok.TMapOpen, Length: 2})
+	default:
+		enc.Step(&tok.Token{Type: tok.TMapOpen, Length: 1})
+	}
+	enc.Step(&tok.Token{Type: tok.TString, Str: "m"})
+	marshalMetadata(enc, m)
+	switch m.Type {
+	case fs.Type_Dir:
+		enc.Step(&tok.Token{Type: tok.TString, Str: "l"})
+		enc.Step(&tok.Token{Type: tok.TArrOpen, Length: -1})
+		for _, child := range children {
+			enc.Step(&tok.Token{Type: tok.TBytes, Bytes: child})
+		}
+		hasher.Write([]byte{0xff}) // same reach-around as HashBucket.
+	case fs.Type_File:
+		enc.Step(&tok.Token{Type: tok.TString, Str: "h"})
+		enc.Step(&tok.Token{Type: tok.TBytes, Bytes: contentHash})
+	}
+	return hasher.Sum(nil)
+}
+
+/*
+	Proofs serialize as JSON, with hashes in base58 (like WareIDs),
+	so they can be read by a human as well as checked by a machine.
+*/
+type serialProof struct {
+	Entry       serialMetadata    `json:"entry"`
+	ContentHash string            `json:"contentHash,omitempty"`
+	Children    []string          `json:"children,omitempty"`
+	Steps       []serialProofStep `json:"steps"`
+}
+
+type serialProofStep struct {
+	Dir    serialMetadata `json:"dir"`
+	Before []string       `json:"before"`
+	After  []string       `json:"after"`
+}
+
+func (p Proof) MarshalJSON() ([]byte, error) {
+	sp := serialProof{
+		Entry:    serializeMetadata(p.Entry),
+		Children: encodeHashes(p.Children),
+		Steps:    make([]serialProofStep, len(p.Steps)),
+	}
+	if p.ContentHash != nil {
+		sp.ContentHash = misc.Base58Encode(p.ContentHash)
+	}
+	for i, step := range p.Steps {
+		sp.Steps[i] = serialProofStep{
+			Dir:    serializeMetadata(step.Metadata),
+			Before: encodeHashes(step.Before),
+			After:  encodeHashes(step.After),
+		}
+	}
+	return json.Marshal(sp)
+}
+
+func (p *Proof) UnmarshalJSON(b []byte) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("invalid proof: %s", err)
+		}
+	}()
+	var sp serialProof
+	if err := json.Unmarshal(b, &sp); err != nil {
+		return err
+	}
+	var q Proof
+	if q.Entry, err = deserializeMetadata(sp.Entry); err != nil {
+		return err
+	}
+	if sp.ContentHash != "" {
+		if q.ContentHash, err = decodeHash(sp.ContentHash); err != nil {
+			return err
+		}
+	}
+	if q.Children, err = decodeHashes(sp.Children); err != nil {
+		return err
+	}
+	q.Steps = make([]ProofStep, len(sp.Steps))
+	for i, step := range sp.Steps {
+		if q.Steps[i].Metadata, err = deserializeMetadata(step.Dir); err != nil {
+			return err
+		}
+		if q.Steps[i].Before, err = decodeHashes(step.Before); err != nil {
+			return err
+		}
+		if q.Steps[i].After, err = decodeHashes(step.After); err != nil {
+			return err
+		}
+	}
+	*p = q
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestProofs(t *testing.T) {
+	Convey("Proofs recompute the bucket's root hash", t, func() {
+		b := &MemoryBucket{}
+		fill(b, fixtureRecords("deep/er"))
+		root := HashBucket(b, sha512.New384)
+		for _, pathStr := range []string{"deep/er/d3/f4", "deep/er/d0/f0", "deep/er/d9", "deep", "."} {
+			Convey("for "+pathStr, func() {
+				proof, err := ProveBucket(b, sha512.New384, fs.MustRelPath(pathStr))
+				So(err, ShouldBeNil)
+				So(proof.Entry.Name, ShouldResemble, fs.MustRelPath(pathStr))
+				So(proof.Steps, ShouldHaveLength, len(fs.MustRelPath(pathStr).SplitParent()))
+				x, err := proof.Root(sha512.New384)
+				So(err, ShouldBeNil)
+				So(x, ShouldResemble, root)
+
+				Convey("and again after a round trip through JSON", func() {
+					msg, err := json.Marshal(proof)
+					So(err, ShouldBeNil)
+					var proof2 Proof
+					So(json.Unmarshal(msg, &proof2), ShouldBeNil)
+					x, err := proof2.Root(sha512.New384)
+					So(err, ShouldBeNil)
+					So(x, ShouldResemble, root)
+				})
+			})
+		}
+	})
+
+	Convey("Proofs for tampered entries don't", t, func() {
+		b := &MemoryBucket{}
+		fill(b, fixtureRecords("."))
+		root := HashBucket(b, sha512.New384)
+		proof, err := ProveBucket(b, sha512.New384, fs.MustRelPath("d3/f4"))
+		So(err, ShouldBeNil)
+
+		Convey("with different content", func() {
+			proof.ContentHash = []byte{9, 9}
+			x, err := proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(x, ShouldNotResemble, root)
+		})
+		Convey("with different metadata", func() {
+			proof.Entry.Perms = 0755
+			x, err := proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(x, ShouldNotResemble, root)
+		})
+		Convey("with a different path", func() {
+			proof.Entry.Name = fs.MustRelPath("d3/f5")
+			x, err := proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(x, ShouldNotResemble, root)
+		})
+		Convey("with siblings moved around", func() {
+			proof.Steps[0].Before, proof.Steps[0].After = proof.Steps[0].Before[1:], append(proof.Steps[0].After, proof.Steps[0].Before[0])
+			x, err := proof.Root(sha512.New384)
+			So(err, ShouldBeNil)
+			So(x, ShouldNotResemble, root)
+		})
+		Convey("with a step missing", func() {
+			proof.Steps = proof.Steps[1:]
+			_, err := proof.Root(sha512.New384)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("with a step for the wrong dir", func() {
+			proof.Steps[0].Metadata.Name = fs.MustRelPath("d4")
+			_, err := proof.Root(sha512.New384)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Proofs can't be made for entries outside the tree hash", t, func() {
+		b := &MemoryBucket{}
+		fill(b, fixtureRecords("."))
+		Convey("such as absent paths", func() {
+			_, err := ProveBucket(b, sha512.New384, fs.MustRelPath("d3/nope"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("or symlinks", func() {
+			_, err := ProveBucket(b, sha512.New384, fs.MustRelPath("d3/lnk"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,102 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package fshash
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/polydawn/refmt/misc"
+	"go.polydawn.net/rio/fs"
+)
+
+/*
+	The serial form of metadata used in proofs and manifests (both JSON).
+	Names are full paths, times are RFC3339, and hashes are base58 (like WareIDs).
+*/
+type serialMetadata struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Perms    fs.Perms          `json:"perms"`
+	Uid      uint32            `json:"uid"`
+	Gid      uint32            `json:"gid"`
+	Linkname string            `json:"linkname,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Mtime    string            `json:"mtime"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+}
+
+func serializeMetadata(m fs.Metadata) serialMetadata {
+	return serialMetadata{
+		Name:     m.Name.String(),
+		Type:     string(m.Type),
+		Perms:    m.Perms,
+		Uid:      m.Uid,
+		Gid:      m.Gid,
+		Linkname: m.Linkname,
+		Devmajor: m.Devmajor,
+		Devminor: m.Devminor,
+		Mtime:    m.Mtime.UTC().Format(time.RFC3339Nano),
+		Xattrs:   m.Xattrs,
+	}
+}
+
+func deserializeMetadata(sm serialMetadata) (fs.Metadata, error) {
+	if sm.Name == "" || sm.Name[0] == '/' {
+		return fs.Metadata{}, fmt.Errorf("entry name %q must be a relative path", sm.Name)
+	}
+	if len(sm.Type) != 1 {
+		return fs.Metadata{}, fmt.Errorf("entry type %q is not a type", sm.Type)
+	}
+	mtime, err := time.Parse(time.RFC3339Nano, sm.Mtime)
+	if err != nil {
+		return fs.Metadata{}, fmt.Errorf("entry mtime: %s", err)
+	}
+	return fs.Metadata{
+		Name:     fs.MustRelPath(sm.Name),
+		Type:     fs.Type(sm.Type[0]),
+		Perms:    sm.Perms,
+		Uid:      sm.Uid,
+		Gid:      sm.Gid,
+		Linkname: sm.Linkname,
+		Devmajor: sm.Devmajor,
+		Devminor: sm.Devminor,
+		Mtime:    mtime,
+		Xattrs:   sm.Xattrs,
+	}, nil
+}
+
+func encodeHashes(hs [][]byte) []string {
+	strs := make([]string, len(hs))
+	for i, h := range hs {
+		strs[i] = misc.Base58Encode(h)
+	}
+	return strs
+}
+
+func decodeHashes(strs []string) ([][]byte, error) {
+	if len(strs) == 0 {
+		return nil, nil
+	}
+	hs := make([][]byte, len(strs))
+	for i, s := range strs {
+		h, err := decodeHash(s)
+		if err != nil {
+			return nil, err
+		}
+		hs[i] = h
+	}
+	return hs, nil
+}
+
+func decodeHash(s string) ([]byte, error) {
+	h := misc.Base58Decode(s)
+	if len(h) == 0 {
+		return nil, fmt.Errorf("%q is not a base58 hash", s)
+	}
+	return h, nil
+}
@@ -0,0 +1,245 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Limits on how much an unpack may write, so that a hostile or broken ware
+	(a "tar bomb", or a git repo with a million empty files) can't fill the disk.
+
+	Transmats make a Tracker for each unpack, and report each entry and
+	wrap each body reader with it as they go.  (A nil Tracker has no limits;
+	that's for the other operations which read wares, like scan and mirror.)  Exceeding any limit is an
+	ErrLimitExceeded error; wrap the unpack func with RollbackOnExceeded to
+	remove whatever was already placed when that happens.
+
+	Limits apply to unpacking; placing a fileset which is already in the
+	cache doesn't unpack anything, so isn't checked again.
+*/
+package limits
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/fsOp"
+)
+
+/*
+	Returned when an unpack is aborted for exceeding one of its limits.
+*/
+const ErrLimitExceeded = rio.ErrorCategory("rio-limit-exceeded")
+
+/*
+	Limits for a single unpack.  Zero means no limit.
+*/
+type Limits struct {
+	TotalBytes int64 // Content bytes, summed over all files.
+	FileBytes  int64 // Content bytes of any one file.
+	Entries    int64 // Number of entries (files, dirs, symlinks, etc).
+	PathDepth  int64 // Number of path segments (e.g. "a/b/c" is 3).
+	PathLength int64 // Bytes in a path (without the leading "./").
+}
+
+/*
+	Returns the limits configured for this host (see config.GetUnpackLimits).
+*/
+func FromConfig() (Limits, error) {
+	var l Limits
+	var err error
+	l.TotalBytes, l.FileBytes, l.Entries, l.PathDepth, l.PathLength, err = config.GetUnpackLimits()
+	return l, err
+}
+
+/*
+	Keeps the running totals for one unpack.
+*/
+type Tracker struct {
+	limits  Limits
+	bytes   int64
+	entries int64
+	err     error
+}
+
+func (l Limits) Track() *Tracker {
+	return &Tracker{limits: l}
+}
+
+/*
+	Counts an entry, and checks its path (and its size, if it's a file that
+	declares one) against the limits.  Call this before placing the entry.
+*/
+func (t *Tracker) Entry(fmeta fs.Metadata) error {
+	if t == nil {
+		return nil
+	}
+	t.entries++
+	if over(t.limits.Entries, t.entries) {
+		return t.exceeded("entries", t.limits.Entries, fmeta.Name, "more than %d entries", t.limits.Entries)
+	}
+	name := strings.TrimPrefix(fmeta.Name.String(), "./")
+	if depth := int64(strings.Count(name, "/") + 1); fmeta.Name != (fs.RelPath{}) && over(t.limits.PathDepth, depth) {
+		return t.exceeded("path-depth", t.limits.PathDepth, fmeta.Name, "path %q is %d deep", fmeta.Name, depth)
+	}
+	if over(t.limits.PathLength, int64(len(name))) {
+		return t.exceeded("path-length", t.limits.PathLength, fmeta.Name, "path %q is %d bytes long", fmeta.Name, len(name))
+	}
+	if fmeta.Type == fs.Type_File {
+		if over(t.limits.FileBytes, fmeta.Size) {
+			return t.exceeded("file-bytes", t.limits.FileBytes, fmeta.Name, "file %q is %d bytes", fmeta.Name, fmeta.Size)
+		}
+		if over(t.limits.TotalBytes, t.bytes+fmeta.Size) {
+			return t.exceeded("bytes", t.limits.TotalBytes, fmeta.Name, "more than %d bytes of content", t.limits.TotalBytes)
+		}
+	}
+	return nil
+}
+
+/*
+	Wraps a file's body reader to count the bytes read from it, which
+	errors as soon as that's more than the limits allow.
+
+	Whatever's copying from the reader will likely wrap that error in its own
+	(losing the category), so check Err when placement fails.
+*/
+func (t *Tracker) Body(name fs.RelPath, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &countingReader{t, name, r, 0}
+}
+
+/*
+	Returns the error for the first limit exceeded, if any.
+*/
+func (t *Tracker) Err() error {
+	if t == nil {
+		return nil
+	}
+	return t.err
+}
+
+func (t *Tracker) exceeded(limit string, max int64, path fs.RelPath, format string, args ...interface{}) error {
+	if t.err == nil {
+		t.err = ErrorDetailed(
+			ErrLimitExceeded,
+			fmt.Sprintf("unpack limit exceeded: "+format, args...),
+			map[string]string{
+				"limit": limit,
+				"max":   fmt.Sprint(max),
+				"path":  path.String(),
+			},
+		)
+	}
+	return t.err
+}
+
+func over(limit, n int64) bool {
+	return limit > 0 && n > limit
+}
+
+type countingReader struct {
+	t     *Tracker
+	name  fs.RelPath
+	r     io.Reader
+	bytes int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.bytes += int64(n)
+	cr.t.bytes += int64(n)
+	if over(cr.t.limits.FileBytes, cr.bytes) {
+		return n, cr.t.exceeded("file-bytes", cr.t.limits.FileBytes, cr.name, "file %q is more than %d bytes", cr.name, cr.t.limits.FileBytes)
+	}
+	if over(cr.t.limits.TotalBytes, cr.t.bytes) {
+		return n, cr.t.exceeded("bytes", cr.t.limits.TotalBytes, cr.name, "more than %d bytes of content", cr.t.limits.TotalBytes)
+	}
+	return n, err
+}
+
+/*
+	Wraps an unpack func so that if it fails for exceeding a limit with direct
+	placement, whatever it placed is removed again: the target path is removed
+	entirely if it didn't exist before, and otherwise, so are the entries in it
+	which weren't there before.  (Entries which were there are left alone,
+	even if the unpack wrote into them; if we can't tell what was there,
+	nothing is removed.)  If removing anything fails, that's reported
+	in the error too, which is still an ErrLimitExceeded.
+	(Other placement modes unpack into the cache's temp dirs, which are
+	cleaned up on any error anyway.)
+*/
+func RollbackOnExceeded(unpackFn rio.UnpackFunc) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		target, err := fs.ParseAbsolutePath(path)
+		if placementMode != rio.Placement_Direct || err != nil {
+			return unpackFn(ctx, wareID, path, filt, placementMode, warehouses, mon) // which will reject a bad path itself.
+		}
+		afs := osfs.New(target)
+		before, beforeErr := afs.ReadDirNames(fs.RelPath{})
+		resultWareID, err := unpackFn(ctx, wareID, path, filt, placementMode, warehouses, mon)
+		if Category(err) != ErrLimitExceeded {
+			return resultWareID, err
+		}
+		var cleanupErr error
+		switch Category(beforeErr) {
+		case nil:
+			cleanupErr = removeAllExcept(afs, before)
+		case fs.ErrNotExists:
+			if err := os.RemoveAll(path); err != nil {
+				cleanupErr = fs.NormalizeIOError(err)
+			}
+		default:
+			// Can't tell what we placed; leave it all.
+		}
+		if cleanupErr == nil {
+			return resultWareID, err
+		}
+		details := map[string]string{"cleanupError": cleanupErr.Error()}
+		if e, ok := err.(Error); ok {
+			for k, v := range e.Details() {
+				details[k] = v
+			}
+		}
+		return resultWareID, ErrorDetailed(
+			ErrLimitExceeded,
+			fmt.Sprintf("%s (and removing what was unpacked failed: %s)", err, cleanupErr),
+			details,
+		)
+	}
+}
+
+func removeAllExcept(afs fs.FS, keep []string) error {
+	names, err := afs.ReadDirNames(fs.RelPath{})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keep)
+	for _, name := range names {
+		if i := sort.SearchStrings(keep, name); i < len(keep) && keep[i] == name {
+			continue
+		}
+		if err := fsOp.RemoveAll(afs, fs.MustRelPath(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package limits
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestLimits(t *testing.T) {
+	file := func(name string, size int64) fs.Metadata {
+		return fs.Metadata{Name: fs.MustRelPath(name), Type: fs.Type_File, Size: size}
+	}
+	Convey("No limits means no limits", t, func() {
+		t := Limits{}.Track()
+		So(t.Entry(file(strings.Repeat("deep/", 100)+"f", 1<<40)), ShouldBeNil)
+		So(t.Err(), ShouldBeNil)
+	})
+	Convey("A nil tracker has no limits", t, func() {
+		var t *Tracker
+		So(t.Entry(file("a", 1<<40)), ShouldBeNil)
+		_, err := ioutil.ReadAll(t.Body(fs.MustRelPath("a"), strings.NewReader("x")))
+		So(err, ShouldBeNil)
+		So(t.Err(), ShouldBeNil)
+	})
+	Convey("Entries are counted", t, func() {
+		t := Limits{Entries: 2}.Track()
+		So(t.Entry(fs.Metadata{Type: fs.Type_Dir}), ShouldBeNil)
+		So(t.Entry(file("a", 0)), ShouldBeNil)
+		So(Category(t.Entry(file("b", 0))), ShouldEqual, ErrLimitExceeded)
+		So(Category(t.Err()), ShouldEqual, ErrLimitExceeded)
+	})
+	Convey("Paths are measured", t, func() {
+		t := Limits{PathDepth: 2, PathLength: 5}.Track()
+		So(t.Entry(fs.Metadata{Type: fs.Type_Dir}), ShouldBeNil)
+		So(t.Entry(file("a/b", 0)), ShouldBeNil)
+		So(t.Entry(file("abcde", 0)), ShouldBeNil)
+		So(Category(t.Entry(file("a/b/c", 0))), ShouldEqual, ErrLimitExceeded)
+		t = Limits{PathLength: 5}.Track()
+		So(Category(t.Entry(file("abcdef", 0))), ShouldEqual, ErrLimitExceeded)
+	})
+	Convey("Declared sizes are checked up front", t, func() {
+		t := Limits{FileBytes: 10, TotalBytes: 15}.Track()
+		So(Category(t.Entry(file("big", 11))), ShouldEqual, ErrLimitExceeded)
+		t = Limits{FileBytes: 10, TotalBytes: 15}.Track()
+		So(t.Entry(file("a", 10)), ShouldBeNil)
+		_, err := ioutil.ReadAll(t.Body(fs.MustRelPath("a"), strings.NewReader(strings.Repeat("x", 10))))
+		So(err, ShouldBeNil)
+		So(Category(t.Entry(file("b", 6))), ShouldEqual, ErrLimitExceeded)
+	})
+	Convey("Bodies are counted as they're read", t, func() {
+		t := Limits{FileBytes: 10}.Track()
+		_, err := ioutil.ReadAll(t.Body(fs.MustRelPath("a"), strings.NewReader(strings.Repeat("x", 11))))
+		So(Category(err), ShouldEqual, ErrLimitExceeded)
+		t = Limits{TotalBytes: 15}.Track()
+		_, err = ioutil.ReadAll(t.Body(fs.MustRelPath("a"), strings.NewReader(strings.Repeat("x", 10))))
+		So(err, ShouldBeNil)
+		_, err = ioutil.ReadAll(t.Body(fs.MustRelPath("b"), strings.NewReader(strings.Repeat("x", 10))))
+		So(Category(err), ShouldEqual, ErrLimitExceeded)
+		So(t.Err().Error(), ShouldContainSubstring, "more than 15 bytes")
+	})
+}
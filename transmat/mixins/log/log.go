@@ -152,3 +152,77 @@ func DirectoryInferred(mon rio.Monitor, inferred, path fs.RelPath) {
 		},
 	}
 }
+
+// Emit debug log entry reporting how the filesystem we're about to write into
+// is kept from being escaped (e.g. "walk" or "beneath"; see `osfs.Confinement`).
+func FilesystemConfinement(mon rio.Monitor, path fs.AbsolutePath, mode string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogDebug,
+			Msg:   fmt.Sprintf("unpacking: filesystem at %q confined by %s mode", path, mode),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"confinement", mode},
+			},
+		},
+	}
+}
+
+// Emit a warning that an entry was left out of an unpack, and why.
+func EntrySkipped(mon rio.Monitor, path fs.RelPath, reason string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: skipped %q, because %s", path, reason),
+			Detail: [][2]string{
+				{"path", path.String()},
+				{"reason", reason},
+			},
+		},
+	}
+}
+
+// Emit a warning that the content replaced by an unpack couldn't be cleared
+// away, and was left where it was set aside.
+func PreviousContentLeft(mon rio.Monitor, path fs.AbsolutePath) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogWarn,
+			Msg:   fmt.Sprintf("unpacking: couldn't remove the previous content, left at %q", path),
+			Detail: [][2]string{
+				{"path", path.String()},
+			},
+		},
+	}
+}
+
+// Log that we're waiting for another operation on the same ware to finish
+// (e.g. in the daemon, so two unpacks of one ware don't both fetch it).
+func WaitingForWare(mon rio.Monitor, ware api.WareID, op string) {
+	if mon.Chan == nil {
+		return
+	}
+	mon.Chan <- rio.Event{
+		Log: &rio.Event_Log{
+			Time:  time.Now(),
+			Level: rio.LogInfo,
+			Msg:   fmt.Sprintf("waiting for another %s of ware %q to finish", op, ware),
+			Detail: [][2]string{
+				{"wareID", ware.String()},
+				{"op", op},
+			},
+		},
+	}
+}
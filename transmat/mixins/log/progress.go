@@ -0,0 +1,150 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+// The phases reported in progress events.
+const (
+	PhaseFetching   = "fetching"   // Reading from a warehouse (and not yet placing anything).
+	PhaseExtracting = "extracting" // Reading from a warehouse and placing files.
+	PhaseHashing    = "hashing"    // Reading files (or a ware) to compute a WareID.
+	PhaseCommitting = "committing" // Moving the result into its final place.
+)
+
+// Progress events are emitted no more often than this (except on phase changes, and when done).
+var ProgressInterval = 100 * time.Millisecond
+
+/*
+	Tracks the progress of one operation, and emits it to the monitor
+	as `rio.Event_Progress`:
+
+	  - Phase is one of the Phase* constants;
+	  - TotalProg is the bytes read so far in this phase;
+	  - TotalWork is the bytes expected in total, or zero if not known;
+	  - Desc is a summary for humans, e.g. "1234 entries".
+
+	Events are throttled (see ProgressInterval), so it's cheap to report
+	every read and every entry.  A nil *Progress does nothing, so callers
+	which don't care about progress can pass nil.
+*/
+type Progress struct {
+	mon     rio.Monitor
+	phase   string
+	bytes   int64
+	total   int64
+	entries int
+	last    time.Time
+}
+
+/*
+	Starts tracking progress, in the given phase, and emits that.
+	The total is the bytes expected in the phase; zero or negative means not known.
+*/
+func NewProgress(mon rio.Monitor, phase string, total int64) *Progress {
+	p := &Progress{mon: mon}
+	p.Phase(phase, total)
+	return p
+}
+
+/*
+	Starts a new phase, and emits that.  The count of bytes starts over
+	(the total is as for NewProgress); the count of entries carries on.
+*/
+func (p *Progress) Phase(phase string, total int64) {
+	if p == nil {
+		return
+	}
+	if total < 0 {
+		total = 0
+	}
+	p.phase = phase
+	p.bytes = 0
+	p.total = total
+	p.emit()
+}
+
+func (p *Progress) Bytes(n int) {
+	if p == nil {
+		return
+	}
+	p.bytes += int64(n)
+	p.maybeEmit()
+}
+
+func (p *Progress) Entry() {
+	if p == nil {
+		return
+	}
+	p.entries++
+	p.maybeEmit()
+}
+
+// Emits the final counts, regardless of throttling.
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+	p.emit()
+}
+
+/*
+	Wraps a reader so that everything read through it is counted.
+	If p is nil, returns the reader unchanged.
+*/
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return progressReader{r, p}
+}
+
+func (p *Progress) maybeEmit() {
+	if p.mon.Chan == nil {
+		return
+	}
+	if time.Since(p.last) < ProgressInterval {
+		return
+	}
+	p.emit()
+}
+
+func (p *Progress) emit() {
+	if p.mon.Chan == nil {
+		return
+	}
+	p.last = time.Now()
+	var desc string
+	if p.entries > 0 {
+		desc = fmt.Sprintf("%d entries", p.entries)
+	}
+	p.mon.Chan <- rio.Event{
+		Progress: &rio.Event_Progress{
+			Time:      p.last,
+			Phase:     p.phase,
+			Desc:      desc,
+			TotalProg: int(p.bytes),
+			TotalWork: int(p.total),
+		},
+	}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.Bytes(n)
+	return n, err
+}
@@ -0,0 +1,212 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Policies for entries which are dangerous to unpack: device nodes,
+	setuid and setgid files, symlinks that lead out of the fileset, and so on.
+
+	Filters (like "sticky") mutate entries so they're harmless; a policy
+	instead decides whether each entry may be placed at all, and either skips
+	it (with a warning) or rejects the whole unpack.
+*/
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/transmat/mixins/log"
+)
+
+type Class string
+
+const (
+	Class_Devices          Class = "devices"           // Block and char devices.
+	Class_Fifos            Class = "fifos"             // Named pipes.
+	Class_Setid            Class = "setid"             // Anything with the setuid or setgid bit.
+	Class_AbsoluteSymlinks Class = "abs-symlinks"      // Symlinks with an absolute target.
+	Class_EscapingSymlinks Class = "escaping-symlinks" // Symlinks with a relative target that leads up out of the root.
+)
+
+var Classes = []Class{
+	Class_Devices,
+	Class_Fifos,
+	Class_Setid,
+	Class_AbsoluteSymlinks,
+	Class_EscapingSymlinks,
+}
+
+type Action string
+
+const (
+	Action_Allow  Action = ""
+	Action_Skip   Action = "skip"
+	Action_Reject Action = "reject"
+)
+
+/*
+	The action to take for each class of entry.  Classes not present are allowed.
+	The zero value allows everything.
+*/
+type Policy map[Class]Action
+
+/*
+	True if the policy doesn't skip or reject anything.
+*/
+func (p Policy) AllowsAll() bool {
+	for _, action := range p {
+		if action != Action_Allow {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Sets the action for each of a comma-separated list of class names
+	(or "all"), returning an error if any name is unknown.
+*/
+func (p Policy) Set(action Action, classes string) error {
+	for _, name := range strings.Split(classes, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "all":
+			for _, class := range Classes {
+				p[class] = action
+			}
+			continue
+		}
+		class := Class(name)
+		known := false
+		for _, c := range Classes {
+			known = known || c == class
+		}
+		if !known {
+			return Errorf(rio.ErrUsage, "unknown unpack policy class %q (known: %s, all)", name, classNames())
+		}
+		p[class] = action
+	}
+	return nil
+}
+
+func classNames() string {
+	names := make([]string, len(Classes))
+	for i, class := range Classes {
+		names[i] = string(class)
+	}
+	return strings.Join(names, ", ")
+}
+
+/*
+	Returns the classes the entry belongs to.
+*/
+func Classify(fmeta fs.Metadata) (classes []Class) {
+	switch fmeta.Type {
+	case fs.Type_Device, fs.Type_CharDevice:
+		classes = append(classes, Class_Devices)
+	case fs.Type_NamedPipe:
+		classes = append(classes, Class_Fifos)
+	case fs.Type_Symlink:
+		if strings.HasPrefix(fmeta.Linkname, "/") {
+			classes = append(classes, Class_AbsoluteSymlinks)
+		} else if target := path.Join(fmeta.Name.Dir().String(), fmeta.Linkname); target == ".." || strings.HasPrefix(target, "../") {
+			classes = append(classes, Class_EscapingSymlinks)
+		}
+	}
+	if fmeta.Type != fs.Type_Symlink && fmeta.Perms&(fs.Perms_Setuid|fs.Perms_Setgid) != 0 {
+		classes = append(classes, Class_Setid)
+	}
+	return
+}
+
+/*
+	Returns the strictest action the policy demands for the entry, and the class which demanded it.
+*/
+func (p Policy) Judge(fmeta fs.Metadata) (Action, Class) {
+	action, because := Action_Allow, Class("")
+	for _, class := range Classify(fmeta) {
+		switch p[class] {
+		case Action_Reject:
+			return Action_Reject, class
+		case Action_Skip:
+			action, because = Action_Skip, class
+		}
+	}
+	return action, because
+}
+
+/*
+	Applies a policy to each entry of an unpack in turn, logging the skipped
+	ones to the monitor, and remembering the rejected ones for Err.
+
+	Entries inside a dir the policy withheld get the same action as it
+	(e.g. everything in a skipped setgid dir is skipped too), unless
+	they'd be rejected anyway.
+*/
+type Enforcer struct {
+	policy       Policy
+	mon          rio.Monitor
+	rejected     []string
+	withheldDirs map[fs.RelPath]Action
+}
+
+func NewEnforcer(p Policy, mon rio.Monitor) *Enforcer {
+	return &Enforcer{policy: p, mon: mon, withheldDirs: map[fs.RelPath]Action{}}
+}
+
+/*
+	Returns true if the entry may be placed.
+	(Rejected entries aren't placed either; the unpack should carry on and
+	check Err at the end, so that every offending path can be reported.)
+	Entries must be given parents first, as they are in a tar.
+*/
+func (e *Enforcer) Admit(fmeta fs.Metadata) bool {
+	action, class := e.policy.Judge(fmeta)
+	skipReason, rejectReason := "unpack policy skips "+string(class), string(class)
+	for _, parent := range fmeta.Name.SplitParent() {
+		if parentAction, isWithheld := e.withheldDirs[parent]; isWithheld && action != Action_Reject {
+			action = parentAction
+			skipReason = fmt.Sprintf("it's inside %q, which unpack policy skips", parent)
+			rejectReason = fmt.Sprintf("inside %s", parent)
+			break
+		}
+	}
+	if action != Action_Allow && fmeta.Type == fs.Type_Dir {
+		e.withheldDirs[fmeta.Name] = action
+	}
+	switch action {
+	case Action_Allow:
+		return true
+	case Action_Skip:
+		log.EntrySkipped(e.mon, fmeta.Name, skipReason)
+		return false
+	case Action_Reject:
+		e.rejected = append(e.rejected, fmt.Sprintf("%s (%s)", fmeta.Name, rejectReason))
+		return false
+	default:
+		panic(fmt.Errorf("invalid unpack policy action %q", action))
+	}
+}
+
+/*
+	Returns an ErrWareCorrupt error listing every rejected entry, or nil if there were none.
+*/
+func (e *Enforcer) Err() error {
+	if len(e.rejected) == 0 {
+		return nil
+	}
+	return ErrorDetailed(
+		rio.ErrWareCorrupt,
+		fmt.Sprintf("ware rejected by unpack policy: %s", strings.Join(e.rejected, ", ")),
+		map[string]string{
+			"rejected": strings.Join(e.rejected, "\n"),
+		},
+	)
+}
@@ -0,0 +1,83 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package policy
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+)
+
+func TestPolicy(t *testing.T) {
+	Convey("Entries are classified", t, func() {
+		for _, tr := range []struct {
+			fmeta  fs.Metadata
+			expect []Class
+		}{
+			{fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File, Perms: 0755}, nil},
+			{fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File, Perms: 0755 | fs.Perms_Setuid}, []Class{Class_Setid}},
+			{fs.Metadata{Name: fs.MustRelPath("d"), Type: fs.Type_Dir, Perms: 0755 | fs.Perms_Setgid}, []Class{Class_Setid}},
+			{fs.Metadata{Name: fs.MustRelPath("dev"), Type: fs.Type_CharDevice}, []Class{Class_Devices}},
+			{fs.Metadata{Name: fs.MustRelPath("dev"), Type: fs.Type_Device, Perms: fs.Perms_Setuid}, []Class{Class_Devices, Class_Setid}},
+			{fs.Metadata{Name: fs.MustRelPath("p"), Type: fs.Type_NamedPipe}, []Class{Class_Fifos}},
+			{fs.Metadata{Name: fs.MustRelPath("a/ln"), Type: fs.Type_Symlink, Linkname: "../b"}, nil},
+			{fs.Metadata{Name: fs.MustRelPath("a/ln"), Type: fs.Type_Symlink, Linkname: "../../b"}, []Class{Class_EscapingSymlinks}},
+			{fs.Metadata{Name: fs.MustRelPath("ln"), Type: fs.Type_Symlink, Linkname: ".."}, []Class{Class_EscapingSymlinks}},
+			{fs.Metadata{Name: fs.MustRelPath("ln"), Type: fs.Type_Symlink, Linkname: "/etc"}, []Class{Class_AbsoluteSymlinks}},
+		} {
+			So(Classify(tr.fmeta), ShouldResemble, tr.expect)
+		}
+	})
+	Convey("Policies judge by the strictest action", t, func() {
+		p := Policy{}
+		So(p.AllowsAll(), ShouldBeTrue)
+		So(p.Set(Action_Skip, "all"), ShouldBeNil)
+		So(p.Set(Action_Reject, "setid"), ShouldBeNil)
+		So(p.AllowsAll(), ShouldBeFalse)
+		action, class := p.Judge(fs.Metadata{Name: fs.MustRelPath("dev"), Type: fs.Type_Device, Perms: fs.Perms_Setuid})
+		So(action, ShouldEqual, Action_Reject)
+		So(class, ShouldEqual, Class_Setid)
+		action, class = p.Judge(fs.Metadata{Name: fs.MustRelPath("dev"), Type: fs.Type_Device})
+		So(action, ShouldEqual, Action_Skip)
+		So(class, ShouldEqual, Class_Devices)
+		action, _ = p.Judge(fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File})
+		So(action, ShouldEqual, Action_Allow)
+
+		So(Category(p.Set(Action_Skip, "devices,bogus")), ShouldEqual, rio.ErrUsage)
+	})
+	Convey("Enforcers report every rejection", t, func() {
+		e := NewEnforcer(Policy{Class_Fifos: Action_Reject, Class_Devices: Action_Skip}, rio.Monitor{})
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("dev"), Type: fs.Type_Device}), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("f"), Type: fs.Type_File}), ShouldBeTrue)
+		So(e.Err(), ShouldBeNil)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("p1"), Type: fs.Type_NamedPipe}), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("p2"), Type: fs.Type_NamedPipe}), ShouldBeFalse)
+		So(Category(e.Err()), ShouldEqual, rio.ErrWareCorrupt)
+		So(e.Err().Error(), ShouldContainSubstring, "./p1 (fifos), ./p2 (fifos)")
+	})
+	Convey("Enforcers withhold what's inside withheld dirs too", t, func() {
+		setgidDir := func(name string) fs.Metadata {
+			return fs.Metadata{Name: fs.MustRelPath(name), Type: fs.Type_Dir, Perms: 0755 | fs.Perms_Setgid}
+		}
+		e := NewEnforcer(Policy{Class_Setid: Action_Skip, Class_Fifos: Action_Reject}, rio.Monitor{})
+		So(e.Admit(setgidDir("d")), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d/f"), Type: fs.Type_File}), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d/sub"), Type: fs.Type_Dir}), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d/sub/f"), Type: fs.Type_File}), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d2/f"), Type: fs.Type_File}), ShouldBeTrue)
+		So(e.Err(), ShouldBeNil)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d/p"), Type: fs.Type_NamedPipe}), ShouldBeFalse)
+		So(e.Err().Error(), ShouldContainSubstring, "./d/p (fifos)")
+
+		e = NewEnforcer(Policy{Class_Setid: Action_Reject}, rio.Monitor{})
+		So(e.Admit(setgidDir("d")), ShouldBeFalse)
+		So(e.Admit(fs.Metadata{Name: fs.MustRelPath("d/f"), Type: fs.Type_File}), ShouldBeFalse)
+		So(e.Err().Error(), ShouldContainSubstring, "./d (setid), ./d/f (inside ./d)")
+	})
+}
@@ -0,0 +1,27 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+// +build linux
+
+package statcache
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFromFileInfo(fi os.FileInfo) (Stat, bool) {
+	sys, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Stat{}, false
+	}
+	return Stat{
+		Dev:   uint64(sys.Dev),
+		Ino:   uint64(sys.Ino),
+		Size:  sys.Size,
+		Mtime: sys.Mtim.Sec*1e9 + sys.Mtim.Nsec,
+		Ctime: sys.Ctim.Sec*1e9 + sys.Ctim.Nsec,
+	}, true
+}
@@ -0,0 +1,165 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	A stat-cache ("index", much like git's) which remembers the content hash
+	of each file alongside the stat data it had when hashed, so that a
+	repeated pack of a mostly unchanged directory can skip re-reading files.
+
+	Entries are keyed by path, and only trusted if the file's device, inode,
+	size, mtime and ctime are all unchanged.  That's not quite enough on its own:
+	a file modified in the same timestamp tick as it was hashed could have
+	changed without its mtime changing (the "racy git" problem).  So we also
+	record when the pack which hashed each file started, and never trust an
+	entry whose mtime or ctime isn't at least a whole second older than that;
+	those are simply rehashed (and will usually be trusted on the next run).
+
+	The index is purely a cache: if it's missing, unreadable, or was made with
+	a different hash algorithm, we start over with an empty one.
+*/
+package statcache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.polydawn.net/rio/fs"
+)
+
+// Bump this if the serial form changes; old indexes are then discarded.
+const formatVersion = 1
+
+/*
+	The stat data which, if unchanged, lets us believe a file's content is unchanged.
+*/
+type Stat struct {
+	Dev   uint64
+	Ino   uint64
+	Size  int64
+	Mtime int64 // unix nanos
+	Ctime int64 // unix nanos
+}
+
+type entry struct {
+	Stat
+	Started int64 // unix nanos when the pack which hashed this began.
+	Hash    []byte
+}
+
+type serialIndex struct {
+	Version   int
+	Algorithm string
+	Entries   map[string]entry
+}
+
+type Index struct {
+	path      string
+	algorithm string
+	started   time.Time
+	old       map[string]entry // what we loaded.
+	next      map[string]entry // what we'll save: only paths seen this time, so removed files drop out.
+}
+
+/*
+	Loads the index at the given path, or starts an empty one if it doesn't
+	exist (or is unusable).  `algorithm` names the hash algorithm in use;
+	entries hashed with anything else are discarded.
+
+	The index considers the current time to be the start of the pack;
+	open it right before walking the filesystem.
+*/
+func Open(path string, algorithm string) *Index {
+	x := &Index{
+		path:      path,
+		algorithm: algorithm,
+		started:   time.Now(),
+		old:       map[string]entry{},
+		next:      map[string]entry{},
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return x
+	}
+	defer f.Close()
+	var si serialIndex
+	if err := gob.NewDecoder(f).Decode(&si); err != nil {
+		return x
+	}
+	if si.Version != formatVersion || si.Algorithm != algorithm {
+		return x
+	}
+	x.old = si.Entries
+	return x
+}
+
+/*
+	Returns the content hash for the file at the path if we have one we can trust.
+*/
+func (x *Index) Lookup(path fs.RelPath, st Stat) ([]byte, bool) {
+	e, ok := x.old[path.String()]
+	if !ok || e.Stat != st {
+		return nil, false
+	}
+	// Racy entries: the file's timestamps are too close to when it was hashed
+	//  to be sure it wasn't modified again in the same tick.
+	horizon := time.Unix(0, e.Started).Truncate(time.Second).Add(-time.Second).UnixNano()
+	if st.Mtime >= horizon || st.Ctime >= horizon {
+		return nil, false
+	}
+	x.next[path.String()] = e
+	return e.Hash, true
+}
+
+/*
+	Records the content hash for the file at the path.
+	The stat should be the one taken before the content was read.
+*/
+func (x *Index) Store(path fs.RelPath, st Stat, hash []byte) {
+	x.next[path.String()] = entry{st, x.started.UnixNano(), hash}
+}
+
+/*
+	Writes the index out, replacing the old one atomically.
+*/
+func (x *Index) Save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(x.path), filepath.Base(x.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot save stat-cache: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = gob.NewEncoder(tmp).Encode(serialIndex{formatVersion, x.algorithm, x.next})
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save stat-cache: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), x.path); err != nil {
+		return fmt.Errorf("cannot save stat-cache: %s", err)
+	}
+	return nil
+}
+
+/*
+	Stats an open file.  Returns false if the file isn't a real os file
+	(in which case you'll just have to hash it).
+*/
+func StatFile(file interface{}) (Stat, bool) {
+	f, ok := file.(interface {
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return Stat{}, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return Stat{}, false
+	}
+	return statFromFileInfo(fi)
+}
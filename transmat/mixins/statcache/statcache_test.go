@@ -0,0 +1,91 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package statcache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestIndex(t *testing.T) {
+	Convey("Stat-cache index", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			indexPath := tmpDir.Join(fs.MustRelPath("index")).String()
+			filePath := tmpDir.Join(fs.MustRelPath("file")).String()
+			So(ioutil.WriteFile(filePath, []byte("abc"), 0644), ShouldBeNil)
+			f, err := os.Open(filePath)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			st, ok := StatFile(f)
+			So(ok, ShouldBeTrue)
+			So(st.Size, ShouldEqual, 3)
+			name := fs.MustRelPath("file")
+
+			Convey("misses when empty", func() {
+				x := Open(indexPath, "")
+				_, ok := x.Lookup(name, st)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("finds entries which are well older than the pack which stored them", func() {
+				x := Open(indexPath, "")
+				x.started = time.Now().Add(time.Hour)
+				x.Store(name, st, []byte("hash"))
+				So(x.Save(), ShouldBeNil)
+
+				x = Open(indexPath, "")
+				hash, ok := x.Lookup(name, st)
+				So(ok, ShouldBeTrue)
+				So(string(hash), ShouldEqual, "hash")
+
+				Convey("and keeps them when saved again", func() {
+					So(x.Save(), ShouldBeNil)
+					_, ok := Open(indexPath, "").Lookup(name, st)
+					So(ok, ShouldBeTrue)
+				})
+				Convey("but not if the stat changed", func() {
+					st2 := st
+					st2.Ctime++
+					_, ok := x.Lookup(name, st2)
+					So(ok, ShouldBeFalse)
+				})
+				Convey("but not if made with another algorithm", func() {
+					_, ok := Open(indexPath, "sha256").Lookup(name, st)
+					So(ok, ShouldBeFalse)
+				})
+			})
+			Convey("doesn't trust racy entries", func() {
+				// The file was just written, and the pack is starting now: same tick.
+				x := Open(indexPath, "")
+				x.Store(name, st, []byte("hash"))
+				So(x.Save(), ShouldBeNil)
+				_, ok := Open(indexPath, "").Lookup(name, st)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("drops entries for paths not seen again", func() {
+				x := Open(indexPath, "")
+				x.started = time.Now().Add(time.Hour)
+				x.Store(name, st, []byte("hash"))
+				So(x.Save(), ShouldBeNil)
+				So(Open(indexPath, "").Save(), ShouldBeNil)
+				_, ok := Open(indexPath, "").Lookup(name, st)
+				So(ok, ShouldBeFalse)
+			})
+			Convey("ignores garbage", func() {
+				So(ioutil.WriteFile(indexPath, []byte("garbage"), 0644), ShouldBeNil)
+				x := Open(indexPath, "")
+				_, ok := x.Lookup(name, st)
+				So(ok, ShouldBeFalse)
+				So(x.Save(), ShouldBeNil)
+			})
+		})
+	})
+}
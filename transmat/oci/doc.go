@@ -0,0 +1,42 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The oci transmat unpacks OCI (and Docker) images, flattening their
+	layers into one fileset, e.g. to use as a rootfs.
+
+	The WareID is the digest of an image manifest, or of an index (in which
+	case the manifest for this host's architecture is picked), e.g.
+	"oci:sha256:e3b0c442...".  Images are read from image warehouses (see
+	`warehouse/impl/oci`): an OCI image layout dir, or a registry.
+
+	Layers are applied in order, lowest first, the way overlay filesystems
+	stack them: later entries replace earlier ones, except dirs, which merge.
+	Whiteouts are honored and not placed: a ".wh.<name>" entry removes
+	<name> from the layers below, and a ".wh..wh..opq" entry in a dir removes
+	everything the layers below put in that dir.  Hardlinks are unpacked as
+	copies of the file they link to.
+
+	Every manifest and layer is checked against its digest (and layers
+	against their size), failing with `rio.ErrWareHashMismatch` if any
+	differs; as with tar, a layer is only fully checked once it's been read,
+	so what's placed before then isn't trusted until the unpack succeeds.
+
+	The unpack returns the WareID of the flattened fileset, as a tar ware
+	(i.e. what `rio pack tar` of it would say), and it's cached as that
+	tar ware, so later unpacks of either the image or that tar ware are
+	cache hits.
+
+	Only unpacking is supported.  Images aren't a pure function of their
+	files (there's also the config, and the layering is a choice), so
+	packing into them wouldn't have a consistent hash.
+*/
+package ocitrans
+
+import (
+	"go.polydawn.net/go-timeless-api"
+)
+
+const PackType = api.PackType("oci")
@@ -0,0 +1,329 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocitrans
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fsOp"
+	"go.polydawn.net/rio/lib/treewalk"
+	"go.polydawn.net/rio/transmat/mixins/filters"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/limits"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/transmat/util"
+)
+
+// Whiteout names, per the image spec (which took them from aufs).
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+/*
+	Applies layers to a filesystem, one after another, keeping a record of
+	every entry placed, and which layer last placed (or mentioned) it,
+	since whiteouts only remove what the layers below placed.
+*/
+type flattener struct {
+	afs     fs.FS
+	filt    apiutil.FilesetFilters
+	algo    fshash.Algorithm
+	tracker *limits.Tracker
+	mon     rio.Monitor
+	prog    *log.Progress
+	entries map[fs.RelPath]*entry
+}
+
+type entry struct {
+	meta  fs.Metadata // as placed, i.e. after filters.
+	hash  []byte      // content hash, for files.
+	layer int
+}
+
+func newFlattener(afs fs.FS, filt apiutil.FilesetFilters, tracker *limits.Tracker, mon rio.Monitor, prog *log.Progress) *flattener {
+	return &flattener{
+		afs:     afs,
+		filt:    filt,
+		algo:    fshash.DefaultAlgorithm,
+		tracker: tracker, // All layers count against the same limits.
+		mon:     mon,
+		prog:    prog,
+		entries: map[fs.RelPath]*entry{},
+	}
+}
+
+/*
+	Applies one layer (a tar, maybe compressed), reading it to the end of the tar.
+*/
+func (f *flattener) applyLayer(ctx context.Context, layer int, r io.Reader) error {
+	reader, err := tartrans.Decompress(r)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt layer compression: %s", err)
+	}
+	tr := tar.NewReader(reader)
+	for {
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			break // sucess!  end of layer.
+		}
+		if err != nil {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer: %s", err)
+		}
+		if ctx.Err() != nil {
+			return Errorf(rio.ErrCancelled, "cancelled")
+		}
+
+		fmeta := fs.Metadata{}
+		if err := tartrans.TarHdrToMetadata(thdr, &fmeta); err != nil {
+			return err
+		}
+		if strings.HasPrefix(fmeta.Name.String(), "..") {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer: paths that use '../' to leave the base dir are invalid")
+		}
+		if err := f.tracker.Entry(fmeta); err != nil {
+			return err
+		}
+		f.prog.Entry()
+
+		// Whiteouts remove things from the layers below, and aren't placed themselves.
+		switch base := fmeta.Name.Last(); {
+		case base == whiteoutOpaque:
+			if err := f.inferParents(layer, fmeta.Name); err != nil {
+				return err
+			}
+			if err := f.removeUnder(layer, fmeta.Name.Dir()); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			name := base[len(whiteoutPrefix):]
+			if name == "" || name == "." || name == ".." {
+				return Errorf(rio.ErrWareCorrupt, "corrupt layer: invalid whiteout %q", fmeta.Name)
+			}
+			if err := f.remove(layer, fmeta.Name.Dir().Join(fs.MustRelPath(name))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := f.inferParents(layer, fmeta.Name); err != nil {
+			return err
+		}
+		if err := f.place(layer, fmeta, tr); err != nil {
+			return err
+		}
+	}
+	// Finish reading the compressed stream, so it's all verified by the caller.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "corrupt layer compression: %s", err)
+	}
+	return nil
+}
+
+/*
+	Makes sure all the parents of the path exist, conjuring any which don't,
+	and marks them as placed by this layer (the layer implies them, even if
+	it doesn't say so), so they're not removed by its whiteouts.
+*/
+func (f *flattener) inferParents(layer int, name fs.RelPath) error {
+	for _, parent := range name.SplitParent() {
+		if e, exists := f.entries[parent]; exists {
+			if e.meta.Type != fs.Type_Dir {
+				return Errorf(rio.ErrWareCorrupt, "corrupt layer: %q is inside %q, which is not a dir", name, parent)
+			}
+			e.layer = layer
+			continue
+		}
+		log.DirectoryInferred(f.mon, parent, name)
+		conjuredFmeta := fshash.DefaultDirMetadata()
+		conjuredFmeta.Name = parent
+		if err := f.tracker.Entry(conjuredFmeta); err != nil {
+			return err
+		}
+		filters.Apply(f.filt, &conjuredFmeta)
+		if err := fsOp.SyncFile(f.afs, conjuredFmeta, nil, f.filt.SkipChown); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		f.entries[parent] = &entry{conjuredFmeta, nil, layer}
+	}
+	return nil
+}
+
+/*
+	Places one entry, replacing whatever the layers below had there
+	(unless both are dirs, which merge).
+*/
+func (f *flattener) place(layer int, fmeta fs.Metadata, body io.Reader) error {
+	if existing, exists := f.entries[fmeta.Name]; exists {
+		if existing.meta.Type != fs.Type_Dir || fmeta.Type != fs.Type_Dir {
+			// SyncFile will remove it from the filesystem; we forget what was under it.
+			f.forget(fmeta.Name)
+		}
+	}
+
+	// Hardlinks become copies of the file they link to.
+	//  Filters were already applied to that file, when it was placed.
+	if fmeta.Type == fs.Type_Hardlink {
+		if strings.HasPrefix(fmeta.Linkname, "/") {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer: hardlink %q points to absolute path %q", fmeta.Name, fmeta.Linkname)
+		}
+		target := fs.MustRelPath(fmeta.Linkname)
+		if target.GoesUp() {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer: hardlink %q points to %q, which is outside the image", fmeta.Name, fmeta.Linkname)
+		}
+		linked, exists := f.entries[target]
+		if !exists || linked.meta.Type != fs.Type_File {
+			return Errorf(rio.ErrWareCorrupt, "corrupt layer: hardlink %q points to %q, which is not a file", fmeta.Name, fmeta.Linkname)
+		}
+		copyFmeta := linked.meta
+		copyFmeta.Name = fmeta.Name
+		file, err := f.afs.OpenFile(target, os.O_RDONLY, 0)
+		if err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		defer file.Close()
+		if err := fsOp.SyncFile(f.afs, copyFmeta, file, f.filt.SkipChown); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		f.entries[fmeta.Name] = &entry{copyFmeta, linked.hash, layer}
+		return nil
+	}
+
+	filteredFmeta := fmeta
+	filters.Apply(f.filt, &filteredFmeta)
+	var contentHash []byte
+	switch fmeta.Type {
+	case fs.Type_File:
+		reader := &util.HashingReader{f.tracker.Body(fmeta.Name, body), f.algo.New()}
+		if err := fsOp.SyncFile(f.afs, filteredFmeta, reader, f.filt.SkipChown); err != nil {
+			if err := f.tracker.Err(); err != nil {
+				return err
+			}
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+		contentHash = reader.Hasher.Sum(nil)
+	default:
+		if err := fsOp.SyncFile(f.afs, filteredFmeta, nil, f.filt.SkipChown); err != nil {
+			return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+	}
+	f.entries[fmeta.Name] = &entry{filteredFmeta, contentHash, layer}
+	return nil
+}
+
+/*
+	Handles ".wh.<name>": removes the entry (and anything under it),
+	if a layer below placed it.
+*/
+func (f *flattener) remove(layer int, name fs.RelPath) error {
+	e, exists := f.entries[name]
+	if !exists || e.layer >= layer {
+		return nil
+	}
+	if err := fsOp.RemoveAll(f.afs, name); err != nil {
+		return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+	f.forget(name)
+	return nil
+}
+
+/*
+	Handles ".wh..wh..opq": removes everything under the dir which a
+	layer below placed.  (Anything this layer placed there has marked its
+	parents as this layer's, so those are kept.)
+*/
+func (f *flattener) removeUnder(layer int, dir fs.RelPath) error {
+	var doomed []fs.RelPath
+	for name, e := range f.entries {
+		if e.layer < layer && isUnder(name, dir) {
+			doomed = append(doomed, name)
+		}
+	}
+	// Parents sort before their children, so each child's parent is already gone, if it's doomed too.
+	sort.Slice(doomed, func(i, j int) bool { return doomed[i].String() < doomed[j].String() })
+	removed := map[fs.RelPath]struct{}{}
+	for _, name := range doomed {
+		if _, gone := removed[name.Dir()]; !gone {
+			if err := fsOp.RemoveAll(f.afs, name); err != nil {
+				return Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+			}
+		}
+		removed[name] = struct{}{}
+		delete(f.entries, name)
+	}
+	return nil
+}
+
+// Forgets the records of an entry and everything under it.
+func (f *flattener) forget(name fs.RelPath) {
+	delete(f.entries, name)
+	for other := range f.entries {
+		if isUnder(other, name) {
+			delete(f.entries, other)
+		}
+	}
+}
+
+// True if the path is strictly inside the dir.
+func isUnder(name, dir fs.RelPath) bool {
+	for _, parent := range name.SplitParent() {
+		if parent == dir {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Fixes up dir times (which placing things inside them has changed),
+	and hashes the flattened fileset, as a tar ware.
+*/
+func (f *flattener) finish() (api.WareID, error) {
+	// An image with no layers (or only empty ones) is still an empty dir.
+	if err := f.inferParents(0, fs.MustRelPath("./x")); err != nil {
+		return api.WareID{}, err
+	}
+
+	threshold, err := config.GetBucketSpillThreshold()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	bucket := fshash.NewDiskBucket(config.GetBucketSpillPath(), threshold)
+	defer bucket.Close()
+	for _, e := range f.entries {
+		bucket.AddRecord(e.meta, e.hash)
+	}
+	if err := bucket.Err(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrLocalCacheProblem, "error while unpacking: %s", err)
+	}
+
+	// Cleanup dir times with a post-order traversal over the bucket.
+	if err := treewalk.Walk(bucket.Iterator(), nil, func(node treewalk.Node) error {
+		record := node.(fshash.RecordIterator).Record()
+		if record.Metadata.Type != fs.Type_Dir {
+			return nil
+		}
+		return f.afs.SetTimesNano(record.Metadata.Name, record.Metadata.Mtime, fs.DefaultAtime)
+	}); err != nil {
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+	}
+
+	return api.WareID{tartrans.PackType, f.algo.Format(fshash.HashBucket(bucket, f.algo.New))}, nil
+}
@@ -0,0 +1,343 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocitrans
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/cache"
+	"go.polydawn.net/rio/transmat/mixins/limits"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/oci"
+)
+
+var (
+	_ rio.UnpackFunc = Unpack
+)
+
+// The platform picked from image indexes.
+var Platform = oci.Platform{OS: "linux", Architecture: runtime.GOARCH}
+
+// Indexes may point to indexes; we'll follow this many before giving up.
+const maxIndexDepth = 4
+
+func Unpack(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch for unpacking.
+	path string, // Where to unpack the fileset (absolute path).
+	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
+	placementMode rio.PlacementMode, // Optionally: a placement mode (default is "copy").
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	if _, err := oci.ParseDigest(wareID.Hash); err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+	if placementMode == "" {
+		placementMode = rio.Placement_Copy
+	}
+	// Wrap the direct unpack func with cache behavior; call that.
+	//  The result is shelved as the tar ware it flattens to, and
+	//  the cache remembers that for the next lookup by the image's digest.
+	cacheFs := osfs.New(config.GetCacheBasePath())
+	return cache.Lrn2Cache(cacheFs, limits.RollbackOnExceeded(unpack))(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+func unpack(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path2 := fs.MustAbsolutePath(path)
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	lims, err := limits.FromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Pick a warehouse, and find the manifest (through any indexes).
+	prog := log.NewProgress(mon, log.PhaseFetching, 0)
+	whCtrl, body, mediaType, err := pickWarehouse(ctx, wareID, warehouses, mon)
+	if err != nil {
+		return api.WareID{}, err
+	}
+	manifest, err := resolveManifest(ctx, whCtrl, wareID.Hash, body, mediaType, 0)
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Construct filesystem wrapper to use for all our ops.
+	//  Layers are untrusted input, just like tars: confine as hard as the kernel lets us.
+	afs := osfs.NewConfined(path2)
+	log.FilesystemConfinement(mon, path2, string(osfs.ConfinementOf(afs)))
+
+	// Apply each layer in turn, checking each as we go.
+	fl := newFlattener(afs, filt2, lims.Track(), mon, prog)
+	for i, layer := range manifest.Layers {
+		if err := applyLayer(ctx, whCtrl, fl, i, layer, prog); err != nil {
+			return api.WareID{}, err
+		}
+	}
+	prog.Done()
+	return fl.finish()
+}
+
+/*
+	Finds the first warehouse which has the manifest (or index) for the wareID,
+	and returns it, with the manifest.
+*/
+func pickWarehouse(
+	ctx context.Context,
+	wareID api.WareID,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (_ warehouse.ImageController, body []byte, mediaType string, err error) {
+	var anyWarehouses bool // for clarity in final error messages
+	for _, addr := range warehouses {
+		whCtrl, err := oci.NewController(addr)
+		switch Category(err) {
+		case nil:
+			// pass
+		case rio.ErrWarehouseUnavailable:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue // okay!  skip to the next one.
+		default:
+			return nil, nil, "", err
+		}
+		body, mediaType, err := whCtrl.OpenManifest(ctx, wareID.Hash)
+		switch Category(err) {
+		case nil:
+			log.WareReaderOpened(mon, addr, wareID)
+			return whCtrl, body, mediaType, nil // happy path return!
+		case rio.ErrWarehouseUnavailable:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue // okay!  skip to the next one.
+		case rio.ErrWareNotFound:
+			anyWarehouses = true
+			log.WareNotFound(mon, err, addr, wareID)
+			continue // okay!  skip to the next one.
+		default:
+			return nil, nil, "", err
+		}
+	}
+	if !anyWarehouses {
+		return nil, nil, "", Errorf(rio.ErrWarehouseUnavailable, "no warehouses were available!")
+	}
+	return nil, nil, "", Errorf(rio.ErrWareNotFound, "none of the available warehouses have ware %q!", wareID)
+}
+
+/*
+	Checks the manifest (or index) against its digest, and parses it.
+	If it's an index, picks the manifest for our Platform from it, and
+	fetches that (from the same warehouse), and so on.
+*/
+func resolveManifest(
+	ctx context.Context,
+	whCtrl warehouse.ImageController,
+	digest string,
+	body []byte,
+	mediaType string,
+	depth int,
+) (*oci.Manifest, error) {
+	if err := checkDigest(digest, body); err != nil {
+		return nil, err
+	}
+
+	// Registries say what kind of thing it is; layouts don't, so look inside.
+	//  Both indexes and manifests usually say, too; failing that, it's in the shape.
+	var probe struct {
+		MediaType string               `json:"mediaType"`
+		Manifests []stdjson.RawMessage `json:"manifests"`
+	}
+	if err := stdjson.Unmarshal(body, &probe); err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "manifest %s is not valid json: %s", digest, err)
+	}
+	switch mediaType {
+	case "", "application/json", "text/plain", "application/octet-stream":
+		mediaType = probe.MediaType
+	}
+	if mediaType == "" && probe.Manifests != nil {
+		mediaType = oci.MediaType_ImageIndex
+	}
+
+	switch mediaType {
+	case oci.MediaType_ImageIndex, oci.MediaType_DockerManifestList:
+		if depth >= maxIndexDepth {
+			return nil, Errorf(rio.ErrWareCorrupt, "index %s points to more than %d levels of indexes", digest, maxIndexDepth)
+		}
+		var index oci.Index
+		if err := stdjson.Unmarshal(body, &index); err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "index %s is not valid: %s", digest, err)
+		}
+		desc, err := pickManifest(digest, index)
+		if err != nil {
+			return nil, err
+		}
+		body, mediaType, err := whCtrl.OpenManifest(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if mediaType == "" {
+			mediaType = desc.MediaType
+		}
+		return resolveManifest(ctx, whCtrl, desc.Digest, body, mediaType, depth+1)
+	case "", oci.MediaType_ImageManifest, oci.MediaType_DockerManifest:
+		var manifest oci.Manifest
+		if err := stdjson.Unmarshal(body, &manifest); err != nil {
+			return nil, Errorf(rio.ErrWareCorrupt, "manifest %s is not valid: %s", digest, err)
+		}
+		if manifest.SchemaVersion != 2 {
+			return nil, Errorf(rio.ErrUsage, "manifest %s has schemaVersion %d; only version 2 is supported", digest, manifest.SchemaVersion)
+		}
+		return &manifest, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "%s is a %q, which isn't an image manifest or index", digest, mediaType)
+	}
+}
+
+/*
+	Picks the manifest for our Platform from an index.
+	An index with just one manifest is taken at its word, whatever it says.
+*/
+func pickManifest(digest string, index oci.Index) (oci.Descriptor, error) {
+	if len(index.Manifests) == 1 {
+		return index.Manifests[0], nil
+	}
+	var have []string
+	for _, desc := range index.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == Platform.OS && desc.Platform.Architecture == Platform.Architecture {
+			return desc, nil
+		}
+		have = append(have, desc.Platform.String())
+	}
+	return oci.Descriptor{}, Errorf(rio.ErrUsage, "index %s has no manifest for %s (it has: %s); use the digest of one of its manifests instead", digest, Platform.String(), strings.Join(have, ", "))
+}
+
+/*
+	Reads one layer from the warehouse and applies it, checking its size and digest.
+*/
+func applyLayer(
+	ctx context.Context,
+	whCtrl warehouse.ImageController,
+	fl *flattener,
+	i int,
+	layer oci.Descriptor,
+	prog *log.Progress,
+) error {
+	d, err := oci.ParseDigest(layer.Digest)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "manifest lists an invalid layer: %s", err)
+	}
+	if strings.Contains(layer.MediaType, "zstd") {
+		return Errorf(rio.ErrUsage, "layer %s is zstd-compressed, which isn't supported", layer.Digest)
+	}
+	reader, err := whCtrl.OpenBlob(ctx, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Hash everything read, including whatever's after the end of the tar.
+	prog.Phase(log.PhaseExtracting, layer.Size)
+	hasher := d.NewHash()
+	counter := &countingWriter{}
+	raw := io.TeeReader(prog.Reader(reader), io.MultiWriter(hasher, counter))
+	//  If the layer is corrupt, keep going to check it anyway: if it's not
+	//  the layer the manifest says, that's the more useful thing to report.
+	applyErr := fl.applyLayer(ctx, i, raw)
+	if applyErr != nil && Category(applyErr) != rio.ErrWareCorrupt {
+		return applyErr
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return Errorf(rio.ErrWareCorrupt, "error reading layer %s: %s", layer.Digest, err)
+	}
+
+	// Check for hash mismatch.
+	//  Size first: it's a simpler message, if that's all it is.
+	if counter.n != layer.Size {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("layer %s has the wrong size: expected %d bytes, got %d", layer.Digest, layer.Size, counter.n),
+			map[string]string{
+				"expected": layer.Digest,
+			},
+		)
+	}
+	if actual := d.Of(hasher.Sum(nil)); actual != d {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected layer %q, got %q", d, actual),
+			map[string]string{
+				"expected": d.String(),
+				"actual":   actual.String(),
+			},
+		)
+	}
+	return applyErr
+}
+
+// Checks a manifest (or index) body against its digest.
+func checkDigest(digest string, body []byte) error {
+	d, err := oci.ParseDigest(digest)
+	if err != nil {
+		return Errorf(rio.ErrWareCorrupt, "invalid digest: %s", err)
+	}
+	hasher := d.NewHash()
+	hasher.Write(body)
+	if actual := d.Of(hasher.Sum(nil)); actual != d {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("hash mismatch: expected manifest %q, got %q", d, actual),
+			map[string]string{
+				"expected": d.String(),
+				"actual":   actual.String(),
+			},
+		)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	w.n += int64(len(bs))
+	return len(bs), nil
+}
@@ -0,0 +1,275 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package ocitrans
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	stdjson "encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/warehouse/impl/oci"
+)
+
+// Writes blobs into an image layout dir, the way image tools would.
+type layoutFixture struct {
+	dir string
+}
+
+func newLayoutFixture(dir string) layoutFixture {
+	So(os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755), ShouldBeNil)
+	So(ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644), ShouldBeNil)
+	return layoutFixture{dir}
+}
+
+func (lf layoutFixture) blob(mediaType string, body []byte) oci.Descriptor {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	So(ioutil.WriteFile(lf.path(digest), body, 0644), ShouldBeNil)
+	return oci.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(body))}
+}
+
+func (lf layoutFixture) path(digest string) string {
+	return filepath.Join(lf.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (lf layoutFixture) manifest(layers ...oci.Descriptor) oci.Descriptor {
+	config := lf.blob("application/vnd.oci.image.config.v1+json", []byte(`{}`))
+	body, err := stdjson.Marshal(oci.Manifest{SchemaVersion: 2, MediaType: oci.MediaType_ImageManifest, Config: config, Layers: layers})
+	So(err, ShouldBeNil)
+	return lf.blob(oci.MediaType_ImageManifest, body)
+}
+
+func (lf layoutFixture) index(manifests ...oci.Descriptor) oci.Descriptor {
+	body, err := stdjson.Marshal(oci.Index{SchemaVersion: 2, MediaType: oci.MediaType_ImageIndex, Manifests: manifests})
+	So(err, ShouldBeNil)
+	return lf.blob(oci.MediaType_ImageIndex, body)
+}
+
+// A tar entry for a layer fixture; the body is only used for regular files.
+type layerEntry struct {
+	name     string
+	typ      byte
+	body     string
+	linkname string
+}
+
+func (lf layoutFixture) layer(entries ...layerEntry) oci.Descriptor {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:     ent.name,
+			Typeflag: ent.typ,
+			Linkname: ent.linkname,
+			Mode:     0644,
+			ModTime:  time.Unix(1500000000, 0),
+		}
+		switch ent.typ {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeReg:
+			hdr.Size = int64(len(ent.body))
+		}
+		So(tw.WriteHeader(hdr), ShouldBeNil)
+		if ent.typ == tar.TypeReg {
+			_, err := tw.Write([]byte(ent.body))
+			So(err, ShouldBeNil)
+		}
+	}
+	So(tw.Close(), ShouldBeNil)
+	So(gz.Close(), ShouldBeNil)
+	return lf.blob("application/vnd.oci.image.layer.v1.tar+gzip", buf.Bytes())
+}
+
+func ociWareID(desc oci.Descriptor) api.WareID {
+	return api.WareID{PackType, desc.Digest}
+}
+
+func TestOciUnpack(t *testing.T) {
+	Convey("OCI transmat: unpacking images", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				defer os.Setenv("RIO_CACHE", os.Getenv("RIO_CACHE"))
+				os.Setenv("RIO_CACHE", tmpDir.String()+"/cache")
+				lf := newLayoutFixture(tmpDir.String() + "/layout")
+				whAddr := api.WarehouseAddr("oci+file://" + lf.dir)
+				unpackTo := func(wareID api.WareID, dir string, warehouses ...api.WarehouseAddr) (api.WareID, error) {
+					return Unpack(context.Background(), wareID, tmpDir.String()+"/"+dir, api.Filter_NoMutation, rio.Placement_Direct, warehouses, rio.Monitor{})
+				}
+				readFile := func(pth string) string {
+					body, err := ioutil.ReadFile(tmpDir.String() + "/" + pth)
+					So(err, ShouldBeNil)
+					return string(body)
+				}
+				exists := func(pth string) bool {
+					_, err := os.Lstat(tmpDir.String() + "/" + pth)
+					return err == nil
+				}
+
+				base := lf.layer(
+					layerEntry{name: "etc/", typ: tar.TypeDir},
+					layerEntry{name: "etc/a", typ: tar.TypeReg, body: "a"},
+					layerEntry{name: "etc/b", typ: tar.TypeReg, body: "b"},
+					layerEntry{name: "opt/x/y", typ: tar.TypeReg, body: "y"}, // parents implied.
+					layerEntry{name: "bin/ls", typ: tar.TypeReg, body: "ls"},
+					layerEntry{name: "usr/lib", typ: tar.TypeSymlink, linkname: "/lib"},
+				)
+				top := lf.layer(
+					layerEntry{name: "etc/.wh.b", typ: tar.TypeReg},
+					layerEntry{name: "etc/a", typ: tar.TypeReg, body: "a2"},
+					layerEntry{name: "opt/.wh..wh..opq", typ: tar.TypeReg},
+					layerEntry{name: "opt/new", typ: tar.TypeReg, body: "new"},
+					layerEntry{name: "bin/sh", typ: tar.TypeLink, linkname: "bin/ls"},
+					layerEntry{name: "usr/lib/", typ: tar.TypeDir}, // replaces the symlink.
+					layerEntry{name: "usr/lib/z", typ: tar.TypeReg, body: "z"},
+				)
+				manifest := lf.manifest(base, top)
+
+				Convey("layers are applied in order, honoring whiteouts", func() {
+					wareID, err := unpackTo(ociWareID(manifest), "out", whAddr)
+					So(err, ShouldBeNil)
+					So(wareID.Type, ShouldEqual, tartrans.PackType)
+					So(readFile("out/etc/a"), ShouldEqual, "a2")
+					So(exists("out/etc/b"), ShouldBeFalse)
+					So(exists("out/etc/.wh.b"), ShouldBeFalse)
+					So(exists("out/opt/x"), ShouldBeFalse)
+					So(exists("out/opt/.wh..wh..opq"), ShouldBeFalse)
+					So(readFile("out/opt/new"), ShouldEqual, "new")
+					So(readFile("out/bin/sh"), ShouldEqual, "ls")
+					So(readFile("out/usr/lib/z"), ShouldEqual, "z")
+
+					Convey("and the result is the tar ware of the flattened fileset", func() {
+						packed, err := tartrans.Pack(context.Background(), tartrans.PackType, tmpDir.String()+"/out", api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(packed, ShouldResemble, wareID)
+					})
+				})
+				Convey("whiteouts don't remove what the same layer placed", func() {
+					layer := lf.layer(
+						layerEntry{name: "a", typ: tar.TypeReg, body: "a"},
+						layerEntry{name: ".wh.a", typ: tar.TypeReg},
+					)
+					_, err := unpackTo(ociWareID(lf.manifest(layer)), "out", whAddr)
+					So(err, ShouldBeNil)
+					So(readFile("out/a"), ShouldEqual, "a")
+				})
+				Convey("indexes are resolved to the manifest for this platform", func() {
+					other := lf.manifest(lf.layer(layerEntry{name: "which", typ: tar.TypeReg, body: "other"}))
+					other.Platform = &oci.Platform{OS: "linux", Architecture: "nonesuch"}
+					ours := lf.manifest(lf.layer(layerEntry{name: "which", typ: tar.TypeReg, body: "ours"}))
+					ours.Platform = &oci.Platform{OS: "linux", Architecture: runtime.GOARCH}
+					_, err := unpackTo(ociWareID(lf.index(other, ours)), "out", whAddr)
+					So(err, ShouldBeNil)
+					So(readFile("out/which"), ShouldEqual, "ours")
+
+					Convey("and refused if there isn't one", func() {
+						_, err := unpackTo(ociWareID(lf.index(other, other)), "out2", whAddr)
+						So(Category(err), ShouldEqual, rio.ErrUsage)
+					})
+				})
+				Convey("a tampered layer is rejected", func() {
+					body, err := ioutil.ReadFile(lf.path(top.Digest))
+					So(err, ShouldBeNil)
+					body = append(body, 0) // trailing garbage counts too.
+					So(ioutil.WriteFile(lf.path(top.Digest), body, 0644), ShouldBeNil)
+					_, err = unpackTo(ociWareID(manifest), "out", whAddr)
+					So(Category(err), ShouldEqual, rio.ErrWareHashMismatch)
+				})
+				Convey("a tampered manifest is rejected", func() {
+					So(ioutil.WriteFile(lf.path(manifest.Digest), []byte(`{"schemaVersion":2,"layers":[]}`), 0644), ShouldBeNil)
+					_, err := unpackTo(ociWareID(manifest), "out", whAddr)
+					So(Category(err), ShouldEqual, rio.ErrWareHashMismatch)
+				})
+				Convey("hardlinks out of the image are rejected", func() {
+					for _, linkname := range []string{"/etc/a", "../etc/a", "etc/../../etc/a"} {
+						bad := lf.manifest(base, lf.layer(
+							layerEntry{name: "bin/sh", typ: tar.TypeLink, linkname: linkname},
+						))
+						_, err := unpackTo(ociWareID(bad), "out", whAddr)
+						So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+						So(exists("out/bin/sh"), ShouldBeFalse)
+					}
+				})
+				Convey("missing images are not found", func() {
+					missing := oci.Descriptor{Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("nope")))}
+					_, err := unpackTo(ociWareID(missing), "out", whAddr)
+					So(Category(err), ShouldEqual, rio.ErrWareNotFound)
+				})
+				Convey("images can come from a registry", func() {
+					var tokenRequests int
+					srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						if req.URL.Path == "/token" {
+							tokenRequests++
+							w.Write([]byte(`{"token":"letmein"}`))
+							return
+						}
+						if req.Header.Get("Authorization") != "Bearer letmein" {
+							w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test",scope="repository:some/image:pull"`, req.Host))
+							w.WriteHeader(401)
+							return
+						}
+						parts := strings.Split(req.URL.Path, "/") // "", "v2", "some", "image", kind, digest
+						if len(parts) != 6 || parts[2]+"/"+parts[3] != "some/image" {
+							w.WriteHeader(404)
+							return
+						}
+						body, err := ioutil.ReadFile(lf.path(parts[5]))
+						if err != nil {
+							w.WriteHeader(404)
+							return
+						}
+						if parts[4] == "manifests" {
+							w.Header().Set("Content-Type", oci.MediaType_ImageManifest)
+						}
+						w.Write(body)
+					}))
+					defer srv.Close()
+					regAddr := api.WarehouseAddr("oci+" + srv.URL + "/some/image")
+					_, err := unpackTo(ociWareID(manifest), "out", regAddr)
+					So(err, ShouldBeNil)
+					So(readFile("out/opt/new"), ShouldEqual, "new")
+					So(tokenRequests, ShouldEqual, 1)
+				})
+				Convey("unpacks are cached, as the tar ware", func() {
+					unpackCopy := func(dir string) (api.WareID, error) {
+						return Unpack(context.Background(), ociWareID(manifest), tmpDir.String()+"/"+dir, api.Filter_NoMutation, rio.Placement_Copy, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					}
+					wareID, err := unpackCopy("out")
+					So(err, ShouldBeNil)
+					So(os.RemoveAll(lf.dir), ShouldBeNil)
+
+					again, err := unpackCopy("out2")
+					So(err, ShouldBeNil)
+					So(again, ShouldResemble, wareID)
+					So(readFile("out2/etc/a"), ShouldEqual, "a2")
+
+					_, err = tartrans.Unpack(context.Background(), wareID, tmpDir.String()+"/out3", api.Filter_NoMutation, rio.Placement_None, nil, rio.Monitor{})
+					So(err, ShouldBeNil)
+				})
+			})
+		}),
+	)
+}
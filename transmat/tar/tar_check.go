@@ -0,0 +1,107 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"bufio"
+	"context"
+	"os"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/drift"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	Compares a directory to the ware it was unpacked from, reporting every
+	path and field which differs (see drift.Check).  Returns the number of
+	differences, which is zero if the directory is exactly as unpacked.
+
+	The filters should be the same ones used when unpacking (the defaults are
+	the same as for unpack), since the directory is compared to the ware as
+	it would be after filters.  The ware is fetched and verified, but not
+	unpacked anywhere.
+*/
+func Check(
+	ctx context.Context, // Long-running call.  Cancellable.
+	pathStr string, // The directory to check (absolute path).
+	wareID api.WareID, // What wareID the directory was unpacked from.
+	filt api.FilesetFilters, // Optionally: filters applied when unpacking.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	report func(drift.Difference), // Called with each difference found.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (n int, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return 0, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return 0, Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return 0, Errorf(rio.ErrUsage, "check must be called with absolute path: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		return 0, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+	afs := osfs.New(path)
+	if _, err := afs.Stat(fs.RelPath{}); err != nil {
+		return 0, Errorf(rio.ErrInoperablePath, "cannot read path for checking: %s", err)
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := PickReader(wareID, warehouses, false, mon)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// "unpack", scanningly, and compare the records to the directory on the way out.
+	_, _, err = unpackTar(ctx, nilFS.New(), false, filt2, nil, nil, reader, algo, func(gotWare api.WareID, _, filtered fshash.Bucket) error {
+		if err := checkWareID(wareID, gotWare); err != nil {
+			return err
+		}
+		n, err = drift.Check(ctx, afs, filtered, algo, report)
+		return err
+	}, mon, nil)
+	return n, err
+}
+
+/*
+	Writes a manifest of the bucket to a file at the (absolute) path.
+*/
+func writeManifest(path string, bucket fshash.Bucket, algo fshash.Algorithm) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := fshash.WriteManifest(w, bucket, algo); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return Errorf(rio.ErrInoperablePath, "cannot write manifest: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/drift"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarCheck(t *testing.T) {
+	Convey("Tar manifests and drift checks", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("out"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				packManifest := tmpDir.Join(fs.MustRelPath("pack.manifest")).String()
+				unpackManifest := tmpDir.Join(fs.MustRelPath("unpack.manifest")).String()
+
+				wareID, err := PackWithOptions(PackOptions{Manifest: packManifest})(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				_, err = UnpackWithOptions(UnpackOptions{Manifest: unpackManifest})(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				var diffs []string
+				report := func(d drift.Difference) {
+					diffs = append(diffs, d.Path.String()+" "+d.Field)
+				}
+				checkManifest := func(dir fs.AbsolutePath, manifest string) int {
+					f, err := os.Open(manifest)
+					So(err, ShouldBeNil)
+					defer f.Close()
+					n, err := drift.CheckManifest(context.Background(), osfs.New(dir), f, report)
+					So(err, ShouldBeNil)
+					return n
+				}
+
+				Convey("find nothing in an untouched unpack", func() {
+					n, err := Check(context.Background(), outDir.String(), wareID, api.Filter_NoMutation, []api.WarehouseAddr{whAddr}, report, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 0)
+					So(checkManifest(outDir, unpackManifest), ShouldEqual, 0)
+				})
+				Convey("find nothing in the packed dir, checked against its manifest", func() {
+					So(checkManifest(dataDir, packManifest), ShouldEqual, 0)
+				})
+				Convey("find every change made after unpacking", func() {
+					afs := osfs.New(outDir)
+					// Same size, same mtime: only the content hash can notice.
+					fmeta, err := afs.LStat(fs.MustRelPath("etc/trick"))
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("etc/trick")).String(), []byte("sub"), 0644), ShouldBeNil)
+					So(afs.SetTimesNano(fs.MustRelPath("etc/trick"), fmeta.Mtime, fs.DefaultAtime), ShouldBeNil)
+					So(os.Chmod(outDir.Join(fs.MustRelPath("var/fun")).String(), 0600), ShouldBeNil)
+					// Adding and removing entries also touches the parents' mtimes.
+					So(os.Remove(outDir.Join(fs.MustRelPath("etc/tricky")).String()), ShouldBeNil)
+					So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("new")).String(), nil, 0644), ShouldBeNil)
+
+					expect := []string{
+						". mtime",
+						"./etc mtime",
+						"./etc/trick content",
+						"./new entry",
+						"./var/fun perms",
+						"./etc/tricky entry",
+					}
+					n, err := Check(context.Background(), outDir.String(), wareID, api.Filter_NoMutation, []api.WarehouseAddr{whAddr}, report, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, len(expect))
+					So(diffs, ShouldResemble, expect)
+
+					diffs = nil
+					So(checkManifest(outDir, unpackManifest), ShouldEqual, len(expect))
+					So(diffs, ShouldResemble, expect)
+				})
+				Convey("refuse to check against a ware the warehouse doesn't have", func() {
+					_, err := Check(context.Background(), outDir.String(), api.WareID{"tar", "nope"}, api.Filter_NoMutation, []api.WarehouseAddr{whAddr}, report, rio.Monitor{})
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,63 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/warehouse/impl/kvenc"
+)
+
+func TestTarEncryptedWarehouse(t *testing.T) {
+	Convey("Tar transmat: encrypted warehouses", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("enc+ca+file://%s/wh", tmpDir))
+				key, _ := kvenc.GenerateKey()
+				keyPath := tmpDir.Join(fs.MustRelPath("key")).String()
+				So(ioutil.WriteFile(keyPath, []byte(key.String()), 0600), ShouldBeNil)
+				os.Setenv("RIO_ENCRYPTION_KEYFILE", keyPath)
+				defer os.Unsetenv("RIO_ENCRYPTION_KEYFILE")
+				// Fresh cache, so unpacking has to read the warehouse.
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				defer os.Unsetenv("RIO_CACHE")
+
+				plainWareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, ShouldBeNil)
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				So(wareID, ShouldResemble, plainWareID)
+
+				Convey("round-trip wares by their plaintext WareID", func() {
+					gotWareID, err := Unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+				})
+				Convey("can't be read as plain warehouses", func() {
+					_, err := Unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr[len("enc+"):]}, rio.Monitor{})
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,104 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/limits"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarUnpackLimits(t *testing.T) {
+	Convey("Tar transmat: unpack limits", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpackWithLimit := func(env, value string) error {
+					// Fresh cache, or this might not be an unpack at all.
+					os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+					defer os.Unsetenv("RIO_CACHE")
+					os.Setenv(env, value)
+					defer os.Unsetenv(env)
+					_, err := Unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					return err
+				}
+
+				Convey("within the limits, unpacking works", func() {
+					So(unpackWithLimit("RIO_LIMIT_BYTES", "1K"), ShouldBeNil)
+				})
+				Convey("too many entries is rolled back", func() {
+					err := unpackWithLimit("RIO_LIMIT_ENTRIES", "3")
+					So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+					_, err = os.Lstat(outDir.String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+				Convey("too many bytes is rolled back, leaving the target dir", func() {
+					So(os.Mkdir(outDir.String(), 0755), ShouldBeNil)
+					err := unpackWithLimit("RIO_LIMIT_BYTES", "10")
+					So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+					names, err := ioutil.ReadDir(outDir.String())
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+				})
+				Convey("a file too big is refused", func() {
+					err := unpackWithLimit("RIO_LIMIT_FILE_BYTES", "3")
+					So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+					So(err.Error(), ShouldContainSubstring, "./etc/init/zed")
+				})
+				Convey("paths too deep are refused", func() {
+					err := unpackWithLimit("RIO_LIMIT_PATH_DEPTH", "2")
+					So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+				})
+				Convey("rolling back leaves what was in the target dir before", func() {
+					So(os.Mkdir(outDir.String(), 0755), ShouldBeNil)
+					So(ioutil.WriteFile(outDir.String()+"/mine", []byte("keep me"), 0644), ShouldBeNil)
+					err := unpackWithLimit("RIO_LIMIT_BYTES", "10")
+					So(Category(err), ShouldEqual, limits.ErrLimitExceeded)
+					names, err := ioutil.ReadDir(outDir.String())
+					So(err, ShouldBeNil)
+					So(names, ShouldHaveLength, 1)
+					So(names[0].Name(), ShouldEqual, "mine")
+				})
+				Convey("invalid limits are a usage error", func() {
+					So(Category(unpackWithLimit("RIO_LIMIT_BYTES", "lots")), ShouldEqual, rio.ErrUsage)
+					So(Category(unpackWithLimit("RIO_LIMIT_BYTES", "-1")), ShouldEqual, rio.ErrUsage)
+					So(Category(unpackWithLimit("RIO_LIMIT_BYTES", "9000000000T")), ShouldEqual, rio.ErrUsage)
+				})
+				Convey("limits only apply to unpacking, not just reading wares", func() {
+					os.Setenv("RIO_LIMIT_ENTRIES", "1")
+					defer os.Unsetenv("RIO_LIMIT_ENTRIES")
+					paths, err := filepath.Glob(tmpDir.String() + "/wh/*/*/" + wareID.Hash)
+					So(err, ShouldBeNil)
+					So(paths, ShouldHaveLength, 1)
+					f, err := os.Open(paths[0])
+					So(err, ShouldBeNil)
+					defer f.Close()
+					So(VerifyStream(context.Background(), wareID, f, rio.Monitor{}), ShouldBeNil)
+				})
+			})
+		}),
+	)
+}
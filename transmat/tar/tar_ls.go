@@ -0,0 +1,60 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	Walks the fileset at the path exactly as Pack would, but without
+	writing anything anywhere, and returns the WareID Pack would have.
+
+	If `entry` is not nil, it's called for each entry in the fileset
+	(in sorted walk order) with the metadata that Pack would have recorded,
+	i.e. after filters are applied.
+
+	If `tree` is not nil, it's called for each directory in the fileset
+	(in post-order, so the root comes last) with the WareID of that
+	directory's subtree: the same WareID you would get from packing that
+	directory alone, with the same filters and hash algorithm.
+*/
+func Ls(
+	ctx context.Context, // Long-running call.  Cancellable.
+	pathStr string, // The fileset to scan (absolute path).
+	filt api.FilesetFilters, // Optionally: filters to apply, as if packing.
+	algo fshash.Algorithm, // The hash algorithm to use, as if packing.
+	entry func(fmeta fs.Metadata), // Optionally: called for every entry.
+	tree func(dir fs.RelPath, wareID api.WareID), // Optionally: called for every directory.
+) (_ api.WareID, err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	path, err := fs.ParseAbsolutePath(pathStr)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "ls must be called with absolute path: %s", err)
+	}
+	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposePack)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
+	}
+
+	// Unlike Pack, a missing path is an error: there's nothing to list.
+	afs := osfs.New(path)
+	if _, err := afs.Stat(fs.RelPath{}); err != nil {
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "cannot read path for listing: %s", err)
+	}
+
+	return packTar(ctx, afs, filt2, nil, algo, nil, packVisitor{entry: entry, tree: tree}, nil)
+}
@@ -15,7 +15,10 @@ import (
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/go-timeless-api/util"
 	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
 	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/signature"
 )
 
 var (
@@ -34,14 +37,21 @@ func Mirror(
 		defer close(mon.Chan)
 	}
 
+	// The hash tells us which algorithm to verify with.
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+
 	// Try to read the ware from the target first; if successfull, no-op out.
 	//  We don't fully re-verify the content, because that requires a time
 	//  committment, and we want this command to be fast when run repeatedly.
+	//  Signatures are still copied, if the sources have any, since they may have gained some.
 	reader, err := PickReader(wareID, []api.WarehouseAddr{target}, false, mon)
 	if err == nil {
 		log.MirrorNoop(mon, target, wareID)
 		reader.Close()
-		return wareID, nil
+		return wareID, signature.Mirror(wareID, target, sources, mon)
 	}
 
 	// Connect to target warehouse, and get write controller opened.
@@ -64,13 +74,14 @@ func Mirror(
 	// Prepare to scan this as we process.
 	//  It would be unfortunate to accidentally foist corrupted or
 	//  wrongly identified content onto a mirror.
+	prog := log.NewProgress(mon, log.PhaseFetching, warehouse.SizeOf(reader))
 	reader = flippingReader{reader, wc}
 	afs := nilFS.New()
 
 	// "unpack", scanningly.  This drives the copy.
 	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
 	// We can ignore the pre/post filter wareIDs, since we know its a no-mutation filter.
-	gotWare, _, err := unpackTar(ctx, afs, filt, reader, mon)
+	gotWare, _, err := unpackTar(ctx, afs, false, filt, nil, nil, reader, algo, nil, mon, prog)
 	if err != nil {
 		// If errors at this stage: still return a blank wareID, because
 		//  we haven't finished *uploading* it.
@@ -92,7 +103,14 @@ func Mirror(
 	}
 
 	// All's quiet: flush and commit.
-	return gotWare, wc.Commit(wareID)
+	prog.Phase(log.PhaseCommitting, 0)
+	if err := wc.Commit(wareID); err != nil {
+		return api.WareID{}, err
+	}
+	prog.Done()
+
+	// Bring along any signatures for the ware.
+	return gotWare, signature.Mirror(wareID, target, sources, mon)
 }
 
 // Proxy read calls, also copying each buffer into another write.
@@ -6,15 +6,18 @@ Sniperkit-Bot
 package tartrans
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/testutil"
 	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/warehouse/signature"
 )
 
 func TestTarMirror(t *testing.T) {
@@ -30,6 +33,45 @@ func TestTarMirror(t *testing.T) {
 					tests.CheckMirror(PackType, Mirror, Pack, Unpack, dstAddr, srcAddr)
 				})
 			})
+			Convey("Signatures are mirrored along with wares:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755)
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("src"), 0755)
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("dst"), 0755)
+					tests.PlaceFixture(osfs.New(tmpDir.Join(fs.MustRelPath("data"))), tests.FixtureAlpha)
+					srcAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/src", tmpDir))
+					dstAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/dst", tmpDir))
+					wareID, err := Pack(context.Background(), PackType, tmpDir.Join(fs.MustRelPath("data")).String(), api.Filter_NoMutation, srcAddr, rio.Monitor{})
+					So(err, ShouldBeNil)
+					pubA, keyA, _ := signature.GenerateKey()
+					pubB, keyB, _ := signature.GenerateKey()
+					So(signature.Store(wareID, signature.Sign(keyA, wareID), srcAddr), ShouldBeNil)
+
+					_, err = Mirror(context.Background(), wareID, dstAddr, []api.WarehouseAddr{srcAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(signature.Require(wareID, signature.Keyring{pubA}, []api.WarehouseAddr{dstAddr}, rio.Monitor{}), ShouldBeNil)
+					So(signature.Require(wareID, signature.Keyring{pubB}, []api.WarehouseAddr{dstAddr}, rio.Monitor{}), ShouldNotBeNil)
+
+					Convey("including new ones, when the ware is already mirrored", func() {
+						So(signature.Store(wareID, signature.Sign(keyB, wareID), srcAddr), ShouldBeNil)
+						_, err = Mirror(context.Background(), wareID, dstAddr, []api.WarehouseAddr{srcAddr}, rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(signature.Require(wareID, signature.Keyring{pubA}, []api.WarehouseAddr{dstAddr}, rio.Monitor{}), ShouldBeNil)
+						So(signature.Require(wareID, signature.Keyring{pubB}, []api.WarehouseAddr{dstAddr}, rio.Monitor{}), ShouldBeNil)
+					})
+					Convey("but a source without any is nothing to mirror, when the ware is already mirrored", func() {
+						osfs.New(tmpDir).Mkdir(fs.MustRelPath("nosigs"), 0755)
+						sources := []api.WarehouseAddr{
+							api.WarehouseAddr(fmt.Sprintf("ca+file://%s/nosigs", tmpDir)),
+							api.WarehouseAddr(fmt.Sprintf("ca+file://%s/nowhere", tmpDir)),
+							"git://example.net/not-a-tar-warehouse",
+						}
+						_, err = Mirror(context.Background(), wareID, dstAddr, sources, rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(signature.Require(wareID, signature.Keyring{pubA}, []api.WarehouseAddr{dstAddr}, rio.Monitor{}), ShouldBeNil)
+					})
+				})
+			})
 		}),
 	)
 }
@@ -9,11 +9,10 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"crypto/sha512"
 	"io"
+	"io/ioutil"
 	"time"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
@@ -23,6 +22,8 @@ import (
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/statcache"
 )
 
 var (
@@ -36,6 +37,57 @@ func Pack(
 	filt api.FilesetFilters, // Optionally: filters we should apply while unpacking.
 	warehouseAddr api.WarehouseAddr, // Warehouse to save into (or blank to just scan).
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	return PackWithOptions(PackOptions{})(ctx, packType, pathStr, filt, warehouseAddr, mon)
+}
+
+/*
+	Tar-specific options for packing.  The zero value is the defaults.
+*/
+type PackOptions struct {
+	// The hash algorithm for the WareID.  Zero means fshash.DefaultAlgorithm.
+	Algorithm fshash.Algorithm
+
+	// Path of a stat-cache file (see the statcache package).  Optional.
+	// When set, a pack with no warehouse (i.e. just computing the WareID)
+	// reuses content hashes for files whose stat data hasn't changed
+	// since the last time, rather than reading them again; the WareID
+	// is the same either way.  It's an error to set this with a warehouse.
+	Index string
+
+	// Path to write a manifest of the packed fileset to (see
+	// fshash.WriteManifest), for checking copies of it for drift later.  Optional.
+	Manifest string
+}
+
+/*
+	Returns a pack func which uses the given tar-specific options.
+	(Pack itself is simply this with the zero PackOptions.)
+*/
+func PackWithOptions(opts PackOptions) rio.PackFunc {
+	if opts.Algorithm.New == nil {
+		opts.Algorithm = fshash.DefaultAlgorithm
+	}
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		pathStr string,
+		filt api.FilesetFilters,
+		warehouseAddr api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		return pack(ctx, packType, pathStr, filt, warehouseAddr, opts, mon)
+	}
+}
+
+func pack(
+	ctx context.Context,
+	packType api.PackType,
+	pathStr string,
+	filt api.FilesetFilters,
+	warehouseAddr api.WarehouseAddr,
+	opts PackOptions,
+	mon rio.Monitor,
 ) (_ api.WareID, err error) {
 	if mon.Chan != nil {
 		defer close(mon.Chan)
@@ -54,6 +106,9 @@ func Pack(
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
+	if opts.Index != "" && warehouseAddr != "" {
+		return api.WareID{}, Errorf(rio.ErrUsage, "a stat-cache index can only be used when packing without a warehouse")
+	}
 
 	// Short-circuit exit if the path does not exist.
 	//  We could let the errors later bubble, but, why bother opening a writeController,
@@ -69,6 +124,28 @@ func Pack(
 		return api.WareID{}, Errorf(rio.ErrPackInvalid, "cannot read path for packing: %s", err)
 	}
 
+	var visit packVisitor
+	if opts.Manifest != "" {
+		visit.bucket = func(bucket fshash.Bucket) error {
+			return writeManifest(opts.Manifest, bucket, opts.Algorithm)
+		}
+	}
+
+	// If we have an index, we're only hashing, and don't need to write (or read!) anything.
+	if opts.Index != "" {
+		index := statcache.Open(opts.Index, opts.Algorithm.Tag)
+		prog := log.NewProgress(mon, log.PhaseHashing, 0)
+		wareID, err := packTar(ctx, afs, filt2, nil, opts.Algorithm, index, visit, prog)
+		if err != nil {
+			return wareID, err
+		}
+		if err := index.Save(); err != nil {
+			return wareID, Errorf(rio.ErrLocalCacheProblem, "%s", err)
+		}
+		prog.Done()
+		return wareID, nil
+	}
+
 	// Connect to warehouse, and get write controller opened.
 	wc, err := OpenWriteController(warehouseAddr, packType, mon)
 	if err != nil {
@@ -87,7 +164,8 @@ func Pack(
 	tarWriter := tar.NewWriter(gzWriter)
 
 	// Scan and tarify!
-	wareID, err := packTar(ctx, afs, filt2, tarWriter)
+	prog := log.NewProgress(mon, log.PhaseHashing, 0)
+	wareID, err := packTar(ctx, afs, filt2, tarWriter, opts.Algorithm, nil, visit, prog)
 	if err != nil {
 		return wareID, err
 	}
@@ -97,18 +175,47 @@ func Pack(
 
 	// If we made it all the way with no errors, commit.
 	//  (Otherwise, the write controller will be closed by default by our defers.)
-	return wareID, wc.Commit(wareID)
+	prog.Phase(log.PhaseCommitting, 0)
+	if err := wc.Commit(wareID); err != nil {
+		return wareID, err
+	}
+	prog.Done()
+	return wareID, nil
+}
+
+/*
+	Optional callbacks for observing a pack as it happens.  See Ls.
+*/
+type packVisitor struct {
+	entry  func(fmeta fs.Metadata)                // called for every entry, in walk order.
+	tree   func(dir fs.RelPath, wareID api.WareID) // called for every dir, after everything in it.
+	bucket func(bucket fshash.Bucket) error       // called with all the records, once hashed.
 }
 
+/*
+	Walks the filesystem and computes its WareID, writing each entry to
+	the tar writer as we go (unless it's nil, in which case this is just a scan).
+
+	The index is optional, and may only be used without a tar writer
+	(since otherwise we need to read every file anyway).
+*/
 func packTar(
 	ctx context.Context,
 	afs fs.FS,
 	filt apiutil.FilesetFilters,
 	tw *tar.Writer,
+	algo fshash.Algorithm,
+	index *statcache.Index,
+	visit packVisitor,
+	prog *log.Progress, // Optionally: counts the entries, and the bytes of file content read.
 ) (api.WareID, error) {
 	// Allocate bucket for keeping each metadata entry and content hash;
 	// the full tree hash will be computed from this at the end.
-	bucket := &fshash.MemoryBucket{}
+	bucket, err := newBucket()
+	if err != nil {
+		return api.WareID{}, err
+	}
+	defer bucket.Close()
 
 	// Walk the filesystem, emitting tar entries and filling the bucket as we go.
 	tarHeader := &tar.Header{}
@@ -136,10 +243,19 @@ func packTar(
 		//  so that the hash and the serial form are describing the same thing.
 		fmeta.Mtime = fmeta.Mtime.Truncate(time.Second)
 
+		if visit.entry != nil {
+			visit.entry(*fmeta)
+		}
+		prog.Entry()
+
 		// Flip our metadata to tar header format, and flush it.
-		MetadataToTarHdr(fmeta, tarHeader)
-		if err := tw.WriteHeader(tarHeader); err != nil {
-			return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+		var body io.Writer = ioutil.Discard
+		if tw != nil {
+			MetadataToTarHdr(fmeta, tarHeader)
+			if err := tw.WriteHeader(tarHeader); err != nil {
+				return Errorf(rio.ErrWarehouseUnwritable, "error while writing pack: %s", err)
+			}
+			body = tw
 		}
 
 		// If it's a file, stream the body into the tar while hashing; for all,
@@ -148,13 +264,27 @@ func packTar(
 			bucket.AddRecord(*fmeta, nil)
 		} else {
 			defer file.Close()
-			hasher := sha512.New384()
-			tee := io.MultiWriter(tw, hasher)
-			_, err := io.Copy(tee, file)
+			// If the index knows this file as it is now, skip reading it.
+			//  Note we stat the open file, so what we hash is what we stat'd.
+			var st statcache.Stat
+			var statOk bool
+			if index != nil {
+				st, statOk = statcache.StatFile(file)
+				if hash, ok := index.Lookup(fmeta.Name, st); ok && statOk {
+					bucket.AddRecord(*fmeta, hash)
+					return nil
+				}
+			}
+			hasher := algo.New()
+			tee := io.MultiWriter(body, hasher)
+			_, err := io.Copy(tee, prog.Reader(file))
 			if err != nil {
 				return err
 			}
 			bucket.AddRecord(*fmeta, hasher.Sum(nil))
+			if statOk {
+				index.Store(fmeta.Name, st, hasher.Sum(nil))
+			}
 		}
 		return nil
 	}
@@ -163,6 +293,20 @@ func packTar(
 	}
 
 	// Hash the thing!
-	hash := fshash.HashBucket(bucket, sha512.New384)
-	return api.WareID{"tar", misc.Base58Encode(hash)}, nil
+	if err := bucket.Err(); err != nil {
+		return api.WareID{}, Errorf(rio.ErrLocalCacheProblem, "error while packing: %s", err)
+	}
+	var treeVisit func(fs.RelPath, []byte)
+	if visit.tree != nil {
+		treeVisit = func(dir fs.RelPath, hash []byte) {
+			visit.tree(dir, api.WareID{"tar", algo.Format(hash)})
+		}
+	}
+	hash := fshash.HashBucketTrees(bucket, algo.New, treeVisit)
+	if visit.bucket != nil {
+		if err := visit.bucket(bucket); err != nil {
+			return api.WareID{}, err
+		}
+	}
+	return api.WareID{"tar", algo.Format(hash)}, nil
 }
@@ -6,9 +6,15 @@ Sniperkit-Bot
 package tartrans
 
 import (
+	"context"
+	"io/ioutil"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/testutil"
 	"go.polydawn.net/rio/transmat/mixins/tests"
 )
@@ -22,3 +28,53 @@ func TestTarPack(t *testing.T) {
 		}),
 	)
 }
+
+func TestTarPackIndex(t *testing.T) {
+	Convey("Tar pack with a stat-cache index", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				indexPath := tmpDir.Join(fs.MustRelPath("index")).String()
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				packIndexed := PackWithOptions(PackOptions{Index: indexPath})
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("gives the same WareID as a full rehash, every time", func() {
+					wareID2, err := packIndexed(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID)
+					wareID3, err := packIndexed(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID3, ShouldResemble, wareID)
+				})
+				Convey("notices a file changed right after it was hashed", func() {
+					_, err := packIndexed(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					// Same size, and we'll put the mtime back, too.
+					//  Only the racy check can save us, since this all happens in the same second.
+					afs := osfs.New(dataDir)
+					fmeta, err := afs.LStat(fs.MustRelPath("etc/trick"))
+					So(err, ShouldBeNil)
+					body, err := ioutil.ReadFile(dataDir.Join(fs.MustRelPath("etc/trick")).String())
+					So(err, ShouldBeNil)
+					body[0]++
+					So(ioutil.WriteFile(dataDir.Join(fs.MustRelPath("etc/trick")).String(), body, 0644), ShouldBeNil)
+					So(afs.SetTimesNano(fs.MustRelPath("etc/trick"), fmeta.Mtime, fs.DefaultAtime), ShouldBeNil)
+
+					wareID2, err := packIndexed(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldNotResemble, wareID)
+					wareID3, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "", rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(wareID2, ShouldResemble, wareID3)
+				})
+				Convey("refuses to be used with a warehouse", func() {
+					_, err := packIndexed(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, "file:///dev/null", rio.Monitor{})
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}),
+	)
+}
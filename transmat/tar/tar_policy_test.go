@@ -0,0 +1,108 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/policy"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarUnpackPolicy(t *testing.T) {
+	mtime := time.Date(1990, 1, 14, 12, 30, 0, 0, time.UTC)
+	fixture := []tests.FixtureFile{
+		{fs.Metadata{Name: fs.MustRelPath("."), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./abs"), Type: fs.Type_Symlink, Linkname: "/etc", Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./bin"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./bin/su"), Type: fs.Type_File, Perms: 0755 | fs.Perms_Setuid, Mtime: mtime, Size: 2}, []byte("su")},
+		{fs.Metadata{Name: fs.MustRelPath("./bin/true"), Type: fs.Type_File, Perms: 0755, Mtime: mtime, Size: 4}, []byte("true")},
+		{fs.Metadata{Name: fs.MustRelPath("./bin/up"), Type: fs.Type_Symlink, Linkname: "../..", Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./pipe"), Type: fs.Type_NamedPipe, Perms: 0644, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./shared"), Type: fs.Type_Dir, Perms: 0755 | fs.Perms_Setgid, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./shared/file"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 4}, []byte("file")},
+		{fs.Metadata{Name: fs.MustRelPath("./shared/sub"), Type: fs.Type_Dir, Perms: 0755, Mtime: mtime}, nil},
+		{fs.Metadata{Name: fs.MustRelPath("./shared/sub/deep"), Type: fs.Type_File, Perms: 0644, Mtime: mtime, Size: 4}, []byte("deep")},
+	}
+	Convey("Tar transmat: unpack policies", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), fixture)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpack := func(pol policy.Policy, filt api.FilesetFilters) (api.WareID, error) {
+					return UnpackWithOptions(UnpackOptions{Policy: pol})(context.Background(), wareID, outDir.String(), filt, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+				}
+				exists := func(path string) bool {
+					_, err := os.Lstat(outDir.Join(fs.MustRelPath(path)).String())
+					return err == nil
+				}
+
+				Convey("skipping leaves out exactly the offending entries", func() {
+					pol := policy.Policy{}
+					So(pol.Set(policy.Action_Skip, "all"), ShouldBeNil)
+					gotWareID, err := unpack(pol, api.Filter_NoMutation)
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldNotResemble, wareID)
+					So(exists("bin/true"), ShouldBeTrue)
+					for _, path := range []string{"abs", "bin/su", "bin/up", "pipe", "shared"} {
+						So(exists(path), ShouldBeFalse)
+					}
+				})
+				Convey("rejecting fails, listing every offending entry", func() {
+					pol := policy.Policy{}
+					So(pol.Set(policy.Action_Reject, "setid,fifos,escaping-symlinks"), ShouldBeNil)
+					_, err := unpack(pol, api.Filter_NoMutation)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+					So(err.Error(), ShouldContainSubstring, "./bin/su (setid), ./bin/up (escaping-symlinks), ./pipe (fifos)")
+					So(exists("bin/su"), ShouldBeFalse)
+				})
+				Convey("skipping a dir skips what's inside it too", func() {
+					pol := policy.Policy{}
+					So(pol.Set(policy.Action_Skip, "setid"), ShouldBeNil)
+					_, err := unpack(pol, api.Filter_NoMutation)
+					So(err, ShouldBeNil)
+					So(exists("bin/true"), ShouldBeTrue)
+					So(exists("shared"), ShouldBeFalse)
+				})
+				Convey("rejecting a dir rejects what's inside it too", func() {
+					pol := policy.Policy{}
+					So(pol.Set(policy.Action_Reject, "setid"), ShouldBeNil)
+					_, err := unpack(pol, api.Filter_NoMutation)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+					So(err.Error(), ShouldContainSubstring, "./shared (setid), ./shared/file (inside ./shared)")
+					So(err.Error(), ShouldContainSubstring, "./shared/sub/deep (inside ./shared)")
+				})
+				Convey("filters have their say first", func() {
+					pol := policy.Policy{}
+					So(pol.Set(policy.Action_Reject, "setid"), ShouldBeNil)
+					filt := api.Filter_NoMutation
+					filt.Sticky = "zero"
+					_, err := unpack(pol, filt)
+					So(err, ShouldBeNil)
+					So(exists("bin/su"), ShouldBeTrue)
+					So(exists("shared/sub/deep"), ShouldBeTrue)
+				})
+			})
+		}),
+	)
+}
@@ -0,0 +1,133 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/go-timeless-api/util"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/nilfs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+)
+
+/*
+	Fetches the ware, and returns a proof that the file or dir at `pathStr`
+	(relative to the root of the ware) is part of it.
+
+	The ware is read in full and verified against its WareID (nothing is
+	unpacked to disk), so the proof is only returned if it's for the real thing.
+	Anyone holding the proof can then check it with VerifyProof and just the
+	WareID, without needing to fetch the ware.
+*/
+func Prove(
+	ctx context.Context, // Long-running call.  Cancellable.
+	wareID api.WareID, // What wareID to fetch and prove inclusion in.
+	pathStr string, // The path to prove, relative to the root of the ware.
+	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
+	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ fshash.Proof, err error) {
+	if mon.Chan != nil {
+		defer close(mon.Chan)
+	}
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	// Sanitize arguments.
+	if wareID.Type != PackType {
+		return fshash.Proof{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return fshash.Proof{}, Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+	if pathStr == "" || strings.HasPrefix(pathStr, "/") {
+		return fshash.Proof{}, Errorf(rio.ErrUsage, "path to prove must be relative to the root of the ware (not %q)", pathStr)
+	}
+	path := fs.MustRelPath(pathStr)
+	if path.GoesUp() {
+		return fshash.Proof{}, Errorf(rio.ErrUsage, "path to prove must be inside the ware (not %q)", pathStr)
+	}
+
+	// Pick a warehouse and get a reader.
+	reader, err := PickReader(wareID, warehouses, false, mon)
+	if err != nil {
+		return fshash.Proof{}, err
+	}
+	defer reader.Close()
+
+	// "unpack", scanningly, and build the proof from the records on the way out.
+	var proof fshash.Proof
+	filt, _ := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+	_, _, err = unpackTar(ctx, nilFS.New(), false, filt, nil, nil, reader, algo, func(gotWare api.WareID, bucket, _ fshash.Bucket) error {
+		// A proof against content that isn't what we asked for is worthless.
+		if err := checkWareID(wareID, gotWare); err != nil {
+			return err
+		}
+		var err error
+		proof, err = fshash.ProveBucket(bucket, algo.New, path)
+		if err != nil {
+			return Errorf(rio.ErrUsage, "cannot prove %q in %q: %s", pathStr, wareID, err)
+		}
+		return nil
+	}, mon, nil)
+	return proof, err
+}
+
+/*
+	Returns a hash mismatch error if the wareIDs differ.
+*/
+func checkWareID(expected, actual api.WareID) error {
+	if actual == expected {
+		return nil
+	}
+	return ErrorDetailed(
+		rio.ErrWareHashMismatch,
+		fmt.Sprintf("hash mismatch: expected %q, got %q", expected, actual),
+		map[string]string{
+			"expected": expected.String(),
+			"actual":   actual.String(),
+		},
+	)
+}
+
+/*
+	Checks that the proof shows its entry is part of the ware with the given ID.
+	No warehouses are needed.
+
+	Returns ErrWareHashMismatch if the proof leads to some other ware,
+	and ErrUsage if the proof is malformed.
+*/
+func VerifyProof(wareID api.WareID, proof fshash.Proof) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	if wareID.Type != PackType {
+		return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+	root, err := proof.Root(algo.New)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "%s", err)
+	}
+	if gotWare := (api.WareID{PackType, algo.Format(root)}); gotWare != wareID {
+		return ErrorDetailed(
+			rio.ErrWareHashMismatch,
+			fmt.Sprintf("proof for %q does not lead to %q (it leads to %q)", proof.Entry.Name, wareID, gotWare),
+			map[string]string{
+				"expected": wareID.String(),
+				"actual":   gotWare.String(),
+			},
+		)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarProve(t *testing.T) {
+	Convey("Tar inclusion proofs", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				Convey("verify against the ware they were made from", func() {
+					proof, err := Prove(context.Background(), wareID, "etc/init.d/service-q", []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(proof.Entry.Name, ShouldResemble, fs.MustRelPath("etc/init.d/service-q"))
+					So(VerifyProof(wareID, proof), ShouldBeNil)
+
+					Convey("but not against any other ware", func() {
+						otherID, err := Pack(context.Background(), PackType, dataDir.Join(fs.MustRelPath("etc")).String(), api.Filter_NoMutation, "", rio.Monitor{})
+						So(err, ShouldBeNil)
+						So(errcat.Category(VerifyProof(otherID, proof)), ShouldEqual, rio.ErrWareHashMismatch)
+					})
+					Convey("and not if the content is claimed to be different", func() {
+						proof.ContentHash[0]++
+						So(errcat.Category(VerifyProof(wareID, proof)), ShouldEqual, rio.ErrWareHashMismatch)
+					})
+				})
+				Convey("can be made for dirs", func() {
+					proof, err := Prove(context.Background(), wareID, "etc", []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(VerifyProof(wareID, proof), ShouldBeNil)
+				})
+				Convey("can't be made for paths not in the ware", func() {
+					_, err := Prove(context.Background(), wareID, "etc/nope", []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(errcat.Category(err), ShouldEqual, rio.ErrUsage)
+					_, err = Prove(context.Background(), wareID, "../etc", []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(errcat.Category(err), ShouldEqual, rio.ErrUsage)
+				})
+			})
+		}),
+	)
+}
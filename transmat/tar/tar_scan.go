@@ -7,6 +7,7 @@ package tartrans
 
 import (
 	"context"
+	"io"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
@@ -15,6 +16,9 @@ import (
 	"go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/fs/nilfs"
 	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/warehouse"
 )
 
 // A "scan" is roughly the same as an unpack to /dev/null,
@@ -39,6 +43,35 @@ func Scan(
 	placementMode rio.PlacementMode, // For scanning only "None" (cache; the default) and "Direct" (don't cache) are valid.
 	addr api.WarehouseAddr, // The *one* warehouse to fetch from.  Must be a monowarehouse (not a CA-mode).
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
+) (_ api.WareID, err error) {
+	return ScanWithAlgorithm(fshash.DefaultAlgorithm)(ctx, packType, filt, placementMode, addr, mon)
+}
+
+/*
+	Returns a scan func which hashes with the given algorithm.
+	(Scan itself is simply this with the default algorithm.)
+*/
+func ScanWithAlgorithm(algo fshash.Algorithm) rio.ScanFunc {
+	return func(
+		ctx context.Context,
+		packType api.PackType,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		addr api.WarehouseAddr,
+		mon rio.Monitor,
+	) (api.WareID, error) {
+		return scan(ctx, packType, filt, placementMode, addr, algo, mon)
+	}
+}
+
+func scan(
+	ctx context.Context,
+	packType api.PackType,
+	filt api.FilesetFilters,
+	placementMode rio.PlacementMode,
+	addr api.WarehouseAddr,
+	algo fshash.Algorithm,
+	mon rio.Monitor,
 ) (_ api.WareID, err error) {
 	if mon.Chan != nil {
 		defer close(mon.Chan)
@@ -86,6 +119,44 @@ func Scan(
 	// Extract.
 	//  For once we can actually discard the *prefilter* wareID, since we don't have
 	//  an expected one to assert against.
-	_, unpackedWareID, err := unpackTar(ctx, afs, filt2, reader, mon)
-	return unpackedWareID, err
+	prog := log.NewProgress(mon, log.PhaseHashing, warehouse.SizeOf(reader))
+	_, unpackedWareID, err := unpackTar(ctx, afs, false, filt2, nil, nil, reader, algo, nil, mon, prog)
+	if err != nil {
+		return unpackedWareID, err
+	}
+	prog.Done()
+	return unpackedWareID, nil
+}
+
+/*
+	Hashes a tar stream, without placing it anywhere, and checks that it's
+	the given ware.  Used to check a ware before accepting it into
+	a warehouse (as `rio serve` does with uploads).
+
+	Reads only as far as the end of the tar; callers which need the whole
+	stream read (e.g. because they're teeing it somewhere) should drain it.
+
+	May return errors of category `rio.ErrWareHashMismatch` if the stream is
+	some other ware, `rio.ErrWareCorrupt` if it's not a tar at all, or
+	`rio.ErrUsage` if the wareID isn't a tar ware.
+*/
+func VerifyStream(ctx context.Context, wareID api.WareID, r io.Reader, mon rio.Monitor) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	if wareID.Type != PackType {
+		return Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+	}
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
+	filt, err := apiutil.ProcessFilters(api.Filter_NoMutation, apiutil.FilterPurposeUnpack)
+	if err != nil {
+		panic(err) // the no-mutation filters are always valid.
+	}
+	prefilterWareID, _, err := unpackTar(ctx, nilFS.New(), false, filt, nil, nil, r, algo, nil, mon, nil)
+	if err != nil {
+		return err
+	}
+	return checkWareID(wareID, prefilterWareID)
 }
@@ -0,0 +1,89 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package tartrans
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/fs/osfs"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/drift"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+)
+
+func TestTarSync(t *testing.T) {
+	Convey("Tar unpack with sync placement", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				elsewhere := tmpDir.Join(fs.MustRelPath("elsewhere"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("elsewhere"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("wh"), 0755), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				sync := func() error {
+					gotWareID, err := Unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, Placement_Sync, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					if err == nil {
+						So(gotWareID, ShouldResemble, wareID)
+					}
+					return err
+				}
+				check := func() []string {
+					var diffs []string
+					_, err := Check(context.Background(), outDir.String(), wareID, api.Filter_NoMutation, []api.WarehouseAddr{whAddr}, func(d drift.Difference) {
+						diffs = append(diffs, d.String())
+					}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					return diffs
+				}
+				So(sync(), ShouldBeNil)
+				So(check(), ShouldBeEmpty)
+
+				Convey("put back only what drifted", func() {
+					untouched, err := os.Lstat(outDir.Join(fs.MustRelPath("etc/init.d/service-p")).String())
+					So(err, ShouldBeNil)
+					So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("etc/trick")).String(), []byte("sub"), 0644), ShouldBeNil)
+					So(os.Chmod(outDir.Join(fs.MustRelPath("var/fun")).String(), 0600), ShouldBeNil)
+					So(os.Remove(outDir.Join(fs.MustRelPath("etc/tricky")).String()), ShouldBeNil)
+					So(os.RemoveAll(outDir.Join(fs.MustRelPath("etc/init")).String()), ShouldBeNil)
+					So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("etc/init")).String(), []byte("not a dir"), 0644), ShouldBeNil)
+					So(os.MkdirAll(outDir.Join(fs.MustRelPath("extra/deeper")).String(), 0755), ShouldBeNil)
+					So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("extra/deeper/file")).String(), nil, 0644), ShouldBeNil)
+					So(len(check()), ShouldBeGreaterThan, 0)
+
+					So(sync(), ShouldBeNil)
+					So(check(), ShouldBeEmpty)
+					stillThere, err := os.Lstat(outDir.Join(fs.MustRelPath("etc/init.d/service-p")).String())
+					So(err, ShouldBeNil)
+					So(os.SameFile(untouched, stillThere), ShouldBeTrue)
+				})
+				Convey("replace symlinks rather than write through them", func() {
+					So(os.RemoveAll(outDir.Join(fs.MustRelPath("var")).String()), ShouldBeNil)
+					So(os.Symlink(elsewhere.String(), outDir.Join(fs.MustRelPath("var")).String()), ShouldBeNil)
+
+					So(sync(), ShouldBeNil)
+					So(check(), ShouldBeEmpty)
+					names, err := ioutil.ReadDir(elsewhere.String())
+					So(err, ShouldBeNil)
+					So(names, ShouldBeEmpty)
+				})
+			})
+		}),
+	)
+}
@@ -8,12 +8,13 @@ package tartrans
 import (
 	"archive/tar"
 	"context"
-	"crypto/sha512"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
 	"strings"
 
-	"github.com/polydawn/refmt/misc"
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
@@ -26,8 +27,11 @@ import (
 	"go.polydawn.net/rio/transmat/mixins/cache"
 	"go.polydawn.net/rio/transmat/mixins/filters"
 	"go.polydawn.net/rio/transmat/mixins/fshash"
+	"go.polydawn.net/rio/transmat/mixins/limits"
 	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/transmat/mixins/policy"
 	"go.polydawn.net/rio/transmat/util"
+	"go.polydawn.net/rio/warehouse"
 )
 
 var (
@@ -43,23 +47,147 @@ func Unpack(
 	warehouses []api.WarehouseAddr, // Warehouses we can try to fetch from.
 	mon rio.Monitor, // Optionally: callbacks for progress monitoring.
 ) (_ api.WareID, err error) {
-	if mon.Chan != nil {
-		defer close(mon.Chan)
+	return UnpackWithOptions(UnpackOptions{})(ctx, wareID, path, filt, placementMode, warehouses, mon)
+}
+
+/*
+	Placement mode which unpacks over whatever's already at the target path,
+	only changing what differs from the ware (see fsOp.SyncFile), and removing
+	anything the ware doesn't have.  When the ware is mostly the same as what's
+	there, this is much less writing than clearing the path and unpacking afresh.
+
+	This mode bypasses the cache entirely.  Nor is a partial sync rolled back
+	if it fails (e.g. for exceeding limits; see the limits mixin).
+*/
+const Placement_Sync rio.PlacementMode = "sync"
+
+/*
+	Tar-specific options for unpacking.  The zero value is the defaults.
+*/
+type UnpackOptions struct {
+	// Path to write a manifest of the unpacked fileset to (see
+	// fshash.WriteManifest), for checking it for drift later.  Optional.
+	// The manifest describes the fileset as unpacked, i.e. after filters.
+	// Since the manifest comes from the unpack itself, this bypasses the
+	// cache for lookups (though the result still goes into the cache).
+	Manifest string
+
+	// If true, direct placements unpack into a staging dir beside the target
+	// path, and only once the ware is verified is it swapped into place
+	// (atomically, where the kernel and filesystem support it; see osfs.Swap).
+	// On any error, the target is left untouched.
+	// Other placement modes verify before placing anyway, except for sync,
+	// which works on the target in place and can't be combined with this.
+	Transactional bool
+
+	// Which kinds of dangerous entries (devices, setuid files, etc) to skip
+	// or reject.  Rejection fails the unpack with an error listing all the
+	// offending paths; with direct placement, combine with Transactional
+	// to keep the target from being half-written.
+	// Like Manifest, anything but the zero value bypasses the cache for lookups.
+	Policy policy.Policy
+}
+
+/*
+	Returns an unpack func which uses the given tar-specific options.
+	(Unpack itself is simply this with the zero UnpackOptions.)
+*/
+func UnpackWithOptions(opts UnpackOptions) rio.UnpackFunc {
+	return func(
+		ctx context.Context,
+		wareID api.WareID,
+		path string,
+		filt api.FilesetFilters,
+		placementMode rio.PlacementMode,
+		warehouses []api.WarehouseAddr,
+		mon rio.Monitor,
+	) (_ api.WareID, err error) {
+		if mon.Chan != nil {
+			defer close(mon.Chan)
+		}
+		defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+		// Sanitize arguments.
+		if wareID.Type != PackType {
+			return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+		}
+		if placementMode == "" {
+			placementMode = rio.Placement_Copy
+		}
+		// Syncing works on the target path itself; there's nothing for the cache to do.
+		if placementMode == Placement_Sync {
+			if opts.Transactional {
+				return api.WareID{}, Errorf(rio.ErrUsage, "transactional unpack can't be used with %q placement", Placement_Sync)
+			}
+			return unpack(ctx, wareID, path, filt, placementMode, warehouses, opts, mon)
+		}
+		// Wrap the direct unpack func with cache behavior; call that.
+		//  If we need a manifest or a policy enforced, we need the unpack to actually happen,
+		//  so the cache must treat this like a hash-altering unpack.
+		unpackFn := limits.RollbackOnExceeded(func(
+			ctx context.Context,
+			wareID api.WareID,
+			path string,
+			filt api.FilesetFilters,
+			placementMode rio.PlacementMode,
+			warehouses []api.WarehouseAddr,
+			mon rio.Monitor,
+		) (api.WareID, error) {
+			return unpack(ctx, wareID, path, filt, placementMode, warehouses, opts, mon)
+		})
+		cacheFs := osfs.New(config.GetCacheBasePath())
+		cachedUnpackFn := cache.Lrn2Cache(cacheFs, unpackFn)
+		if opts.Manifest != "" || !opts.Policy.AllowsAll() {
+			cachedUnpackFn = cache.Lrn2CacheAltered(cacheFs, unpackFn)
+		}
+		if opts.Transactional && placementMode == rio.Placement_Direct {
+			return unpackStaged(ctx, wareID, path, filt, warehouses, cachedUnpackFn, mon)
+		}
+		return cachedUnpackFn(ctx, wareID, path, filt, placementMode, warehouses, mon)
 	}
-	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+}
 
-	// Sanitize arguments.
-	if wareID.Type != PackType {
-		return api.WareID{}, Errorf(rio.ErrUsage, "this transmat implementation only supports packtype %q (not %q)", PackType, wareID.Type)
+/*
+	Unpacks (directly) into a fresh staging dir beside the target path,
+	and swaps it into place only if that succeeds.
+	Whatever was at the target path before is removed afterwards.
+*/
+func unpackStaged(
+	ctx context.Context,
+	wareID api.WareID,
+	path string,
+	filt api.FilesetFilters,
+	warehouses []api.WarehouseAddr,
+	unpackFn rio.UnpackFunc,
+	mon rio.Monitor,
+) (_ api.WareID, err error) {
+	target, err := fs.ParseAbsolutePath(path)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "unpack must be called with absolute path: %s", err)
+	}
+	// Beside the target, so it's on the same filesystem and can be renamed into place.
+	stagePath, err := ioutil.TempDir(target.Dir().String(), "."+target.Last()+".rio-staging-")
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "cannot create staging dir for unpack: %s", err)
+	}
+	defer os.RemoveAll(stagePath)
+
+	unpackWareID, err := unpackFn(ctx, wareID, stagePath, filt, rio.Placement_Direct, warehouses, mon)
+	if err != nil {
+		return unpackWareID, err
 	}
-	if placementMode == "" {
-		placementMode = rio.Placement_Copy
+	stage := fs.MustAbsolutePath(stagePath)
+	old, swapped, err := osfs.Swap(target, stage)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrInoperablePath, "cannot move unpacked fileset into place: %s", err)
 	}
-	// Wrap the direct unpack func with cache behavior; call that.
-	return cache.Lrn2Cache(
-		osfs.New(config.GetCacheBasePath()),
-		unpack,
-	)(ctx, wareID, path, filt, placementMode, warehouses, mon)
+	// The unpack is in place now, so clearing out the old content is best-effort.
+	if swapped && old != stage {
+		if err := os.RemoveAll(old.String()); err != nil {
+			log.PreviousContentLeft(mon, old)
+		}
+	}
+	return unpackWareID, nil
 }
 
 func unpack(
@@ -69,16 +197,30 @@ func unpack(
 	filt api.FilesetFilters,
 	placementMode rio.PlacementMode,
 	warehouses []api.WarehouseAddr,
+	opts UnpackOptions,
 	mon rio.Monitor,
 ) (_ api.WareID, err error) {
 	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
 
 	// Sanitize arguments.
 	path2 := fs.MustAbsolutePath(path)
+	algo, err := fshash.AlgorithmOf(wareID.Hash)
+	if err != nil {
+		return api.WareID{}, Errorf(rio.ErrUsage, "invalid ware ID %q: %s", wareID, err)
+	}
 	filt2, err := apiutil.ProcessFilters(filt, apiutil.FilterPurposeUnpack)
 	if err != nil {
 		return api.WareID{}, Errorf(rio.ErrUsage, "invalid filter specification: %s", err)
 	}
+	lims, err := limits.FromConfig()
+	if err != nil {
+		return api.WareID{}, err
+	}
+
+	// Construct filesystem wrapper to use for all our ops.
+	//  Tars are untrusted input: confine as hard as the kernel lets us.
+	afs := osfs.NewConfined(path2)
+	log.FilesystemConfinement(mon, path2, string(osfs.ConfinementOf(afs)))
 
 	// Pick a warehouse and get a reader.
 	reader, err := PickReader(wareID, warehouses, false, mon)
@@ -87,14 +229,20 @@ func unpack(
 	}
 	defer reader.Close()
 
-	// Construct filesystem wrapper to use for all our ops.
-	afs := osfs.New(path2)
-
 	// Extract.
-	prefilterWareID, unpackWareID, err := unpackTar(ctx, afs, filt2, reader, mon)
+	prog := log.NewProgress(mon, log.PhaseExtracting, warehouse.SizeOf(reader))
+	var inspect func(api.WareID, fshash.Bucket, fshash.Bucket) error
+	if opts.Manifest != "" {
+		inspect = func(_ api.WareID, _, filtered fshash.Bucket) error {
+			return writeManifest(opts.Manifest, filtered, algo)
+		}
+	}
+	sync := placementMode == Placement_Sync
+	prefilterWareID, unpackWareID, err := unpackTar(ctx, afs, sync, filt2, opts.Policy, lims.Track(), reader, algo, inspect, mon, prog)
 	if err != nil {
 		return unpackWareID, err
 	}
+	prog.Done()
 
 	// Check for hash mismatch before returning, because that IS an error,
 	//  but also return the hash we got either way.
@@ -115,9 +263,15 @@ func unpack(
 func unpackTar(
 	ctx context.Context,
 	afs fs.FS,
+	sync bool, // If true, afs may have content already: change only what differs, and remove what's extra.
 	filt apiutil.FilesetFilters,
+	pol policy.Policy, // Optionally: which entries not to place.  The ware is still verified in full.
+	tracker *limits.Tracker, // Optionally: counts what's placed against the limits for an unpack.
 	reader io.Reader,
+	algo fshash.Algorithm,
+	inspect func(prefilterWareID api.WareID, prefilter, filtered fshash.Bucket) error, // Optionally: called with all the records, once hashed.
 	mon rio.Monitor,
+	prog *log.Progress, // Optionally: counts the bytes read, and the entries.
 ) (
 	prefilterWareID api.WareID,
 	actualWareID api.WareID,
@@ -127,7 +281,7 @@ func unpackTar(
 
 	// Wrap input stream with decompression as necessary.
 	//  Which kind of decompression to use can be autodetected by magic bytes.
-	reader2, err := Decompress(reader)
+	reader2, err := Decompress(prog.Reader(reader))
 	if err != nil {
 		return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar compression: %s", err)
 	}
@@ -139,14 +293,33 @@ func unpackTar(
 	// the full tree hash will be computed from this at the end.
 	// We keep one for the raw ware data as we consume it, so we can verify no fuckery;
 	// we keep a second, separate one for the filtered data, which will compute a different hash.
-	prefilterBucket := &fshash.MemoryBucket{}
-	filteredBucket := &fshash.MemoryBucket{}
+	prefilterBucket, err := newBucket()
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	defer prefilterBucket.Close()
+	filteredBucket, err := newBucket()
+	if err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+	defer filteredBucket.Close()
 
 	// Also allocate a map for keeping records of which dirs we've created.
 	// This is necessary for correct bookkeepping in the face of the tar format's
 	// allowance for implicit parent dirs.
 	dirs := map[fs.RelPath]struct{}{}
 
+	// Keep track of the entries policy kept us from placing, too.
+	//  Anything claiming to be inside one of them can't be placed either.
+	enforcer := policy.NewEnforcer(pol, mon)
+	withheld := map[fs.RelPath]fs.Type{}
+
+	// Pick how to put each entry in place.
+	placeFile := fsOp.PlaceFile
+	if sync {
+		placeFile = fsOp.SyncFile
+	}
+
 	// Iterate over each tar entry, mutating filesystem as we go.
 	for {
 		fmeta := fs.Metadata{}
@@ -170,6 +343,10 @@ func unpackTar(
 		if strings.HasPrefix(fmeta.Name.String(), "..") {
 			return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: paths that use '../' to leave the base dir are invalid")
 		}
+		if err := tracker.Entry(fmeta); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+		prog.Entry()
 
 		// Infer parents, if necessary.  The tar format allows implicit parent dirs.
 		//
@@ -178,7 +355,14 @@ func unpackTar(
 		// It may well be possible to construct a tar like that, but it's already well established that
 		// tars with repeated filenames are just asking for trouble and shall be rejected without
 		// ceremony because they're just a ridiculous idea.
+		// Inside a withheld dir, there's nothing to infer: the enforcer withholds these too.
 		for _, parent := range fmeta.Name.SplitParent() {
+			if typ, isWithheld := withheld[parent]; isWithheld {
+				if typ != fs.Type_Dir {
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %q is inside %q, which is not a dir", fmeta.Name, parent)
+				}
+				break
+			}
 			// If we already initialized this parent, superb; move along.
 			if _, exists := dirs[parent]; exists {
 				continue
@@ -187,11 +371,14 @@ func unpackTar(
 			log.DirectoryInferred(mon, parent, fmeta.Name)
 			conjuredFmeta := fshash.DefaultDirMetadata()
 			conjuredFmeta.Name = parent
+			if err := tracker.Entry(conjuredFmeta); err != nil {
+				return api.WareID{}, api.WareID{}, err
+			}
 			prefilterBucket.AddRecord(conjuredFmeta, nil)
 			filters.Apply(filt, &conjuredFmeta)
 			filteredBucket.AddRecord(conjuredFmeta, nil)
 			dirs[conjuredFmeta.Name] = struct{}{}
-			if err := fsOp.PlaceFile(afs, conjuredFmeta, nil, filt.SkipChown); err != nil {
+			if err := placeFile(afs, conjuredFmeta, nil, filt.SkipChown); err != nil {
 				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 		}
@@ -202,11 +389,33 @@ func unpackTar(
 		filteredFmeta := fmeta
 		filters.Apply(filt, &filteredFmeta)
 
+		// Apply policy (to the entry as it would be placed, so e.g. the sticky filter gets its say first).
+		//  Entries we won't place still have to be read, so the ware can be verified.
+		if !enforcer.Admit(filteredFmeta) {
+			var contentHash []byte
+			if fmeta.Type == fs.Type_File {
+				hasher := algo.New()
+				if _, err := io.Copy(hasher, tracker.Body(fmeta.Name, tr)); err != nil {
+					if err := tracker.Err(); err != nil {
+						return api.WareID{}, api.WareID{}, err
+					}
+					return api.WareID{}, api.WareID{}, Errorf(rio.ErrWareCorrupt, "corrupt tar: %s", err)
+				}
+				contentHash = hasher.Sum(nil)
+			}
+			prefilterBucket.AddRecord(fmeta, contentHash)
+			withheld[fmeta.Name] = fmeta.Type
+			continue
+		}
+
 		// Place the file.
 		switch fmeta.Type {
 		case fs.Type_File:
-			reader := &util.HashingReader{tr, sha512.New384()}
-			if err := fsOp.PlaceFile(afs, filteredFmeta, reader, filt.SkipChown); err != nil {
+			reader := &util.HashingReader{tracker.Body(fmeta.Name, tr), algo.New()}
+			if err := placeFile(afs, filteredFmeta, reader, filt.SkipChown); err != nil {
+				if err := tracker.Err(); err != nil {
+					return api.WareID{}, api.WareID{}, err
+				}
 				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, reader.Hasher.Sum(nil))
@@ -215,7 +424,7 @@ func unpackTar(
 			dirs[fmeta.Name] = struct{}{}
 			fallthrough
 		default:
-			if err := fsOp.PlaceFile(afs, filteredFmeta, nil, filt.SkipChown); err != nil {
+			if err := placeFile(afs, filteredFmeta, nil, filt.SkipChown); err != nil {
 				return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
 			}
 			prefilterBucket.AddRecord(fmeta, nil)
@@ -223,6 +432,23 @@ func unpackTar(
 		}
 	}
 
+	for _, bucket := range []*fshash.DiskBucket{prefilterBucket, filteredBucket} {
+		if err := bucket.Err(); err != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrLocalCacheProblem, "error while unpacking: %s", err)
+		}
+	}
+	if err := enforcer.Err(); err != nil {
+		return api.WareID{}, api.WareID{}, err
+	}
+
+	// If syncing, remove whatever was there before that isn't in the ware.
+	//  This has to happen before fixing dir times, since it changes them.
+	if sync {
+		if err := pruneExtraneous(afs, filteredBucket); err != nil {
+			return api.WareID{}, api.WareID{}, Errorf(rio.ErrInoperablePath, "error while unpacking: %s", err)
+		}
+	}
+
 	// Cleanup dir times with a post-order traversal over the bucket.
 	//  Files and dirs placed inside dirs cause the parent's mtime to update, so we have to re-pave them.
 	if err := treewalk.Walk(filteredBucket.Iterator(), nil, func(node treewalk.Node) error {
@@ -236,9 +462,9 @@ func unpackTar(
 	}
 
 	// Hash the thing!
-	prefilterHash := misc.Base58Encode(fshash.HashBucket(prefilterBucket, sha512.New384))
-	filteredHash := misc.Base58Encode(fshash.HashBucket(filteredBucket, sha512.New384))
-	if !filt.IsHashAltering() {
+	prefilterHash := algo.Format(fshash.HashBucket(prefilterBucket, algo.New))
+	filteredHash := algo.Format(fshash.HashBucket(filteredBucket, algo.New))
+	if !filt.IsHashAltering() && len(withheld) == 0 {
 		// Paranoia check for new feature.
 		//  When paranoia reduced, replace with skipping the double computation.
 		if prefilterHash != filteredHash {
@@ -246,5 +472,71 @@ func unpackTar(
 		}
 	}
 
+	if inspect != nil {
+		if err := inspect(api.WareID{"tar", prefilterHash}, prefilterBucket, filteredBucket); err != nil {
+			return api.WareID{}, api.WareID{}, err
+		}
+	}
+
 	return api.WareID{"tar", prefilterHash}, api.WareID{"tar", filteredHash}, nil
 }
+
+/*
+	Returns a bucket which will spill to disk past the configured
+	number of records, so huge filesets don't have to fit in memory.
+*/
+func newBucket() (*fshash.DiskBucket, error) {
+	threshold, err := config.GetBucketSpillThreshold()
+	if err != nil {
+		return nil, err
+	}
+	return fshash.NewDiskBucket(config.GetBucketSpillPath(), threshold), nil
+}
+
+/*
+	Removes everything in the filesystem which doesn't have a record in the bucket.
+
+	This merges two sorted walks rather than holding every path: the records
+	of each dir come off the bucket's iterator in order, and when the walk
+	leaves the dir, they're compared against the dir's sorted listing.
+	Only dirs which the bucket says are dirs are descended into, and those have
+	already been placed, so no symlinks are traversed.
+*/
+func pruneExtraneous(afs fs.FS, bucket fshash.Bucket) error {
+	var recorded [][]string // the names recorded in each dir the walk is in, innermost last.
+	return treewalk.Walk(bucket.Iterator(), func(node treewalk.Node) error {
+		fmeta := node.(fshash.RecordIterator).Record().Metadata
+		if n := len(recorded); n > 0 {
+			recorded[n-1] = append(recorded[n-1], fmeta.Name.Last())
+		}
+		if fmeta.Type == fs.Type_Dir {
+			recorded = append(recorded, nil)
+		}
+		return nil
+	}, func(node treewalk.Node) error {
+		fmeta := node.(fshash.RecordIterator).Record().Metadata
+		if fmeta.Type != fs.Type_Dir {
+			return nil
+		}
+		keep := recorded[len(recorded)-1]
+		recorded = recorded[:len(recorded)-1]
+		names, err := afs.ReadDirNames(fmeta.Name)
+		if err != nil {
+			return err
+		}
+		sort.Strings(keep) // the bucket sorts dirs as if they had a trailing slash.
+		sort.Strings(names)
+		for _, name := range names {
+			for len(keep) > 0 && keep[0] < name {
+				keep = keep[1:]
+			}
+			if len(keep) > 0 && keep[0] == name {
+				continue
+			}
+			if err := fsOp.RemoveAll(afs, fmeta.Name.Join(fs.MustRelPath(name))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -9,6 +9,8 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -20,6 +22,8 @@ import (
 	"go.polydawn.net/rio/fs/osfs"
 	"go.polydawn.net/rio/fsOp"
 	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/drift"
+	"go.polydawn.net/rio/transmat/mixins/fshash"
 	"go.polydawn.net/rio/transmat/mixins/tests"
 )
 
@@ -39,6 +43,63 @@ func TestTarUnpack(t *testing.T) {
 					tests.CheckRoundTrip(PackType, Pack, Unpack, api.WarehouseAddr(fmt.Sprintf("file://%s/bounce", tmpDir)))
 				})
 			})
+			Convey("Using a non-default hash algorithm:", func() {
+				testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+					osfs.New(tmpDir).Mkdir(fs.MustRelPath("bounce"), 0755)
+					tests.CheckRoundTrip(PackType, PackWithOptions(PackOptions{Algorithm: fshash.Algorithm_SHA256}), Unpack, api.WarehouseAddr(fmt.Sprintf("ca+file://%s/bounce", tmpDir)))
+				})
+			})
+		}),
+	)
+}
+
+func TestTarUnpackTransactional(t *testing.T) {
+	Convey("Tar transmat: transactional direct unpacks", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				dataDir := tmpDir.Join(fs.MustRelPath("data"))
+				outDir := tmpDir.Join(fs.MustRelPath("out"))
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("data"), 0755), ShouldBeNil)
+				So(osfs.New(tmpDir).Mkdir(fs.MustRelPath("out"), 0755), ShouldBeNil)
+				So(ioutil.WriteFile(outDir.Join(fs.MustRelPath("old")).String(), []byte("precious"), 0644), ShouldBeNil)
+				tests.PlaceFixture(osfs.New(dataDir), tests.FixtureGamma)
+				// Not content-addressable, so the warehouse will hand over the data for any ware ID.
+				whAddr := api.WarehouseAddr(fmt.Sprintf("file://%s/ware.tar", tmpDir))
+				wareID, err := Pack(context.Background(), PackType, dataDir.String(), api.Filter_NoMutation, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+				unpack := UnpackWithOptions(UnpackOptions{Transactional: true})
+				leftovers := func() []string {
+					matches, err := filepath.Glob(tmpDir.String() + "/.out.rio-staging-*")
+					So(err, ShouldBeNil)
+					return matches
+				}
+
+				Convey("leave the target alone if the ware doesn't verify", func() {
+					wrongWareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+					_, err := unpack(context.Background(), wrongWareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldNotBeNil)
+					names, err := ioutil.ReadDir(outDir.String())
+					So(err, ShouldBeNil)
+					So(names, ShouldHaveLength, 1)
+					So(names[0].Name(), ShouldEqual, "old")
+					So(leftovers(), ShouldBeEmpty)
+				})
+				Convey("replace the target once the ware verifies", func() {
+					gotWareID, err := unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(gotWareID, ShouldResemble, wareID)
+					n, err := Check(context.Background(), outDir.String(), wareID, api.Filter_NoMutation, []api.WarehouseAddr{whAddr}, func(drift.Difference) {}, rio.Monitor{})
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 0)
+					_, err = os.Lstat(outDir.Join(fs.MustRelPath("old")).String())
+					So(os.IsNotExist(err), ShouldBeTrue)
+					So(leftovers(), ShouldBeEmpty)
+				})
+				Convey("refuse to combine with sync placement", func() {
+					_, err := unpack(context.Background(), wareID, outDir.String(), api.Filter_NoMutation, Placement_Sync, []api.WarehouseAddr{whAddr}, rio.Monitor{})
+					So(err, ShouldNotBeNil)
+				})
+			})
 		}),
 	)
 }
@@ -125,3 +186,66 @@ func TestTarFixtureUnpack(t *testing.T) {
 		}),
 	)
 }
+
+func TestTarUnpackProgress(t *testing.T) {
+	Convey("Tar transmat: unpacks report progress", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+				whPath := tmpDir.Join(fs.MustRelPath("ware.tgz")).String()
+				fixture, err := ioutil.ReadFile("fixtures/tar_kitchenSink.tgz")
+				So(err, ShouldBeNil)
+				So(ioutil.WriteFile(whPath, fixture, 0644), ShouldBeNil)
+				whAddr := api.WarehouseAddr("file://" + whPath)
+				wareID, err := Scan(context.Background(), PackType, api.Filter_NoMutation, rio.Placement_Direct, whAddr, rio.Monitor{})
+				So(err, ShouldBeNil)
+
+				monChan := make(chan rio.Event)
+				var progress []rio.Event_Progress
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for evt := range monChan {
+						if evt.Progress != nil {
+							progress = append(progress, *evt.Progress)
+						}
+					}
+				}()
+				_, err = Unpack(context.Background(), wareID, tmpDir.Join(fs.MustRelPath("out")).String(), api.Filter_NoMutation, rio.Placement_Direct, []api.WarehouseAddr{whAddr}, rio.Monitor{Chan: monChan})
+				So(err, ShouldBeNil)
+				<-done
+
+				So(len(progress), ShouldBeGreaterThanOrEqualTo, 2)
+				So(progress[0].Phase, ShouldEqual, "extracting")
+				So(progress[0].TotalProg, ShouldEqual, 0)
+				last := progress[len(progress)-1]
+				So(last.Phase, ShouldEqual, "extracting")
+				So(last.TotalWork, ShouldEqual, len(fixture))
+				So(last.TotalProg, ShouldEqual, len(fixture))
+				So(last.Desc, ShouldEndWith, " entries")
+
+				// Through the cache, there's committing to it after; that finishes too.
+				os.Setenv("RIO_CACHE", tmpDir.Join(fs.MustRelPath("cache")).String())
+				defer os.Unsetenv("RIO_CACHE")
+				monChan = make(chan rio.Event)
+				progress = nil
+				done = make(chan struct{})
+				go func() {
+					defer close(done)
+					for evt := range monChan {
+						if evt.Progress != nil {
+							progress = append(progress, *evt.Progress)
+						}
+					}
+				}()
+				_, err = Unpack(context.Background(), wareID, tmpDir.Join(fs.MustRelPath("out2")).String(), api.Filter_NoMutation, rio.Placement_Copy, []api.WarehouseAddr{whAddr}, rio.Monitor{Chan: monChan})
+				So(err, ShouldBeNil)
+				<-done
+
+				So(len(progress), ShouldBeGreaterThanOrEqualTo, 4)
+				So(progress[len(progress)-2].Phase, ShouldEqual, "committing")
+				last = progress[len(progress)-1]
+				So(last.Phase, ShouldEqual, "committing")
+			})
+		}),
+	)
+}
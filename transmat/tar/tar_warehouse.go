@@ -8,14 +8,17 @@ package tartrans
 import (
 	"io"
 	"net/url"
+	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
 	"go.polydawn.net/rio/transmat/mixins/log"
 	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvenc"
 	"go.polydawn.net/rio/warehouse/impl/kvfs"
 	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+	"go.polydawn.net/rio/warehouse/impl/oci"
 )
 
 // The shared bits of warehouseAddr parse and dial code.
@@ -53,8 +56,20 @@ func PickReader(
 			fallthrough
 		case "http", "https":
 			whCtrl, err = kvhttp.NewController(addr)
+		case "enc+ca+file", "enc+ca+http", "enc+ca+https":
+			if requireMono {
+				return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (a single-ware warehouse is required, not CA-mode)", u.Scheme)
+			}
+			fallthrough
+		case "enc+file", "enc+http", "enc+https":
+			whCtrl, err = kvenc.NewController(addr)
+		case "ca+oci+http", "ca+oci+https":
+			if requireMono {
+				return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (a single-ware warehouse is required, not CA-mode)", u.Scheme)
+			}
+			whCtrl, err = oci.NewBlobstoreController(addr)
 		default:
-			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', or 'ca+https')", u.Scheme)
+			return nil, Errorf(rio.ErrUsage, "this fetch operation doesn't support %q scheme (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', or 'ca+https', any of which may be prefixed with 'enc+'; or 'ca+oci+http' or 'ca+oci+https')", u.Scheme)
 		}
 		switch Category(err) {
 		case nil:
@@ -106,8 +121,20 @@ func OpenWriteController(
 	switch u.Scheme {
 	case "":
 		return nil, Errorf(rio.ErrUsage, "urls must always have a scheme (e.g. start with 'file://', 'ca+file://', or similar)")
-	case "file", "ca+file":
-		whCtrl, err := kvfs.NewController(warehouseAddr)
+	case "file", "ca+file", "enc+file", "enc+ca+file",
+		"http", "ca+http", "https", "ca+https",
+		"ca+oci+http", "ca+oci+https":
+		var whCtrl warehouse.BlobstoreController
+		switch {
+		case strings.HasPrefix(u.Scheme, "enc+"):
+			whCtrl, err = kvenc.NewController(warehouseAddr)
+		case strings.HasPrefix(u.Scheme, "ca+oci+"):
+			whCtrl, err = oci.NewBlobstoreController(warehouseAddr)
+		case strings.HasSuffix(u.Scheme, "file"):
+			whCtrl, err = kvfs.NewController(warehouseAddr)
+		default:
+			whCtrl, err = kvhttp.NewController(warehouseAddr)
+		}
 		switch Category(err) {
 		case nil:
 			// pass
@@ -128,6 +155,6 @@ func OpenWriteController(
 			return nil, err
 		}
 	default:
-		return nil, Errorf(rio.ErrUsage, "this save operation doesn't support %q scheme (valid options are 'file' or 'ca+file')", u.Scheme)
+		return nil, Errorf(rio.ErrUsage, "this save operation doesn't support %q scheme (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', 'ca+https', 'enc+file', 'enc+ca+file', 'ca+oci+http', or 'ca+oci+https')", u.Scheme)
 	}
 }
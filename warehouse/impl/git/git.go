@@ -44,6 +44,7 @@ import (
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	"gopkg.in/src-d/go-git.v4/storage"
@@ -58,6 +59,7 @@ var (
 
 const githubHostname = "github.com"
 const gitmodulesFile = ".gitmodules"
+const mirrorRemoteName = "rio-mirror"
 
 // protocols
 const (
@@ -242,6 +244,126 @@ func (c *Controller) Update(ctx context.Context) error {
 	return nil
 }
 
+/*
+	Returns the name of the ref rio uses to hold onto a mirrored commit.
+
+	Git will garbage collect any commit that isn't reachable from a ref,
+	so each mirrored commit gets a ref of its own, namespaced well away
+	from any branches or tags.
+*/
+func MirrorRefName(hash string) plumbing.ReferenceName {
+	return plumbing.ReferenceName("refs/rio/" + hash)
+}
+
+/*
+	Returns true if the remote already has the commit for the given hash.
+
+	For local repositories we look in the object store directly.
+	For remote repositories all we can see are the advertised refs,
+	so this only returns true if some ref points exactly at the commit;
+	commits buried in history won't be noticed, but pushing them again is cheap.
+*/
+func (c *Controller) RemoteContains(hash string) (bool, error) {
+	commitHash, err := StringToHash(hash)
+	if err != nil {
+		return false, err
+	}
+	if c.protocol == protocolFile {
+		return c.Contains(hash), nil
+	}
+	refs, err := c.lsRemote()
+	if err != nil {
+		return false, Errorf(rio.ErrWarehouseUnavailable, "warehouse unavailable: %s", err)
+	}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.HashReference && ref.Hash() == commitHash {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/*
+	Pushes the commit for the given hash from this controller's object store
+	to the target warehouse, under the ref named by MirrorRefName.
+
+	The commit must already be in the local object store (e.g. after
+	Clone and Update).  Pushing a commit the target already has is a no-op.
+
+	The refs of this controller's repo are never touched (it may be a local
+	repo that's serving as a source, and none of ours).
+
+	May return errors of category:
+
+	  - `rio.ErrWareNotFound` -- if the commit isn't in the local object store
+	  - `rio.ErrWarehouseUnwritable` -- if the push is refused or fails
+	  - `rio.ErrCancelled` -- if the context is cancelled
+*/
+func (c *Controller) Push(ctx context.Context, hash string, target *Controller) error {
+	commitHash, err := StringToHash(hash)
+	if err != nil {
+		return err
+	}
+	if !c.Contains(hash) {
+		return Errorf(rio.ErrWareNotFound, "commit not found")
+	}
+
+	// Git only pushes refs, never bare commits, so we need a local ref to push from.
+	//  We use the same name locally as on the target, and keep it in memory.
+	refName := MirrorRefName(hash)
+	store := scratchRefStorage{c.store, memory.ReferenceStorage{}}
+	store.refs.SetReference(plumbing.NewHashReference(refName, commitHash))
+
+	remote := srcd_git.NewRemote(store, &config.RemoteConfig{
+		Name: mirrorRemoteName,
+		URLs: []string{target.sanitizedAddr},
+	})
+	err = remote.PushContext(ctx, &srcd_git.PushOptions{
+		RemoteName: mirrorRemoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(refName + ":" + refName)},
+		// Auth credentials, if required, to use with the target repository.
+		Auth: target.transportAuthMethod,
+	})
+	switch {
+	case err == nil, err == srcd_git.NoErrAlreadyUpToDate:
+		return nil
+	case ctx.Err() != nil:
+		return Errorf(rio.ErrCancelled, "cancelled: %s", err)
+	default:
+		return Errorf(rio.ErrWarehouseUnwritable, "unable to push to repository: %s", err)
+	}
+}
+
+/*
+	A storer with the objects of another, but refs of its own, kept in memory.
+*/
+type scratchRefStorage struct {
+	storage.Storer
+	refs memory.ReferenceStorage
+}
+
+func (s scratchRefStorage) SetReference(ref *plumbing.Reference) error {
+	return s.refs.SetReference(ref)
+}
+func (s scratchRefStorage) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	return s.refs.CheckAndSetReference(ref, old)
+}
+func (s scratchRefStorage) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	return s.refs.Reference(name)
+}
+func (s scratchRefStorage) IterReferences() (storer.ReferenceIter, error) {
+	return s.refs.IterReferences()
+}
+func (s scratchRefStorage) RemoveReference(name plumbing.ReferenceName) error {
+	return s.refs.RemoveReference(name)
+}
+func (s scratchRefStorage) CountLooseRefs() (int, error) {
+	return s.refs.CountLooseRefs()
+}
+func (s scratchRefStorage) PackRefs() error {
+	return s.refs.PackRefs()
+}
+
 /*
 	Opens the repository or clones it if it is does not exist
 	Will not clone if allowClone is false.
@@ -282,6 +404,7 @@ func (c *Controller) open(ctx context.Context, store storage.Storer, allowClone
 /*
 	Pretty straight forward `git ls-remote` implementation
 	Returns the list of references available on the remote
+	(which is an empty list, not an error, if the remote is an empty repository).
 */
 func (c *Controller) lsRemote() (memory.ReferenceStorage, error) {
 	endpoint, err := transport.NewEndpoint(c.sanitizedAddr)
@@ -297,7 +420,11 @@ func (c *Controller) lsRemote() (memory.ReferenceStorage, error) {
 		return nil, err
 	}
 	advertisedRefs, err := gitSession.AdvertisedReferences()
-	if err != nil {
+	if err == transport.ErrEmptyRemoteRepository {
+		// An empty repository exists; it just has no refs yet (e.g. a fresh mirror target).
+		gitSession.Close()
+		return make(memory.ReferenceStorage), nil
+	} else if err != nil {
 		return nil, err
 	}
 	refs, err := advertisedRefs.AllReferences()
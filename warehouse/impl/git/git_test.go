@@ -24,6 +24,7 @@ import (
 	"go.polydawn.net/go-timeless-api/rio"
 	riofs "go.polydawn.net/rio/fs"
 	"go.polydawn.net/rio/testutil"
+	srcd_git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
@@ -840,6 +841,73 @@ func TestSubmodules(t *testing.T) {
 	})
 }
 
+func TestPush(t *testing.T) {
+	WithTarballTmpDir(t, func(absPath riofs.AbsolutePath) {
+		wareAddr := api.WarehouseAddr(absPath.Join(RelPathBare).String())
+		source := mustNewController(t, nil, wareAddr)
+		mirrorPath := absPath.Join(riofs.MustRelPath("./mirror"))
+		if _, err := srcd_git.PlainInit(mirrorPath.String(), true); err != nil {
+			t.Fatal(err)
+		}
+		target := mustNewController(t, nil, api.WarehouseAddr(mirrorPath.String()))
+		t.Run("target starts empty", func(t *testing.T) {
+			has, err := target.RemoteContains(hash2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has {
+				t.Errorf("expected %v", false)
+			}
+		})
+		t.Run("push missing commit", func(t *testing.T) {
+			err := source.Push(context.Background(), hashB, target)
+			if errcat.Category(err) != rio.ErrWareNotFound {
+				t.Errorf("expected error category \"%s\" but got \"%s\"", rio.ErrWareNotFound, errcat.Category(err))
+			}
+		})
+		t.Run("push ok commit", func(t *testing.T) {
+			sourceRefs := func() (names []plumbing.ReferenceName) {
+				iter, err := source.store.IterReferences()
+				if err != nil {
+					t.Fatal(err)
+				}
+				iter.ForEach(func(ref *plumbing.Reference) error {
+					names = append(names, ref.Name())
+					return nil
+				})
+				return
+			}
+			refsBefore := sourceRefs()
+			if err := source.Push(context.Background(), hash2, target); err != nil {
+				t.Fatal(err)
+			}
+			has, err := target.RemoteContains(hash2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !has {
+				t.Errorf("expected %v", true)
+			}
+			ref, err := target.store.Reference(MirrorRefName(hash2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Hash().String() != hash2 {
+				t.Errorf("expected \"%s\" but got \"%s\"", hash2, ref.Hash())
+			}
+			// the source's refs should be untouched.
+			if refsAfter := sourceRefs(); !reflect.DeepEqual(refsAfter, refsBefore) {
+				t.Errorf("expected source refs %v but got %v", refsBefore, refsAfter)
+			}
+		})
+		t.Run("push again", func(t *testing.T) {
+			if err := source.Push(context.Background(), hash2, target); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
 // Example of using the reader
 func TestReader(t *testing.T) {
 	WithTarballTmpDir(t, func(absPath riofs.AbsolutePath) {
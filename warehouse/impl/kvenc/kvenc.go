@@ -0,0 +1,199 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Client-side encryption for blobstore warehouses.
+
+	Addresses with an "enc+" prefix (e.g. "enc+ca+file:///wh" or
+	"enc+ca+https://bucket.example/wh") name the same warehouse as without it,
+	but everything written is encrypted before it leaves this machine, and
+	decrypted after it's read back.  Whoever operates the storage sees only
+	ciphertext, and can't alter it without the read failing.
+
+	Wares are still identified by the hash of their plaintext fileset,
+	so the WareID of an encrypted ware is the same as it would be unencrypted.
+	(This does mean the storage operator can tell whether the warehouse has
+	some ware they already know the ID of; only contents are hidden.)
+
+	The key is read from the key file named by config (see
+	`config.GetEncryptionKeyPath`), and never from the address.
+	Key files hold "aes256gcm:<base58>" with a 32 byte key;
+	`rio keygen --encryption` makes one.
+
+	Sidecars (e.g. signatures) are passed through unencrypted.
+*/
+package kvenc
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/polydawn/refmt/misc"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+)
+
+var (
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.SidecarController        = Controller{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
+	_ warehouse.SizedReader              = &decrypter{}
+)
+
+const keyPrefix = "aes256gcm:"
+
+type Key [32]byte
+
+func GenerateKey() (k Key, err error) {
+	_, err = io.ReadFull(rand.Reader, k[:])
+	return
+}
+
+func (k Key) String() string {
+	return keyPrefix + misc.Base58Encode(k[:])
+}
+
+func ParseKey(s string) (k Key, err error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, keyPrefix) {
+		return k, Errorf(rio.ErrUsage, "invalid encryption key: must start with %q", keyPrefix)
+	}
+	bs := misc.Base58Decode(s[len(keyPrefix):])
+	if len(bs) != len(k) {
+		return k, Errorf(rio.ErrUsage, "invalid encryption key: not %d bytes of base58", len(k))
+	}
+	copy(k[:], bs)
+	return k, nil
+}
+
+func LoadKey(path string) (Key, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, Errorf(rio.ErrUsage, "cannot read encryption key: %s", err)
+	}
+	return ParseKey(string(bs))
+}
+
+type Controller struct {
+	addr  api.WarehouseAddr // user's string retained for messages
+	inner warehouse.BlobstoreController
+	key   Key
+}
+
+/*
+	Initialize a new warehouse controller that encrypts what's stored in
+	another blobstore warehouse, using the key from config.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses, or if there's no usable key
+	  - `rio.ErrWarehouseUnavailable` -- if the warehouse doesn't exist
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	keyPath := config.GetEncryptionKeyPath()
+	if keyPath == "" {
+		return nil, Errorf(rio.ErrUsage, "encrypted warehouse %s needs a key: set RIO_ENCRYPTION_KEYFILE", addr)
+	}
+	key, err := LoadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewControllerWithKey(addr, key)
+}
+
+/*
+	As NewController, but with the key given explicitly rather than from config.
+*/
+func NewControllerWithKey(addr api.WarehouseAddr, key Key) (warehouse.BlobstoreController, error) {
+	whCtrl := Controller{
+		addr: addr,
+		key:  key,
+	}
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return whCtrl, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if !strings.HasPrefix(u.Scheme, "enc+") {
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (encrypted warehouses must start with 'enc+')", u.Scheme)
+	}
+	innerAddr := api.WarehouseAddr(strings.TrimPrefix(string(addr), "enc+"))
+	switch strings.TrimPrefix(u.Scheme, "enc+") {
+	case "file", "ca+file":
+		whCtrl.inner, err = kvfs.NewController(innerAddr)
+	case "http", "ca+http", "https", "ca+https":
+		whCtrl.inner, err = kvhttp.NewController(innerAddr)
+	default:
+		return whCtrl, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'enc+' followed by 'file', 'ca+file', 'http', 'ca+http', 'https', or 'ca+https')", u.Scheme)
+	}
+	return whCtrl, err
+}
+
+/*
+	Opens a reader which decrypts the ware as it's read.
+	Reads return `rio.ErrWareCorrupt` as soon as any chunk fails authentication
+	(which is also what a wrong key looks like).
+*/
+func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
+	reader, err := whCtrl.inner.OpenReader(wareID)
+	if err != nil {
+		return nil, err
+	}
+	return newDecrypter(reader, whCtrl.key, whCtrl.addr), nil
+}
+
+func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	wc, err := whCtrl.inner.OpenWriter()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newEncrypter(wc, whCtrl.key)
+	if err != nil {
+		wc.Close()
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "failed to start encrypted write: %s", err)
+	}
+	return &WriteController{enc, wc}, nil
+}
+
+func (whCtrl Controller) OpenSidecarReader(wareID api.WareID, suffix string) (io.ReadCloser, error) {
+	return whCtrl.inner.(warehouse.SidecarController).OpenSidecarReader(wareID, suffix)
+}
+
+func (whCtrl Controller) WriteSidecar(wareID api.WareID, suffix string, body []byte) error {
+	return whCtrl.inner.(warehouse.SidecarController).WriteSidecar(wareID, suffix, body)
+}
+
+type WriteController struct {
+	enc   *encrypter                         // Write to this.
+	inner warehouse.BlobstoreWriteController // Needed to commit or cancel.
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.enc.Write(bs)
+}
+
+/*
+	Cancel the current write.
+*/
+func (wc *WriteController) Close() error {
+	return wc.inner.Close()
+}
+
+/*
+	Seal the last chunk, then commit the ciphertext under the (plaintext) WareID.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	if err := wc.enc.Finish(); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to commit encrypted write: %s", err)
+	}
+	return wc.inner.Commit(wareID)
+}
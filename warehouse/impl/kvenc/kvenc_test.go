@@ -0,0 +1,143 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvenc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestEncryptedWarehouse(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+	Convey("Keys round-trip through their string form", t, func() {
+		key2, err := ParseKey(key.String() + "\n")
+		So(err, ShouldBeNil)
+		So(key2, ShouldResemble, key)
+		_, err = ParseKey("aes256gcm:abc")
+		So(Category(err), ShouldEqual, rio.ErrUsage)
+	})
+	Convey("Encrypted warehouses", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			whAddr := api.WarehouseAddr(fmt.Sprintf("enc+ca+file://%s", tmpDir))
+			whCtrl, err := NewControllerWithKey(whAddr, key)
+			So(err, ShouldBeNil)
+			blobPath := filepath.Join(tmpDir.String(), "5y6/NvK", wareID.Hash)
+			put := func(body []byte) {
+				wc, err := whCtrl.OpenWriter()
+				So(err, ShouldBeNil)
+				_, err = wc.Write(body)
+				So(err, ShouldBeNil)
+				So(wc.Commit(wareID), ShouldBeNil)
+			}
+			get := func(whCtrl interface {
+				OpenReader(api.WareID) (io.ReadCloser, error)
+			}) ([]byte, error) {
+				reader, err := whCtrl.OpenReader(wareID)
+				So(err, ShouldBeNil)
+				defer reader.Close()
+				return ioutil.ReadAll(reader)
+			}
+
+			for _, size := range []int{0, 1, chunkSize - 1, chunkSize, 2*chunkSize + 5} {
+				Convey(fmt.Sprintf("round-trip %d bytes", size), func() {
+					body := make([]byte, size)
+					rand.Read(body)
+					put(body)
+					stored, err := ioutil.ReadFile(blobPath)
+					So(err, ShouldBeNil)
+					So(len(stored), ShouldEqual, headerSize+size+(size/chunkSize+1)*16)
+					if size > 16 {
+						// (Shorter than this, random bytes could show up in the ciphertext by chance.)
+						So(bytes.Contains(stored, body[:size/2+1]), ShouldBeFalse)
+					}
+					got, err := get(whCtrl)
+					So(err, ShouldBeNil)
+					So(got, ShouldResemble, body)
+				})
+			}
+			Convey("detect tampering", func() {
+				body := make([]byte, 3*chunkSize)
+				rand.Read(body)
+				put(body)
+				stored, _ := ioutil.ReadFile(blobPath)
+
+				Convey("(each stream being salted, so never stored the same way twice)", func() {
+					put(body)
+					restored, _ := ioutil.ReadFile(blobPath)
+					So(restored[:headerSize], ShouldNotResemble, stored[:headerSize])
+					So(restored[headerSize:headerSize+sealedChunkSize], ShouldNotResemble, stored[headerSize:headerSize+sealedChunkSize])
+				})
+				Convey("failing at the chunk that was changed", func() {
+					stored[headerSize+sealedChunkSize+100] ^= 1
+					So(ioutil.WriteFile(blobPath, stored, 0644), ShouldBeNil)
+					got, err := get(whCtrl)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+					So(got, ShouldResemble, body[:chunkSize])
+				})
+				Convey("or that the stream was truncated at a chunk boundary", func() {
+					So(ioutil.WriteFile(blobPath, stored[:headerSize+2*sealedChunkSize], 0644), ShouldBeNil)
+					_, err := get(whCtrl)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+				})
+				Convey("or that chunks were reordered", func() {
+					reordered := append([]byte{}, stored[:headerSize]...)
+					reordered = append(reordered, stored[headerSize+sealedChunkSize:headerSize+2*sealedChunkSize]...)
+					reordered = append(reordered, stored[headerSize:headerSize+sealedChunkSize]...)
+					reordered = append(reordered, stored[headerSize+2*sealedChunkSize:]...)
+					So(ioutil.WriteFile(blobPath, reordered, 0644), ShouldBeNil)
+					_, err := get(whCtrl)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+				})
+				Convey("or that the salt was changed", func() {
+					stored[len(magic)] ^= 1
+					So(ioutil.WriteFile(blobPath, stored, 0644), ShouldBeNil)
+					_, err := get(whCtrl)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+				})
+				Convey("or that the key is wrong", func() {
+					otherKey, _ := GenerateKey()
+					whCtrl2, err := NewControllerWithKey(whAddr, otherKey)
+					So(err, ShouldBeNil)
+					_, err = get(whCtrl2)
+					So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+				})
+			})
+			Convey("take keys from config", func() {
+				os.Setenv("RIO_ENCRYPTION_KEYFILE", "")
+				defer os.Setenv("RIO_ENCRYPTION_KEYFILE", "")
+				_, err := NewController(whAddr)
+				So(Category(err), ShouldEqual, rio.ErrUsage)
+
+				keyPath := filepath.Join(tmpDir.String(), "key")
+				So(ioutil.WriteFile(keyPath, []byte(key.String()+"\n"), 0600), ShouldBeNil)
+				os.Setenv("RIO_ENCRYPTION_KEYFILE", keyPath)
+				put([]byte("hello"))
+				whCtrl2, err := NewController(whAddr)
+				So(err, ShouldBeNil)
+				got, err := get(whCtrl2)
+				So(err, ShouldBeNil)
+				So(string(got), ShouldEqual, "hello")
+			})
+		})
+	})
+}
@@ -0,0 +1,240 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+	The encrypted stream format is a header, then a series of chunks:
+
+	  - the header is the magic bytes "rioenc1\n", then a random 32 byte salt;
+	  - each chunk is up to 64KiB of plaintext, sealed with AES-256-GCM
+	    (so 16 bytes longer than its plaintext), under a key for the stream
+	    alone: derived from the warehouse key and the salt with HKDF-SHA256;
+	  - each chunk's nonce is 7 zero bytes, then the chunk's index as a 4 byte
+	    big-endian counter, then a byte which is 1 for the last chunk and 0 otherwise.
+
+	Since every stream has its own key, nonces only need to be unique within
+	a stream, which the counter sees to; no matter how many streams share
+	the warehouse key.
+
+	Every chunk but the last is full size, and the last is always short
+	(even if that means it's empty), so readers know the last chunk when
+	they see it.  Since the last chunk is sealed as last, truncating the
+	stream (even at a chunk boundary) is detected, as is reordering chunks
+	or splicing in chunks from other streams.
+	Each chunk is authenticated before any of its plaintext is returned.
+*/
+const (
+	magic           = "rioenc1\n"
+	saltSize        = 32
+	headerSize      = len(magic) + saltSize
+	chunkSize       = 64 * 1024
+	maxChunks       = 1<<32 - 1
+	sealedChunkSize = chunkSize + 16 // with the GCM tag
+)
+
+const hkdfInfo = "rio kvenc stream key"
+
+/*
+	Returns the AEAD for one stream: keyed by HKDF-SHA256 of the warehouse key and the stream's salt.
+*/
+func newAEAD(key Key, salt []byte) cipher.AEAD {
+	var streamKey Key
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key[:], salt, []byte(hkdfInfo)), streamKey[:]); err != nil {
+		panic(err) // only if asking for more than HKDF can give, which we don't.
+	}
+	block, err := aes.NewCipher(streamKey[:])
+	if err != nil {
+		panic(err) // only on wrong key size, which the type prevents.
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func chunkNonce(index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encrypter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	index uint32
+	buf   []byte // plaintext not yet sealed; always shorter than a full chunk between writes.
+}
+
+func newEncrypter(w io.Writer, key Key) (*encrypter, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(magic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		w:    w,
+		aead: newAEAD(key, salt),
+		buf:  make([]byte, 0, sealedChunkSize),
+	}, nil
+}
+
+func (e *encrypter) Write(bs []byte) (int, error) {
+	n := 0
+	for len(bs) > 0 {
+		take := chunkSize - len(e.buf)
+		if take > len(bs) {
+			take = len(bs)
+		}
+		e.buf = append(e.buf, bs[:take]...)
+		bs = bs[take:]
+		n += take
+		if len(e.buf) == chunkSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+/*
+	Seals whatever's buffered as the last chunk.
+*/
+func (e *encrypter) Finish() error {
+	return e.seal(true)
+}
+
+func (e *encrypter) seal(last bool) error {
+	if e.index == maxChunks {
+		return fmt.Errorf("stream too long to encrypt")
+	}
+	sealed := e.aead.Seal(e.buf[:0], chunkNonce(e.index, last), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decrypter struct {
+	r      io.ReadCloser
+	key    Key
+	aead   cipher.AEAD       // nil until the header's been read.
+	addr   api.WarehouseAddr // for messages
+	index  uint32
+	sealed []byte
+	plain  []byte // decrypted, not yet returned.
+	done   bool   // true once the last chunk has been decrypted.
+	err    error
+}
+
+func newDecrypter(r io.ReadCloser, key Key, addr api.WarehouseAddr) *decrypter {
+	return &decrypter{
+		r:      r,
+		key:    key,
+		addr:   addr,
+		sealed: make([]byte, sealedChunkSize),
+	}
+}
+
+func (d *decrypter) Read(bs []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(bs, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+/*
+	Reads and authenticates the next chunk (and the header first, if needed).
+	Errors are sticky; a stream which fails once is never read further.
+*/
+func (d *decrypter) next() error {
+	if d.aead == nil {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return d.corrupt("missing header: %s", err)
+		}
+		if string(header[:len(magic)]) != magic {
+			return d.corrupt("not an encrypted ware")
+		}
+		d.aead = newAEAD(d.key, header[len(magic):])
+	}
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch err {
+	case nil:
+		// A full chunk; not the last.
+	case io.EOF, io.ErrUnexpectedEOF:
+		// A short chunk; must be the last.
+		d.done = true
+	default:
+		return Errorf(rio.ErrWarehouseUnavailable, "error reading from warehouse %s: %s", d.addr, err)
+	}
+	if d.index == maxChunks {
+		return d.corrupt("too many chunks")
+	}
+	if n < d.aead.Overhead() {
+		return d.corrupt("truncated")
+	}
+	d.plain, err = d.aead.Open(d.sealed[:0], chunkNonce(d.index, d.done), d.sealed[:n], nil)
+	if err != nil {
+		return d.corrupt("chunk %d failed authentication (tampered with, or wrong key)", d.index)
+	}
+	d.index++
+	return nil
+}
+
+func (d *decrypter) corrupt(format string, args ...interface{}) error {
+	return Errorf(rio.ErrWareCorrupt, "encrypted ware from warehouse %s is corrupt: %s", d.addr, fmt.Sprintf(format, args...))
+}
+
+/*
+	Returns the plaintext size, worked out from the size of the stored
+	stream (every chunk but the last is full, and each has a tag),
+	or -1 if the store doesn't say or the size is impossible.
+*/
+func (d *decrypter) Size() int64 {
+	sealed := warehouse.SizeOf(d.r) - int64(headerSize)
+	if sealed < 16 {
+		return -1
+	}
+	chunks := sealed/sealedChunkSize + 1
+	return sealed - chunks*16
+}
+
+func (d *decrypter) Close() error {
+	return d.r.Close()
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
@@ -22,7 +23,9 @@ import (
 
 var (
 	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.SidecarController        = Controller{}
 	_ warehouse.BlobstoreWriteController = &WriteController{}
+	_ warehouse.SizedReader              = sizedFile{}
 )
 
 type Controller struct {
@@ -90,19 +93,29 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 	}
 }
 
-func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
-	finalPath := whCtrl.basePath
-	if whCtrl.ctntAddr {
-		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
-		finalPath = finalPath.
-			Join(fs.MustRelPath(chunkA)).
-			Join(fs.MustRelPath(chunkB)).
-			Join(fs.MustRelPath(wareID.Hash))
+/*
+	Returns the path of the ware's blob, or with a suffix, of one of its sidecars.
+*/
+func (whCtrl Controller) warePath(wareID api.WareID, suffix string) fs.AbsolutePath {
+	if !whCtrl.ctntAddr {
+		if suffix == "" {
+			return whCtrl.basePath
+		}
+		return whCtrl.basePath.Dir().Join(fs.MustRelPath(whCtrl.basePath.Last() + suffix))
 	}
+	chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+	return whCtrl.basePath.
+		Join(fs.MustRelPath(chunkA)).
+		Join(fs.MustRelPath(chunkB)).
+		Join(fs.MustRelPath(wareID.Hash + suffix))
+}
+
+func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
+	finalPath := whCtrl.warePath(wareID, "")
 	file, err := os.OpenFile(finalPath.String(), os.O_RDONLY, 0)
 	switch {
 	case err == nil:
-		return file, nil
+		return sizedFile{file}, nil
 	case os.IsNotExist(err):
 		return nil, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
 	default:
@@ -110,6 +123,18 @@ func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
 	}
 }
 
+type sizedFile struct {
+	*os.File
+}
+
+func (f sizedFile) Size() int64 {
+	stat, err := f.Stat()
+	if err != nil {
+		return -1
+	}
+	return stat.Size()
+}
+
 func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
 	wc := &WriteController{whCtrl: whCtrl}
 	// Pick a random upload path.
@@ -131,6 +156,62 @@ func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error
 	return wc, nil
 }
 
+func (whCtrl Controller) OpenSidecarReader(wareID api.WareID, suffix string) (io.ReadCloser, error) {
+	if err := checkSidecarSuffix(suffix); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(whCtrl.warePath(wareID, suffix).String(), os.O_RDONLY, 0)
+	switch {
+	case err == nil:
+		return file, nil
+	case os.IsNotExist(err):
+		return nil, Errorf(rio.ErrWareNotFound, "no %s sidecar for ware %s in warehouse %s", suffix, wareID, whCtrl.addr)
+	default:
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "%s sidecar for ware %s could not be retrieved from warehouse %s: %s", suffix, wareID, whCtrl.addr, err)
+	}
+}
+
+/*
+	Write a sidecar beside the ware, replacing any previous one.
+	Like blobs, sidecars are staged in temp space and moved into place,
+	so readers never see a partial write.
+*/
+func (whCtrl Controller) WriteSidecar(wareID api.WareID, suffix string, body []byte) error {
+	if err := checkSidecarSuffix(suffix); err != nil {
+		return err
+	}
+	finalPath := whCtrl.warePath(wareID, suffix)
+	if whCtrl.ctntAddr {
+		if err := os.MkdirAll(finalPath.Dir().String(), 0755); err != nil {
+			return Errorf(rio.ErrWarehouseUnwritable, "failed to write sidecar: %s", err)
+		}
+	}
+	stagePath := finalPath.Dir().Join(fs.MustRelPath(".tmp.upload." + finalPath.Last() + "." + guid.New()))
+	file, err := os.OpenFile(stagePath.String(), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space in warehouse: %s", err)
+	}
+	defer os.Remove(stagePath.String())
+	_, err = file.Write(body)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to write sidecar: %s", err)
+	}
+	if err := os.Rename(stagePath.String(), finalPath.String()); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to write sidecar: %s", err)
+	}
+	return nil
+}
+
+func checkSidecarSuffix(suffix string) error {
+	if len(suffix) < 2 || suffix[0] != '.' || strings.ContainsRune(suffix, '/') {
+		return Errorf(rio.ErrUsage, "invalid sidecar suffix %q (must start with a dot, and not contain slashes)", suffix)
+	}
+	return nil
+}
+
 type WriteController struct {
 	stream    io.WriteCloser  // Write to this.
 	whCtrl    Controller      // Needed for the final move-into-place.
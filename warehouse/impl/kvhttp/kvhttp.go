@@ -7,25 +7,37 @@ package kvhttp
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"strings"
+	"time"
 
 	. "github.com/warpfork/go-errcat"
 	"go.polydawn.net/go-timeless-api"
 	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
 	"go.polydawn.net/rio/warehouse"
 	"go.polydawn.net/rio/warehouse/util"
 )
 
 var (
-	_ warehouse.BlobstoreController = Controller{}
+	_ warehouse.BlobstoreController      = Controller{}
+	_ warehouse.SidecarController        = Controller{}
+	_ warehouse.SizedReader              = sizedBody{}
+	_ warehouse.BlobstoreWriteController = &WriteController{}
 )
 
 type Controller struct {
 	addr     api.WarehouseAddr // user's string retained for messages
 	baseUrl  *url.URL
 	ctntAddr bool
+	client   *http.Client
+	auth     string // "Authorization" header value, if any
+	retries  int
 }
 
 /*
@@ -65,6 +77,26 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 	}
 	whCtrl.baseUrl = u
 
+	// Apply any settings config has for this warehouse.
+	//  Timeouts are for the warehouse to start responding, not for the
+	//  whole download, since wares can be arbitrarily large.
+	whCtrl.client = http.DefaultClient
+	if settings, ok := config.GetWarehouseSettings(string(addr)); ok {
+		timeout, _ := settings.TimeoutDuration() // validated when loaded.
+		if timeout > 0 {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+			transport.TLSHandshakeTimeout = timeout
+			transport.ResponseHeaderTimeout = timeout
+			whCtrl.client = &http.Client{Transport: transport}
+		}
+		whCtrl.auth, err = settings.Auth.Header()
+		if err != nil {
+			return whCtrl, Errorf(rio.ErrUsage, "%s", err)
+		}
+		whCtrl.retries = settings.Retries
+	}
+
 	// We skip checking that the warehouse exists.
 	//  It's as costly as just starting the actual download.
 
@@ -72,18 +104,18 @@ func NewController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error
 }
 
 func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
-	u := whCtrl.baseUrl
+	u := *whCtrl.baseUrl
 	if whCtrl.ctntAddr {
 		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
 		u.Path = path.Join(u.Path, chunkA, chunkB, wareID.Hash)
 	}
-	resp, err := http.Get(u.String())
+	resp, err := whCtrl.get(u.String())
 	if err != nil {
-		return nil, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+		return nil, err
 	}
 	switch resp.StatusCode {
 	case 200:
-		return resp.Body, nil
+		return sizedBody{resp.Body, resp.ContentLength}, nil
 	case 404:
 		resp.Body.Close()
 		return nil, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.addr)
@@ -93,6 +125,145 @@ func (whCtrl Controller) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
 	}
 }
 
+// A response body, which knows its Content-Length (or -1, if it didn't say).
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b sizedBody) Size() int64 { return b.size }
+
+/*
+	Issues a GET, with auth if configured, and retrying as configured
+	if the request fails in a way that might not happen again
+	(can't connect, or a 5xx or 429 response).
+*/
+func (whCtrl Controller) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "invalid request to warehouse %s: %s", whCtrl.addr, err)
+	}
+	if whCtrl.auth != "" {
+		req.Header.Set("Authorization", whCtrl.auth)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := whCtrl.client.Do(req)
+		retryable := err != nil || resp.StatusCode >= 500 || resp.StatusCode == 429
+		if !retryable || attempt >= whCtrl.retries {
+			switch {
+			case err != nil:
+				return nil, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+			case resp.StatusCode == 401 || resp.StatusCode == 403:
+				resp.Body.Close()
+				return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s refused access (check the auth in config): %s", whCtrl.addr, resp.Status)
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep((100 * time.Millisecond) << uint(attempt))
+	}
+}
+
+/*
+	Opens a writer, which spools to a temp file (since the URL to write to
+	depends on the hash, which isn't known until the end), and uploads
+	with a PUT on commit.  The server decides whether to accept it;
+	`rio serve` does, with the right auth, and only once it's checked the ware.
+*/
 func (whCtrl Controller) OpenWriter() (warehouse.BlobstoreWriteController, error) {
-	return nil, Errorf(rio.ErrUsage, "http warehouses are readonly!")
+	file, err := ioutil.TempFile("", "rio-upload-")
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	return &WriteController{whCtrl: whCtrl, spool: file}, nil
+}
+
+type WriteController struct {
+	whCtrl Controller
+	spool  *os.File
+}
+
+func (wc *WriteController) Write(bs []byte) (int, error) {
+	return wc.spool.Write(bs)
+}
+
+/*
+	Cancel the current write.  Nothing has been sent; just removes the spool.
+*/
+func (wc *WriteController) Close() error {
+	wc.spool.Close()
+	return os.Remove(wc.spool.Name())
+}
+
+/*
+	Uploads the spooled data as the given ware, and closes the writer.
+*/
+func (wc *WriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	size, err := wc.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to read back upload: %s", err)
+	}
+	if _, err := wc.spool.Seek(0, io.SeekStart); err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to read back upload: %s", err)
+	}
+	u := *wc.whCtrl.baseUrl
+	if wc.whCtrl.ctntAddr {
+		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+		u.Path = path.Join(u.Path, chunkA, chunkB, wareID.Hash)
+	}
+	req, err := http.NewRequest("PUT", u.String(), ioutil.NopCloser(wc.spool))
+	if err != nil {
+		return Errorf(rio.ErrUsage, "invalid request to warehouse %s: %s", wc.whCtrl.addr, err)
+	}
+	req.ContentLength = size
+	if wc.whCtrl.auth != "" {
+		req.Header.Set("Authorization", wc.whCtrl.auth)
+	}
+	resp, err := wc.whCtrl.client.Do(req)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "error connecting to warehouse %s: %s", wc.whCtrl.addr, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return Errorf(rio.ErrWarehouseUnwritable, "warehouse %s refused the upload (check the auth in config): %s", wc.whCtrl.addr, resp.Status)
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Errorf(rio.ErrWarehouseUnwritable, "warehouse %s refused the upload: %s: %s", wc.whCtrl.addr, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+func (whCtrl Controller) OpenSidecarReader(wareID api.WareID, suffix string) (io.ReadCloser, error) {
+	if len(suffix) < 2 || suffix[0] != '.' || strings.ContainsRune(suffix, '/') {
+		return nil, Errorf(rio.ErrUsage, "invalid sidecar suffix %q (must start with a dot, and not contain slashes)", suffix)
+	}
+	u := *whCtrl.baseUrl
+	if whCtrl.ctntAddr {
+		chunkA, chunkB, _ := util.ChunkifyHash(wareID)
+		u.Path = path.Join(u.Path, chunkA, chunkB, wareID.Hash)
+	}
+	u.Path += suffix
+	resp, err := whCtrl.get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return resp.Body, nil
+	case 404:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWareNotFound, "no %s sidecar for ware %s in warehouse %s", suffix, wareID, whCtrl.addr)
+	default:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", whCtrl.addr, resp.Status)
+	}
+}
+
+func (whCtrl Controller) WriteSidecar(wareID api.WareID, suffix string, body []byte) error {
+	return Errorf(rio.ErrUsage, "http warehouses can't store sidecars")
 }
@@ -0,0 +1,90 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package kvhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+func TestHttpWarehouseConfig(t *testing.T) {
+	Convey("HTTP warehouses use the auth and retries from config", t, func() {
+		wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+		failures := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Header.Get("Authorization") != "Bearer hunter2":
+				w.WriteHeader(401)
+			case failures > 0:
+				failures--
+				w.WriteHeader(503)
+			case r.URL.Path == "/wh/5y6/NvK/"+wareID.Hash:
+				fmt.Fprint(w, "ware")
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+		defer srv.Close()
+		addr := api.WarehouseAddr("ca+" + srv.URL + "/wh")
+
+		tmpDir, err := ioutil.TempDir("", "rio-kvhttp-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(tmpDir)
+		cfgPath := filepath.Join(tmpDir, "config.json")
+		So(ioutil.WriteFile(cfgPath, []byte(fmt.Sprintf(
+			`{"warehouses": {"test": {"addr": %q, "auth": {"token": "hunter2"}, "retries": 2}}}`, addr,
+		)), 0644), ShouldBeNil)
+		defer os.Setenv("RIO_CONFIG", os.Getenv("RIO_CONFIG"))
+		os.Setenv("RIO_CONFIG", cfgPath)
+		defer os.Setenv("RIO_SYSTEM_CONFIG", os.Getenv("RIO_SYSTEM_CONFIG"))
+		os.Setenv("RIO_SYSTEM_CONFIG", filepath.Join(tmpDir, "none"))
+
+		whCtrl, err := NewController(addr)
+		So(err, ShouldBeNil)
+		read := func() (string, error) {
+			reader, err := whCtrl.OpenReader(wareID)
+			if err != nil {
+				return "", err
+			}
+			defer reader.Close()
+			bs, err := ioutil.ReadAll(reader)
+			return string(bs), err
+		}
+
+		Convey("sending credentials", func() {
+			body, err := read()
+			So(err, ShouldBeNil)
+			So(body, ShouldEqual, "ware")
+		})
+		Convey("retrying transient failures", func() {
+			failures = 2
+			body, err := read()
+			So(err, ShouldBeNil)
+			So(body, ShouldEqual, "ware")
+		})
+		Convey("but not forever", func() {
+			failures = 3
+			_, err := read()
+			So(Category(err), ShouldEqual, rio.ErrWarehouseUnavailable)
+		})
+		Convey("and refusals are reported", func() {
+			whCtrl, err = NewController(api.WarehouseAddr("ca+" + srv.URL + "/elsewhere"))
+			So(err, ShouldBeNil)
+			_, err := read()
+			So(Category(err), ShouldEqual, rio.ErrWarehouseUnavailable)
+		})
+	})
+}
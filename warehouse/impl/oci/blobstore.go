@@ -0,0 +1,272 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	stdjson "encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+var (
+	_ warehouse.BlobstoreController      = &BlobstoreController{}
+	_ warehouse.SidecarController        = &BlobstoreController{}
+	_ warehouse.BlobstoreWriteController = &BlobstoreWriteController{}
+)
+
+const (
+	// The artifactType of the manifests which tag wares (and sidecars).
+	ArtifactType_Ware = "application/vnd.polydawn.rio.ware.v1"
+
+	// Media type of the layer holding a ware's blob is this plus its packtype (e.g. ".tar").
+	MediaType_WarePrefix = "application/vnd.polydawn.rio.ware.v1."
+	MediaType_Sidecar    = "application/vnd.polydawn.rio.sidecar.v1"
+	MediaType_Empty      = "application/vnd.oci.empty.v1+json"
+
+	// Annotations on the manifests which tag wares, saying which.
+	Annotation_WareID  = "net.polydawn.rio.ware-id"
+	Annotation_Sidecar = "net.polydawn.rio.sidecar"
+)
+
+// Tags allowed by the distribution API.
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// The config every ware manifest has, since manifests must have one: "{}".
+var emptyConfig = []byte("{}")
+
+/*
+	Keeps wares in a repository in a registry ("ca+oci+http" or
+	"ca+oci+https"), with the distribution API.
+
+	Ware hashes aren't registry digests (they're of the fileset, not the
+	blob), so each ware's blob is pushed as the one layer of a small
+	manifest, which is tagged "<packtype>-<hash>" (e.g. "tar-5y6NvK6G...").
+	Reads resolve that tag, then fetch the blob with
+	`GET /v2/<name>/blobs/<digest>`; writes push the blob with a chunked
+	upload, and then the manifest.  Sidecars are kept the same way, tagged
+	with their suffix added (e.g. "tar-5y6NvK6G....sig").
+
+	The manifests say which ware (and sidecar) they're for in annotations,
+	which are checked on read, so nothing else which happens to be at the
+	tag is mistaken for a ware.  As with other warehouses, the blob isn't
+	trusted until the transmat has checked it against the wareID.
+*/
+type BlobstoreController struct {
+	reg *RegistryController
+}
+
+/*
+	Initialize a controller which keeps wares in a registry repository.
+	The path of the address is the repository's name.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+*/
+func NewBlobstoreController(addr api.WarehouseAddr) (warehouse.BlobstoreController, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "ca+oci+http":
+		u.Scheme = "http"
+	case "ca+oci+https":
+		u.Scheme = "https"
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'ca+oci+http' or 'ca+oci+https')", u.Scheme)
+	}
+	reg, err := newRegistryController(addr, u)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobstoreController{reg}, nil
+}
+
+func (whCtrl *BlobstoreController) OpenReader(wareID api.WareID) (io.ReadCloser, error) {
+	ctx := context.Background()
+	layer, err := whCtrl.resolve(ctx, wareID, "")
+	if err != nil {
+		return nil, err
+	}
+	return whCtrl.reg.OpenBlob(ctx, layer.Digest)
+}
+
+/*
+	Opens a writer, which spools to a temp file (since the tag to push to
+	depends on the hash, which isn't known until the end, and the upload
+	needs the blob's digest), and pushes it on commit.
+*/
+func (whCtrl *BlobstoreController) OpenWriter() (warehouse.BlobstoreWriteController, error) {
+	file, err := ioutil.TempFile("", "rio-upload-")
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnwritable, "failed to reserve temp space for upload: %s", err)
+	}
+	return &BlobstoreWriteController{whCtrl: whCtrl, spool: file, hasher: sha256.New()}, nil
+}
+
+type BlobstoreWriteController struct {
+	whCtrl *BlobstoreController
+	spool  *os.File
+	hasher hash.Hash
+}
+
+func (wc *BlobstoreWriteController) Write(bs []byte) (int, error) {
+	wc.hasher.Write(bs)
+	return wc.spool.Write(bs)
+}
+
+/*
+	Cancel the current write.  Nothing has been sent; just removes the spool.
+*/
+func (wc *BlobstoreWriteController) Close() error {
+	wc.spool.Close()
+	return os.Remove(wc.spool.Name())
+}
+
+/*
+	Pushes the spooled data as the given ware, and closes the writer.
+*/
+func (wc *BlobstoreWriteController) Commit(wareID api.WareID) error {
+	defer wc.Close()
+	size, err := wc.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "failed to read back upload: %s", err)
+	}
+	layer := Descriptor{
+		MediaType: MediaType_WarePrefix + string(wareID.Type),
+		Digest:    fmt.Sprintf("sha256:%x", wc.hasher.Sum(nil)),
+		Size:      size,
+	}
+	return wc.whCtrl.push(context.Background(), wareID, "", layer, wc.spool)
+}
+
+func (whCtrl *BlobstoreController) OpenSidecarReader(wareID api.WareID, suffix string) (io.ReadCloser, error) {
+	if err := checkSidecarSuffix(suffix); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	layer, err := whCtrl.resolve(ctx, wareID, suffix)
+	if err != nil {
+		return nil, err
+	}
+	return whCtrl.reg.OpenBlob(ctx, layer.Digest)
+}
+
+func (whCtrl *BlobstoreController) WriteSidecar(wareID api.WareID, suffix string, body []byte) error {
+	if err := checkSidecarSuffix(suffix); err != nil {
+		return err
+	}
+	layer := Descriptor{
+		MediaType: MediaType_Sidecar,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(body)),
+		Size:      int64(len(body)),
+	}
+	return whCtrl.push(context.Background(), wareID, suffix, layer, bytes.NewReader(body))
+}
+
+func checkSidecarSuffix(suffix string) error {
+	if len(suffix) < 2 || suffix[0] != '.' || strings.ContainsRune(suffix, '/') {
+		return Errorf(rio.ErrUsage, "invalid sidecar suffix %q (must start with a dot, and not contain slashes)", suffix)
+	}
+	return nil
+}
+
+/*
+	Returns the tag a ware (or its sidecar, if suffix isn't empty) is kept at.
+*/
+func tagFor(wareID api.WareID, suffix string) (string, error) {
+	tag := string(wareID.Type) + "-" + wareID.Hash + suffix
+	if !tagPattern.MatchString(tag) {
+		return "", Errorf(rio.ErrUsage, "ware %s can't be kept in a registry: %q isn't a valid tag", wareID, tag)
+	}
+	return tag, nil
+}
+
+/*
+	Finds the manifest tagging a ware (or sidecar), checks it's the one,
+	and returns its layer.
+*/
+func (whCtrl *BlobstoreController) resolve(ctx context.Context, wareID api.WareID, suffix string) (Descriptor, error) {
+	tag, err := tagFor(wareID, suffix)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	body, _, err := whCtrl.reg.fetchManifest(ctx, tag)
+	switch Category(err) {
+	case nil:
+		// pass
+	case rio.ErrWareNotFound:
+		if suffix != "" {
+			return Descriptor{}, Errorf(rio.ErrWareNotFound, "no %s sidecar for ware %s in warehouse %s", suffix, wareID, whCtrl.reg.addr)
+		}
+		return Descriptor{}, Errorf(rio.ErrWareNotFound, "ware %s not found in warehouse %s", wareID, whCtrl.reg.addr)
+	default:
+		return Descriptor{}, err
+	}
+	var manifest Manifest
+	if err := stdjson.Unmarshal(body, &manifest); err != nil {
+		return Descriptor{}, Errorf(rio.ErrWareCorrupt, "manifest at tag %q in warehouse %s is not valid: %s", tag, whCtrl.reg.addr, err)
+	}
+	if manifest.Annotations[Annotation_WareID] != wareID.String() ||
+		manifest.Annotations[Annotation_Sidecar] != suffix ||
+		len(manifest.Layers) != 1 {
+		return Descriptor{}, Errorf(rio.ErrWareCorrupt, "manifest at tag %q in warehouse %s is not for ware %s", tag, whCtrl.reg.addr, wareID)
+	}
+	return manifest.Layers[0], nil
+}
+
+/*
+	Pushes a ware's (or sidecar's) blob, and the manifest which tags it.
+	The tag is pushed last, so it's never seen before the blob is there.
+*/
+func (whCtrl *BlobstoreController) push(ctx context.Context, wareID api.WareID, suffix string, layer Descriptor, body io.ReaderAt) error {
+	tag, err := tagFor(wareID, suffix)
+	if err != nil {
+		return err
+	}
+	config := Descriptor{
+		MediaType: MediaType_Empty,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(emptyConfig)),
+		Size:      int64(len(emptyConfig)),
+	}
+	if err := whCtrl.reg.uploadBlob(ctx, config, bytes.NewReader(emptyConfig)); err != nil {
+		return err
+	}
+	if err := whCtrl.reg.uploadBlob(ctx, layer, body); err != nil {
+		return err
+	}
+	annotations := map[string]string{Annotation_WareID: wareID.String()}
+	if suffix != "" {
+		annotations[Annotation_Sidecar] = suffix
+	}
+	manifest, err := stdjson.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaType_ImageManifest,
+		ArtifactType:  ArtifactType_Ware,
+		Config:        config,
+		Layers:        []Descriptor{layer},
+		Annotations:   annotations,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return whCtrl.reg.putManifest(ctx, tag, manifest)
+}
@@ -0,0 +1,238 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package oci_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/testutil"
+	"go.polydawn.net/rio/transmat/mixins/tests"
+	"go.polydawn.net/rio/transmat/tar"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/oci"
+)
+
+/*
+	Just enough of a registry to push to and pull from one repository:
+	blobs, chunked uploads, and manifests by tag or digest, behind a
+	token challenge like real registries have.
+*/
+type fakeRegistry struct {
+	name     string
+	readOnly bool
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte // by tag, and by digest.
+	uploads   map[string]*bytes.Buffer
+	patches   int
+	tokens    int
+}
+
+func newFakeRegistry(name string) *fakeRegistry {
+	return &fakeRegistry{
+		name:      name,
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+}
+
+func (reg *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if req.URL.Path == "/token" {
+		reg.tokens++
+		fmt.Fprint(w, `{"token":"letmein"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer letmein" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, req.Host))
+		w.WriteHeader(401)
+		return
+	}
+	prefix := "/v2/" + reg.name + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(404)
+		return
+	}
+	if reg.readOnly && req.Method != "GET" && req.Method != "HEAD" {
+		w.WriteHeader(403)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	switch rest := strings.TrimPrefix(req.URL.Path, prefix); {
+	case rest == "blobs/uploads/" && req.Method == "POST":
+		id := strconv.Itoa(len(reg.uploads))
+		reg.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", prefix+"blobs/uploads/"+id+"?state=x")
+		w.WriteHeader(202)
+	case strings.HasPrefix(rest, "blobs/uploads/"):
+		buf, ok := reg.uploads[strings.TrimPrefix(rest, "blobs/uploads/")]
+		switch {
+		case !ok || req.URL.Query().Get("state") != "x":
+			w.WriteHeader(404)
+		case req.Method == "PATCH":
+			if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", buf.Len(), buf.Len()+len(body)-1) {
+				w.WriteHeader(416)
+				return
+			}
+			reg.patches++
+			buf.Write(body)
+			w.Header().Set("Location", req.URL.String())
+			w.WriteHeader(202)
+		case req.Method == "PUT":
+			buf.Write(body)
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes()))
+			if req.URL.Query().Get("digest") != digest {
+				w.WriteHeader(400)
+				fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID"}]}`)
+				return
+			}
+			reg.blobs[digest] = buf.Bytes()
+			w.WriteHeader(201)
+		default:
+			w.WriteHeader(405)
+		}
+	case strings.HasPrefix(rest, "blobs/"):
+		blob, ok := reg.blobs[strings.TrimPrefix(rest, "blobs/")]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(blob)
+	case strings.HasPrefix(rest, "manifests/"):
+		ref := strings.TrimPrefix(rest, "manifests/")
+		switch req.Method {
+		case "PUT":
+			if req.Header.Get("Content-Type") != oci.MediaType_ImageManifest {
+				w.WriteHeader(400)
+				return
+			}
+			reg.manifests[ref] = body
+			reg.manifests[fmt.Sprintf("sha256:%x", sha256.Sum256(body))] = body
+			w.WriteHeader(201)
+		default:
+			manifest, ok := reg.manifests[ref]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Header().Set("Content-Type", oci.MediaType_ImageManifest)
+			w.Write(manifest)
+		}
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestRegistryBlobstore(t *testing.T) {
+	defer func(size int64) { oci.UploadChunkSize = size }(oci.UploadChunkSize)
+	oci.UploadChunkSize = 1000
+
+	Convey("Registry blobstore warehouses", t, func() {
+		reg := newFakeRegistry("team/wares")
+		srv := httptest.NewServer(reg)
+		defer srv.Close()
+		whCtrl, err := oci.NewBlobstoreController(api.WarehouseAddr("ca+oci+" + srv.URL + "/team/wares"))
+		So(err, ShouldBeNil)
+		wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+		write := func(wareID api.WareID, body []byte) error {
+			wc, err := whCtrl.OpenWriter()
+			So(err, ShouldBeNil)
+			_, err = wc.Write(body)
+			So(err, ShouldBeNil)
+			return wc.Commit(wareID)
+		}
+		read := func(wareID api.WareID) (string, error) {
+			reader, err := whCtrl.OpenReader(wareID)
+			if err != nil {
+				return "", err
+			}
+			defer reader.Close()
+			bs, err := ioutil.ReadAll(reader)
+			return string(bs), err
+		}
+		body := bytes.Repeat([]byte("ware"), 625) // 2500 bytes: three chunks.
+
+		Convey("push wares in chunks, and tag them", func() {
+			So(write(wareID, body), ShouldBeNil)
+			So(reg.patches, ShouldEqual, 1+3) // the config, then the ware.
+			So(reg.tokens, ShouldEqual, 1)
+			So(reg.manifests, ShouldContainKey, "tar-"+wareID.Hash)
+
+			Convey("and read them back", func() {
+				got, err := read(wareID)
+				So(err, ShouldBeNil)
+				So(got, ShouldEqual, string(body))
+			})
+			Convey("and don't upload blobs the registry already has", func() {
+				So(write(wareID, body), ShouldBeNil)
+				So(reg.patches, ShouldEqual, 1+3)
+			})
+			Convey("and don't take other things at the tag for the ware", func() {
+				otherID := api.WareID{"tar", "6q7G4hWr283FpTa5Lf8heVqw9t97b5VoMU6AGszuBYAz9EzQdeHVFAou7c4W9vFcQ6"}
+				So(write(otherID, []byte("other")), ShouldBeNil)
+				reg.manifests["tar-"+wareID.Hash] = reg.manifests["tar-"+otherID.Hash]
+				_, err := read(wareID)
+				So(Category(err), ShouldEqual, rio.ErrWareCorrupt)
+			})
+		})
+		Convey("say wares they don't have are not found", func() {
+			_, err := read(wareID)
+			So(Category(err), ShouldEqual, rio.ErrWareNotFound)
+		})
+		Convey("refuse wares which can't be tags", func() {
+			err := write(api.WareID{"tar", "not/a/tag"}, body)
+			So(Category(err), ShouldEqual, rio.ErrUsage)
+		})
+		Convey("report refused pushes as unwritable", func() {
+			reg.readOnly = true
+			err := write(wareID, body)
+			So(Category(err), ShouldEqual, rio.ErrWarehouseUnwritable)
+		})
+		Convey("keep sidecars", func() {
+			sc := whCtrl.(warehouse.SidecarController)
+			_, err := sc.OpenSidecarReader(wareID, ".sig")
+			So(Category(err), ShouldEqual, rio.ErrWareNotFound)
+
+			So(sc.WriteSidecar(wareID, ".sig", []byte("signed")), ShouldBeNil)
+			So(reg.manifests, ShouldContainKey, "tar-"+wareID.Hash+".sig")
+			reader, err := sc.OpenSidecarReader(wareID, ".sig")
+			So(err, ShouldBeNil)
+			defer reader.Close()
+			got, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, "signed")
+
+			Convey("which aren't mistaken for the ware", func() {
+				_, err := read(wareID)
+				So(Category(err), ShouldEqual, rio.ErrWareNotFound)
+			})
+		})
+	})
+
+	Convey("Spec compliance: packing to and unpacking from a registry", t,
+		testutil.Requires(testutil.RequiresCanManageOwnership, func() {
+			srv := httptest.NewServer(newFakeRegistry("wares"))
+			defer srv.Close()
+			tests.CheckRoundTrip(tartrans.PackType, tartrans.Pack, tartrans.Unpack, api.WarehouseAddr("ca+oci+"+srv.URL+"/wares"))
+		}),
+	)
+}
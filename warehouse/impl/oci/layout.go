@@ -0,0 +1,104 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package oci
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+var (
+	_ warehouse.ImageController = &LayoutController{}
+	_ warehouse.SizedReader     = sizedFile{}
+)
+
+/*
+	Reads from an OCI image layout dir.
+	Manifests are blobs like any other there, so their media type isn't known
+	until they're read (OpenManifest always returns it empty).
+*/
+type LayoutController struct {
+	addr     api.WarehouseAddr // user's string retained for messages
+	basePath string
+}
+
+/*
+	Initialize a controller for an OCI image layout dir ("oci+file").
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+	  - `rio.ErrWarehouseUnavailable` -- if the dir doesn't exist, or isn't an image layout
+*/
+func NewLayoutController(addr api.WarehouseAddr) (*LayoutController, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	if u.Scheme != "oci+file" {
+		return nil, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'oci+file')", u.Scheme)
+	}
+	absPth, err := filepath.Abs(filepath.Join(u.Host, u.Path))
+	if err != nil {
+		panic(err)
+	}
+
+	// Check that the warehouse exists, and is a layout.
+	//  The "oci-layout" file is the one thing every layout must have.
+	if _, err := os.Stat(filepath.Join(absPth, "oci-layout")); err != nil {
+		if os.IsNotExist(err) {
+			return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse unavailable: %q is not an OCI image layout (no 'oci-layout' file)", absPth)
+		}
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse unavailable: %q could not be read: %s", absPth, err)
+	}
+	return &LayoutController{addr, absPth}, nil
+}
+
+func (whCtrl *LayoutController) OpenManifest(ctx context.Context, digest string) ([]byte, string, error) {
+	reader, err := whCtrl.OpenBlob(ctx, digest)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	body, err := readManifest(reader, whCtrl.addr, digest)
+	return body, "", err
+}
+
+func (whCtrl *LayoutController) OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	d, err := ParseDigest(digest)
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "%s", err)
+	}
+	file, err := os.Open(filepath.Join(whCtrl.basePath, "blobs", d.Algorithm, d.Hex))
+	switch {
+	case err == nil:
+		return sizedFile{file}, nil
+	case os.IsNotExist(err):
+		return nil, Errorf(rio.ErrWareNotFound, "blob %s not found in warehouse %s", digest, whCtrl.addr)
+	default:
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "blob %s could not be retrieved from warehouse %s: %s", digest, whCtrl.addr, err)
+	}
+}
+
+type sizedFile struct {
+	*os.File
+}
+
+func (f sizedFile) Size() int64 {
+	stat, err := f.Stat()
+	if err != nil {
+		return -1
+	}
+	return stat.Size()
+}
@@ -0,0 +1,205 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	The oci warehouses hold OCI (and Docker) images, and are what the oci
+	transmat reads layers from.
+
+	There are two kinds:
+
+	  - 'oci+file:///path/to/layout' is an OCI image layout dir (as made by
+	    e.g. `skopeo copy ... oci:/path/to/layout`), where blobs are files
+	    at "blobs/<algorithm>/<hex>";
+	  - 'oci+https://registry.example.com/library/ubuntu' (or 'oci+http')
+	    is a repository in a registry, read with the distribution API's
+	    `GET /v2/<name>/manifests/<digest>` and `GET /v2/<name>/blobs/<digest>`.
+
+	Images are found by digest; tags are mutable, so they aren't used.
+
+	A registry repository can also be a blobstore warehouse, holding wares
+	like any other: 'ca+oci+https://registry.example.com/team/wares' (or
+	'ca+oci+http').  See BlobstoreController for how wares are kept there.
+*/
+package oci
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/warehouse"
+)
+
+// Media types of manifests, as the registry reports them, or as they say themselves.
+const (
+	MediaType_ImageIndex         = "application/vnd.oci.image.index.v1+json"
+	MediaType_ImageManifest      = "application/vnd.oci.image.manifest.v1+json"
+	MediaType_DockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaType_DockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Manifests bigger than this are refused; real ones are a few KB.
+const MaxManifestSize = 4 << 20
+
+/*
+	Points to a blob (or manifest), with its size, so it can be checked.
+*/
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *Platform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+/*
+	An image manifest: a config blob, and the layers, lowest first.
+*/
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+	An image index (or Docker "manifest list"): manifests for several platforms.
+*/
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+/*
+	A parsed digest, e.g. "sha256:e3b0c442...".
+	Only sha256 and sha512 are supported, which is what the image spec allows.
+*/
+type Digest struct {
+	Algorithm string
+	Hex       string
+}
+
+func ParseDigest(s string) (Digest, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return Digest{}, fmt.Errorf("digest %q must be of the form \"<algorithm>:<hex>\"", s)
+	}
+	d := Digest{s[:i], s[i+1:]}
+	var size int
+	switch d.Algorithm {
+	case "sha256":
+		size = sha256.Size
+	case "sha512":
+		size = sha512.Size
+	default:
+		return Digest{}, fmt.Errorf("digest %q uses unsupported algorithm %q (valid options are 'sha256' or 'sha512')", s, d.Algorithm)
+	}
+	if len(d.Hex) != size*2 || strings.ToLower(d.Hex) != d.Hex {
+		return Digest{}, fmt.Errorf("digest %q must have %d lowercase hex characters", s, size*2)
+	}
+	if _, err := hex.DecodeString(d.Hex); err != nil {
+		return Digest{}, fmt.Errorf("digest %q must have %d lowercase hex characters", s, size*2)
+	}
+	return d, nil
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+// Returns a hasher for the digest's algorithm.
+func (d Digest) NewHash() hash.Hash {
+	switch d.Algorithm {
+	case "sha512":
+		return sha512.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// Formats the sum of a hasher from NewHash as a digest of the same algorithm.
+func (d Digest) Of(sum []byte) Digest {
+	return Digest{d.Algorithm, hex.EncodeToString(sum)}
+}
+
+/*
+	Initialize a controller for an image warehouse, by its scheme.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+	  - `rio.ErrWarehouseUnavailable` -- if the warehouse doesn't exist
+*/
+func NewController(addr api.WarehouseAddr) (warehouse.ImageController, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "oci+file":
+		whCtrl, err := NewLayoutController(addr)
+		if err != nil {
+			return nil, err
+		}
+		return whCtrl, nil
+	case "oci+http", "oci+https":
+		whCtrl, err := NewRegistryController(addr)
+		if err != nil {
+			return nil, err
+		}
+		return whCtrl, nil
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'oci+file', 'oci+http', or 'oci+https')", u.Scheme)
+	}
+}
+
+// A blob body, which knows its size (or -1, if it's not known).
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b sizedBody) Size() int64 { return b.size }
+
+// Reads a manifest body, refusing it if it's over MaxManifestSize.
+func readManifest(r io.Reader, addr api.WarehouseAddr, digest string) ([]byte, error) {
+	bs, err := ioutil.ReadAll(io.LimitReader(r, MaxManifestSize+1))
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "error reading manifest %s from warehouse %s: %s", digest, addr, err)
+	}
+	if len(bs) > MaxManifestSize {
+		return nil, Errorf(rio.ErrWareCorrupt, "manifest %s in warehouse %s is implausibly large (over %d bytes)", digest, addr, MaxManifestSize)
+	}
+	return bs, nil
+}
@@ -0,0 +1,471 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package oci
+
+import (
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/config"
+	"go.polydawn.net/rio/warehouse"
+)
+
+var (
+	_ warehouse.ImageController = &RegistryController{}
+	_ warehouse.SizedReader     = sizedBody{}
+)
+
+// Uploads are sent in chunks of this many bytes.  Registries (and the
+//  proxies in front of them) often limit the size of a request.
+var UploadChunkSize int64 = 8 << 20
+
+/*
+	Reads from a repository in a registry, with the distribution API.
+	(Writes, too, for BlobstoreController; image warehouses are only read.)
+
+	Auth comes from config, like for http warehouses.  If the registry
+	wants a token from its token service instead (as most do, even for
+	anonymous pulls), one is fetched (sending the configured credentials,
+	if any) and used for the rest of the controller's requests.
+*/
+type RegistryController struct {
+	addr    api.WarehouseAddr // user's string retained for messages
+	baseUrl *url.URL          // just the scheme and host
+	name    string            // the repository, e.g. "library/ubuntu"
+	client  *http.Client
+	auth    string // "Authorization" header value from config, if any
+	retries int
+
+	mu    sync.Mutex
+	token string // from the registry's token service, once we've needed one
+}
+
+/*
+	Initialize a controller for a registry repository ("oci+http" or "oci+https").
+	The path of the address is the repository's name.
+
+	May return errors of category:
+
+	  - `rio.ErrUsage` -- for unsupported addressses
+*/
+func NewRegistryController(addr api.WarehouseAddr) (*RegistryController, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	switch u.Scheme {
+	case "oci+http":
+		u.Scheme = "http"
+	case "oci+https":
+		u.Scheme = "https"
+	default:
+		return nil, Errorf(rio.ErrUsage, "unsupported scheme in warehouse addr: %q (valid options are 'oci+http' or 'oci+https')", u.Scheme)
+	}
+	return newRegistryController(addr, u)
+}
+
+// The shared bits of NewRegistryController and NewBlobstoreController, once the scheme is just http(s).
+func newRegistryController(addr api.WarehouseAddr, u *url.URL) (_ *RegistryController, err error) {
+	whCtrl := &RegistryController{
+		addr:    addr,
+		baseUrl: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		name:    strings.Trim(u.Path, "/"),
+	}
+	if whCtrl.name == "" {
+		return nil, Errorf(rio.ErrUsage, "registry warehouse addr %q must name a repository (e.g. 'oci+https://registry.example.com/library/ubuntu')", addr)
+	}
+
+	// Apply any settings config has for this warehouse.
+	//  Same as for http warehouses: timeouts are for the registry to start
+	//  responding, not for the whole download.
+	whCtrl.client = http.DefaultClient
+	if settings, ok := config.GetWarehouseSettings(string(addr)); ok {
+		timeout, _ := settings.TimeoutDuration() // validated when loaded.
+		if timeout > 0 {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+			transport.TLSHandshakeTimeout = timeout
+			transport.ResponseHeaderTimeout = timeout
+			whCtrl.client = &http.Client{Transport: transport}
+		}
+		whCtrl.auth, err = settings.Auth.Header()
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "%s", err)
+		}
+		whCtrl.retries = settings.Retries
+	}
+
+	// We skip checking that the registry exists.
+	//  It's as costly as just asking for what we want.
+	return whCtrl, nil
+}
+
+func (whCtrl *RegistryController) OpenManifest(ctx context.Context, digest string) ([]byte, string, error) {
+	if _, err := ParseDigest(digest); err != nil {
+		return nil, "", Errorf(rio.ErrUsage, "%s", err)
+	}
+	return whCtrl.fetchManifest(ctx, digest)
+}
+
+// Fetches a manifest by digest or tag.
+func (whCtrl *RegistryController) fetchManifest(ctx context.Context, ref string) ([]byte, string, error) {
+	resp, err := whCtrl.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", whCtrl.url("manifests", ref), nil)
+		if err == nil {
+			req.Header.Set("Accept", strings.Join([]string{
+				MediaType_ImageIndex,
+				MediaType_ImageManifest,
+				MediaType_DockerManifestList,
+				MediaType_DockerManifest,
+			}, ", "))
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		body, err := readManifest(resp.Body, whCtrl.addr, ref)
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		return body, mediaType, err
+	case 404:
+		return nil, "", Errorf(rio.ErrWareNotFound, "manifest %s not found in warehouse %s", ref, whCtrl.addr)
+	default:
+		return nil, "", Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", whCtrl.addr, resp.Status)
+	}
+}
+
+func (whCtrl *RegistryController) OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if _, err := ParseDigest(digest); err != nil {
+		return nil, Errorf(rio.ErrUsage, "%s", err)
+	}
+	resp, err := whCtrl.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", whCtrl.url("blobs", digest), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		return sizedBody{resp.Body, resp.ContentLength}, nil
+	case 404:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWareNotFound, "blob %s not found in warehouse %s", digest, whCtrl.addr)
+	default:
+		resp.Body.Close()
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "unexpected HTTP code from warehouse %s: %s", whCtrl.addr, resp.Status)
+	}
+}
+
+/*
+	Uploads a blob, unless the registry has it already: opens an upload
+	session, sends the body in chunks of UploadChunkSize, and then commits
+	it with its digest (which the registry checks the body against).
+*/
+func (whCtrl *RegistryController) uploadBlob(ctx context.Context, desc Descriptor, body io.ReaderAt) error {
+	resp, err := whCtrl.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("HEAD", whCtrl.url("blobs", desc.Digest), nil)
+	})
+	if err != nil {
+		return unwritable(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return nil // Already there.  Blobs are by digest, so it's the same.
+	}
+
+	// Open the upload session.
+	resp, err = whCtrl.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("POST", whCtrl.url("blobs", "uploads/"), nil)
+	})
+	if err != nil {
+		return unwritable(err)
+	}
+	location, err := whCtrl.uploadLocation(resp, 202)
+	if err != nil {
+		return err
+	}
+
+	// Send the chunks.
+	//  Each response says where to send the next one.
+	for offset := int64(0); offset < desc.Size; {
+		start, n := offset, desc.Size-offset
+		if n > UploadChunkSize {
+			n = UploadChunkSize
+		}
+		resp, err = whCtrl.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest("PATCH", location, io.NewSectionReader(body, start, n))
+			if err == nil {
+				req.ContentLength = n
+				req.Header.Set("Content-Type", "application/octet-stream")
+				req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, start+n-1))
+			}
+			return req, err
+		})
+		if err != nil {
+			return unwritable(err)
+		}
+		if location, err = whCtrl.uploadLocation(resp, 202); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	// Commit it.
+	u, err := url.Parse(location)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnwritable, "warehouse %s gave an unusable upload address %q: %s", whCtrl.addr, location, err)
+	}
+	q := u.Query()
+	q.Set("digest", desc.Digest)
+	u.RawQuery = q.Encode()
+	resp, err = whCtrl.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("PUT", u.String(), nil)
+	})
+	if err != nil {
+		return unwritable(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return whCtrl.refused(resp)
+	}
+	return nil
+}
+
+/*
+	Returns where to send the next part of an upload, from the Location
+	of a response with the expected status code (and closes it).
+*/
+func (whCtrl *RegistryController) uploadLocation(resp *http.Response, expect int) (string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != expect {
+		return "", whCtrl.refused(resp)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "warehouse %s didn't say where to send the upload", whCtrl.addr)
+	}
+	u, err := resp.Request.URL.Parse(location) // may be relative.
+	if err != nil {
+		return "", Errorf(rio.ErrWarehouseUnwritable, "warehouse %s gave an unusable upload address %q: %s", whCtrl.addr, location, err)
+	}
+	return u.String(), nil
+}
+
+// Puts a manifest, by digest or tag.
+func (whCtrl *RegistryController) putManifest(ctx context.Context, ref string, body []byte) error {
+	resp, err := whCtrl.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", whCtrl.url("manifests", ref), bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", MediaType_ImageManifest)
+		}
+		return req, err
+	})
+	if err != nil {
+		return unwritable(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return whCtrl.refused(resp)
+	}
+	return nil
+}
+
+// Makes an error of an unexpected response to part of an upload.
+func (whCtrl *RegistryController) refused(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return Errorf(rio.ErrWarehouseUnwritable, "warehouse %s refused the upload: %s: %s", whCtrl.addr, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Errors from do are about reading, unless we're writing; then say so.
+func unwritable(err error) error {
+	if Category(err) == rio.ErrWarehouseUnavailable {
+		return Errorf(rio.ErrWarehouseUnwritable, "%s", err)
+	}
+	return err
+}
+
+// Returns the URL of "/v2/<name>/<kind>/<ref>".
+func (whCtrl *RegistryController) url(kind, ref string) string {
+	u := *whCtrl.baseUrl
+	u.Path = "/v2/" + whCtrl.name + "/" + kind + "/" + ref
+	return u.String()
+}
+
+/*
+	Issues a request (made fresh by newReq for each attempt), with auth,
+	and retrying as configured if it fails in a way that might not happen
+	again (can't connect, or a 5xx or 429 response).
+
+	If the registry refuses with a challenge to go get a token, we do that
+	(once), and try again with it.  Refusals after that are errors.
+*/
+func (whCtrl *RegistryController) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	triedToken := false
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "invalid request to warehouse %s: %s", whCtrl.addr, err)
+		}
+		req = req.WithContext(ctx)
+		if auth := whCtrl.authorization(); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := whCtrl.client.Do(req)
+		if err == nil && resp.StatusCode == 401 && !triedToken {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if err := whCtrl.fetchToken(ctx, challenge); err != nil {
+				return nil, err
+			}
+			triedToken = true
+			attempt--
+			continue
+		}
+		retryable := err != nil || resp.StatusCode >= 500 || resp.StatusCode == 429
+		if !retryable || attempt >= whCtrl.retries {
+			switch {
+			case ctx.Err() != nil:
+				return nil, Errorf(rio.ErrCancelled, "cancelled")
+			case err != nil:
+				return nil, Errorf(rio.ErrWarehouseUnavailable, "error connecting to warehouse %s: %s", whCtrl.addr, err)
+			case resp.StatusCode == 401 || resp.StatusCode == 403:
+				resp.Body.Close()
+				return nil, Errorf(rio.ErrWarehouseUnavailable, "warehouse %s refused access (check the auth in config): %s", whCtrl.addr, resp.Status)
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep((100 * time.Millisecond) << uint(attempt))
+	}
+}
+
+func (whCtrl *RegistryController) authorization() string {
+	whCtrl.mu.Lock()
+	defer whCtrl.mu.Unlock()
+	if whCtrl.token != "" {
+		return "Bearer " + whCtrl.token
+	}
+	return whCtrl.auth
+}
+
+/*
+	Answers a "WWW-Authenticate: Bearer realm=...,service=...,scope=..."
+	challenge by asking the realm for a token (with our configured
+	credentials, if any), and keeps it for later requests.
+*/
+func (whCtrl *RegistryController) fetchToken(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "Bearer") || params["realm"] == "" {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s refused access (check the auth in config): 401 Unauthorized", whCtrl.addr)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s sent an unusable token service address %q: %s", whCtrl.addr, params["realm"], err)
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s sent an unusable token service address %q: %s", whCtrl.addr, params["realm"], err)
+	}
+	req = req.WithContext(ctx)
+	if whCtrl.auth != "" {
+		req.Header.Set("Authorization", whCtrl.auth)
+	}
+	resp, err := whCtrl.client.Do(req)
+	if err != nil {
+		return Errorf(rio.ErrWarehouseUnavailable, "error getting a token for warehouse %s: %s", whCtrl.addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s refused to issue a token (check the auth in config): %s", whCtrl.addr, resp.Status)
+	}
+	var msg struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := stdjson.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&msg); err != nil {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s issued an unintelligible token: %s", whCtrl.addr, err)
+	}
+	token := msg.Token
+	if token == "" {
+		token = msg.AccessToken
+	}
+	if token == "" {
+		return Errorf(rio.ErrWarehouseUnavailable, "warehouse %s issued an empty token", whCtrl.addr)
+	}
+	whCtrl.mu.Lock()
+	whCtrl.token = token
+	whCtrl.mu.Unlock()
+	return nil
+}
+
+/*
+	Parses a WWW-Authenticate header value like
+	`Bearer realm="https://auth.example.com/token",service="registry"`
+	into its scheme and params.  (Only one challenge is understood.)
+*/
+func parseChallenge(s string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	s = strings.TrimSpace(s)
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, params
+	}
+	scheme, s = s[:i], s[i+1:]
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				val, s = s, ""
+			} else {
+				val, s = s[:end], s[end:]
+			}
+		}
+		params[key] = val
+	}
+	return scheme, params
+}
@@ -0,0 +1,220 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package signature
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/transmat/mixins/log"
+	"go.polydawn.net/rio/warehouse"
+	"go.polydawn.net/rio/warehouse/impl/kvenc"
+	"go.polydawn.net/rio/warehouse/impl/kvfs"
+	"go.polydawn.net/rio/warehouse/impl/kvhttp"
+	"go.polydawn.net/rio/warehouse/impl/oci"
+)
+
+/*
+	Dials a blobstore warehouse which can keep signature sidecars.
+*/
+func dial(addr api.WarehouseAddr) (warehouse.SidecarController, warehouse.BlobstoreController, error) {
+	u, err := url.Parse(string(addr))
+	if err != nil {
+		return nil, nil, Errorf(rio.ErrUsage, "failed to parse URI: %s", err)
+	}
+	var whCtrl warehouse.BlobstoreController
+	switch u.Scheme {
+	case "file", "ca+file":
+		whCtrl, err = kvfs.NewController(addr)
+	case "http", "https", "ca+http", "ca+https":
+		whCtrl, err = kvhttp.NewController(addr)
+	case "enc+file", "enc+ca+file", "enc+http", "enc+https", "enc+ca+http", "enc+ca+https":
+		whCtrl, err = kvenc.NewController(addr)
+	case "ca+oci+http", "ca+oci+https":
+		whCtrl, err = oci.NewBlobstoreController(addr)
+	default:
+		return nil, nil, Errorf(rio.ErrUsage, "signatures are not supported for %q warehouses (valid options are 'file', 'ca+file', 'http', 'ca+http', 'https', or 'ca+https', any of which may be prefixed with 'enc+'; or 'ca+oci+http' or 'ca+oci+https')", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return whCtrl.(warehouse.SidecarController), whCtrl, nil
+}
+
+/*
+	Reads the signatures kept beside a ware in one warehouse.
+	Returns ErrWareNotFound if there are none.
+*/
+func read(sc warehouse.SidecarController, addr api.WarehouseAddr, wareID api.WareID) ([]Signature, error) {
+	reader, err := sc.OpenSidecarReader(wareID, SidecarSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, Errorf(rio.ErrWarehouseUnavailable, "error reading signatures for ware %s from warehouse %s: %s", wareID, addr, err)
+	}
+	sigs, err := Unmarshal(bs)
+	if err != nil {
+		return nil, Errorf(rio.ErrWareCorrupt, "corrupt signatures for ware %s in warehouse %s: %s", wareID, addr, err)
+	}
+	return sigs, nil
+}
+
+/*
+	Fetches the ware's signatures from the warehouses, and checks that at
+	least one is valid and made by a key in the keyring.
+	Every warehouse is tried until one has such a signature, since a mirror
+	may not have all of a ware's signatures (or may have corrupt ones).
+
+	Returns ErrSignatureRejected if none of the warehouses have a valid
+	signature, or an error from the warehouses if none could be read at all.
+*/
+func Require(
+	wareID api.WareID,
+	kr Keyring,
+	warehouses []api.WarehouseAddr,
+	mon rio.Monitor,
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	var anyWarehouses bool // for clarity in final error messages
+	var all []Signature
+	for _, addr := range warehouses {
+		sc, _, err := dial(addr)
+		switch Category(err) {
+		case nil:
+			anyWarehouses = true
+		case rio.ErrWarehouseUnavailable:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue
+		default:
+			return err
+		}
+		sigs, err := read(sc, addr, wareID)
+		switch Category(err) {
+		case nil:
+			// pass
+		case rio.ErrWareNotFound:
+			continue
+		case rio.ErrWarehouseUnavailable, rio.ErrWareCorrupt:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue
+		default:
+			return err
+		}
+		if kr.Check(wareID, sigs) == nil {
+			return nil
+		}
+		all = append(all, sigs...)
+	}
+	if !anyWarehouses {
+		return Errorf(rio.ErrWarehouseUnavailable, "no warehouses were available!")
+	}
+	return kr.Check(wareID, all)
+}
+
+/*
+	Adds a signature to those kept beside the ware in the target warehouse
+	(replacing any earlier signature by the same key).
+	The ware must already be in the warehouse.
+*/
+func Store(
+	wareID api.WareID,
+	sig Signature,
+	target api.WarehouseAddr,
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	if !sig.Verify(wareID) {
+		return Errorf(rio.ErrUsage, "signature is not valid for ware %s", wareID)
+	}
+	sc, whCtrl, err := dial(target)
+	if err != nil {
+		return err
+	}
+	reader, err := whCtrl.OpenReader(wareID)
+	if err != nil {
+		return err
+	}
+	reader.Close()
+	sigs, err := read(sc, target, wareID)
+	switch Category(err) {
+	case nil, rio.ErrWareNotFound:
+		// pass
+	default:
+		return err
+	}
+	sigs, changed := merge(sigs, sig)
+	if !changed {
+		return nil
+	}
+	return sc.WriteSidecar(wareID, SidecarSuffix, Marshal(sigs))
+}
+
+/*
+	Copies the ware's signatures from the source warehouses to the target,
+	adding to any it already has.  Signatures which aren't valid for the
+	ware are not copied.
+
+	The target is only touched if a source has signatures to copy.
+	A source that has none, or can't be read, just has nothing to mirror
+	(unreadable ones are logged); only failing to update the target is an error.
+*/
+func Mirror(
+	wareID api.WareID,
+	target api.WarehouseAddr,
+	sources []api.WarehouseAddr,
+	mon rio.Monitor,
+) (err error) {
+	defer RequireErrorHasCategory(&err, rio.ErrorCategory(""))
+
+	var found []Signature
+	for _, addr := range sources {
+		sc, _, err := dial(addr)
+		if err != nil {
+			continue // the ware was mirrored from elsewhere (or needn't have been).
+		}
+		sigs, err := read(sc, addr, wareID)
+		switch Category(err) {
+		case nil:
+			// pass
+		case rio.ErrWareNotFound:
+			continue
+		default:
+			log.WarehouseUnavailable(mon, err, addr, wareID, "read")
+			continue
+		}
+		for _, s := range sigs {
+			if s.Verify(wareID) {
+				found, _ = merge(found, s)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	sc, _, err := dial(target)
+	if err != nil {
+		return err
+	}
+	sigs, err := read(sc, target, wareID)
+	switch Category(err) {
+	case nil, rio.ErrWareNotFound:
+		// pass
+	default:
+		return err
+	}
+	sigs, changed := merge(sigs, found...)
+	if !changed {
+		return nil
+	}
+	return sc.WriteSidecar(wareID, SidecarSuffix, Marshal(sigs))
+}
@@ -0,0 +1,260 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+/*
+	Detached ed25519 signatures over WareIDs.
+
+	A signature vouches for a WareID (and so, since the ID is a hash, for the
+	ware's whole content) without touching the ware itself.
+	Signatures are kept in a sidecar beside the ware's blob in blobstore
+	warehouses (see warehouse.SidecarController), so anyone fetching the ware
+	can also fetch its signatures, and check them against the keys they trust
+	before doing any work with the ware.
+
+	Keys and signatures are written in base58, like hashes:
+	public keys as "ed25519:<base58>", private keys as "ed25519-private:<base58 seed>".
+	A sidecar holds one signature per line, as "<public key> <base58 signature>",
+	so a ware may carry signatures from several keys.
+*/
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/polydawn/refmt/misc"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+)
+
+/*
+	Returned when a signature is required but there's no valid one from a trusted key.
+*/
+const ErrSignatureRejected = rio.ErrorCategory("rio-signature-rejected")
+
+// The suffix of the sidecar that signatures are kept in.
+const SidecarSuffix = ".sig"
+
+const (
+	publicPrefix  = "ed25519:"
+	privatePrefix = "ed25519-private:"
+)
+
+type PublicKey ed25519.PublicKey
+
+type PrivateKey ed25519.PrivateKey
+
+func (k PublicKey) String() string {
+	return publicPrefix + misc.Base58Encode(k)
+}
+
+func (k PrivateKey) String() string {
+	return privatePrefix + misc.Base58Encode(ed25519.PrivateKey(k).Seed())
+}
+
+func (k PrivateKey) Public() PublicKey {
+	return PublicKey(ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+
+func GenerateKey() (PublicKey, PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	return PublicKey(pub), PrivateKey(priv), err
+}
+
+func ParsePublicKey(s string) (PublicKey, error) {
+	if !strings.HasPrefix(s, publicPrefix) {
+		return nil, Errorf(rio.ErrUsage, "invalid public key %q: must start with %q", s, publicPrefix)
+	}
+	bs := misc.Base58Decode(s[len(publicPrefix):])
+	if len(bs) != ed25519.PublicKeySize {
+		return nil, Errorf(rio.ErrUsage, "invalid public key %q: not %d bytes of base58", s, ed25519.PublicKeySize)
+	}
+	return PublicKey(bs), nil
+}
+
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, privatePrefix) {
+		return nil, Errorf(rio.ErrUsage, "invalid private key: must start with %q", privatePrefix)
+	}
+	bs := misc.Base58Decode(s[len(privatePrefix):])
+	if len(bs) != ed25519.SeedSize {
+		return nil, Errorf(rio.ErrUsage, "invalid private key: not %d bytes of base58", ed25519.SeedSize)
+	}
+	return PrivateKey(ed25519.NewKeyFromSeed(bs)), nil
+}
+
+func LoadPrivateKey(path string) (PrivateKey, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "cannot read private key: %s", err)
+	}
+	return ParsePrivateKey(string(bs))
+}
+
+/*
+	A set of public keys whose signatures are trusted.
+*/
+type Keyring []PublicKey
+
+/*
+	Loads a keyring from a single public key string, or if the string
+	isn't a public key, from the file it names.
+	Keyring files hold one public key per line; blank lines and lines
+	starting with "#" are ignored.
+*/
+func LoadKeyring(s string) (Keyring, error) {
+	if strings.HasPrefix(s, publicPrefix) {
+		k, err := ParsePublicKey(s)
+		return Keyring{k}, err
+	}
+	f, err := os.Open(s)
+	if err != nil {
+		return nil, Errorf(rio.ErrUsage, "cannot read keyring: %s", err)
+	}
+	defer f.Close()
+	var kr Keyring
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		k, err := ParsePublicKey(line)
+		if err != nil {
+			return nil, Errorf(rio.ErrUsage, "invalid keyring %q: %s", s, err)
+		}
+		kr = append(kr, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errorf(rio.ErrUsage, "cannot read keyring: %s", err)
+	}
+	if len(kr) == 0 {
+		return nil, Errorf(rio.ErrUsage, "keyring %q contains no keys", s)
+	}
+	return kr, nil
+}
+
+func (kr Keyring) Contains(k PublicKey) bool {
+	for _, k2 := range kr {
+		if bytes.Equal(k, k2) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	One key's signature over a WareID.
+*/
+type Signature struct {
+	Key PublicKey
+	Sig []byte
+}
+
+func (s Signature) String() string {
+	return s.Key.String() + " " + misc.Base58Encode(s.Sig)
+}
+
+/*
+	Returns the bytes actually signed for a WareID.
+	The prefix keeps these signatures from being mistaken for
+	(or replayed as) signatures over anything else.
+*/
+func message(wareID api.WareID) []byte {
+	return []byte("rio ware signature v1\x00" + wareID.String())
+}
+
+func Sign(k PrivateKey, wareID api.WareID) Signature {
+	return Signature{k.Public(), ed25519.Sign(ed25519.PrivateKey(k), message(wareID))}
+}
+
+func (s Signature) Verify(wareID api.WareID) bool {
+	return len(s.Key) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(s.Key), message(wareID), s.Sig)
+}
+
+/*
+	Checks that at least one of the signatures is valid for the WareID,
+	and made by a key in the keyring.
+	Returns ErrSignatureRejected if not.
+*/
+func (kr Keyring) Check(wareID api.WareID, sigs []Signature) error {
+	for _, s := range sigs {
+		if kr.Contains(s.Key) && s.Verify(wareID) {
+			return nil
+		}
+	}
+	if len(sigs) == 0 {
+		return Errorf(ErrSignatureRejected, "ware %s is not signed", wareID)
+	}
+	return Errorf(ErrSignatureRejected, "ware %s has no valid signature from a trusted key (%d signatures checked)", wareID, len(sigs))
+}
+
+/*
+	Serializes signatures in the sidecar format, one per line, sorted by key.
+*/
+func Marshal(sigs []Signature) []byte {
+	lines := make([]string, len(sigs))
+	for i, s := range sigs {
+		lines[i] = s.String() + "\n"
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, ""))
+}
+
+func Unmarshal(bs []byte) ([]Signature, error) {
+	var sigs []Signature
+	for i, line := range strings.Split(string(bs), "\n") {
+		if line == "" {
+			continue
+		}
+		hunks := strings.Split(line, " ")
+		if len(hunks) != 2 {
+			return nil, fmt.Errorf("invalid signature on line %d: expected a key and a signature", i+1)
+		}
+		k, err := ParsePublicKey(hunks[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature on line %d: %s", i+1, err)
+		}
+		sig := misc.Base58Decode(hunks[1])
+		if len(sig) != ed25519.SignatureSize {
+			return nil, fmt.Errorf("invalid signature on line %d: not %d bytes of base58", i+1, ed25519.SignatureSize)
+		}
+		sigs = append(sigs, Signature{k, sig})
+	}
+	return sigs, nil
+}
+
+/*
+	Merges signatures into a set, with at most one signature per key;
+	later signatures replace earlier ones from the same key.
+	Returns the merged set, and whether it differs from `into`.
+*/
+func merge(into []Signature, sigs ...Signature) ([]Signature, bool) {
+	changed := false
+outer:
+	for _, s := range sigs {
+		for i, s2 := range into {
+			if bytes.Equal(s.Key, s2.Key) {
+				if !bytes.Equal(s.Sig, s2.Sig) {
+					into[i] = s
+					changed = true
+				}
+				continue outer
+			}
+		}
+		into = append(into, s)
+		changed = true
+	}
+	return into, changed
+}
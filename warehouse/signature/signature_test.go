@@ -0,0 +1,110 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package signature
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "github.com/warpfork/go-errcat"
+	"go.polydawn.net/go-timeless-api"
+	"go.polydawn.net/go-timeless-api/rio"
+	"go.polydawn.net/rio/fs"
+	"go.polydawn.net/rio/testutil"
+)
+
+func TestSignatures(t *testing.T) {
+	wareID := api.WareID{"tar", "5y6NvK6GBPQ6CcuNyJyWtSrMAJQ4LVrAcZSoCRAzMSk5o53pkTYiieWyRivfvhZwhZ"}
+	pub, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("Keys round-trip through their string forms", t, func() {
+		pub2, err := ParsePublicKey(pub.String())
+		So(err, ShouldBeNil)
+		So(pub2, ShouldResemble, pub)
+		priv2, err := ParsePrivateKey(priv.String() + "\n")
+		So(err, ShouldBeNil)
+		So(priv2, ShouldResemble, priv)
+
+		_, err = ParsePublicKey("ed25519:abc")
+		So(Category(err), ShouldEqual, rio.ErrUsage)
+		_, err = ParsePrivateKey(pub.String())
+		So(Category(err), ShouldEqual, rio.ErrUsage)
+	})
+	Convey("Signatures verify for their ware only", t, func() {
+		sig := Sign(priv, wareID)
+		So(sig.Verify(wareID), ShouldBeTrue)
+		So(sig.Verify(api.WareID{"tar", "somethingelse"}), ShouldBeFalse)
+		So(sig.Verify(api.WareID{"git", wareID.Hash}), ShouldBeFalse)
+
+		Convey("and keyrings only accept trusted keys", func() {
+			other, _, _ := GenerateKey()
+			So(Keyring{other, pub}.Check(wareID, []Signature{sig}), ShouldBeNil)
+			So(Category(Keyring{other}.Check(wareID, []Signature{sig})), ShouldEqual, ErrSignatureRejected)
+			So(Category(Keyring{pub}.Check(wareID, nil)), ShouldEqual, ErrSignatureRejected)
+		})
+		Convey("and round-trip through the sidecar format", func() {
+			_, priv2, _ := GenerateKey()
+			sigs := []Signature{sig, Sign(priv2, wareID)}
+			sigs2, err := Unmarshal(Marshal(sigs))
+			So(err, ShouldBeNil)
+			So(sigs2, ShouldHaveLength, 2)
+			So(Marshal(sigs2), ShouldResemble, Marshal(sigs))
+
+			_, err = Unmarshal([]byte(pub.String() + "\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("Keyrings load from keys or files", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			kr, err := LoadKeyring(pub.String())
+			So(err, ShouldBeNil)
+			So(kr, ShouldResemble, Keyring{pub})
+
+			other, _, _ := GenerateKey()
+			path := tmpDir.Join(fs.MustRelPath("keyring")).String()
+			So(ioutil.WriteFile(path, []byte(fmt.Sprintf("# trusted\n%s\n\n%s\n", pub, other)), 0644), ShouldBeNil)
+			kr, err = LoadKeyring(path)
+			So(err, ShouldBeNil)
+			So(kr, ShouldResemble, Keyring{pub, other})
+
+			_, err = LoadKeyring(tmpDir.Join(fs.MustRelPath("nope")).String())
+			So(Category(err), ShouldEqual, rio.ErrUsage)
+		})
+	})
+	Convey("Signatures are stored beside wares in warehouses", t, func() {
+		testutil.WithTmpdir(func(tmpDir fs.AbsolutePath) {
+			So(os.MkdirAll(tmpDir.Join(fs.MustRelPath("wh/5y6/NvK")).String(), 0755), ShouldBeNil)
+			So(os.Mkdir(tmpDir.Join(fs.MustRelPath("wh2")).String(), 0755), ShouldBeNil)
+			whAddr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh", tmpDir))
+			wh2Addr := api.WarehouseAddr(fmt.Sprintf("ca+file://%s/wh2", tmpDir))
+			kr := Keyring{pub}
+
+			So(Category(Store(wareID, Sign(priv, wareID), whAddr)), ShouldEqual, rio.ErrWareNotFound)
+			So(ioutil.WriteFile(tmpDir.Join(fs.MustRelPath("wh/5y6/NvK/"+wareID.Hash)).String(), []byte("blob"), 0644), ShouldBeNil)
+			So(Category(Require(wareID, kr, []api.WarehouseAddr{whAddr}, rio.Monitor{})), ShouldEqual, ErrSignatureRejected)
+
+			So(Store(wareID, Sign(priv, wareID), whAddr), ShouldBeNil)
+			_, err := os.Stat(tmpDir.Join(fs.MustRelPath("wh/5y6/NvK/" + wareID.Hash + SidecarSuffix)).String())
+			So(err, ShouldBeNil)
+			So(Require(wareID, kr, []api.WarehouseAddr{whAddr}, rio.Monitor{}), ShouldBeNil)
+			So(Require(wareID, kr, []api.WarehouseAddr{wh2Addr, whAddr}, rio.Monitor{}), ShouldBeNil)
+			So(Category(Require(wareID, kr, []api.WarehouseAddr{wh2Addr}, rio.Monitor{})), ShouldEqual, ErrSignatureRejected)
+
+			Convey("and refuse signatures that don't match", func() {
+				So(Category(Store(wareID, Sign(priv, api.WareID{"tar", "other"}), whAddr)), ShouldEqual, rio.ErrUsage)
+			})
+			Convey("and are mirrored", func() {
+				So(Mirror(wareID, wh2Addr, []api.WarehouseAddr{whAddr}, rio.Monitor{}), ShouldBeNil)
+				So(Require(wareID, kr, []api.WarehouseAddr{wh2Addr}, rio.Monitor{}), ShouldBeNil)
+			})
+		})
+	})
+}
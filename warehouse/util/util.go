@@ -6,6 +6,8 @@ Sniperkit-Bot
 package util
 
 import (
+	"strings"
+
 	"go.polydawn.net/go-timeless-api"
 )
 
@@ -20,11 +22,20 @@ import (
 	invalid semantically anyway, but we're not going to error about that here.)
 	A hash of empty string will result in a return of `"---", "---", "-"` (in other
 	words, as if the hash had been padded to a min of 7 characts, all dashes).
+
+	If the hash is tagged with an algorithm (e.g. "sha256-3rrT3EnF..."),
+	the chunks are taken from the digest after the tag, and the tag is kept
+	on the remaining chunk (e.g. `"3rr", "T3E", "sha256-nF..."`), so that
+	wares of every algorithm are spread out the same way.
 */
 func ChunkifyHash(wareID api.WareID) (string, string, string) {
 	hash := wareID.Hash
+	tag := ""
+	if i := strings.IndexByte(hash, '-'); i > 0 {
+		tag, hash = hash[:i+1], hash[i+1:]
+	}
 	if len(hash) < 7 {
 		hash = hash + "-------"[:7-len(hash)]
 	}
-	return hash[0:3], hash[3:6], hash[6:]
+	return hash[0:3], hash[3:6], tag + hash[6:]
 }
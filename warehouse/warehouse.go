@@ -18,7 +18,8 @@ import (
 
 	Blobstore backing implementations are typically simple key-value stores.
 	Examples are 'kvfs' (using a local filesystem),
-	'kvhttp' (readonly, aiming at http(s) URLs),
+	'kvhttp' (aiming at http(s) URLs; writes are PUTs, as `rio serve` accepts),
+	'ca+oci+https' (a repository in a registry; see `warehouse/impl/oci`),
 	'kvgs' (using Google Cloud Storage as a k/v bucket),
 	'kvs3' (using AWS S3 as a k/v bucket), etc.
 
@@ -51,6 +52,41 @@ type BlobstoreWriteController interface {
 	Commit(wareID api.WareID) error
 }
 
+/*
+	Readers returned by BlobstoreController.OpenReader may also implement
+	this, if they know the size of the ware's blob up front (e.g. from the
+	file's size, or an http Content-Length), so progress can be reported
+	against it.  Size returns -1 if it's not known after all.
+*/
+type SizedReader interface {
+	io.ReadCloser
+	Size() int64
+}
+
+/*
+	Returns the size of a reader from OpenReader, or -1 if it's not known.
+*/
+func SizeOf(r io.Reader) int64 {
+	if sr, ok := r.(SizedReader); ok {
+		return sr.Size()
+	}
+	return -1
+}
+
+/*
+	Blobstore warehouses which can also keep small "sidecar" objects beside
+	each ware's blob (e.g. detached signatures) implement this too.
+	Sidecars are named by the ware they accompany plus a suffix
+	(e.g. ".sig"), so they're found and mirrored the same way as the blob.
+
+	OpenSidecarReader returns `rio.ErrWareNotFound` if there's no such sidecar.
+	WriteSidecar replaces any existing sidecar with the same suffix, atomically.
+*/
+type SidecarController interface {
+	OpenSidecarReader(wareID api.WareID, suffix string) (io.ReadCloser, error)
+	WriteSidecar(wareID api.WareID, suffix string, body []byte) error
+}
+
 /*
 	A no-op implementation of BlobstoreWriteController.
 	You can use this to invoke a PackFunc as "scan only" -- it'll produce
@@ -75,3 +111,19 @@ func (NullBlobstoreWriteController) Commit(wareID api.WareID) error { return nil
 type RepositoryController interface {
 	Clone(context.Context) error
 }
+
+/*
+	An image-style warehouse holds OCI (or Docker) images: blobs found by
+	their digest (e.g. "sha256:e3b0c442..."), and manifests, which list the
+	blobs that make up an image.  Examples are 'oci+file' (an OCI image
+	layout dir) and 'oci+https' (a registry, speaking the distribution API).
+
+	Both methods return `rio.ErrWareNotFound` if there's no such digest.
+	Like blobstores, these are a transport layer: nothing read is verified,
+	and callers must check it against the digest themselves.
+	The mediaType is whatever the warehouse says, and may be empty.
+*/
+type ImageController interface {
+	OpenManifest(ctx context.Context, digest string) (body []byte, mediaType string, err error)
+	OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error)
+}